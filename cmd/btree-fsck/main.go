@@ -0,0 +1,63 @@
+// Command btree-fsck checks the files of trees from pkg/btree/disk and
+// prints a report for each one. It exits with status 1 if any of them has
+// problems.
+//
+// Usage:
+//
+//	btree-fsck [-q] [-keys 'command [arg...]'] file...
+//
+// Encrypted trees need -keys, the command printing their keys, as described
+// by disk.CommandKeys.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/franciscosbf/b-tree-go/pkg/btree/disk"
+)
+
+func main() {
+	quiet := flag.Bool("q", false, "only report files with problems")
+	keys := flag.String("keys", "", "command printing the encryption keys")
+
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "usage: btree-fsck [-q] [-keys 'command [arg...]'] file...")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	opts := &disk.VerifyOptions{}
+	if command := strings.Fields(*keys); len(command) > 0 {
+		opts.Encryption = disk.CommandKeys(command[0], command[1:]...)
+	}
+
+	status := 0
+
+	for _, path := range flag.Args() {
+		r, err := disk.Verify(path, opts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v: %v\n", path, err)
+			status = 1
+
+			continue
+		}
+
+		if !r.OK() {
+			status = 1
+		} else if *quiet {
+			continue
+		}
+
+		fmt.Printf("%v:\n%v", path, r)
+	}
+
+	os.Exit(status)
+}
@@ -0,0 +1,54 @@
+// Command btree-migrate upgrades the files of trees from pkg/btree/disk to
+// the current format, in place, as disk.Migrate does. Version 1 is the only
+// format so far, so it checks that each file is a tree file of version 1,
+// and prints its version. Trees mustn't be open while they're migrated.
+//
+// Usage:
+//
+//	btree-migrate file...
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/franciscosbf/b-tree-go/pkg/btree/disk"
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "usage: btree-migrate file...")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	status := 0
+
+	for _, path := range flag.Args() {
+		err := disk.Migrate(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v: %v\n", path, err)
+			status = 1
+
+			continue
+		}
+
+		version, err := disk.FormatVersion(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v: %v\n", path, err)
+			status = 1
+
+			continue
+		}
+
+		fmt.Printf("%v: version %d\n", path, version)
+	}
+
+	os.Exit(status)
+}
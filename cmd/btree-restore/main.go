@@ -0,0 +1,115 @@
+// Command btree-restore restores trees of pkg/btree/disk from backups, and
+// rolls them forward through archived WAL segments, as gathered by
+// disk.Options.ArchiveDir.
+//
+// Usage:
+//
+//	btree-restore backup file full [incremental...]
+//	btree-restore pitr [-lsn n] [-time t] file wal-dir
+//
+// The backup subcommand restores a full backup, then the incremental ones
+// taken after it, in order, to file, which mustn't exist. The pitr
+// subcommand rolls the tree at file, closed, forward to the operation of
+// LSN -lsn, or to the last one committed at or before -time, given in RFC
+// 3339 format, or to the end of the segments in wal-dir without either.
+// Undoing a bad write thus takes restoring the last backup taken before it,
+// then rolling it forward to just before the write.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/franciscosbf/b-tree-go/pkg/btree/disk"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: btree-restore backup file full [incremental...]")
+	fmt.Fprintln(os.Stderr, "       btree-restore pitr [-lsn n] [-time t] file wal-dir")
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	var err error
+
+	switch os.Args[1] {
+	case "backup":
+		err = backup(os.Args[2:])
+	case "pitr":
+		err = pitr(os.Args[2:])
+	default:
+		usage()
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "btree-restore: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func backup(args []string) error {
+	if len(args) < 2 {
+		usage()
+	}
+
+	var backups []io.Reader
+
+	for _, name := range args[1:] {
+		file, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		backups = append(backups, file)
+	}
+
+	if err := disk.Restore(args[0], backups[0], backups[1:]...); err != nil {
+		return err
+	}
+
+	fmt.Printf("%v: restored from %d backups\n", args[0], len(backups))
+
+	return nil
+}
+
+func pitr(args []string) error {
+	flags := flag.NewFlagSet("pitr", flag.ExitOnError)
+	lsn := flags.Uint64("lsn", 0, "LSN of the last operation to recover")
+	at := flags.String("time", "", "time of the last operation to recover, in RFC 3339 format")
+
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: btree-restore pitr [-lsn n] [-time t] file wal-dir")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	target := disk.RecoveryTarget{LSN: *lsn}
+	if *at != "" {
+		var err error
+		if target.Time, err = time.Parse(time.RFC3339Nano, *at); err != nil {
+			return err
+		}
+	}
+
+	recovered, err := disk.RestoreTo(flags.Arg(0), flags.Arg(1), target)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%v: recovered to LSN %d\n", flags.Arg(0), recovered)
+
+	return nil
+}
@@ -0,0 +1,73 @@
+// Command btree-rotate re-encrypts a tree from pkg/btree/disk with the
+// current key, while it stays usable by the process running the command.
+// Keys are asked to a command, like the client of a key management
+// service, as described by disk.CommandKeys. Once it's done, the previous
+// keys are no longer needed.
+//
+// Usage:
+//
+//	btree-rotate -keys 'command [arg...]' [-step n] file
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/franciscosbf/b-tree-go/pkg/btree/codec"
+	"github.com/franciscosbf/b-tree-go/pkg/btree/disk"
+)
+
+// raw leaves keys and values as they're stored. It isn't named, so it isn't
+// checked against the codecs the tree was created with.
+type raw struct {
+	codec.Codec[[]byte]
+}
+
+func main() {
+	keys := flag.String("keys", "", "command printing the encryption keys")
+	step := flag.Int("step", 64, "pages rewritten at a time")
+
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "usage: btree-rotate -keys 'command [arg...]' [-step n] file")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	command := strings.Fields(*keys)
+	if flag.NArg() != 1 || len(command) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := rotate(flag.Arg(0), disk.CommandKeys(command[0], command[1:]...), *step); err != nil {
+		fmt.Fprintf(os.Stderr, "%v: %v\n", flag.Arg(0), err)
+		os.Exit(1)
+	}
+}
+
+func rotate(path string, keys disk.KeyProvider, step int) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	// Pages are rewritten as they are, so the codecs don't matter.
+	bt, err := disk.Open(path, &disk.Options[[]byte]{
+		Keys:       raw{codec.Bytes()},
+		Values:     codec.Any[[]byte](raw{codec.Bytes()}),
+		Encryption: keys,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = bt.RotateKey(ctx, step)
+
+	if cerr := bt.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
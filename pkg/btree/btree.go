@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"slices"
 	"sync"
+	"sync/atomic"
 )
 
 type entry[K cmp.Ordered] struct {
@@ -19,6 +20,7 @@ func (e *entry[K]) String() string {
 }
 
 type node[K cmp.Ordered] struct {
+	gen     uint64
 	leaf    bool
 	entries []*entry[K]
 	childs  []*node[K]
@@ -31,16 +33,50 @@ func (n *node[K]) String() string {
 }
 
 type BTree[K cmp.Ordered] struct {
-	mutex sync.RWMutex
-	t     int
-	root  *node[K]
+	mutex     sync.RWMutex
+	t         int
+	root      *node[K]
+	tier      *tier[K]
+	gen       uint64
+	versioned bool
+	version   uint64
+	versions  []revision[K]
+	watchers  watchers[K]
+	id        atomic.Uint64
+	tx        *txState[K]
 }
 
 func (bt *BTree[K]) isFull(n *node[K]) bool {
 	return len(n.entries) == (2*bt.t)-1
 }
 
+func (bt *BTree[K]) mutable(n *node[K]) *node[K] {
+	if n.gen == bt.gen {
+		bt.tier.changed(n)
+
+		return n
+	}
+
+	c := &node[K]{
+		gen:     bt.gen,
+		leaf:    n.leaf,
+		entries: slices.Clone(n.entries),
+		childs:  slices.Clone(n.childs),
+	}
+	bt.tier.inherit(c, n, false)
+
+	return c
+}
+
+func (bt *BTree[K]) mutableChild(n *node[K], i int) *node[K] {
+	c := bt.mutable(bt.child(n, i))
+	n.childs[i] = c
+
+	return c
+}
+
 func (bt *BTree[K]) search(n *node[K], k K) any {
+	n = bt.tier.visit(n)
 	entries := n.entries
 	i := 0
 
@@ -58,9 +94,35 @@ func (bt *BTree[K]) search(n *node[K], k K) any {
 	return bt.search(n.childs[i], k)
 }
 
+func (bt *BTree[K]) ascend(n *node[K], lo, hi K, fn func(e *entry[K]) bool) bool {
+	n = bt.tier.visit(n)
+	i := 0
+
+	for ; i < len(n.entries) && n.entries[i].k < lo; i++ {
+	}
+
+	for ; i < len(n.entries); i++ {
+		if !n.leaf && !bt.ascend(n.childs[i], lo, hi, fn) {
+			return false
+		}
+
+		if n.entries[i].k >= hi || !fn(n.entries[i]) {
+			return false
+		}
+	}
+
+	if n.leaf {
+		return true
+	}
+
+	return bt.ascend(n.childs[i], lo, hi, fn)
+}
+
 func (bt *BTree[K]) splitChild(n *node[K], i int) {
-	left := n.childs[i]
-	right := &node[K]{leaf: left.leaf}
+	left := bt.mutableChild(n, i)
+	right := &node[K]{gen: bt.gen, leaf: left.leaf}
+	bt.tier.inherit(right, left, false)
+	bt.tier.grow(nodeOverhead + childOverhead)
 
 	median := left.entries[bt.t-1]
 
@@ -84,7 +146,9 @@ func (bt *BTree[K]) splitChild(n *node[K], i int) {
 }
 
 func (bt *BTree[K]) splitRoot() {
+	bt.tier.grow(nodeOverhead + childOverhead)
 	bt.root = &node[K]{
+		gen:    bt.gen,
 		childs: []*node[K]{bt.root},
 	}
 
@@ -99,20 +163,14 @@ func (bt *BTree[K]) findRawPos(n *node[K], k K) int {
 	return i
 }
 
-func (bt *BTree[K]) findPos(n *node[K], k K) int {
-	i := bt.findRawPos(n, k)
-	i++
-
-	return i
-}
-
-func (bt *BTree[K]) insertNonNull(n *node[K], k K, v any) {
+func (bt *BTree[K]) insertNonNull(n *node[K], k K, v any) *entry[K] {
 	i := bt.findRawPos(n, k)
 
 	if i >= 0 && k == n.entries[i].k {
-		n.entries[i].v = v
+		old := n.entries[i]
+		n.entries[i] = &entry[K]{k: k, v: v}
 
-		return
+		return old
 	}
 
 	i++
@@ -122,143 +180,141 @@ func (bt *BTree[K]) insertNonNull(n *node[K], k K, v any) {
 			n.entries[:i],
 			append([]*entry[K]{{k: k, v: v}}, n.entries[i:]...)...)
 
-		return
+		return nil
 	}
 
-	if bt.isFull(n.childs[i]) {
+	if bt.isFull(bt.child(n, i)) {
 		bt.splitChild(n, i)
 
-		if k > n.entries[i].k {
+		switch {
+		case k == n.entries[i].k:
+			old := n.entries[i]
+			n.entries[i] = &entry[K]{k: k, v: v}
+
+			return old
+		case k > n.entries[i].k:
 			i++
 		}
 	}
 
-	bt.insertNonNull(n.childs[i], k, v)
+	return bt.insertNonNull(bt.mutableChild(n, i), k, v)
 }
 
-func (bt *BTree[K]) deleteAtLeafNode(n *node[K], k K) any {
-	for i, entry := range n.entries {
-		if k == entry.k {
-			v := entry.v
+func (bt *BTree[K]) minEntry(n *node[K]) *entry[K] {
+	for !n.leaf {
+		n = bt.child(n, 0)
+	}
 
-			n.entries = slices.Delete(n.entries, i, i+1)
+	return n.entries[0]
+}
 
-			return v
-		}
+func (bt *BTree[K]) maxEntry(n *node[K]) *entry[K] {
+	for !n.leaf {
+		n = bt.child(n, len(n.childs)-1)
 	}
 
-	return nil
+	return n.entries[len(n.entries)-1]
 }
 
-func (bt *BTree[K]) deleteAtInternalNode(n *node[K], i int) any {
-	v := n.entries[i].v
+func (bt *BTree[K]) rotateRight(n *node[K], i int) {
+	left := bt.mutableChild(n, i-1)
+	c := bt.mutableChild(n, i)
 
-	pc := n.childs[i]
-	fc := n.childs[i+1]
-	switch {
-	case len(pc.entries) >= bt.t:
-		pe := pc.entries[len(pc.entries)-1]
+	c.entries = slices.Insert(c.entries, 0, n.entries[i-1])
+	n.entries[i-1] = left.entries[len(left.entries)-1]
+	left.entries = slices.Delete(left.entries, len(left.entries)-1, len(left.entries))
 
-		bt.delete(pc, pe.k)
+	if !left.leaf {
+		c.childs = slices.Insert(c.childs, 0, left.childs[len(left.childs)-1])
+		left.childs = slices.Delete(left.childs, len(left.childs)-1, len(left.childs))
+	}
+}
 
-		n.entries[i] = pe
-	case len(pc.entries) == bt.t-1 && len(fc.entries) >= bt.t:
-		fe := fc.entries[len(fc.entries)-1]
+func (bt *BTree[K]) rotateLeft(n *node[K], i int) {
+	right := bt.mutableChild(n, i+1)
+	c := bt.mutableChild(n, i)
 
-		bt.delete(fc, fe.k)
+	c.entries = append(c.entries, n.entries[i])
+	n.entries[i] = right.entries[0]
+	right.entries = slices.Delete(right.entries, 0, 1)
 
-		n.entries[i] = fe
-	default:
-		pc.entries = append(pc.entries, fc.entries...)
-		pc.childs = append(pc.childs, fc.childs...)
+	if !right.leaf {
+		c.childs = append(c.childs, right.childs[0])
+		right.childs = slices.Delete(right.childs, 0, 1)
+	}
+}
+
+func (bt *BTree[K]) merge(n *node[K], i int) *node[K] {
+	left := bt.mutableChild(n, i)
+	right := bt.child(n, i+1)
+
+	left.entries = append(
+		append(left.entries, n.entries[i]),
+		right.entries...)
+	left.childs = append(left.childs, right.childs...)
+
+	n.entries = slices.Delete(n.entries, i, i+1)
+	n.childs = slices.Delete(n.childs, i+1, i+1+1)
+
+	if len(n.entries) == 0 && bt.root == n {
+		bt.root = left
+	}
 
-		n.entries = slices.Delete(n.entries, i, i+1)
-		n.childs = slices.Delete(n.childs, i+1, i+1+1)
+	return left
+}
+
+func (bt *BTree[K]) deleteAtLeafNode(n *node[K], k K) *entry[K] {
+	for i, entry := range n.entries {
+		if k == entry.k {
+			n.entries = slices.Delete(n.entries, i, i+1)
 
-		if len(n.entries) == 0 && bt.root == n {
-			bt.root = pc
+			return entry
 		}
 	}
 
-	return v
+	return nil
 }
 
-func (bt *BTree[K]) deleteBalance(n *node[K], i int, k K) any {
-	if len(n.childs[i].entries) == bt.t-1 {
-		ki := max(i-1, 0)
+func (bt *BTree[K]) deleteAtInternalNode(n *node[K], i int) *entry[K] {
+	e := n.entries[i]
+
+	switch {
+	case len(bt.child(n, i).entries) >= bt.t:
+		pc := bt.mutableChild(n, i)
+
+		n.entries[i] = bt.delete(pc, bt.maxEntry(pc).k)
+	case len(bt.child(n, i+1).entries) >= bt.t:
+		fc := bt.mutableChild(n, i+1)
 
+		n.entries[i] = bt.delete(fc, bt.minEntry(fc).k)
+	default:
+		bt.delete(bt.merge(n, i), e.k)
+	}
+
+	return e
+}
+
+func (bt *BTree[K]) deleteBalance(n *node[K], i int, k K) *entry[K] {
+	if len(bt.child(n, i).entries) == bt.t-1 {
 		im1, ip1 := i-1, i+1
 
-		if im1 >= 0 && len(n.childs[im1].entries) >= bt.t {
-			n.childs[i].entries = append(
-				[]*entry[K]{n.entries[ki]},
-				n.childs[i].entries...)
-			n.entries[ki] = n.childs[im1].entries[len(n.childs[im1].entries)-1]
-			n.childs[im1].entries = n.childs[im1].entries[:len(n.childs[im1].entries)-1]
-
-			if !n.childs[im1].leaf {
-				n.childs[i].childs = append(
-					[]*node[K]{n.childs[im1].childs[len(n.childs[im1].childs)-1]},
-					n.childs[ip1].childs...)
-				n.childs[im1].childs = n.childs[im1].childs[:len(n.childs[im1].childs)-1]
-			}
-		} else if ip1 < len(n.childs) && len(n.childs[ip1].entries) >= bt.t {
-			if i >= 1 && i <= len(n.entries) {
-				ki++
-			}
-
-			n.childs[i].entries = append(n.childs[i].entries, n.entries[ki])
-			n.entries[ki] = n.childs[ip1].entries[0]
-			n.childs[ip1].entries = n.childs[ip1].entries[1:]
-
-			if !n.childs[ip1].leaf {
-				n.childs[i].childs = append(n.childs[i].childs, n.childs[ip1].childs[0])
-				n.childs[ip1].childs = n.childs[ip1].childs[1:]
-			}
-		} else {
-			var nn *node[K]
-
-			if im1 >= 0 && len(n.childs[im1].entries) == bt.t-1 {
-				pc := n.childs[im1]
-				nn = pc
-				median := n.entries[ki]
-
-				pc.entries = append(
-					pc.entries,
-					append([]*entry[K]{median}, n.childs[i].entries...)...)
-				pc.childs = append(pc.childs, n.childs[i].childs...)
-
-				n.entries = slices.Delete(n.entries, ki, ki+1)
-				n.childs = slices.Delete(n.childs, i, i+1)
-			} else if ip1 < len(n.childs) && len(n.childs[ip1].entries) == bt.t-1 {
-				fc := n.childs[ip1]
-				nn = fc
-				median := n.entries[ki]
-
-				fc.entries = append(
-					append(n.childs[i].entries, median),
-					fc.entries...)
-				fc.childs = append(n.childs[i].childs, fc.childs...)
-
-				n.entries = slices.Delete(n.entries, ki, ki+1)
-				n.childs = slices.Delete(n.childs, i, i+1)
-			} else {
-				return bt.delete(n.childs[i], k)
-			}
-
-			if len(n.entries) == 0 && bt.root == n {
-				bt.root = nn
-				n = bt.root
-			}
+		switch {
+		case im1 >= 0 && len(bt.child(n, im1).entries) >= bt.t:
+			bt.rotateRight(n, i)
+		case ip1 < len(n.childs) && len(bt.child(n, ip1).entries) >= bt.t:
+			bt.rotateLeft(n, i)
+		case im1 >= 0:
+			bt.merge(n, im1)
+			i = im1
+		default:
+			bt.merge(n, i)
 		}
-
-		i = bt.findPos(n, k)
 	}
 
-	return bt.delete(n.childs[i], k)
+	return bt.delete(bt.mutableChild(n, i), k)
 }
 
-func (bt *BTree[K]) deleteTraverse(n *node[K], k K) any {
+func (bt *BTree[K]) deleteTraverse(n *node[K], k K) *entry[K] {
 	i := bt.findRawPos(n, k)
 
 	if i >= 0 && n.entries[i].k == k {
@@ -268,7 +324,7 @@ func (bt *BTree[K]) deleteTraverse(n *node[K], k K) any {
 	return bt.deleteBalance(n, i+1, k)
 }
 
-func (bt *BTree[K]) delete(n *node[K], k K) any {
+func (bt *BTree[K]) delete(n *node[K], k K) *entry[K] {
 	if n.leaf {
 		return bt.deleteAtLeafNode(n, k)
 	}
@@ -276,6 +332,24 @@ func (bt *BTree[K]) delete(n *node[K], k K) any {
 	return bt.deleteTraverse(n, k)
 }
 
+func (bt *BTree[K]) insertKey(k K, v any) *entry[K] {
+	bt.tier.tick()
+	bt.tier.add(k, v)
+	bt.root = bt.mutable(bt.root)
+	if bt.isFull(bt.root) {
+		bt.splitRoot()
+	}
+
+	return bt.insertNonNull(bt.root, k, v)
+}
+
+func (bt *BTree[K]) deleteKey(k K) *entry[K] {
+	bt.tier.tick()
+	bt.root = bt.mutable(bt.root)
+
+	return bt.delete(bt.root, k)
+}
+
 func (bt *BTree[K]) Search(k K) any {
 	bt.mutex.RLock()
 	defer bt.mutex.RUnlock()
@@ -285,20 +359,33 @@ func (bt *BTree[K]) Search(k K) any {
 
 func (bt *BTree[K]) Insert(k K, v any) {
 	bt.mutex.Lock()
-	defer bt.mutex.Unlock()
 
-	if bt.isFull(bt.root) {
-		bt.splitRoot()
-	}
+	prev := bt.beginWrite()
+
+	old := bt.insertKey(k, v)
+
+	bt.commitWrite(prev)
 
-	bt.insertNonNull(bt.root, k, v)
+	bt.unlockAndNotify(insertEvent(k, v, old, bt.version))
 }
 
 func (bt *BTree[K]) Delete(k K) any {
 	bt.mutex.Lock()
-	defer bt.mutex.Unlock()
 
-	return bt.delete(bt.root, k)
+	prev := bt.beginWrite()
+
+	old := bt.deleteKey(k)
+	if old == nil {
+		bt.unlockAndNotify()
+
+		return nil
+	}
+
+	bt.commitWrite(prev)
+
+	bt.unlockAndNotify(deleteEvent(old, bt.version))
+
+	return old.v
 }
 
 func (bt *BTree[K]) String() string {
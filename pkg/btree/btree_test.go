@@ -1,6 +1,8 @@
 package btree
 
 import (
+	"cmp"
+	"math/rand"
 	"slices"
 	"testing"
 )
@@ -34,6 +36,54 @@ func checkTree(t *testing.T, got *node[string], expected *node[string]) {
 	}
 }
 
+func checkInvariants[K cmp.Ordered](t *testing.T, bt *BTree[K]) {
+	depth := -1
+
+	var walk func(n *node[K], level int, lo, hi *K)
+	walk = func(n *node[K], level int, lo, hi *K) {
+		n = bt.tier.visit(n)
+
+		if n != bt.root && (len(n.entries) < bt.t-1 || len(n.entries) > 2*bt.t-1) {
+			t.Fatalf("node has %v entries (degree %v): %v", len(n.entries), bt.t, n)
+		}
+
+		for i, e := range n.entries {
+			if lo != nil && e.k <= *lo || hi != nil && e.k >= *hi ||
+				i > 0 && e.k <= n.entries[i-1].k {
+				t.Fatalf("entry %v is out of order in node %v", e, n)
+			}
+		}
+
+		if n.leaf {
+			if depth == -1 {
+				depth = level
+			} else if depth != level {
+				t.Fatalf("leaves at different depths: %v and %v", depth, level)
+			}
+
+			return
+		}
+
+		if len(n.childs) != len(n.entries)+1 {
+			t.Fatalf("node has %v childs for %v entries: %v", len(n.childs), len(n.entries), n)
+		}
+
+		for i, c := range n.childs {
+			clo, chi := lo, hi
+			if i > 0 {
+				clo = &n.entries[i-1].k
+			}
+			if i < len(n.entries) {
+				chi = &n.entries[i].k
+			}
+
+			walk(c, level+1, clo, chi)
+		}
+	}
+
+	walk(bt.root, 0, nil, nil)
+}
+
 func TestSearch(t *testing.T) {
 	bt := &BTree[string]{
 		t: 2,
@@ -701,3 +751,70 @@ func TestDeletion(t *testing.T) {
 		}
 	}
 }
+
+func TestRandomOperations(t *testing.T) {
+	for degree := 2; degree <= 5; degree++ {
+		r := rand.New(rand.NewSource(int64(degree)))
+		bt := New[int](degree)
+		expected := map[int]int{}
+
+		for i := range 10000 {
+			key := r.Intn(300)
+
+			if r.Intn(2) == 0 {
+				bt.Insert(key, i)
+				expected[key] = i
+
+				continue
+			}
+
+			value := bt.Delete(key)
+			expectedValue, ok := expected[key]
+			if !ok && value != nil || ok && value != expectedValue {
+				t.Fatalf(
+					"got different value deleting key %v (degree %v): got=%v expected=%v",
+					key, degree, value, expectedValue)
+			}
+
+			delete(expected, key)
+		}
+
+		for key, expectedValue := range expected {
+			if value := bt.Search(key); value != expectedValue {
+				t.Fatalf(
+					"got different value for key %v (degree %v): got=%v expected=%v",
+					key, degree, value, expectedValue)
+			}
+		}
+
+		checkInvariants(t, bt)
+	}
+}
+
+func TestDeleteKeepsInvariants(t *testing.T) {
+	for degree := 2; degree <= 5; degree++ {
+		bt := New[int](degree)
+		for key := range 500 {
+			bt.Insert(key, key)
+		}
+
+		// Deleting every other key from the middle out reaches internal
+		// entries, rotations and merges at every level.
+		for i := range 250 {
+			key := 250 + i
+			if i%2 == 0 {
+				key = 249 - i
+			}
+
+			if value := bt.Delete(key); value != key {
+				t.Fatalf("got different value deleting key %v (degree %v): got=%v", key, degree, value)
+			}
+
+			checkInvariants(t, bt)
+
+			if value := bt.Search(key); value != nil {
+				t.Fatalf("key %v is still there after its deletion (degree %v): %v", key, degree, value)
+			}
+		}
+	}
+}
@@ -0,0 +1,77 @@
+// Package codec turns keys and values into bytes, for trees that store or
+// send them somewhere.
+package codec
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrInvalidEncoding = errors.New("codec: invalid encoding")
+
+// KeyCodec encodes keys preserving their order: comparing two encoded keys
+// with bytes.Compare must give the same result as comparing the keys.
+type KeyCodec[K any] interface {
+	AppendKey(dst []byte, k K) []byte
+	DecodeKey(src []byte) (K, error)
+}
+
+type ValueCodec[V any] interface {
+	AppendValue(dst []byte, v V) ([]byte, error)
+	DecodeValue(src []byte) (V, error)
+}
+
+// Codec encodes both keys and values of type T.
+type Codec[T any] interface {
+	KeyCodec[T]
+	ValueCodec[T]
+}
+
+// Named is implemented by codecs with a name identifying their encoding,
+// which stores record to tell whether data is read back with the codec
+// that wrote it. The codecs of this package are named.
+type Named interface {
+	Name() string
+}
+
+// Name returns the name of c, or "" if it isn't Named.
+func Name(c any) string {
+	if n, ok := c.(Named); ok {
+		return n.Name()
+	}
+
+	return ""
+}
+
+type anyValues[V any] struct {
+	c ValueCodec[V]
+}
+
+func (a anyValues[V]) AppendValue(dst []byte, v any) ([]byte, error) {
+	tv, ok := v.(V)
+	if !ok && v != nil {
+		var zero V
+
+		return nil, fmt.Errorf("codec: value %v isn't a %T", v, zero)
+	}
+
+	return a.c.AppendValue(dst, tv)
+}
+
+func (a anyValues[V]) DecodeValue(src []byte) (any, error) {
+	return a.c.DecodeValue(src)
+}
+
+func (a anyValues[V]) Name() string {
+	return Name(a.c)
+}
+
+// Any adapts c to values of any type, failing to encode the ones that
+// aren't a V. A nil value is encoded as the zero V.
+func Any[V any](c ValueCodec[V]) ValueCodec[any] {
+	if c, ok := any(c).(ValueCodec[any]); ok {
+		return c
+	}
+
+	return anyValues[V]{c: c}
+}
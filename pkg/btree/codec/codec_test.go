@@ -0,0 +1,218 @@
+package codec
+
+import (
+	"bytes"
+	"cmp"
+	"math"
+	"math/rand"
+	"slices"
+	"testing"
+	"time"
+)
+
+func checkOrder[K cmp.Ordered](t *testing.T, keys []K) {
+	c := Ordered[K]()
+
+	for _, a := range keys {
+		ea := c.AppendKey(nil, a)
+
+		decoded, err := c.DecodeKey(ea)
+		if err != nil {
+			t.Fatalf("failed to decode %v: %v", a, err)
+		}
+
+		if cmp.Compare(decoded, a) != 0 {
+			t.Fatalf("got different key after decoding: got=%v expected=%v", decoded, a)
+		}
+
+		for _, b := range keys {
+			eb := c.AppendKey(nil, b)
+
+			if got, expected := bytes.Compare(ea, eb), cmp.Compare(a, b); got != expected {
+				t.Fatalf(
+					"encoding doesn't preserve order of %v and %v: got=%v expected=%v",
+					a, b, got, expected)
+			}
+		}
+	}
+}
+
+func randomKeys[K cmp.Ordered](r *rand.Rand, gen func() K, edges ...K) []K {
+	keys := slices.Clone(edges)
+
+	for range 200 {
+		keys = append(keys, gen())
+	}
+
+	return keys
+}
+
+type name string
+
+func TestOrderedKeys(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+
+	checkOrder(t, randomKeys(r, func() int { return int(r.Uint64()) },
+		math.MinInt, -1, 0, 1, math.MaxInt))
+	checkOrder(t, randomKeys(r, func() int8 { return int8(r.Intn(256) - 128) },
+		math.MinInt8, -1, 0, 1, math.MaxInt8))
+	checkOrder(t, randomKeys(r, func() int16 { return int16(r.Intn(1<<16) - 1<<15) },
+		math.MinInt16, -1, 0, math.MaxInt16))
+	checkOrder(t, randomKeys(r, func() int32 { return int32(r.Uint32()) },
+		math.MinInt32, -1, 0, math.MaxInt32))
+	checkOrder(t, randomKeys(r, func() uint8 { return uint8(r.Intn(256)) }, 0, math.MaxUint8))
+	checkOrder(t, randomKeys(r, func() uint32 { return r.Uint32() }, 0, math.MaxUint32))
+	checkOrder(t, randomKeys(r, func() uint64 { return r.Uint64() }, 0, math.MaxUint64))
+	checkOrder(t, randomKeys(r, func() uintptr { return uintptr(r.Uint64()) }, 0))
+	checkOrder(t, randomKeys(r, func() float64 { return r.NormFloat64() * 1e6 },
+		math.Inf(-1), -math.MaxFloat64, -1, -math.SmallestNonzeroFloat64, 0,
+		math.SmallestNonzeroFloat64, 1, math.MaxFloat64, math.Inf(1)))
+	checkOrder(t, randomKeys(r, func() float32 { return float32(r.NormFloat64()) },
+		float32(math.Inf(-1)), -math.MaxFloat32, -1, 0, 1, math.MaxFloat32, float32(math.Inf(1))))
+	checkOrder(t, randomKeys(r, func() string {
+		b := make([]byte, r.Intn(6))
+		r.Read(b)
+
+		return string(b)
+	}, "", "\x00", "a", "ab", "b"))
+	checkOrder(t, randomKeys(r, func() name { return name(rune('a' + r.Intn(26))) }, "", "zz"))
+}
+
+func TestFloatSpecialValues(t *testing.T) {
+	c := Ordered[float64]()
+
+	if !bytes.Equal(c.AppendKey(nil, math.Copysign(0, -1)), c.AppendKey(nil, 0)) {
+		t.Fatalf("zeros have different encodings")
+	}
+
+	nan := c.AppendKey(nil, math.NaN())
+	if bytes.Compare(nan, c.AppendKey(nil, math.Inf(-1))) >= 0 {
+		t.Fatalf("NaN isn't ordered before -Inf")
+	}
+
+	if f, err := c.DecodeKey(nan); err != nil || !math.IsNaN(f) {
+		t.Fatalf("got different key after decoding NaN: %v", f)
+	}
+}
+
+func TestDecodeInvalidKey(t *testing.T) {
+	if _, err := Ordered[int32]().DecodeKey([]byte{1, 2}); err == nil {
+		t.Fatalf("decoded a key with the wrong size")
+	}
+}
+
+func TestDefaultKeys(t *testing.T) {
+	if _, err := DefaultKeys[name](); err != nil {
+		t.Fatalf("no default codec for a string type: %v", err)
+	}
+
+	c, err := DefaultKeys[[]byte]()
+	if err != nil {
+		t.Fatalf("no default codec for []byte: %v", err)
+	}
+
+	if k, err := c.DecodeKey(c.AppendKey(nil, []byte("key"))); err != nil || string(k) != "key" {
+		t.Fatalf("got different key after decoding: %v", k)
+	}
+
+	for _, f := range []func() error{
+		func() error { _, err := DefaultKeys[any](); return err },
+		func() error { _, err := DefaultKeys[struct{}](); return err },
+	} {
+		if f() == nil {
+			t.Fatalf("got a default codec for a type that isn't ordered")
+		}
+	}
+}
+
+func roundTrip[V any](t *testing.T, c ValueCodec[V], v V) V {
+	b, err := c.AppendValue([]byte("prefix"), v)
+	if err != nil {
+		t.Fatalf("failed to encode %v: %v", v, err)
+	}
+
+	if !bytes.HasPrefix(b, []byte("prefix")) {
+		t.Fatalf("encoding didn't append to dst: %q", b)
+	}
+
+	decoded, err := c.DecodeValue(b[len("prefix"):])
+	if err != nil {
+		t.Fatalf("failed to decode %v: %v", v, err)
+	}
+
+	return decoded
+}
+
+func TestValueCodecs(t *testing.T) {
+	type point struct {
+		X, Y int
+	}
+
+	if v := roundTrip(t, Gob[point](), point{1, 2}); v != (point{1, 2}) {
+		t.Fatalf("got different value: %v", v)
+	}
+
+	if v := roundTrip(t, Gob[any](), any("value")); v != "value" {
+		t.Fatalf("got different value: %v", v)
+	}
+
+	if v := roundTrip(t, JSON[point](), point{3, 4}); v != (point{3, 4}) {
+		t.Fatalf("got different value: %v", v)
+	}
+
+	now := time.Now()
+	if v := roundTrip(t, Binary[time.Time](), now); !v.Equal(now) {
+		t.Fatalf("got different value: got=%v expected=%v", v, now)
+	}
+
+	if v := roundTrip(t, ValueCodec[[]byte](Bytes()), []byte{1, 2}); !bytes.Equal(v, []byte{1, 2}) {
+		t.Fatalf("got different value: %v", v)
+	}
+
+	if v := roundTrip(t, ValueCodec[int](Ordered[int]()), -7); v != -7 {
+		t.Fatalf("got different value: %v", v)
+	}
+}
+
+func TestAny(t *testing.T) {
+	c := Any(JSON[string]())
+
+	if v := roundTrip(t, c, "value"); v != "value" {
+		t.Fatalf("got different value: %v", v)
+	}
+
+	if _, err := c.AppendValue(nil, 1); err == nil {
+		t.Fatalf("encoded a value of another type")
+	}
+
+	if gob := Gob[any](); Any(gob) != gob {
+		t.Fatalf("adapted a codec of any values")
+	}
+}
+
+func TestNames(t *testing.T) {
+	type id int64
+
+	names := []struct {
+		c    any
+		name string
+	}{
+		{Ordered[int](), "ordered/int64"},
+		{Ordered[id](), "ordered/int64"},
+		{Ordered[uint8](), "ordered/uint8"},
+		{Ordered[float32](), "ordered/float32"},
+		{Ordered[string](), "ordered/string"},
+		{Bytes(), "bytes"},
+		{Gob[any](), "gob"},
+		{JSON[int](), "json"},
+		{Binary[time.Time](), "binary"},
+		{Any(JSON[string]()), "json"},
+		{struct{ KeyCodec[int] }{Ordered[int]()}, ""},
+	}
+
+	for _, n := range names {
+		if name := Name(n.c); name != n.name {
+			t.Errorf("expected %T to be named %q, got %q", n.c, n.name, name)
+		}
+	}
+}
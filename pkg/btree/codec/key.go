@@ -0,0 +1,229 @@
+package codec
+
+import (
+	"cmp"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+)
+
+type ordered[K any] struct {
+	kind reflect.Kind
+	size int
+}
+
+func newOrdered[K any]() (*ordered[K], bool) {
+	var k K
+
+	t := reflect.TypeOf(k)
+	if t == nil {
+		return nil, false
+	}
+
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		return &ordered[K]{kind: t.Kind(), size: int(t.Size())}, true
+	case reflect.String:
+		return &ordered[K]{kind: t.Kind()}, true
+	default:
+		return nil, false
+	}
+}
+
+func (o *ordered[K]) appendUint(dst []byte, u uint64) []byte {
+	switch o.size {
+	case 1:
+		return append(dst, byte(u))
+	case 2:
+		return binary.BigEndian.AppendUint16(dst, uint16(u))
+	case 4:
+		return binary.BigEndian.AppendUint32(dst, uint32(u))
+	default:
+		return binary.BigEndian.AppendUint64(dst, u)
+	}
+}
+
+func (o *ordered[K]) uint(src []byte) (uint64, error) {
+	if len(src) != o.size {
+		return 0, fmt.Errorf("%w: %d bytes for a %d bytes key", ErrInvalidEncoding, len(src), o.size)
+	}
+
+	switch o.size {
+	case 1:
+		return uint64(src[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(src)), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(src)), nil
+	default:
+		return binary.BigEndian.Uint64(src), nil
+	}
+}
+
+func (o *ordered[K]) signBit() uint64 {
+	return 1 << (o.size*8 - 1)
+}
+
+// floatBits maps f to an integer of o.size bytes ordered as f is. Both
+// zeros map to the positive one and every NaN to zero, below -Inf, as
+// cmp.Compare orders them.
+func (o *ordered[K]) floatBits(f float64) uint64 {
+	if math.IsNaN(f) {
+		return 0
+	}
+
+	if f == 0 {
+		f = 0
+	}
+
+	bits := math.Float64bits(f)
+	if o.size == 4 {
+		bits = uint64(math.Float32bits(float32(f)))
+	}
+
+	if bits&o.signBit() != 0 {
+		return ^bits & (o.signBit()<<1 - 1)
+	}
+
+	return bits | o.signBit()
+}
+
+func (o *ordered[K]) float(bits uint64) float64 {
+	if bits == 0 {
+		return math.NaN()
+	}
+
+	if bits&o.signBit() != 0 {
+		bits &^= o.signBit()
+	} else {
+		bits = ^bits & (o.signBit()<<1 - 1)
+	}
+
+	if o.size == 4 {
+		return float64(math.Float32frombits(uint32(bits)))
+	}
+
+	return math.Float64frombits(bits)
+}
+
+func (o *ordered[K]) AppendKey(dst []byte, k K) []byte {
+	rv := reflect.ValueOf(k)
+
+	switch o.kind {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return o.appendUint(dst, uint64(rv.Int())^o.signBit())
+	case reflect.Float32, reflect.Float64:
+		return o.appendUint(dst, o.floatBits(rv.Float()))
+	case reflect.String:
+		return append(dst, rv.String()...)
+	default:
+		return o.appendUint(dst, rv.Uint())
+	}
+}
+
+func (o *ordered[K]) DecodeKey(src []byte) (K, error) {
+	var k K
+
+	rv := reflect.ValueOf(&k).Elem()
+
+	if o.kind == reflect.String {
+		rv.SetString(string(src))
+
+		return k, nil
+	}
+
+	u, err := o.uint(src)
+	if err != nil {
+		return k, err
+	}
+
+	switch o.kind {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		u ^= o.signBit()
+		rv.SetInt(int64(u<<(64-o.size*8)) >> (64 - o.size*8))
+	case reflect.Float32, reflect.Float64:
+		rv.SetFloat(o.float(u))
+	default:
+		rv.SetUint(u)
+	}
+
+	return k, nil
+}
+
+// Name tells apart the encodings of signed and unsigned integers, floats
+// and strings, and their sizes, but not types sharing one.
+func (o *ordered[K]) Name() string {
+	switch o.kind {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return fmt.Sprintf("ordered/int%d", o.size*8)
+	case reflect.Float32, reflect.Float64:
+		return fmt.Sprintf("ordered/float%d", o.size*8)
+	case reflect.String:
+		return "ordered/string"
+	default:
+		return fmt.Sprintf("ordered/uint%d", o.size*8)
+	}
+}
+
+func (o *ordered[K]) AppendValue(dst []byte, v K) ([]byte, error) {
+	return o.AppendKey(dst, v), nil
+}
+
+func (o *ordered[K]) DecodeValue(src []byte) (K, error) {
+	return o.DecodeKey(src)
+}
+
+// Ordered encodes any cmp.Ordered type: integers as big-endian with the
+// sign bit flipped, floats with the usual total order transform and strings
+// as their bytes. It can encode values as well.
+func Ordered[K cmp.Ordered]() Codec[K] {
+	o, _ := newOrdered[K]()
+
+	return o
+}
+
+type bytesCodec struct{}
+
+func (bytesCodec) AppendKey(dst []byte, k []byte) []byte {
+	return append(dst, k...)
+}
+
+func (bytesCodec) DecodeKey(src []byte) ([]byte, error) {
+	return append([]byte{}, src...), nil
+}
+
+func (bytesCodec) Name() string {
+	return "bytes"
+}
+
+func (c bytesCodec) AppendValue(dst []byte, v []byte) ([]byte, error) {
+	return c.AppendKey(dst, v), nil
+}
+
+func (c bytesCodec) DecodeValue(src []byte) ([]byte, error) {
+	return c.DecodeKey(src)
+}
+
+// Bytes stores byte slices as they are, for keys and values.
+func Bytes() Codec[[]byte] {
+	return bytesCodec{}
+}
+
+// DefaultKeys returns Ordered for types whose underlying type is ordered
+// and Bytes for []byte. Other types have no default codec.
+func DefaultKeys[K any]() (KeyCodec[K], error) {
+	if o, ok := newOrdered[K](); ok {
+		return o, nil
+	}
+
+	if c, ok := any(bytesCodec{}).(KeyCodec[K]); ok {
+		return c, nil
+	}
+
+	var k K
+
+	return nil, fmt.Errorf("codec: no default key codec for %T", k)
+}
@@ -0,0 +1,103 @@
+package codec
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/gob"
+	"encoding/json"
+)
+
+type gobCodec[V any] struct{}
+
+func (gobCodec[V]) AppendValue(dst []byte, v V) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+
+	if err := gob.NewEncoder(buf).Encode(&v); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (gobCodec[V]) Name() string {
+	return "gob"
+}
+
+func (gobCodec[V]) DecodeValue(src []byte) (V, error) {
+	var v V
+
+	err := gob.NewDecoder(bytes.NewReader(src)).Decode(&v)
+
+	return v, err
+}
+
+// Gob encodes values with encoding/gob. When V is an interface, the
+// concrete types stored in it must be registered with gob.Register, except
+// for the basic ones.
+func Gob[V any]() ValueCodec[V] {
+	return gobCodec[V]{}
+}
+
+type jsonCodec[V any] struct{}
+
+func (jsonCodec[V]) AppendValue(dst []byte, v V) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(dst, b...), nil
+}
+
+func (jsonCodec[V]) Name() string {
+	return "json"
+}
+
+func (jsonCodec[V]) DecodeValue(src []byte) (V, error) {
+	var v V
+
+	err := json.Unmarshal(src, &v)
+
+	return v, err
+}
+
+func JSON[V any]() ValueCodec[V] {
+	return jsonCodec[V]{}
+}
+
+type binaryCodec[V any, PV interface {
+	*V
+	encoding.BinaryMarshaler
+	encoding.BinaryUnmarshaler
+}] struct{}
+
+func (binaryCodec[V, PV]) AppendValue(dst []byte, v V) ([]byte, error) {
+	b, err := PV(&v).MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	return append(dst, b...), nil
+}
+
+func (binaryCodec[V, PV]) Name() string {
+	return "binary"
+}
+
+func (binaryCodec[V, PV]) DecodeValue(src []byte) (V, error) {
+	var v V
+
+	err := PV(&v).UnmarshalBinary(src)
+
+	return v, err
+}
+
+// Binary encodes values with their encoding.BinaryMarshaler and
+// encoding.BinaryUnmarshaler implementations, e.g. Binary[time.Time]().
+func Binary[V any, PV interface {
+	*V
+	encoding.BinaryMarshaler
+	encoding.BinaryUnmarshaler
+}]() ValueCodec[V] {
+	return binaryCodec[V, PV]{}
+}
@@ -0,0 +1,298 @@
+package disk
+
+import (
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// Archived segments are WAL files, named by the LSN of their first record,
+// so they sort in order.
+const segmentSuffix = ".wal"
+
+var ErrIncompleteArchive = errors.New("disk: archived WAL segments don't reach the recovery target")
+
+func segmentName(start uint64) string {
+	return fmt.Sprintf("%020d%s", start, segmentSuffix)
+}
+
+// archiveRecords copies the records of the log to a new segment in the
+// archive directory, if it has one and they aren't torn, and syncs it,
+// along with the directory on OSFS, before the log is emptied.
+// Segments are written over if the log is archived again after a crash.
+func (w *wal) archiveRecords() error {
+	if w.archive == "" {
+		return nil
+	}
+
+	records, err := w.records()
+	if err != nil || len(records) == 0 {
+		return err
+	}
+
+	name := filepath.Join(w.archive, segmentName(records[0].lsn))
+
+	file, err := w.fs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("disk: failed to archive the WAL: %w", err)
+	}
+
+	s := &wal{file: file, pageSize: w.pageSize, start: records[0].lsn, size: walHeaderSize}
+
+	err = s.writeHeader()
+	for _, r := range records {
+		if err != nil {
+			break
+		}
+
+		buf := r.encode()
+		_, err = file.WriteAt(buf, s.size)
+		s.size += int64(len(buf))
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+
+	err = errors.Join(err, file.Close())
+	if err == nil && w.fs == OSFS {
+		err = syncDir(w.archive)
+	}
+	if err != nil {
+		return fmt.Errorf("disk: failed to archive the WAL: %w", err)
+	}
+
+	return nil
+}
+
+// RecoveryTarget is the point RestoreTo recovers a tree to. With neither
+// field set, it's the last operation archived.
+type RecoveryTarget struct {
+	// LSN, if set, is the last operation recovered.
+	LSN uint64
+	// Time, if set, stops the recovery before the first operation
+	// committed after it.
+	Time time.Time
+}
+
+// segment is an archived WAL segment.
+type segment struct {
+	path  string
+	start uint64
+}
+
+// segments returns the WAL segments in dir, by the LSN they start at.
+func segments(dir string) ([]segment, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var found []segment
+
+	for _, e := range entries {
+		if !e.Type().IsRegular() {
+			continue
+		}
+
+		path := filepath.Join(dir, e.Name())
+
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+
+		header := make([]byte, walHeaderSize)
+		_, err = io.ReadFull(file, header)
+		file.Close()
+
+		if err == nil && [8]byte(header[:8]) == walMagic {
+			found = append(found, segment{path: path, start: binary.BigEndian.Uint64(header[16:])})
+		}
+	}
+
+	slices.SortFunc(found, func(a, b segment) int {
+		return cmp.Compare(a.start, b.start)
+	})
+
+	return found, nil
+}
+
+// RestoreTo rolls the tree at base forward to target, replaying the
+// operations archived in walDir after the last one base holds, and returns
+// the LSN of the last one replayed. base is a tree file that isn't open,
+// like the ones Restore leaves, and walDir holds the segments gathered by
+// Options.ArchiveDir, along with, to recover operations not archived yet, a
+// copy of the WAL of the tree. Pages are replayed as stored, so encrypted
+// trees need no keys. The tree is locked meanwhile, as by a writer, failing
+// with ErrLocked if it's open.
+//
+// The tree is rolled forward next to base, at base+".recover", and only
+// moved over it once complete, so a failed recovery leaves base as it was.
+// If the segments miss operations up to target, it fails with
+// ErrIncompleteArchive.
+func RestoreTo(base, walDir string, target RecoveryTarget) (uint64, error) {
+	unlock, err := lockOffline(base)
+	if err != nil {
+		return 0, err
+	}
+
+	lsn, err := restoreTo(base, walDir, target)
+
+	return lsn, errors.Join(err, unlock())
+}
+
+func restoreTo(base, walDir string, target RecoveryTarget) (uint64, error) {
+	m, err := readMetaHeader(base)
+	if err != nil {
+		return 0, err
+	}
+
+	if m.appendOnly {
+		return 0, errors.New("disk: append-only trees have no WAL to recover from")
+	}
+
+	if target.LSN != 0 && target.LSN < m.lsn {
+		return 0, fmt.Errorf("disk: %v is at LSN %d, past the recovery target", base, m.lsn)
+	}
+
+	if o, err := readWAL(OSFS, base+"-wal"); err != nil {
+		return 0, err
+	} else if o.records > 0 {
+		return 0, fmt.Errorf("disk: %v has a WAL to replay first, by opening the tree", base)
+	}
+
+	found, err := segments(walDir)
+	if err != nil {
+		return 0, err
+	}
+
+	tmp := base + ".recover"
+	if err := copyFile(base, tmp); err != nil {
+		return 0, errors.Join(err, removeIfExists(tmp))
+	}
+
+	file, err := os.OpenFile(tmp, os.O_RDWR, 0)
+	if err != nil {
+		return 0, errors.Join(err, removeIfExists(tmp))
+	}
+
+	p := &pager{file: osFile{file}, pageSize: int(m.pageSize)}
+
+	lsn, err := replay(p, found, m, target)
+	if err == nil {
+		err = p.sync()
+	}
+
+	if err = errors.Join(err, p.close()); err != nil {
+		return 0, errors.Join(err, os.Remove(tmp))
+	}
+
+	if err := os.Rename(tmp, base); err != nil {
+		return 0, err
+	}
+
+	return lsn, syncDir(filepath.Dir(base))
+}
+
+// replay writes the pages of the operations in the segments found that
+// follow the tree of meta m, up to target, returning the LSN of the last
+// one.
+func replay(p *pager, found []segment, m *meta, target RecoveryTarget) (uint64, error) {
+	lsn, count := m.lsn, m.count
+	reached, gap := false, false
+
+	for _, s := range found {
+		if s.start > lsn+1 {
+			gap = true
+
+			break
+		}
+
+		file, err := os.Open(s.path)
+		if err != nil {
+			return 0, err
+		}
+
+		w := &wal{file: osFile{file}}
+		records, err := w.records()
+		file.Close()
+
+		if err != nil {
+			return 0, err
+		}
+
+		if len(records) > 0 && w.pageSize != p.pageSize {
+			return 0, fmt.Errorf("disk: segment %v holds pages of %d bytes, expected %d", s.path, w.pageSize, p.pageSize)
+		}
+
+		for _, r := range records {
+			if r.lsn <= lsn {
+				continue
+			}
+
+			if target.LSN != 0 && r.lsn > target.LSN || !target.Time.IsZero() && r.time.After(target.Time) {
+				reached = true
+
+				break
+			}
+
+			for _, page := range r.pages {
+				if page.id == metaPage {
+					rm, err := decodeMeta(page.data)
+					if err != nil {
+						return 0, fmt.Errorf("disk: segment %v: %w", s.path, err)
+					}
+
+					count = rm.count
+				}
+
+				if err := p.writeRaw(page.id, page.data); err != nil {
+					return 0, err
+				}
+			}
+
+			lsn = r.lsn
+		}
+
+		if reached {
+			break
+		}
+	}
+
+	if gap || target.LSN != 0 && lsn < target.LSN {
+		return 0, fmt.Errorf("%w: they stop at LSN %d", ErrIncompleteArchive, lsn)
+	}
+
+	// Operations replayed may have shrunk the tree.
+	if lsn != m.lsn {
+		if err := p.truncate(count); err != nil {
+			return 0, err
+		}
+	}
+
+	return lsn, nil
+}
+
+// copyFile copies the file at src to dst, which is created or truncated.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+
+	return errors.Join(err, out.Close())
+}
@@ -0,0 +1,159 @@
+package disk
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// archivedTree returns a tree archiving its WAL to dir, along with a full
+// backup of it holding the keys from 0 to 499.
+func archivedTree(t *testing.T, dir string) (*BTree[int], *Options[int], []byte) {
+	opts := &Options[int]{
+		PageSize:       256,
+		MinimumDegree:  2,
+		CheckpointSize: 8 << 10,
+		ArchiveDir:     dir,
+		Encryption:     KeyRing{1: testKey(1)},
+		Compression:    CompressFlate,
+	}
+
+	bt := openTree(t, filepath.Join(t.TempDir(), "tree"), opts)
+
+	for k := range 500 {
+		if err := bt.Insert(k, k); err != nil {
+			t.Fatalf("failed to insert %v: %v", k, err)
+		}
+	}
+
+	full, _ := takeBackup(t, bt, 0)
+
+	return bt, opts, full
+}
+
+func restoreBase(t *testing.T, full []byte) string {
+	path := filepath.Join(t.TempDir(), "restored")
+
+	if err := Restore(path, bytes.NewReader(full)); err != nil {
+		t.Fatalf("failed to restore: %v", err)
+	}
+
+	return path
+}
+
+func TestRestoreTo(t *testing.T) {
+	dir := t.TempDir()
+	bt, opts, full := archivedTree(t, dir)
+
+	expected := map[int]int{}
+	for k := range 1000 {
+		if err := bt.Insert(k, k); err != nil {
+			t.Fatalf("failed to insert %v: %v", k, err)
+		}
+		expected[k] = k
+	}
+
+	lsn := bt.meta.lsn
+	time.Sleep(10 * time.Millisecond)
+	before := time.Now()
+	time.Sleep(10 * time.Millisecond)
+
+	// The bad bulk write to undo.
+	for k := range 1000 {
+		if _, err := bt.Delete(k); err != nil {
+			t.Fatalf("failed to delete %v: %v", k, err)
+		}
+	}
+
+	if err := bt.Close(); err != nil {
+		t.Fatalf("failed to close tree: %v", err)
+	}
+
+	if segments, _ := os.ReadDir(dir); len(segments) < 3 {
+		t.Fatalf("expected several archived segments, got %v", len(segments))
+	}
+
+	for _, target := range []RecoveryTarget{{LSN: lsn}, {Time: before}} {
+		path := restoreBase(t, full)
+
+		got, err := RestoreTo(path, dir, target)
+		if err != nil {
+			t.Fatalf("failed to recover to %+v: %v", target, err)
+		}
+
+		if got != lsn {
+			t.Errorf("expected to recover to LSN %v, got %v", lsn, got)
+		}
+
+		if r, err := Verify(path, &VerifyOptions{Encryption: opts.Encryption}); err != nil || !r.OK() {
+			t.Fatalf("expected the recovered tree to verify, got %v, %v", r, err)
+		}
+
+		restored := openTree(t, path, opts)
+		checkContents(t, restored, expected)
+		restored.Close()
+	}
+
+	// Up to the end of the archive, with the keys deleted.
+	path := restoreBase(t, full)
+	if _, err := RestoreTo(path, dir, RecoveryTarget{}); err != nil {
+		t.Fatalf("failed to recover: %v", err)
+	}
+
+	restored := openTree(t, path, opts)
+	defer restored.Close()
+
+	checkContents(t, restored, map[int]int{})
+}
+
+func TestRestoreToIncompleteArchive(t *testing.T) {
+	dir := t.TempDir()
+	bt, _, full := archivedTree(t, dir)
+
+	for k := range 1000 {
+		if err := bt.Insert(k, -k); err != nil {
+			t.Fatalf("failed to insert %v: %v", k, err)
+		}
+	}
+
+	lsn := bt.meta.lsn
+
+	if err := bt.Close(); err != nil {
+		t.Fatalf("failed to close tree: %v", err)
+	}
+
+	path := restoreBase(t, full)
+
+	if _, err := RestoreTo(path, dir, RecoveryTarget{LSN: lsn + 1}); !errors.Is(err, ErrIncompleteArchive) {
+		t.Errorf("expected ErrIncompleteArchive recovering past the archive, got %v", err)
+	}
+
+	found, err := segments(dir)
+	if err != nil || len(found) < 3 {
+		t.Fatalf("expected several archived segments, got %v, %v", found, err)
+	}
+
+	if err := os.Remove(found[len(found)/2].path); err != nil {
+		t.Fatalf("failed to remove a segment: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read %v: %v", path, err)
+	}
+
+	if _, err := RestoreTo(path, dir, RecoveryTarget{}); !errors.Is(err, ErrIncompleteArchive) {
+		t.Errorf("expected ErrIncompleteArchive recovering over a missing segment, got %v", err)
+	}
+
+	if after, _ := os.ReadFile(path); !bytes.Equal(after, data) {
+		t.Errorf("expected a failed recovery to leave the base as it was")
+	}
+
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Errorf("expected only the base to be left, got %v", entries)
+	}
+}
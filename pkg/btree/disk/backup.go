@@ -0,0 +1,454 @@
+package disk
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	iofs "io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// A backup starts with a header: magic, format version, page size, the LSN
+// of the backup it's incremental to, or 0, and its own LSN. Each page
+// follows, as stored in the tree file and prefixed by backupPage, its ID and
+// size. The meta pages come last, page 0 after page 1 of append-only
+// trees. The pages end with backupEnd, their count
+// and the CRC32C of everything before it.
+const (
+	backupVersion    = 1
+	backupHeaderSize = 8 + 2 + 4 + 8 + 8
+
+	backupPage byte = 1
+	backupEnd  byte = 0
+)
+
+var (
+	backupMagic = [8]byte{'b', 't', 'r', 'e', 'e', 'b', 'a', 'k'}
+
+	ErrInvalidBackup = errors.New("disk: invalid backup")
+)
+
+// backup is a backup being taken, of the tree as of its LSN. Pages it
+// didn't copy yet are saved before they change.
+type backup struct {
+	count  uint32
+	copied map[pageID]bool
+	saved  map[pageID][]byte
+}
+
+// image returns the committed image of page id.
+func (bt *BTree[K]) image(id pageID) ([]byte, error) {
+	if bt.readOnly {
+		return bt.pager.read(id)
+	}
+
+	f, err := bt.pool.get(id)
+	if err != nil {
+		return nil, err
+	}
+	defer bt.pool.unpin(f)
+
+	return f.data, nil
+}
+
+// preserve saves, for the backups being taken, the pages an operation is
+// about to commit, changing or dropping them, that they didn't copy yet.
+func (bt *BTree[K]) preserve() error {
+	if len(bt.backups) == 0 {
+		return nil
+	}
+
+	ids := slices.Collect(maps.Keys(bt.dirty))
+	for id := bt.meta.count; id < bt.committed.count; id++ {
+		ids = append(ids, pageID(id))
+	}
+
+	for _, b := range bt.backups {
+		for _, id := range ids {
+			if uint32(id) >= b.count || b.copied[id] || b.saved[id] != nil {
+				continue
+			}
+
+			buf, err := bt.image(id)
+			if err != nil {
+				return err
+			}
+
+			b.saved[id] = buf
+		}
+	}
+
+	return nil
+}
+
+// copy returns the image of page id as of backup b.
+func (bt *BTree[K]) copy(b *backup, id pageID) ([]byte, error) {
+	bt.mutex.RLock()
+	defer bt.mutex.RUnlock()
+
+	if err := bt.usable(); err != nil {
+		return nil, err
+	}
+
+	b.copied[id] = true
+
+	if buf, ok := b.saved[id]; ok {
+		delete(b.saved, id)
+
+		return buf, nil
+	}
+
+	return bt.image(id)
+}
+
+// backupWriter writes a backup, hashing what it writes.
+type backupWriter struct {
+	w *bufio.Writer
+	h hash.Hash32
+}
+
+func (bw *backupWriter) write(p []byte) error {
+	bw.h.Write(p)
+	_, err := bw.w.Write(p)
+
+	return err
+}
+
+func (bw *backupWriter) page(id pageID, data []byte) error {
+	header := []byte{backupPage}
+	header = binary.BigEndian.AppendUint32(header, uint32(id))
+	header = binary.BigEndian.AppendUint32(header, uint32(len(data)))
+
+	if err := bw.write(header); err != nil {
+		return err
+	}
+
+	return bw.write(data)
+}
+
+func (bt *BTree[K]) backup(ctx context.Context, w io.Writer, since uint64) (uint64, error) {
+	bt.mutex.Lock()
+
+	if err := bt.usable(); err != nil {
+		bt.mutex.Unlock()
+
+		return 0, err
+	}
+
+	m := *bt.meta
+
+	if since > m.lsn {
+		bt.mutex.Unlock()
+
+		return 0, fmt.Errorf("disk: no backup was taken at LSN %d", since)
+	}
+
+	b := &backup{count: m.count, copied: map[pageID]bool{}, saved: map[pageID][]byte{}}
+	bt.backups = append(bt.backups, b)
+
+	bt.mutex.Unlock()
+
+	defer func() {
+		bt.mutex.Lock()
+		defer bt.mutex.Unlock()
+
+		bt.backups = slices.DeleteFunc(bt.backups, func(o *backup) bool {
+			return o == b
+		})
+	}()
+
+	bw := &backupWriter{w: bufio.NewWriter(w), h: crc32.New(castagnoli)}
+
+	header := binary.BigEndian.AppendUint16(slices.Clone(backupMagic[:]), backupVersion)
+	header = binary.BigEndian.AppendUint32(header, uint32(bt.pager.pageSize))
+	header = binary.BigEndian.AppendUint64(header, since)
+	header = binary.BigEndian.AppendUint64(header, m.lsn)
+
+	if err := bw.write(header); err != nil {
+		return 0, err
+	}
+
+	var count uint32
+
+	for id := pageID(1); uint32(id) < m.count; id++ {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+
+		if bt.pager.isMeta(id) {
+			continue
+		}
+
+		buf, err := bt.copy(b, id)
+		if err != nil {
+			return 0, err
+		}
+
+		if since != 0 && pageLSN(buf) <= since {
+			continue
+		}
+
+		page, err := bt.pager.seal(id, buf, pageLSN(buf))
+		if err != nil {
+			return 0, err
+		}
+
+		if err := bw.page(id, page); err != nil {
+			return 0, err
+		}
+
+		count++
+	}
+
+	metas := []pageID{metaPage}
+	if bt.pager.dualMeta {
+		metas = []pageID{1, metaPage}
+	}
+
+	for _, id := range metas {
+		buf := make([]byte, bt.pager.imageSize(id))
+		m.encode(buf)
+		stampLSN(buf, m.lsn)
+		seal(id, buf)
+
+		page, err := bt.pager.seal(id, buf, m.lsn)
+		if err != nil {
+			return 0, err
+		}
+
+		if err := bw.page(id, page); err != nil {
+			return 0, err
+		}
+
+		count++
+	}
+
+	trailer := binary.BigEndian.AppendUint32([]byte{backupEnd}, count)
+	if err := bw.write(trailer); err != nil {
+		return 0, err
+	}
+
+	if _, err := bw.w.Write(binary.BigEndian.AppendUint32(nil, bw.h.Sum32())); err != nil {
+		return 0, err
+	}
+
+	if err := bw.w.Flush(); err != nil {
+		return 0, err
+	}
+
+	return m.lsn, nil
+}
+
+// Backup writes a copy of the tree to w, as it is when Backup is called.
+// Writers aren't held while it runs: the pages they change are saved first,
+// until copied. It returns the LSN the copy is at, which incremental
+// backups taken later on start from.
+func (bt *BTree[K]) Backup(ctx context.Context, w io.Writer) (uint64, error) {
+	return bt.backup(ctx, w, 0)
+}
+
+// BackupIncremental writes to w the pages changed since the backup at LSN
+// since, full or incremental, as Backup does. It returns the LSN the copy
+// is at.
+func (bt *BTree[K]) BackupIncremental(ctx context.Context, w io.Writer, since uint64) (uint64, error) {
+	if since == 0 {
+		return 0, errors.New("disk: incremental backups need the LSN of a previous backup")
+	}
+
+	return bt.backup(ctx, w, since)
+}
+
+// backupReader reads a backup, hashing what it reads.
+type backupReader struct {
+	r *bufio.Reader
+	h hash.Hash32
+}
+
+func (br *backupReader) read(n int) ([]byte, error) {
+	buf := make([]byte, n)
+
+	if _, err := io.ReadFull(br.r, buf); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, fmt.Errorf("%w: truncated stream", ErrInvalidBackup)
+		}
+
+		return nil, err
+	}
+
+	br.h.Write(buf)
+
+	return buf, nil
+}
+
+// restore writes the pages of backup r, which must follow the one at LSN
+// since, returning its LSN.
+func restore(p *pager, r io.Reader, since uint64) (uint64, error) {
+	br := &backupReader{r: bufio.NewReader(r), h: crc32.New(castagnoli)}
+
+	invalid := func(format string, args ...any) (uint64, error) {
+		return 0, fmt.Errorf("%w: %v", ErrInvalidBackup, fmt.Sprintf(format, args...))
+	}
+
+	header, err := br.read(backupHeaderSize)
+	if err != nil {
+		return 0, err
+	}
+
+	if [8]byte(header[:8]) != backupMagic {
+		return invalid("not a backup")
+	}
+
+	if v := binary.BigEndian.Uint16(header[8:]); v != backupVersion {
+		return invalid("unsupported version %d", v)
+	}
+
+	pageSize := int(binary.BigEndian.Uint32(header[10:]))
+	if p.pageSize == 0 {
+		p.pageSize = pageSize
+	} else if pageSize != p.pageSize {
+		return invalid("page size %d, expected %d", pageSize, p.pageSize)
+	}
+
+	if s := binary.BigEndian.Uint64(header[14:]); s != since {
+		if since == 0 {
+			return invalid("incremental backup given as a full one")
+		}
+
+		return invalid("backup follows LSN %d, expected %d", s, since)
+	}
+
+	var (
+		m     *meta
+		count uint32
+	)
+
+	for {
+		marker, err := br.read(1)
+		if err != nil {
+			return 0, err
+		}
+
+		if marker[0] == backupEnd {
+			break
+		} else if marker[0] != backupPage {
+			return invalid("unknown marker %d", marker[0])
+		}
+
+		ph, err := br.read(4 + 4)
+		if err != nil {
+			return 0, err
+		}
+
+		id, size := pageID(binary.BigEndian.Uint32(ph)), int(binary.BigEndian.Uint32(ph[4:]))
+		if size > pageSize {
+			return invalid("page %d of %d bytes", id, size)
+		}
+
+		data, err := br.read(size)
+		if err != nil {
+			return 0, err
+		}
+
+		if id == metaPage {
+			if m, err = decodeMeta(data); err != nil {
+				return invalid("invalid meta page")
+			}
+		}
+
+		if err := p.writeRaw(id, data); err != nil {
+			return 0, err
+		}
+
+		count++
+	}
+
+	trailer, err := br.read(4)
+	if err != nil {
+		return 0, err
+	}
+
+	sum := br.h.Sum32()
+
+	crc := make([]byte, 4)
+	if _, err := io.ReadFull(br.r, crc); err != nil {
+		return invalid("truncated stream")
+	}
+
+	if binary.BigEndian.Uint32(crc) != sum {
+		return invalid("checksum mismatch")
+	}
+
+	if n := binary.BigEndian.Uint32(trailer); n != count || m == nil {
+		return invalid("expected %d pages and the meta page, got %d", n, count)
+	}
+
+	// The tree may have shrunk since the previous backup.
+	if err := p.truncate(m.count); err != nil {
+		return 0, err
+	}
+
+	return binary.BigEndian.Uint64(header[22:]), nil
+}
+
+// Restore restores a full backup to path, which mustn't exist, then the
+// incremental backups taken after it, in order. The tree is written next
+// to path first, and only moved there once complete, so a failed restore
+// leaves nothing behind. The tree is locked meanwhile, as by a writer.
+func Restore(path string, full io.Reader, incrementals ...io.Reader) (err error) {
+	unlock, err := lockOffline(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = errors.Join(err, unlock())
+	}()
+
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("disk: %v already exists", path)
+	} else if !errors.Is(err, iofs.ErrNotExist) {
+		return err
+	}
+
+	// A WAL left next to path would be replayed into the tree.
+	if err := removeIfExists(path + "-wal"); err != nil {
+		return err
+	}
+
+	tmp := path + ".restore"
+
+	file, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+
+	p := &pager{file: osFile{file}}
+
+	var lsn uint64
+	for _, r := range append([]io.Reader{full}, incrementals...) {
+		if lsn, err = restore(p, r, lsn); err != nil {
+			break
+		}
+	}
+
+	if err == nil {
+		err = p.sync()
+	}
+
+	if err = errors.Join(err, p.close()); err != nil {
+		return errors.Join(err, os.Remove(tmp))
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	return syncDir(filepath.Dir(path))
+}
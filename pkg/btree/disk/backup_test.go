@@ -0,0 +1,308 @@
+package disk
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func takeBackup(t *testing.T, bt *BTree[int], since uint64) ([]byte, uint64) {
+	var buf bytes.Buffer
+
+	var (
+		lsn uint64
+		err error
+	)
+	if since == 0 {
+		lsn, err = bt.Backup(context.Background(), &buf)
+	} else {
+		lsn, err = bt.BackupIncremental(context.Background(), &buf, since)
+	}
+	if err != nil {
+		t.Fatalf("failed to back up: %v", err)
+	}
+
+	return buf.Bytes(), lsn
+}
+
+func restoreTree(t *testing.T, opts *Options[int], backups ...[]byte) *BTree[int] {
+	path := filepath.Join(t.TempDir(), "restored")
+
+	var incrementals []io.Reader
+	for _, b := range backups[1:] {
+		incrementals = append(incrementals, bytes.NewReader(b))
+	}
+
+	if err := Restore(path, bytes.NewReader(backups[0]), incrementals...); err != nil {
+		t.Fatalf("failed to restore: %v", err)
+	}
+
+	if r, err := Verify(path, &VerifyOptions{Encryption: opts.Encryption}); err != nil || !r.OK() {
+		t.Fatalf("expected the restored tree to verify, got %v, %v", r, err)
+	}
+
+	return openTree(t, path, opts)
+}
+
+// mutatingWriter runs mutate on the first write, in the middle of a backup.
+type mutatingWriter struct {
+	bytes.Buffer
+	mutate func()
+}
+
+func (w *mutatingWriter) Write(p []byte) (int, error) {
+	if w.mutate != nil {
+		w.mutate()
+		w.mutate = nil
+	}
+
+	return w.Buffer.Write(p)
+}
+
+func TestBackup(t *testing.T) {
+	opts := &Options[int]{PageSize: 256, MinimumDegree: 2}
+
+	bt := openTree(t, filepath.Join(t.TempDir(), "tree"), opts)
+	defer bt.Close()
+
+	expected := fillAndThin(t, bt)
+
+	// Pages not copied yet change, move and are dropped during the backup,
+	// which still copies them as they were.
+	w := &mutatingWriter{mutate: func() {
+		for k := range 2000 {
+			if err := bt.Insert(k, -k); err != nil {
+				t.Fatalf("failed to insert %v: %v", k, err)
+			}
+		}
+
+		for k := 0; k < 2000; k += 10 {
+			if _, err := bt.Delete(k); err != nil {
+				t.Fatalf("failed to delete %v: %v", k, err)
+			}
+		}
+
+		if err := bt.Vacuum(); err != nil {
+			t.Fatalf("failed to vacuum: %v", err)
+		}
+	}}
+
+	if _, err := bt.Backup(context.Background(), w); err != nil {
+		t.Fatalf("failed to back up: %v", err)
+	}
+
+	if w.mutate != nil {
+		t.Fatalf("expected the tree to change during the backup")
+	}
+
+	restored := restoreTree(t, opts, w.Bytes())
+	defer restored.Close()
+
+	checkContents(t, restored, expected)
+}
+
+func TestBackupConcurrentWriters(t *testing.T) {
+	opts := &Options[int]{PageSize: 256, MinimumDegree: 2}
+
+	bt := openTree(t, filepath.Join(t.TempDir(), "tree"), opts)
+	defer bt.Close()
+
+	for k := range 500 {
+		if err := bt.Insert(k, k); err != nil {
+			t.Fatalf("failed to insert %v: %v", k, err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		for k := 500; k < 2000; k++ {
+			if err := bt.Insert(k, k); err != nil {
+				t.Errorf("failed to insert %v: %v", k, err)
+
+				return
+			}
+		}
+	}()
+
+	data, _ := takeBackup(t, bt, 0)
+	wg.Wait()
+
+	restored := restoreTree(t, opts, data)
+	defer restored.Close()
+
+	checkInvariants(t, restored)
+
+	// Keys are inserted in order, so the copy holds the ones inserted
+	// before it was taken.
+	count := 0
+	for k := range 2000 {
+		v, err := restored.Search(k)
+		if err != nil {
+			t.Fatalf("failed to search %v: %v", k, err)
+		}
+
+		if v == nil {
+			break
+		}
+
+		if v != k {
+			t.Fatalf("expected %v to be %v, got %v", k, k, v)
+		}
+		count++
+	}
+
+	for k := count; k < 2000; k++ {
+		if v, _ := restored.Search(k); v != nil {
+			t.Fatalf("expected %v to be missing after %v keys, got %v", k, count, v)
+		}
+	}
+
+	if count < 500 {
+		t.Fatalf("expected at least 500 keys, got %v", count)
+	}
+}
+
+func TestBackupIncremental(t *testing.T) {
+	opts := &Options[int]{PageSize: 256, MinimumDegree: 2}
+
+	bt := openTree(t, filepath.Join(t.TempDir(), "tree"), opts)
+	defer bt.Close()
+
+	expected := fillAndThin(t, bt)
+	full, lsn := takeBackup(t, bt, 0)
+
+	for k := 1; k < 2000; k += 100 {
+		if err := bt.Insert(k, -k); err != nil {
+			t.Fatalf("failed to insert %v: %v", k, err)
+		}
+		expected[k] = -k
+	}
+
+	first, lsn := takeBackup(t, bt, lsn)
+
+	if err := bt.Vacuum(); err != nil {
+		t.Fatalf("failed to vacuum: %v", err)
+	}
+
+	for k := 0; k < 2000; k += 20 {
+		if _, err := bt.Delete(k); err != nil {
+			t.Fatalf("failed to delete %v: %v", k, err)
+		}
+		delete(expected, k)
+	}
+
+	second, _ := takeBackup(t, bt, lsn)
+
+	if len(first) >= len(full)/2 || len(second) >= len(full) {
+		t.Errorf("expected incremental backups to be smaller than the full one, got %v and %v bytes, against %v",
+			len(first), len(second), len(full))
+	}
+
+	restored := restoreTree(t, opts, full, first, second)
+	defer restored.Close()
+
+	checkContents(t, restored, expected)
+
+	dir := t.TempDir()
+	for i, backups := range [][][]byte{{first}, {full, second}, {full, first, first}} {
+		path := filepath.Join(dir, "tree")
+
+		var incrementals []io.Reader
+		for _, b := range backups[1:] {
+			incrementals = append(incrementals, bytes.NewReader(b))
+		}
+
+		if err := Restore(path, bytes.NewReader(backups[0]), incrementals...); !errors.Is(err, ErrInvalidBackup) {
+			t.Errorf("expected ErrInvalidBackup restoring chain %v, got %v", i, err)
+		}
+
+		if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+			t.Errorf("expected nothing left after restoring chain %v, got %v", i, entries)
+		}
+	}
+}
+
+func TestBackupCorrupted(t *testing.T) {
+	opts := &Options[int]{PageSize: 256, MinimumDegree: 2}
+
+	bt := openTree(t, filepath.Join(t.TempDir(), "tree"), opts)
+	defer bt.Close()
+
+	fillAndThin(t, bt)
+	data, _ := takeBackup(t, bt, 0)
+
+	flipped := bytes.Clone(data)
+	flipped[len(flipped)/2] ^= 1
+
+	dir := t.TempDir()
+	for i, b := range [][]byte{flipped, data[:len(data)-1], data[:len(data)/2], []byte("not a backup")} {
+		path := filepath.Join(dir, "tree")
+
+		if err := Restore(path, bytes.NewReader(b)); !errors.Is(err, ErrInvalidBackup) {
+			t.Errorf("expected ErrInvalidBackup restoring backup %v, got %v", i, err)
+		}
+
+		if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+			t.Errorf("expected nothing left after restoring backup %v, got %v", i, entries)
+		}
+	}
+
+	path := filepath.Join(dir, "tree")
+	if err := os.WriteFile(path, nil, 0o644); err != nil {
+		t.Fatalf("failed to create %v: %v", path, err)
+	}
+
+	if err := Restore(path, bytes.NewReader(data)); err == nil {
+		t.Errorf("expected restoring over an existing file to fail")
+	}
+}
+
+func TestBackupEncryptedCompressed(t *testing.T) {
+	keys := KeyRing{1: testKey(1)}
+	opts := &Options[int]{PageSize: 256, MinimumDegree: 2, Encryption: keys, Compression: CompressFlate}
+	secret := strings.Repeat("secret", 100)
+
+	bt := openTree(t, filepath.Join(t.TempDir(), "tree"), opts)
+	defer bt.Close()
+
+	for k := range 300 {
+		if err := bt.Insert(k, secret); err != nil {
+			t.Fatalf("failed to insert %v: %v", k, err)
+		}
+	}
+
+	full, lsn := takeBackup(t, bt, 0)
+
+	if _, err := bt.Delete(0); err != nil {
+		t.Fatalf("failed to delete 0: %v", err)
+	}
+
+	incremental, _ := takeBackup(t, bt, lsn)
+
+	for _, b := range [][]byte{full, incremental} {
+		if bytes.Contains(b, []byte("secret")) {
+			t.Errorf("backup holds plain values")
+		}
+	}
+
+	restored := restoreTree(t, opts, full, incremental)
+	defer restored.Close()
+
+	checkInvariants(t, restored)
+
+	for k := range 300 {
+		if v, err := restored.Search(k); err != nil || k == 0 && v != nil || k != 0 && v != secret {
+			t.Fatalf("expected %v to be restored, got %v, %v", k, v, err)
+		}
+	}
+}
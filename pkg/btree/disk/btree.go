@@ -0,0 +1,1363 @@
+package disk
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/franciscosbf/b-tree-go/pkg/btree/codec"
+)
+
+var (
+	ErrNotTreeFile   = errors.New("disk: file isn't a b-tree file")
+	ErrCorrupted     = errors.New("disk: corrupted page")
+	ErrEntryTooLarge = errors.New("disk: key doesn't fit in a node")
+	ErrClosed        = errors.New("disk: tree is closed")
+	ErrFailed        = errors.New("disk: tree must be reopened after a failure")
+	ErrReadOnly      = errors.New("disk: tree is read-only")
+	ErrFormatVersion = errors.New("disk: unsupported file format version")
+	ErrCodecMismatch = errors.New("disk: codecs don't match the ones the tree was created with")
+	ErrAppendOnly    = errors.New("disk: operation isn't supported by append-only trees")
+	ErrBuckets       = errors.New("disk: file holds the buckets of a DB")
+)
+
+const (
+	DefaultPageSize       = 4096
+	DefaultMinimumDegree  = 8
+	DefaultCheckpointSize = 4 << 20
+	DefaultCacheSize      = 4 << 20
+
+	// minCachePages keeps the buffer pool usable when CacheSize is smaller
+	// than a few pages.
+	minCachePages = 8
+
+	minPageSize = 64
+	maxPageSize = 1 << 16
+)
+
+type Options[K any] struct {
+	// PageSize and MinimumDegree only apply to new files. Existing ones
+	// keep the values they were created with. Leaves hold between t-1
+	// and 2t-1 entries, for a minimum degree t, and internal nodes at
+	// least t-1 keys and as many as fit in their page.
+	PageSize      int
+	MinimumDegree int
+
+	// Keys defaults to codec.DefaultKeys and Values to codec.Gob, so value
+	// types other than the basic ones must be registered with
+	// gob.Register. New files record the names of named codecs, and
+	// opening them with other named ones fails with ErrCodecMismatch.
+	Keys   codec.KeyCodec[K]
+	Values codec.ValueCodec[any]
+
+	// FS defaults to OSFS.
+	FS FS
+
+	// CheckpointSize is the size the WAL may grow to before a checkpoint.
+	CheckpointSize int64
+
+	// CacheSize is the memory budget of the buffer pool, in bytes, and
+	// Eviction the policy it follows once full. The root page is always
+	// kept in the pool, and the pages of other internal nodes are evicted
+	// after the ones of leaves while they take at most half of it.
+	CacheSize int
+	Eviction  Eviction
+
+	// Mmap opens the tree read-only, mapping its file in memory instead
+	// of reading pages into the buffer pool. Processes mapping the same
+	// file share its pages. Writes return ErrReadOnly, and the WAL isn't
+	// replayed but read into memory, so the file mustn't be written while
+	// mapped. Keys and values decoded by codecs that keep their input,
+	// like codec.Bytes, are only valid until Close. Other options but the
+	// codecs and Encryption are ignored. Mapping a tree open without Mmap,
+	// by another process or this one, fails with ErrLocked.
+	Mmap bool
+
+	// Encryption, when set, encrypts every page with AES-GCM, in the tree
+	// file and in the WAL, with keys from the provider. It only applies to
+	// new files, and must be set to open encrypted ones.
+	Encryption KeyProvider
+
+	// Durability sets when writes are synced to disk. It defaults to
+	// SyncEveryWrite.
+	Durability Durability
+
+	// Compression compresses pages with the given codec, which shrinks the
+	// WAL and backups. The tree file keeps its size, as pages keep their
+	// place in it, but the blocks past the end of compressed pages are
+	// deallocated, on Linux or on a SparseFile, so it takes less space on
+	// disk once pages span several blocks, like 16 KiB pages on a file
+	// system of 4 KiB blocks. It only applies to new files; existing ones
+	// keep the one they were created with.
+	Compression Compression
+
+	// ArchiveDir, when set, is the directory the records of the WAL are
+	// copied to before checkpoints drop them, one segment file per
+	// checkpoint, for RestoreTo. The directory must exist. It doesn't
+	// apply to append-only trees, which have no WAL.
+	ArchiveDir string
+
+	// AppendOnly creates new files copy-on-write, without a WAL: commits
+	// write the pages they change to new locations and then flip between
+	// two meta pages, and View reads the tree as of a past commit. Each
+	// commit syncs the file twice, so Durability and CheckpointSize don't
+	// apply, and neither Vacuum nor RotateKey are supported. Existing files
+	// keep the layout they were created with.
+	AppendOnly bool
+}
+
+// BTree is a B+Tree stored in a single file, one node per page. Leaves hold
+// the entries, and internal nodes the shortest keys separating their
+// childs, cut short of the keys of entries so they fit more of them. Nodes
+// store the prefix their keys share once, in their page and once read, and
+// only what follows it for each key. Pages are read from the file into a
+// bounded buffer pool as operations reach them, and every write is
+// committed to a write-ahead log before returning, or copy-on-write for
+// append-only trees. Keys are compared by their encoding, so the key codec
+// must preserve their order.
+type BTree[K any] struct {
+	mutex    sync.RWMutex
+	pager    *pager
+	meta     *meta
+	t        int
+	maxEntry int
+	dirty    map[pageID]*node
+	closed   bool
+	keys     codec.KeyCodec[K]
+	values   codec.ValueCodec[any]
+
+	wal            *wal
+	commit         *committer
+	checkpointSize int64
+	failed         error
+
+	pool *pool
+	root *frame
+
+	readOnly bool
+	// committed is the meta of the last committed operation.
+	committed meta
+	// backups are the backups being taken.
+	backups []*backup
+	// cow is set for append-only trees, which have no WAL.
+	cow *cow
+	// catalog is set for the tree of a DB, which records its buckets.
+	catalog bool
+	// lock keeps other processes out, unless the tree is on another FS.
+	lock *fileLock
+	// vacuuming serializes vacuums, which relocate pages without the tree
+	// lock.
+	vacuuming sync.Mutex
+}
+
+// overfull reports whether n holds more than it may: leaves hold up to 2t-1
+// entries, and internal nodes as many keys as fit in their page, at least
+// 2t-1 as keys are short enough.
+func (bt *BTree[K]) overfull(n *node) bool {
+	if n.leaf {
+		return len(n.entries) > 2*bt.t-1
+	}
+
+	return n.size() > bt.pager.nodeSpace()
+}
+
+// load returns the node of the page r references, which must hold the LSN
+// r expects unless the running operation changed it: older images of the
+// page don't.
+func (bt *BTree[K]) load(r ref) (*node, error) {
+	n, err := bt.loadPage(r.id)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := bt.dirty[r.id]; !ok && n.lsn != r.lsn {
+		return nil, staleLSN(r, n.lsn)
+	}
+
+	return n, nil
+}
+
+// loadPage returns the node of page id, whatever its LSN, for pages reached
+// by their ID alone, whose referrer checks it.
+func (bt *BTree[K]) loadPage(id pageID) (*node, error) {
+	if n, ok := bt.dirty[id]; ok {
+		return n, nil
+	}
+
+	if bt.readOnly {
+		buf, err := bt.pager.read(id)
+		if err != nil {
+			return nil, err
+		}
+
+		return decodeNode(id, buf)
+	}
+
+	f, err := bt.pool.get(id)
+	if err != nil {
+		return nil, err
+	}
+	defer bt.pool.unpin(f)
+
+	n, err := decodeNode(id, f.data)
+	if err == nil && bt.cow != nil && bt.cow.touched != nil {
+		bt.cow.touched[id] = n
+	}
+
+	return n, err
+}
+
+func (bt *BTree[K]) mark(n *node) {
+	bt.dirty[n.id] = n
+}
+
+// allocate takes a page from the free list, or a new one at the end of the
+// file if it's empty. Append-only trees take pages no version of the tree
+// reads instead.
+func (bt *BTree[K]) allocate(leaf bool) (*node, error) {
+	id := pageID(bt.meta.count)
+
+	if bt.cow != nil {
+		id = bt.cow.take(bt.meta)
+	} else if bt.meta.free.id != 0 {
+		f, err := bt.load(bt.meta.free)
+		if err != nil {
+			return nil, err
+		}
+
+		if !f.free {
+			return nil, corruption(f.id, "page in the free list isn't free")
+		}
+
+		id, bt.meta.free = f.id, f.next
+	} else {
+		bt.meta.count++
+	}
+
+	n := &node{id: id, leaf: leaf}
+	bt.mark(n)
+
+	return n, nil
+}
+
+// release puts the page of n on the free list, or drops it for append-only
+// trees.
+func (bt *BTree[K]) release(n *node) {
+	if bt.cow != nil {
+		delete(bt.dirty, n.id)
+		bt.cow.freed = append(bt.cow.freed, n.id)
+
+		return
+	}
+
+	bt.mark(&node{id: n.id, free: true, next: bt.meta.free})
+	bt.meta.free = ref{id: n.id}
+}
+
+// nextLSN returns the LSN the running operation commits at, which the pages
+// it changes are written at.
+func (bt *BTree[K]) nextLSN() uint64 {
+	if bt.cow != nil {
+		return bt.committed.lsn + 1
+	}
+
+	return bt.wal.next
+}
+
+// stamp sets the LSN r expects to the one of the running operation if it
+// changed the page r references.
+func (bt *BTree[K]) stamp(r *ref) {
+	if _, ok := bt.dirty[r.id]; ok {
+		r.lsn = bt.nextLSN()
+	}
+}
+
+// stampRefs stamps the references n holds, before it's encoded.
+func (bt *BTree[K]) stampRefs(n *node) {
+	bt.stamp(&n.next)
+
+	for i := range n.childs {
+		bt.stamp(&n.childs[i])
+	}
+
+	for _, e := range n.entries {
+		bt.stamp(&e.overflow)
+	}
+}
+
+// flush commits the pages changed by an operation: their images are
+// appended to the WAL and then put in the buffer pool, which writes them to
+// the tree file later on. The WAL is synced as the durability requires,
+// which the returned commit tells. If it fails after the WAL append, the
+// operation is committed anyway, so the tree stops accepting operations
+// until it's reopened and recovered.
+func (bt *BTree[K]) flush() (*Commit, error) {
+	if bt.cow != nil {
+		return bt.flushAppendOnly()
+	}
+
+	if err := bt.preserve(); err != nil {
+		return nil, err
+	}
+
+	r := &walRecord{time: time.Now()}
+	bt.meta.lsn = bt.nextLSN()
+
+	// The WAL holds pages as stored in the file, and the buffer pool their
+	// images.
+	var images []pageImage
+
+	for _, id := range append(slices.Sorted(maps.Keys(bt.dirty)), metaPage) {
+		buf, page, err := bt.encode(id)
+		if err != nil {
+			return nil, err
+		}
+
+		images = append(images, pageImage{id: id, data: buf})
+		r.pages = append(r.pages, pageImage{id: id, data: page})
+	}
+
+	if err := bt.wal.append(r); err != nil {
+		return nil, err
+	}
+
+	commit := bt.commit.committed(r.lsn)
+
+	clear(bt.dirty)
+	bt.committed = *bt.meta
+
+	for _, p := range images {
+		if err := bt.pool.put(p.id, p.data, bt.meta.lsn); err != nil {
+			bt.failed = err
+
+			return nil, err
+		}
+	}
+
+	if err := bt.pinRoot(); err != nil {
+		bt.failed = err
+
+		return nil, err
+	}
+
+	if bt.wal.size >= bt.checkpointSize {
+		if err := bt.checkpoint(); err != nil {
+			bt.failed = err
+		}
+	}
+
+	return commit, nil
+}
+
+// encode returns the image of page id, a dirty one or a meta page, and what's
+// stored for it.
+func (bt *BTree[K]) encode(id pageID) ([]byte, []byte, error) {
+	buf := make([]byte, bt.pager.imageSize(id))
+	if bt.pager.isMeta(id) {
+		bt.stamp(&bt.meta.root)
+		bt.stamp(&bt.meta.free)
+		bt.meta.encode(buf)
+	} else {
+		bt.stampRefs(bt.dirty[id])
+		bt.dirty[id].encode(buf)
+	}
+
+	stampLSN(buf, bt.meta.lsn)
+	seal(id, buf)
+
+	page, err := bt.pager.seal(id, buf, bt.meta.lsn)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return buf, page, nil
+}
+
+// pinRoot keeps the root page in the buffer pool.
+func (bt *BTree[K]) pinRoot() error {
+	if bt.root != nil && bt.root.id == bt.meta.root.id {
+		return nil
+	}
+
+	f, err := bt.pool.get(bt.meta.root.id)
+	if err != nil {
+		return err
+	}
+
+	if bt.root != nil {
+		bt.pool.unpin(bt.root)
+	}
+
+	bt.root = f
+
+	return nil
+}
+
+// checkpoint writes back every dirty page and syncs the tree file, which
+// then holds every committed operation, and empties the WAL. Append-only
+// trees have nothing to checkpoint.
+func (bt *BTree[K]) checkpoint() error {
+	if bt.cow != nil {
+		return nil
+	}
+
+	if err := bt.pool.writeBack(); err != nil {
+		return err
+	}
+
+	if err := bt.pager.sync(); err != nil {
+		return err
+	}
+
+	if err := bt.wal.reset(bt.meta.lsn + 1); err != nil {
+		return err
+	}
+
+	bt.commit.durable(bt.meta.lsn)
+
+	return nil
+}
+
+// reset drops the changes of a failed operation, going back to the last
+// committed state.
+func (bt *BTree[K]) reset() {
+	clear(bt.dirty)
+
+	if bt.cow != nil {
+		bt.cow.reset()
+	}
+
+	m := bt.committed
+	bt.meta = &m
+}
+
+func (bt *BTree[K]) usable() error {
+	if bt.closed {
+		return ErrClosed
+	}
+
+	if bt.failed != nil {
+		return fmt.Errorf("%w: %w", ErrFailed, bt.failed)
+	}
+
+	if bt.commit != nil {
+		if err := bt.commit.failure(); err != nil {
+			return fmt.Errorf("%w: %w", ErrFailed, err)
+		}
+	}
+
+	return nil
+}
+
+func (bt *BTree[K]) writable() error {
+	if bt.readOnly && !bt.closed {
+		return ErrReadOnly
+	}
+
+	return bt.usable()
+}
+
+// child returns the index of the child of the internal node n whose
+// subtree may hold k.
+func (n *node) child(k []byte) int {
+	i, found := slices.BinarySearchFunc(n.entries, k, (*entry).compare)
+	if found {
+		i++
+	}
+
+	return i
+}
+
+// find returns the leaf holding k, and its position in it, or nil if it
+// isn't in the tree.
+func (bt *BTree[K]) find(n *node, k []byte) (*node, int, error) {
+	for !n.leaf {
+		var err error
+		if n, err = bt.load(n.childs[n.child(k)]); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	i, found := slices.BinarySearchFunc(n.entries, k, (*entry).compare)
+	if !found {
+		return nil, 0, nil
+	}
+
+	return n, i, nil
+}
+
+func (bt *BTree[K]) search(n *node, k []byte) (*entry, error) {
+	n, i, err := bt.find(n, k)
+	if err != nil || n == nil {
+		return nil, err
+	}
+
+	return n.entries[i], nil
+}
+
+// split moves the upper half of c, the i-th child of n, to a new node. A
+// leaf is separated from it in n by the shortest key above the ones it
+// keeps, and an internal node by its middle key.
+func (bt *BTree[K]) split(n *node, i int, c *node) (*node, error) {
+	right, err := bt.allocate(c.leaf)
+	if err != nil {
+		return nil, err
+	}
+
+	h := len(c.entries) / 2
+
+	var sep *entry
+	if c.leaf {
+		right.entries = append(right.entries, c.entries[h:]...)
+		c.entries = c.entries[:h]
+		sep = separator(c.entries[h-1], right.entries[0])
+	} else {
+		sep = c.entries[h]
+		right.entries = append(right.entries, c.entries[h+1:]...)
+		right.childs = append(right.childs, c.childs[h+1:]...)
+		c.entries = c.entries[:h]
+		c.childs = c.childs[:h+1]
+	}
+
+	n.entries = slices.Insert(n.entries, i, sep)
+	n.childs = slices.Insert(n.childs, i+1, ref{id: right.id})
+
+	bt.mark(n)
+	bt.mark(c)
+
+	return right, nil
+}
+
+// replace overwrites the i-th entry of n by e, freeing the overflow chain
+// of the old one.
+func (bt *BTree[K]) replace(n *node, i int, e *entry) error {
+	if err := bt.unspill(n.entries[i]); err != nil {
+		return err
+	}
+
+	n.entries[i] = e
+	bt.mark(n)
+
+	return nil
+}
+
+// insertAt inserts e in the subtree of n. The nodes it changes are
+// balanced by their parent on the way back up.
+func (bt *BTree[K]) insertAt(n *node, e *entry) error {
+	if n.leaf {
+		i, found := slices.BinarySearchFunc(n.entries, e.key(), (*entry).compare)
+		if found {
+			return bt.replace(n, i, e)
+		}
+
+		n.entries = slices.Insert(n.entries, i, e)
+		bt.mark(n)
+
+		return nil
+	}
+
+	i := n.child(e.key())
+
+	c, err := bt.load(n.childs[i])
+	if err != nil {
+		return err
+	}
+
+	if err := bt.insertAt(c, e); err != nil {
+		return err
+	}
+
+	return bt.balance(n, i, c)
+}
+
+// balance brings c, the i-th child of n, back within its bounds once an
+// operation changed it: overfull nodes are split, and the ones left with
+// less than t-1 entries or keys take one from a sibling, or are merged
+// with it. n may be overfull afterwards, for its own parent to balance.
+func (bt *BTree[K]) balance(n *node, i int, c *node) error {
+	// n holds the LSN of c, which changes as c does.
+	if _, ok := bt.dirty[c.id]; ok {
+		bt.mark(n)
+	}
+
+	if bt.overfull(c) {
+		right, err := bt.split(n, i, c)
+		if err != nil {
+			return err
+		}
+
+		// Halves of internal nodes may still not fit, if their keys are
+		// long ones.
+		if err := bt.balance(n, i+1, right); err != nil {
+			return err
+		}
+
+		return bt.balance(n, i, c)
+	}
+
+	if len(c.entries) >= bt.t-1 {
+		return nil
+	}
+
+	var (
+		left, right *node
+		err         error
+	)
+
+	if i > 0 {
+		if left, err = bt.load(n.childs[i-1]); err != nil {
+			return err
+		}
+	}
+
+	if i < len(n.childs)-1 {
+		if right, err = bt.load(n.childs[i+1]); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case left != nil && len(left.entries) >= bt.t:
+		bt.rotateRight(n, i, left, c)
+	case right != nil && len(right.entries) >= bt.t:
+		bt.rotateLeft(n, i, c, right)
+	case left != nil:
+		bt.merge(n, i-1, left, c)
+	default:
+		bt.merge(n, i, c, right)
+	}
+
+	return nil
+}
+
+// balanceRoot grows the tree by a level once root is overfull, and shrinks
+// it once root is an internal node left without keys.
+func (bt *BTree[K]) balanceRoot(root *node) error {
+	if bt.overfull(root) {
+		s, err := bt.allocate(false)
+		if err != nil {
+			return err
+		}
+
+		s.childs = []ref{{id: root.id, lsn: root.lsn}}
+		bt.meta.root = ref{id: s.id}
+
+		return bt.balance(s, 0, root)
+	}
+
+	if !root.leaf && len(root.entries) == 0 {
+		bt.meta.root = root.childs[0]
+		bt.release(root)
+	}
+
+	return nil
+}
+
+// rotateRight moves the last entry or key of left to its right sibling c,
+// the i-th child of n.
+func (bt *BTree[K]) rotateRight(n *node, i int, left, c *node) {
+	last := len(left.entries) - 1
+
+	if c.leaf {
+		c.entries = slices.Insert(c.entries, 0, left.entries[last])
+		left.entries = slices.Delete(left.entries, last, last+1)
+		n.entries[i-1] = separator(left.entries[last-1], c.entries[0])
+	} else {
+		c.entries = slices.Insert(c.entries, 0, n.entries[i-1])
+		n.entries[i-1] = left.entries[last]
+		left.entries = slices.Delete(left.entries, last, last+1)
+
+		c.childs = slices.Insert(c.childs, 0, left.childs[last+1])
+		left.childs = slices.Delete(left.childs, last+1, last+2)
+	}
+
+	bt.mark(n)
+	bt.mark(left)
+	bt.mark(c)
+}
+
+// rotateLeft moves the first entry or key of right to its left sibling c,
+// the i-th child of n.
+func (bt *BTree[K]) rotateLeft(n *node, i int, c, right *node) {
+	if c.leaf {
+		c.entries = append(c.entries, right.entries[0])
+		right.entries = slices.Delete(right.entries, 0, 1)
+		n.entries[i] = separator(c.entries[len(c.entries)-1], right.entries[0])
+	} else {
+		c.entries = append(c.entries, n.entries[i])
+		n.entries[i] = right.entries[0]
+		right.entries = slices.Delete(right.entries, 0, 1)
+
+		c.childs = append(c.childs, right.childs[0])
+		right.childs = slices.Delete(right.childs, 0, 1)
+	}
+
+	bt.mark(n)
+	bt.mark(c)
+	bt.mark(right)
+}
+
+// merge moves right, the i+1-th child of n, into its left sibling, along
+// with the key separating them if they're internal nodes.
+func (bt *BTree[K]) merge(n *node, i int, left, right *node) {
+	if !left.leaf {
+		left.entries = append(left.entries, n.entries[i])
+	}
+	left.entries = append(left.entries, right.entries...)
+	left.childs = append(left.childs, right.childs...)
+
+	n.entries = slices.Delete(n.entries, i, i+1)
+	n.childs = slices.Delete(n.childs, i+1, i+2)
+
+	bt.mark(n)
+	bt.mark(left)
+	bt.release(right)
+}
+
+// delete deletes k from the subtree of n, returning its entry, or nil if
+// it isn't there. The nodes it changes are balanced by their parent on the
+// way back up.
+func (bt *BTree[K]) delete(n *node, k []byte) (*entry, error) {
+	if n.leaf {
+		i, found := slices.BinarySearchFunc(n.entries, k, (*entry).compare)
+		if !found {
+			return nil, nil
+		}
+
+		e := n.entries[i]
+		n.entries = slices.Delete(n.entries, i, i+1)
+		bt.mark(n)
+
+		return e, nil
+	}
+
+	i := n.child(k)
+
+	c, err := bt.load(n.childs[i])
+	if err != nil {
+		return nil, err
+	}
+
+	e, err := bt.delete(c, k)
+	if err != nil || e == nil {
+		return nil, err
+	}
+
+	return e, bt.balance(n, i, c)
+}
+
+// write runs op and commits the pages it changed, or drops them if it
+// fails.
+func (bt *BTree[K]) write(op func(root *node) error) (*Commit, error) {
+	if err := bt.writable(); err != nil {
+		return nil, err
+	}
+
+	if bt.cow != nil {
+		bt.cow.begin()
+		defer bt.cow.end()
+	}
+
+	var commit *Commit
+
+	root, err := bt.load(bt.meta.root)
+	if err == nil {
+		err = op(root)
+	}
+	if err == nil {
+		commit, err = bt.flush()
+	}
+	if err != nil && bt.failed == nil {
+		bt.reset()
+	}
+
+	return commit, err
+}
+
+func (bt *BTree[K]) Search(k K) (any, error) {
+	bt.mutex.RLock()
+	defer bt.mutex.RUnlock()
+
+	if err := bt.usable(); err != nil {
+		return nil, err
+	}
+
+	return bt.lookup(bt.meta.root, k)
+}
+
+// lookup returns the value of k in the tree of the given root.
+func (bt *BTree[K]) lookup(root ref, k K) (any, error) {
+	v, found, err := bt.get(root, bt.keys.AppendKey(nil, k))
+	if err != nil || !found {
+		return nil, err
+	}
+
+	return bt.values.DecodeValue(v)
+}
+
+// get returns the encoded value of the encoded key k in the tree of the
+// given root, and whether it's there.
+func (bt *BTree[K]) get(r ref, k []byte) ([]byte, bool, error) {
+	root, err := bt.load(r)
+	if err != nil {
+		return nil, false, err
+	}
+
+	e, err := bt.search(root, k)
+	if err != nil || e == nil {
+		return nil, false, err
+	}
+
+	v, err := bt.value(e)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return v, true, nil
+}
+
+// walk calls fn with the entries of the subtree of the page r references,
+// in order.
+func (bt *BTree[K]) walk(r ref, fn func(e *entry) error) error {
+	n, err := bt.load(r)
+	if err != nil {
+		return err
+	}
+
+	if !n.leaf {
+		for _, c := range n.childs {
+			if err := bt.walk(c, fn); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	for _, e := range n.entries {
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Insert inserts k with value v, replacing the value it had, and returns
+// once the write is as durable as Options.Durability requires.
+func (bt *BTree[K]) Insert(k K, v any) error {
+	commit, err := bt.InsertAsync(k, v)
+	if err != nil {
+		return err
+	}
+
+	return commit.Wait()
+}
+
+// InsertAsync inserts k like Insert, but returns without waiting for the
+// write to be durable, which the returned commit tells.
+func (bt *BTree[K]) InsertAsync(k K, v any) (*Commit, error) {
+	ev, err := bt.values.AppendValue(nil, v)
+	if err != nil {
+		return nil, err
+	}
+
+	return bt.insert(&entry{k: bt.keys.AppendKey(nil, k), v: ev})
+}
+
+// insert inserts the encoded entry e.
+func (bt *BTree[K]) insert(e *entry) (*Commit, error) {
+	bt.mutex.Lock()
+	defer bt.mutex.Unlock()
+
+	return bt.write(func(root *node) error {
+		return bt.put(root, e)
+	})
+}
+
+// put inserts the encoded entry e in the tree of root, as part of a write.
+func (bt *BTree[K]) put(root *node, e *entry) error {
+	// Values that don't fit in a node go to overflow pages, but keys must.
+	if e.size() > bt.maxEntry {
+		if entryOverhead+e.keyLen()+overflowRefSize > bt.maxEntry {
+			return ErrEntryTooLarge
+		}
+
+		if err := bt.spill(e); err != nil {
+			return err
+		}
+	}
+
+	if err := bt.insertAt(root, e); err != nil {
+		return err
+	}
+
+	return bt.balanceRoot(root)
+}
+
+// Delete deletes k, returning its value, or nil if it wasn't in the tree,
+// once the write is as durable as Options.Durability requires.
+func (bt *BTree[K]) Delete(k K) (any, error) {
+	v, commit, err := bt.DeleteAsync(k)
+	if err != nil {
+		return nil, err
+	}
+
+	return v, commit.Wait()
+}
+
+// DeleteAsync deletes k like Delete, but returns without waiting for the
+// write to be durable, which the returned commit tells.
+func (bt *BTree[K]) DeleteAsync(k K) (any, *Commit, error) {
+	bt.mutex.Lock()
+	defer bt.mutex.Unlock()
+
+	var (
+		v     []byte
+		found bool
+	)
+
+	commit, err := bt.write(func(root *node) (err error) {
+		v, found, err = bt.remove(root, bt.keys.AppendKey(nil, k))
+
+		return err
+	})
+	if err != nil || !found {
+		return nil, commit, err
+	}
+
+	value, err := bt.values.DecodeValue(v)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return value, commit, nil
+}
+
+// remove deletes the encoded key k from the tree of root, as part of a
+// write, returning its encoded value and whether it was there.
+func (bt *BTree[K]) remove(root *node, k []byte) ([]byte, bool, error) {
+	e, err := bt.delete(root, k)
+	if err == nil && e != nil {
+		err = bt.balanceRoot(root)
+	}
+	if err != nil || e == nil {
+		return nil, false, err
+	}
+
+	v, err := bt.value(e)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return v, true, bt.unspill(e)
+}
+
+// Checkpoint syncs the tree file and empties the WAL. Checkpoints also
+// happen on their own once the WAL grows past Options.CheckpointSize, and
+// on Close.
+func (bt *BTree[K]) Checkpoint() error {
+	bt.mutex.Lock()
+	defer bt.mutex.Unlock()
+
+	if err := bt.writable(); err != nil {
+		return err
+	}
+
+	return bt.checkpoint()
+}
+
+func (bt *BTree[K]) Close() error {
+	bt.mutex.Lock()
+	defer bt.mutex.Unlock()
+
+	if bt.closed {
+		return ErrClosed
+	}
+
+	bt.closed = true
+
+	if bt.readOnly {
+		return errors.Join(bt.pager.close(), bt.lock.unlock())
+	}
+
+	var err error
+	if bt.failed == nil && bt.commit.failure() == nil {
+		err = bt.checkpoint()
+	}
+
+	bt.commit.close()
+
+	return errors.Join(err, bt.pager.close(), bt.closeWAL(), bt.lock.unlock())
+}
+
+func (bt *BTree[K]) closeWAL() error {
+	if bt.wal == nil {
+		return nil
+	}
+
+	return bt.wal.file.Close()
+}
+
+// CompressionStats returns the counters of page compression, and the space
+// it saves in the tree file, which are zero unless the tree is compressed.
+func (bt *BTree[K]) CompressionStats() CompressionStats {
+	if bt.pager.compress == nil {
+		return CompressionStats{}
+	}
+
+	s := bt.pager.compress.stats()
+	s.Saved = bt.pager.saved()
+
+	return s
+}
+
+// CacheStats returns the counters of the buffer pool.
+func (bt *BTree[K]) CacheStats() CacheStats {
+	if bt.pool == nil {
+		return CacheStats{}
+	}
+
+	return bt.pool.cacheStats()
+}
+
+func (bt *BTree[K]) String() string {
+	return fmt.Sprintf(
+		"BTree{pageSize: %v, degree: %v, root: %v, pages: %v}",
+		bt.pager.pageSize, bt.t, bt.meta.root, bt.meta.count)
+}
+
+// maxEntrySize returns the largest entry nodes of the given degree can
+// hold, out of space bytes: leaves fit 2t-1 such entries, and internal
+// nodes 2t-1 of their keys.
+func maxEntrySize(space, degree int) int {
+	return (space - nodeHeaderSize - 2*degree*childSize) / (2*degree - 1)
+}
+
+// Open opens the tree stored at path, creating it if the file doesn't exist
+// or is empty. The WAL is kept next to it, at path+"-wal", and whatever it
+// holds is replayed first, recovering the tree from a crash.
+// Files holding the buckets of a DB fail with ErrBuckets.
+//
+// While open, trees on OSFS are locked against other processes, through a
+// lock file at path+"-lock": opening a tree that's already open, by another
+// process or this one, fails with ErrLocked, unless both map it with
+// Options.Mmap, sharing the lock.
+func Open[K any](path string, opts *Options[K]) (*BTree[K], error) {
+	return openFile(path, opts, false)
+}
+
+// openFile opens the tree stored at path as Open does, as the catalog of a
+// DB if catalog is set.
+func openFile[K any](path string, opts *Options[K], catalog bool) (*BTree[K], error) {
+	if opts == nil {
+		opts = &Options[K]{}
+	}
+
+	keys := opts.Keys
+	if keys == nil {
+		var err error
+		if keys, err = codec.DefaultKeys[K](); err != nil {
+			return nil, err
+		}
+	}
+
+	values := opts.Values
+	if values == nil {
+		values = codec.Gob[any]()
+	}
+
+	var crypt *crypter
+	if opts.Encryption != nil {
+		var err error
+		if crypt, err = newCrypter(opts.Encryption); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.Mmap {
+		return openMapped(path, keys, values, crypt, catalog)
+	}
+
+	fs := cmp.Or(opts.FS, OSFS)
+
+	var lock *fileLock
+	if fs == OSFS {
+		var err error
+		if lock, err = lockFile(path, false); err != nil {
+			return nil, err
+		}
+	}
+
+	file, err := fs.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, errors.Join(err, lock.unlock())
+	}
+
+	cow, err := appendOnly(fs, file, path, opts.AppendOnly)
+	if err != nil {
+		return nil, errors.Join(err, file.Close(), lock.unlock())
+	}
+
+	var w *wal
+	if !cow {
+		if w, err = openWAL(fs, path+"-wal"); err != nil {
+			return nil, errors.Join(err, file.Close(), lock.unlock())
+		}
+
+		w.archive = opts.ArchiveDir
+	}
+
+	bt := &BTree[K]{
+		pager:          &pager{file: file, crypt: crypt},
+		wal:            w,
+		dirty:          map[pageID]*node{},
+		keys:           keys,
+		values:         values,
+		checkpointSize: cmp.Or(opts.CheckpointSize, DefaultCheckpointSize),
+		catalog:        catalog,
+		lock:           lock,
+	}
+
+	if cow {
+		bt.cow = newCow()
+	}
+
+	if err := bt.open(opts); err != nil {
+		return nil, errors.Join(err, file.Close(), bt.closeWAL(), lock.unlock())
+	}
+
+	return bt, nil
+}
+
+// recover applies the records left in the WAL to the tree file.
+func (bt *BTree[K]) recover() error {
+	if bt.wal == nil {
+		return nil
+	}
+
+	records, err := bt.wal.records()
+	if err != nil || len(records) == 0 {
+		return err
+	}
+
+	bt.pager.pageSize = bt.wal.pageSize
+
+	for _, r := range records {
+		for _, p := range r.pages {
+			if err := bt.pager.writeRaw(p.id, p.data); err != nil {
+				return err
+			}
+		}
+	}
+
+	return bt.pager.sync()
+}
+
+func (bt *BTree[K]) open(opts *Options[K]) error {
+	if err := bt.recover(); err != nil {
+		return err
+	}
+
+	size, err := bt.pager.file.Size()
+	if err != nil {
+		return err
+	}
+
+	if size == 0 {
+		return bt.create(opts)
+	}
+
+	m, err := bt.pager.readMeta()
+	if err != nil {
+		return err
+	}
+
+	// The meta page written first by the creation of append-only trees.
+	if bt.cow != nil && m.lsn == 0 {
+		if err := bt.pager.truncate(0); err != nil {
+			return err
+		}
+
+		bt.pager = &pager{file: bt.pager.file, crypt: bt.pager.crypt}
+
+		return bt.create(opts)
+	}
+
+	if err := bt.checkFile(m); err != nil {
+		return err
+	}
+
+	bt.init(m, opts)
+	bt.commit.durable(m.lsn)
+
+	// Replaying the WAL may bring back pages a vacuum dropped.
+	if size > int64(m.count)*int64(bt.pager.pageSize) {
+		if err := bt.pager.truncate(m.count); err != nil {
+			return err
+		}
+	}
+
+	if bt.wal != nil {
+		if err := bt.wal.reset(m.lsn + 1); err != nil {
+			return err
+		}
+	}
+
+	if err := bt.pinRoot(); err != nil {
+		return err
+	}
+
+	if bt.cow != nil {
+		return bt.scan()
+	}
+
+	return nil
+}
+
+// checkFile checks that the file of meta m holds a DB if the tree is the
+// catalog of one, and a single tree otherwise, with the codecs of the tree.
+func (bt *BTree[K]) checkFile(m *meta) error {
+	if m.buckets && !bt.catalog {
+		return fmt.Errorf("%w, to open with OpenDB", ErrBuckets)
+	}
+
+	if !m.buckets && bt.catalog {
+		return errors.New("disk: file holds a single tree, to open with Open")
+	}
+
+	return bt.checkCodecs(m)
+}
+
+// checkCodecs checks that the codecs of the tree are the ones its file was
+// created with, when both are named.
+func (bt *BTree[K]) checkCodecs(m *meta) error {
+	for _, c := range []struct{ kind, file, name string }{
+		{"key", m.keyCodec, codec.Name(bt.keys)},
+		{"value", m.valueCodec, codec.Name(bt.values)},
+	} {
+		if c.file != "" && c.name != "" && c.file != c.name {
+			return fmt.Errorf("%w: %v codec %v, created with %v", ErrCodecMismatch, c.kind, c.name, c.file)
+		}
+	}
+
+	return nil
+}
+
+func (bt *BTree[K]) init(m *meta, opts *Options[K]) {
+	bt.meta = m
+	bt.committed = *m
+	bt.pager.pageSize = int(m.pageSize)
+	bt.t = int(m.degree)
+	bt.maxEntry = maxEntrySize(bt.pager.nodeSpace(), bt.t)
+
+	// Append-only commits are durable once flushed.
+	durability := opts.Durability
+	if bt.wal != nil {
+		bt.wal.pageSize = bt.pager.pageSize
+	} else {
+		durability = NoSync
+	}
+
+	capacity := max(cmp.Or(opts.CacheSize, DefaultCacheSize)/bt.pager.pageSize, minCachePages)
+	bt.commit = newCommitter(bt.wal, durability)
+	bt.pool = newPool(bt.pager, capacity, opts.Eviction, bt.commit.sync)
+}
+
+func (bt *BTree[K]) create(opts *Options[K]) error {
+	m := &meta{
+		version:     formatVersion,
+		pageSize:    uint32(cmp.Or(opts.PageSize, DefaultPageSize)),
+		degree:      uint32(cmp.Or(opts.MinimumDegree, DefaultMinimumDegree)),
+		root:        ref{id: 1},
+		count:       1,
+		encrypted:   bt.pager.crypt != nil,
+		compression: opts.Compression,
+		appendOnly:  bt.cow != nil,
+		buckets:     bt.catalog,
+		keyCodec:    codec.Name(bt.keys),
+		valueCodec:  codec.Name(bt.values),
+	}
+
+	// Page 1 is the second meta page of append-only trees.
+	if m.appendOnly {
+		m.root, m.count = ref{id: 2}, 2
+	}
+
+	if m.pageSize < minPageSize || m.pageSize > maxPageSize {
+		return fmt.Errorf("disk: page size must be between %d and %d", minPageSize, maxPageSize)
+	}
+
+	if m.degree < 2 {
+		return errors.New("disk: minimum degree must be at least 2")
+	}
+
+	if m.compression != CompressNone {
+		bt.pager.pageSize = int(m.pageSize)
+		if err := bt.pager.compressWith(m.compression); err != nil {
+			return err
+		}
+	}
+
+	bt.pager.dualMeta = m.appendOnly
+	bt.init(m, opts)
+
+	if bt.maxEntry < 2*entryOverhead {
+		return errors.New("disk: minimum degree is too large for the page size")
+	}
+
+	if err := bt.pager.fitsMeta(m); err != nil {
+		return err
+	}
+
+	if bt.cow != nil {
+		return bt.createAppendOnly()
+	}
+
+	if err := bt.wal.reset(1); err != nil {
+		return err
+	}
+
+	if _, err := bt.allocate(true); err != nil {
+		return err
+	}
+
+	_, err := bt.flush()
+
+	return err
+}
+
+// createAppendOnly writes the meta page of LSN 0, then commits the root
+// twice, so both meta pages are valid.
+func (bt *BTree[K]) createAppendOnly() error {
+	bt.cow.begin()
+	defer bt.cow.end()
+
+	_, page, err := bt.encode(metaPage)
+	if err == nil {
+		err = bt.pager.writeRaw(metaPage, page)
+	}
+	if err == nil {
+		err = bt.pager.sync()
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := bt.allocate(true); err != nil {
+		return err
+	}
+
+	for range 2 {
+		if _, err := bt.flush(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
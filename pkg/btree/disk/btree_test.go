@@ -0,0 +1,324 @@
+package disk
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/franciscosbf/b-tree-go/pkg/btree/codec"
+)
+
+func openTree[K any](t *testing.T, path string, opts *Options[K]) *BTree[K] {
+	bt, err := Open[K](path, opts)
+	if err != nil {
+		t.Fatalf("failed to open %v: %v", path, err)
+	}
+
+	return bt
+}
+
+func checkInvariants[K any](t *testing.T, bt *BTree[K]) {
+	depth := -1
+
+	var walk func(r ref, level int, lo, hi []byte)
+	walk = func(r ref, level int, lo, hi []byte) {
+		n, err := bt.load(r)
+		if err != nil {
+			t.Fatalf("failed to load page %v: %v", r, err)
+		}
+
+		if r != bt.meta.root && len(n.entries) < bt.t-1 || n.leaf && len(n.entries) > 2*bt.t-1 {
+			t.Fatalf("node has %v entries (degree %v): %v", len(n.entries), bt.t, n)
+		}
+
+		if !n.leaf && n.size() > bt.pager.nodeSpace() {
+			t.Fatalf("node doesn't fit in a page: %v", n)
+		}
+
+		for i, e := range n.entries {
+			if lo != nil && (e.compare(lo) < 0 || !n.leaf && e.compare(lo) == 0) ||
+				hi != nil && e.compare(hi) >= 0 || i > 0 && e.compare(n.entries[i-1].key()) <= 0 {
+				t.Fatalf("entry %v is out of order in node %v", e, n)
+			}
+		}
+
+		if n.leaf {
+			if depth == -1 {
+				depth = level
+			} else if depth != level {
+				t.Fatalf("leaves at different depths: %v and %v", depth, level)
+			}
+
+			return
+		}
+
+		for i, c := range n.childs {
+			clo, chi := lo, hi
+			if i > 0 {
+				clo = n.entries[i-1].key()
+			}
+			if i < len(n.entries) {
+				chi = n.entries[i].key()
+			}
+
+			walk(c, level+1, clo, chi)
+		}
+	}
+
+	walk(bt.meta.root, 0, nil, nil)
+}
+
+func TestRandomOperations(t *testing.T) {
+	for _, degree := range []int{2, 3, 8} {
+		path := filepath.Join(t.TempDir(), "tree")
+		r := rand.New(rand.NewSource(int64(degree)))
+		expected := map[int]int{}
+
+		bt := openTree[int](t, path, &Options[int]{PageSize: 1024, MinimumDegree: degree})
+
+		for i := range 3000 {
+			key := r.Intn(400) - 200
+
+			switch r.Intn(3) {
+			case 0, 1:
+				if err := bt.Insert(key, i); err != nil {
+					t.Fatalf("failed to insert %v: %v", key, err)
+				}
+
+				expected[key] = i
+			default:
+				value, err := bt.Delete(key)
+				if err != nil {
+					t.Fatalf("failed to delete %v: %v", key, err)
+				}
+
+				expectedValue, ok := expected[key]
+				if !ok && value != nil || ok && value != expectedValue {
+					t.Fatalf(
+						"got different value deleting key %v (degree %v): got=%v expected=%v",
+						key, degree, value, expectedValue)
+				}
+
+				delete(expected, key)
+			}
+
+			if i%1000 == 999 {
+				if err := bt.Close(); err != nil {
+					t.Fatalf("failed to close: %v", err)
+				}
+
+				bt = openTree[int](t, path, nil)
+			}
+		}
+
+		checkInvariants(t, bt)
+
+		for key := -200; key < 200; key++ {
+			value, err := bt.Search(key)
+			if err != nil {
+				t.Fatalf("failed to search %v: %v", key, err)
+			}
+
+			if expectedValue, ok := expected[key]; !ok && value != nil || ok && value != expectedValue {
+				t.Fatalf(
+					"got different value for key %v (degree %v): got=%v expected=%v",
+					key, degree, value, expectedValue)
+			}
+		}
+
+		bt.Close()
+	}
+}
+
+func TestRandomKeys(t *testing.T) {
+	// Keys of any length, some sharing long prefixes, so internal nodes
+	// hold many keys or few, and are split and merged by their size.
+	prefixes := []string{"", "a", "users/", "users/0042/files/", strings.Repeat("p", 32)}
+
+	for _, degree := range []int{2, 3} {
+		path := filepath.Join(t.TempDir(), "tree")
+		r := rand.New(rand.NewSource(int64(degree)))
+		expected := map[string]int{}
+
+		key := func() string {
+			return prefixes[r.Intn(len(prefixes))] + strconv.Itoa(r.Intn(300)) + strings.Repeat("s", r.Intn(30))
+		}
+
+		bt := openTree[string](t, path, &Options[string]{PageSize: 512, MinimumDegree: degree})
+
+		for i := range 6000 {
+			k := key()
+
+			switch r.Intn(3) {
+			case 0, 1:
+				if err := bt.Insert(k, i); err != nil {
+					t.Fatalf("failed to insert %v: %v", k, err)
+				}
+
+				expected[k] = i
+			default:
+				value, err := bt.Delete(k)
+				if err != nil {
+					t.Fatalf("failed to delete %v: %v", k, err)
+				}
+
+				if expectedValue, ok := expected[k]; !ok && value != nil || ok && value != expectedValue {
+					t.Fatalf("got different value deleting key %v: got=%v expected=%v", k, value, expectedValue)
+				}
+
+				delete(expected, k)
+			}
+
+			if i%1000 == 999 {
+				checkInvariants(t, bt)
+
+				if err := bt.Close(); err != nil {
+					t.Fatalf("failed to close: %v", err)
+				}
+
+				bt = openTree[string](t, path, nil)
+			}
+		}
+
+		for k, v := range expected {
+			if value, err := bt.Search(k); err != nil || value != v {
+				t.Fatalf("got different value for key %v: got=%v expected=%v, err=%v", k, value, v, err)
+			}
+		}
+
+		// Deleting everything shrinks the tree back to a leaf.
+		for k := range expected {
+			if _, err := bt.Delete(k); err != nil {
+				t.Fatalf("failed to delete %v: %v", k, err)
+			}
+		}
+
+		if root, err := bt.load(bt.meta.root); err != nil || !root.leaf || len(root.entries) != 0 {
+			t.Fatalf("expected an empty leaf as the root, got %v, %v", root, err)
+		}
+
+		bt.Close()
+
+		if r := verify(t, path); !r.OK() {
+			t.Fatalf("unexpected report:\n%v", r)
+		}
+	}
+}
+
+func TestValues(t *testing.T) {
+	bt := openTree[string](t, filepath.Join(t.TempDir(), "tree"), nil)
+	defer bt.Close()
+
+	for key, value := range map[string]any{
+		"nil":    nil,
+		"string": "value",
+		"float":  1.5,
+		"bytes":  []byte{1, 2, 3},
+	} {
+		if err := bt.Insert(key, value); err != nil {
+			t.Fatalf("failed to insert %v: %v", key, err)
+		}
+
+		got, err := bt.Search(key)
+		if err != nil {
+			t.Fatalf("failed to search %v: %v", key, err)
+		}
+
+		if b, ok := value.([]byte); ok && !bytes.Equal(got.([]byte), b) || !ok && got != value {
+			t.Fatalf("got different value for key %v: got=%v expected=%v", key, got, value)
+		}
+	}
+}
+
+func TestEntryTooLarge(t *testing.T) {
+	bt := openTree[string](t, filepath.Join(t.TempDir(), "tree"), &Options[string]{PageSize: 256, MinimumDegree: 2})
+	defer bt.Close()
+
+	// Values go to overflow pages, but keys must fit in a node.
+	if err := bt.Insert(strings.Repeat("k", 100), "x"); !errors.Is(err, ErrEntryTooLarge) {
+		t.Fatalf("got different error: %v", err)
+	}
+
+	if err := bt.Insert("key", strings.Repeat("x", 100)); err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+}
+
+func TestReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tree")
+
+	bt := openTree[string](t, path, &Options[string]{PageSize: 512, MinimumDegree: 3})
+	for _, key := range []string{"F", "S", "Q", "K", "C", "L", "H", "T", "V", "W", "M", "R", "N"} {
+		if err := bt.Insert(key, key+key); err != nil {
+			t.Fatalf("failed to insert %v: %v", key, err)
+		}
+	}
+	bt.Close()
+
+	if _, err := bt.Search("F"); !errors.Is(err, ErrClosed) {
+		t.Fatalf("closed tree didn't fail: %v", err)
+	}
+
+	bt = openTree[string](t, path, &Options[string]{PageSize: 4096})
+	defer bt.Close()
+
+	if bt.pager.pageSize != 512 || bt.t != 3 {
+		t.Fatalf("reopened tree didn't keep its settings: %v", bt)
+	}
+
+	if value, err := bt.Search("W"); err != nil || value != "WW" {
+		t.Fatalf("got different value after reopening: value=%v err=%v", value, err)
+	}
+}
+
+func TestOpenInvalidFile(t *testing.T) {
+	if _, err := Open[int](filepath.Join(t.TempDir(), "tree"), &Options[int]{MinimumDegree: 1}); err == nil {
+		t.Fatalf("opened a tree with degree 1")
+	}
+
+	if _, err := Open[int](filepath.Join(t.TempDir(), "tree"), &Options[int]{PageSize: 128, MinimumDegree: 32}); err == nil {
+		t.Fatalf("opened a tree whose nodes don't fit in a page")
+	}
+
+	garbage := filepath.Join(t.TempDir(), "garbage")
+	if err := os.WriteFile(garbage, []byte("not a tree"), 0o644); err != nil {
+		t.Fatalf("failed to write %v: %v", garbage, err)
+	}
+
+	if _, err := Open[int](garbage, nil); !errors.Is(err, ErrNotTreeFile) {
+		t.Fatalf("got different error: %v", err)
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	bt := openTree(t, filepath.Join(t.TempDir(), "tree"), &Options[[]byte]{
+		MinimumDegree: 2,
+		Values:        codec.Any(codec.JSON[string]()),
+	})
+	defer bt.Close()
+
+	for i := range 50 {
+		if err := bt.Insert([]byte{byte(i)}, strconv.Itoa(i)); err != nil {
+			t.Fatalf("failed to insert %v: %v", i, err)
+		}
+	}
+
+	checkInvariants(t, bt)
+
+	if value, err := bt.Search([]byte{7}); err != nil || value != "7" {
+		t.Fatalf("got different value: value=%v err=%v", value, err)
+	}
+
+	if err := bt.Insert([]byte{0}, 1); err == nil {
+		t.Fatalf("inserted a value the codec can't encode")
+	}
+
+	if _, err := Open[struct{}](filepath.Join(t.TempDir(), "tree"), nil); err == nil {
+		t.Fatalf("opened a tree without a key codec")
+	}
+}
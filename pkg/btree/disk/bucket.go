@@ -0,0 +1,632 @@
+package disk
+
+import (
+	"cmp"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+
+	"github.com/franciscosbf/b-tree-go/pkg/btree/codec"
+)
+
+// A DB stores several trees, its buckets, in a single file. The tree of
+// the file is the catalog, whose entries map the name of each bucket to the
+// root and minimum degree of its tree and the names of its codecs. Bucket
+// trees share the pages, the free list and the WAL of the file, so a write
+// to several buckets, their catalog entries included, is committed as a
+// single WAL record.
+
+var (
+	ErrBucketNotFound = errors.New("disk: bucket not found")
+	ErrTxDone         = errors.New("disk: transaction is done")
+)
+
+// bucket is the catalog entry of a bucket.
+type bucket struct {
+	root       ref
+	degree     int
+	keyCodec   string
+	valueCodec string
+	// changed is set once the running operation moved or wrote the root.
+	changed bool
+}
+
+func (b *bucket) size() int {
+	return refSize + 4 + 1 + len(b.keyCodec) + 1 + len(b.valueCodec)
+}
+
+func (b *bucket) encode() []byte {
+	buf := make([]byte, b.size())
+	putRef(buf, b.root)
+	binary.BigEndian.PutUint32(buf[refSize:], uint32(b.degree))
+
+	off := refSize + 4
+	for _, name := range []string{b.keyCodec, b.valueCodec} {
+		buf[off] = byte(len(name))
+		off += 1 + copy(buf[off+1:], name)
+	}
+
+	return buf
+}
+
+func decodeBucket(buf []byte) (*bucket, bool) {
+	if len(buf) < refSize+4 {
+		return nil, false
+	}
+
+	b := &bucket{
+		root:   getRef(buf),
+		degree: int(binary.BigEndian.Uint32(buf[refSize:])),
+	}
+
+	var names [2]string
+
+	off := refSize + 4
+	for i := range names {
+		if off >= len(buf) || off+1+int(buf[off]) > len(buf) {
+			return nil, false
+		}
+
+		names[i] = string(buf[off+1 : off+1+int(buf[off])])
+		off += 1 + int(buf[off])
+	}
+
+	b.keyCodec, b.valueCodec = names[0], names[1]
+
+	return b, off == len(buf) && b.degree >= 2
+}
+
+// in runs op, part of a write, on the tree of bucket b instead of the
+// catalog: the tree algorithms work on the root the meta page holds and on
+// the degree of the tree, which are the ones of b while op runs. b records
+// the root op leaves, and is changed if op wrote it, as it holds its LSN.
+func (bt *BTree[K]) in(b *bucket, op func(root *node) error) error {
+	root, t, maxEntry := bt.meta.root, bt.t, bt.maxEntry
+
+	bt.meta.root, bt.t = b.root, b.degree
+	bt.maxEntry = maxEntrySize(bt.pager.nodeSpace(), b.degree)
+
+	defer func() {
+		if _, ok := bt.dirty[bt.meta.root.id]; ok || bt.meta.root != b.root {
+			b.root, b.changed = bt.meta.root, true
+		}
+
+		bt.meta.root, bt.t, bt.maxEntry = root, t, maxEntry
+	}()
+
+	n, err := bt.load(bt.meta.root)
+	if err != nil {
+		return err
+	}
+
+	return op(n)
+}
+
+// drop releases the pages of the subtree of the page r references,
+// overflow chains included.
+func (bt *BTree[K]) drop(r ref) error {
+	n, err := bt.load(r)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range n.entries {
+		if err := bt.unspill(e); err != nil {
+			return err
+		}
+	}
+
+	if !n.leaf {
+		for _, c := range n.childs {
+			if err := bt.drop(c); err != nil {
+				return err
+			}
+		}
+	}
+
+	bt.release(n)
+
+	return nil
+}
+
+// rawCodec stores keys and values as they're encoded. It isn't named, so
+// it isn't checked against the codecs files record.
+type rawCodec struct {
+	codec.Codec[[]byte]
+}
+
+// DB is a file holding several named trees, its buckets, each with its own
+// codecs and minimum degree. Writes to buckets made in the same transaction
+// are committed atomically.
+type DB struct {
+	bt *BTree[string]
+}
+
+// OpenDB opens the DB stored at path, creating it if the file doesn't exist
+// or is empty, as Open does with trees. MinimumDegree is the one of the
+// catalog, and Keys and Values don't apply. DBs can't be append-only, so
+// AppendOnly fails with ErrAppendOnly. Files holding a single tree can't be
+// opened as DBs, nor DBs as single trees.
+func OpenDB(path string, opts *Options[string]) (*DB, error) {
+	var o Options[string]
+	if opts != nil {
+		o = *opts
+	}
+
+	if o.AppendOnly {
+		return nil, ErrAppendOnly
+	}
+
+	raw := rawCodec{codec.Bytes()}
+	o.Keys, o.Values = nil, codec.Any[[]byte](raw)
+
+	bt, err := openFile(path, &o, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DB{bt: bt}, nil
+}
+
+// bucket returns the catalog entry of the bucket name.
+func (db *DB) bucket(name string) (*bucket, error) {
+	bt := db.bt
+
+	v, found, err := bt.get(bt.meta.root, bt.keys.AppendKey(nil, name))
+	if err != nil {
+		return nil, err
+	}
+
+	if !found {
+		return nil, fmt.Errorf("%w: %v", ErrBucketNotFound, name)
+	}
+
+	b, ok := decodeBucket(v)
+	if !ok {
+		return nil, fmt.Errorf("%w: bucket %v has a malformed catalog entry", ErrCorrupted, name)
+	}
+
+	return b, nil
+}
+
+// read returns the catalog entry of the bucket name, as of the last commit.
+func (db *DB) read(name string) (*bucket, error) {
+	db.bt.mutex.RLock()
+	defer db.bt.mutex.RUnlock()
+
+	if err := db.bt.usable(); err != nil {
+		return nil, err
+	}
+
+	return db.bucket(name)
+}
+
+// Buckets returns the names of the buckets, in order.
+func (db *DB) Buckets() ([]string, error) {
+	bt := db.bt
+
+	bt.mutex.RLock()
+	defer bt.mutex.RUnlock()
+
+	if err := bt.usable(); err != nil {
+		return nil, err
+	}
+
+	var names []string
+
+	err := bt.walk(bt.meta.root, func(e *entry) error {
+		name, err := bt.keys.DecodeKey(e.key())
+		names = append(names, name)
+
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return names, nil
+}
+
+// Bucket opens the bucket name, creating it if it doesn't exist, with
+// []byte keys and the default value codec. See OpenBucket.
+func (db *DB) Bucket(name string) (*Bucket[[]byte], error) {
+	return OpenBucket[[]byte](db, name, nil)
+}
+
+// DeleteBucket deletes the bucket name and every entry it holds.
+func (db *DB) DeleteBucket(name string) error {
+	return db.Update(func(tx *Tx) error {
+		return tx.DeleteBucket(name)
+	})
+}
+
+// Update runs fn in a transaction, and commits the writes it made through
+// the transaction once it returns, or drops them if it fails. It returns
+// once the commit is as durable as Options.Durability requires. Other
+// operations wait until fn returns, which mustn't open buckets nor run
+// other transactions.
+func (db *DB) Update(fn func(tx *Tx) error) error {
+	bt := db.bt
+
+	bt.mutex.Lock()
+
+	tx := &Tx{db: db, buckets: map[string]*bucket{}}
+
+	commit, err := bt.write(func(*node) error {
+		if err := fn(tx); err != nil {
+			return err
+		}
+
+		return tx.save()
+	})
+
+	tx.done = true
+	bt.mutex.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	return commit.Wait()
+}
+
+// Checkpoint syncs the file and empties the WAL, as BTree.Checkpoint does.
+func (db *DB) Checkpoint() error {
+	return db.bt.Checkpoint()
+}
+
+// Backup writes a copy of the DB to w, as BTree.Backup does.
+func (db *DB) Backup(ctx context.Context, w io.Writer) (uint64, error) {
+	return db.bt.Backup(ctx, w)
+}
+
+// BackupIncremental writes to w the pages changed since the backup at LSN
+// since, as BTree.BackupIncremental does.
+func (db *DB) BackupIncremental(ctx context.Context, w io.Writer, since uint64) (uint64, error) {
+	return db.bt.BackupIncremental(ctx, w, since)
+}
+
+// RotateKey re-encrypts every page with the current key, as
+// BTree.RotateKey does.
+func (db *DB) RotateKey(ctx context.Context, step int) error {
+	return db.bt.RotateKey(ctx, step)
+}
+
+func (db *DB) Close() error {
+	return db.bt.Close()
+}
+
+// Tx is a transaction of a DB, only valid until the function given to
+// Update returns.
+type Tx struct {
+	db *DB
+	// buckets holds the catalog entries of the buckets the transaction
+	// reached, with the roots its writes left them at.
+	buckets map[string]*bucket
+	done    bool
+}
+
+// bucket returns the catalog entry of the bucket name, as the transaction
+// left it.
+func (tx *Tx) bucket(name string) (*bucket, error) {
+	if tx.done {
+		return nil, ErrTxDone
+	}
+
+	if b, ok := tx.buckets[name]; ok {
+		return b, nil
+	}
+
+	b, err := tx.db.bucket(name)
+	if err != nil {
+		return nil, err
+	}
+
+	tx.buckets[name] = b
+
+	return b, nil
+}
+
+// create creates the bucket name, with the degree and codecs of b, whose
+// tree starts with an empty leaf.
+func (tx *Tx) create(name string, b *bucket) error {
+	bt := tx.db.bt
+
+	if b.degree < 2 {
+		return errors.New("disk: minimum degree must be at least 2")
+	}
+
+	if maxEntrySize(bt.pager.nodeSpace(), b.degree) < 2*entryOverhead {
+		return errors.New("disk: minimum degree is too large for the page size")
+	}
+
+	if len(b.keyCodec) > 0xff || len(b.valueCodec) > 0xff {
+		return errors.New("disk: codec names must be at most 255 bytes long")
+	}
+
+	// Catalog entries never spill, so they can be written over in place.
+	if entryOverhead+len(bt.keys.AppendKey(nil, name))+b.size() > bt.maxEntry {
+		return fmt.Errorf("disk: bucket name %v doesn't fit in a catalog node", name)
+	}
+
+	n, err := bt.allocate(true)
+	if err != nil {
+		return err
+	}
+
+	b.root, b.changed = ref{id: n.id}, true
+	tx.buckets[name] = b
+
+	return nil
+}
+
+// DeleteBucket deletes the bucket name and every entry it holds.
+func (tx *Tx) DeleteBucket(name string) error {
+	b, err := tx.bucket(name)
+	if err != nil {
+		return err
+	}
+
+	bt := tx.db.bt
+
+	if err := bt.drop(b.root); err != nil {
+		return err
+	}
+
+	delete(tx.buckets, name)
+
+	root, err := bt.load(bt.meta.root)
+	if err != nil {
+		return err
+	}
+
+	_, _, err = bt.remove(root, bt.keys.AppendKey(nil, name))
+
+	return err
+}
+
+// save writes the catalog entries of the buckets whose root moved or was
+// written.
+func (tx *Tx) save() error {
+	bt := tx.db.bt
+
+	for _, name := range slices.Sorted(maps.Keys(tx.buckets)) {
+		b := tx.buckets[name]
+		if !b.changed {
+			continue
+		}
+
+		if err := bt.saveBucket(bt.keys.AppendKey(nil, name), b); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// saveBucket writes b as the catalog entry of key k.
+func (bt *BTree[K]) saveBucket(k []byte, b *bucket) error {
+	root, err := bt.load(bt.meta.root)
+	if err != nil {
+		return err
+	}
+
+	bt.stamp(&b.root)
+
+	return bt.put(root, &entry{k: k, v: b.encode()})
+}
+
+// BucketOptions are the options of a bucket. They only apply to new
+// buckets, but for the codecs: Keys defaults to codec.DefaultKeys and Values
+// to codec.Gob, and named ones must match the ones the bucket was created
+// with, as Options requires of trees.
+type BucketOptions[K any] struct {
+	// MinimumDegree defaults to DefaultMinimumDegree.
+	MinimumDegree int
+
+	Keys   codec.KeyCodec[K]
+	Values codec.ValueCodec[any]
+}
+
+// Bucket is a tree of a DB. Its operations are committed on their own,
+// unless made in a transaction through With.
+type Bucket[K any] struct {
+	db     *DB
+	name   string
+	keys   codec.KeyCodec[K]
+	values codec.ValueCodec[any]
+	tx     *Tx
+}
+
+// OpenBucket opens the bucket name of db, creating it if it doesn't exist.
+// It mustn't be called from a transaction.
+func OpenBucket[K any](db *DB, name string, opts *BucketOptions[K]) (*Bucket[K], error) {
+	if opts == nil {
+		opts = &BucketOptions[K]{}
+	}
+
+	keys := opts.Keys
+	if keys == nil {
+		var err error
+		if keys, err = codec.DefaultKeys[K](); err != nil {
+			return nil, err
+		}
+	}
+
+	values := opts.Values
+	if values == nil {
+		values = codec.Gob[any]()
+	}
+
+	b := &Bucket[K]{db: db, name: name, keys: keys, values: values}
+
+	// Existing buckets open in read-only DBs too.
+	if d, err := db.read(name); err == nil {
+		return b, b.check(d)
+	} else if !errors.Is(err, ErrBucketNotFound) {
+		return nil, err
+	}
+
+	err := db.Update(func(tx *Tx) error {
+		d, err := tx.bucket(name)
+		if err == nil {
+			return b.check(d)
+		} else if !errors.Is(err, ErrBucketNotFound) {
+			return err
+		}
+
+		return tx.create(name, &bucket{
+			degree:     cmp.Or(opts.MinimumDegree, DefaultMinimumDegree),
+			keyCodec:   codec.Name(keys),
+			valueCodec: codec.Name(values),
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// check checks that the codecs of b are the ones the bucket of catalog
+// entry d was created with, when both are named.
+func (b *Bucket[K]) check(d *bucket) error {
+	for _, c := range []struct{ kind, bucket, name string }{
+		{"key", d.keyCodec, codec.Name(b.keys)},
+		{"value", d.valueCodec, codec.Name(b.values)},
+	} {
+		if c.bucket != "" && c.name != "" && c.bucket != c.name {
+			return fmt.Errorf("%w: bucket %v: %v codec %v, created with %v",
+				ErrCodecMismatch, b.name, c.kind, c.name, c.bucket)
+		}
+	}
+
+	return nil
+}
+
+// With returns the bucket, with its operations made in the transaction tx,
+// of the same DB.
+func (b *Bucket[K]) With(tx *Tx) *Bucket[K] {
+	w := *b
+	w.tx = tx
+
+	return &w
+}
+
+// Name returns the name of the bucket.
+func (b *Bucket[K]) Name() string {
+	return b.name
+}
+
+// entry returns the catalog entry of the bucket, as the transaction of b
+// left it.
+func (b *Bucket[K]) entry() (*bucket, error) {
+	if b.tx.db != b.db {
+		return nil, errors.New("disk: transaction is of another DB")
+	}
+
+	d, err := b.tx.bucket(b.name)
+	if err != nil {
+		return nil, err
+	}
+
+	return d, b.check(d)
+}
+
+// Search returns the value of k, or nil if it isn't in the bucket. In a
+// transaction, it sees the writes made in it.
+func (b *Bucket[K]) Search(k K) (any, error) {
+	bt := b.db.bt
+
+	var (
+		d   *bucket
+		err error
+	)
+
+	if b.tx != nil {
+		d, err = b.entry()
+	} else {
+		bt.mutex.RLock()
+		defer bt.mutex.RUnlock()
+
+		if err = bt.usable(); err == nil {
+			d, err = b.db.bucket(b.name)
+		}
+		if err == nil {
+			err = b.check(d)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	v, found, err := bt.get(d.root, b.keys.AppendKey(nil, k))
+	if err != nil || !found {
+		return nil, err
+	}
+
+	return b.values.DecodeValue(v)
+}
+
+// Insert inserts k with value v, replacing the value it had.
+func (b *Bucket[K]) Insert(k K, v any) error {
+	if b.tx == nil {
+		return b.db.Update(func(tx *Tx) error {
+			return b.With(tx).Insert(k, v)
+		})
+	}
+
+	ev, err := b.values.AppendValue(nil, v)
+	if err != nil {
+		return err
+	}
+
+	d, err := b.entry()
+	if err != nil {
+		return err
+	}
+
+	return b.db.bt.in(d, func(root *node) error {
+		return b.db.bt.put(root, &entry{k: b.keys.AppendKey(nil, k), v: ev})
+	})
+}
+
+// Delete deletes k, returning its value, or nil if it wasn't in the bucket.
+func (b *Bucket[K]) Delete(k K) (any, error) {
+	if b.tx == nil {
+		var v any
+
+		err := b.db.Update(func(tx *Tx) (err error) {
+			v, err = b.With(tx).Delete(k)
+
+			return err
+		})
+
+		return v, err
+	}
+
+	d, err := b.entry()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		v     []byte
+		found bool
+	)
+
+	err = b.db.bt.in(d, func(root *node) (err error) {
+		v, found, err = b.db.bt.remove(root, b.keys.AppendKey(nil, k))
+
+		return err
+	})
+	if err != nil || !found {
+		return nil, err
+	}
+
+	return b.values.DecodeValue(v)
+}
@@ -0,0 +1,347 @@
+package disk
+
+import (
+	"errors"
+	"math/rand"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/franciscosbf/b-tree-go/pkg/btree/codec"
+)
+
+func openDB(t *testing.T, path string, opts *Options[string]) *DB {
+	db, err := OpenDB(path, opts)
+	if err != nil {
+		t.Fatalf("failed to open %v: %v", path, err)
+	}
+
+	return db
+}
+
+func openBucket[K any](t *testing.T, db *DB, name string, opts *BucketOptions[K]) *Bucket[K] {
+	b, err := OpenBucket(db, name, opts)
+	if err != nil {
+		t.Fatalf("failed to open bucket %v: %v", name, err)
+	}
+
+	return b
+}
+
+func checkBucket(t *testing.T, b *Bucket[int], expected map[int]int) {
+	for k := range 2000 {
+		v, err := b.Search(k)
+		if err != nil {
+			t.Fatalf("failed to search %v in %v: %v", k, b.Name(), err)
+		}
+
+		if ev, ok := expected[k]; !ok && v != nil || ok && v != ev {
+			t.Fatalf("expected %v to be %v in %v, got %v", k, ev, b.Name(), v)
+		}
+	}
+}
+
+func TestBuckets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+
+	db := openDB(t, path, &Options[string]{PageSize: 1024, MinimumDegree: 2})
+
+	users := openBucket(t, db, "users", &BucketOptions[int]{MinimumDegree: 2})
+	index := openBucket(t, db, "index", &BucketOptions[int]{MinimumDegree: 3})
+
+	expected := map[int]int{}
+	for k := range 2000 {
+		if err := users.Insert(k, k); err != nil {
+			t.Fatalf("failed to insert %v: %v", k, err)
+		}
+		if err := index.Insert(k, -k); err != nil {
+			t.Fatalf("failed to insert %v: %v", k, err)
+		}
+		expected[k] = k
+	}
+
+	for k := range 2000 {
+		if k%3 != 0 {
+			if v, err := users.Delete(k); err != nil || v != k {
+				t.Fatalf("expected to delete %v, got %v, %v", k, v, err)
+			}
+			delete(expected, k)
+		}
+	}
+
+	raw, err := db.Bucket("raw")
+	if err != nil {
+		t.Fatalf("failed to open bucket raw: %v", err)
+	}
+	if err := raw.Insert([]byte("k"), "v"); err != nil {
+		t.Fatalf("failed to insert k: %v", err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("failed to close DB: %v", err)
+	}
+
+	if r := verify(t, path); !r.OK() || r.Buckets != 3 {
+		t.Fatalf("expected a DB of 3 buckets to verify, got %v", r)
+	}
+
+	db = openDB(t, path, nil)
+	defer db.Close()
+
+	names, err := db.Buckets()
+	if err != nil || !slices.Equal(names, []string{"index", "raw", "users"}) {
+		t.Fatalf("expected buckets index, raw and users, got %v, %v", names, err)
+	}
+
+	users = openBucket[int](t, db, "users", nil)
+	checkBucket(t, users, expected)
+
+	// The degree is the one the bucket was created with.
+	index = openBucket(t, db, "index", &BucketOptions[int]{MinimumDegree: 8})
+	for k := range 2000 {
+		if v, err := index.Search(k); err != nil || v != -k {
+			t.Fatalf("expected %v to be %v in index, got %v, %v", k, -k, v, err)
+		}
+	}
+
+	raw, err = db.Bucket("raw")
+	if err != nil {
+		t.Fatalf("failed to open bucket raw: %v", err)
+	}
+	if v, err := raw.Search([]byte("k")); err != nil || v != "v" {
+		t.Errorf("expected k to be v, got %v, %v", v, err)
+	}
+}
+
+func TestBucketTransactions(t *testing.T) {
+	db := openDB(t, filepath.Join(t.TempDir(), "db"), &Options[string]{PageSize: 256, MinimumDegree: 2})
+	defer db.Close()
+
+	a := openBucket(t, db, "a", &BucketOptions[int]{MinimumDegree: 2})
+	b := openBucket(t, db, "b", &BucketOptions[int]{MinimumDegree: 2})
+
+	fail := errors.New("fail")
+
+	err := db.Update(func(tx *Tx) error {
+		for k := range 500 {
+			if err := a.With(tx).Insert(k, k); err != nil {
+				return err
+			}
+			if err := b.With(tx).Insert(k, -k); err != nil {
+				return err
+			}
+		}
+
+		// Writes made in the transaction are seen by it.
+		if v, err := a.With(tx).Search(499); err != nil || v != 499 {
+			t.Errorf("expected the transaction to see 499, got %v, %v", v, err)
+		}
+
+		return fail
+	})
+	if !errors.Is(err, fail) {
+		t.Fatalf("expected the transaction to fail, got %v", err)
+	}
+
+	checkBucket(t, a, nil)
+	checkBucket(t, b, nil)
+
+	var done *Tx
+
+	err = db.Update(func(tx *Tx) error {
+		done = tx
+
+		for k := range 500 {
+			if err := a.With(tx).Insert(k, k); err != nil {
+				return err
+			}
+			if err := b.With(tx).Insert(k, -k); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to commit: %v", err)
+	}
+
+	expected := map[int]int{}
+	for k := range 500 {
+		expected[k] = k
+	}
+	checkBucket(t, a, expected)
+
+	if err := a.With(done).Insert(1, 1); !errors.Is(err, ErrTxDone) {
+		t.Errorf("expected ErrTxDone writing in a done transaction, got %v", err)
+	}
+}
+
+func TestBucketCrashRecovery(t *testing.T) {
+	for seed := range int64(100) {
+		r := rand.New(rand.NewSource(seed))
+		fs := newMemFS(1 + r.Intn(2000))
+		opts := &Options[string]{
+			PageSize:       256,
+			MinimumDegree:  2,
+			FS:             fs,
+			CheckpointSize: 8 << 10,
+			CacheSize:      16 * 256,
+		}
+
+		db, err := OpenDB("db", opts)
+		var a, b *Bucket[int]
+		if err == nil {
+			a, err = OpenBucket(db, "a", &BucketOptions[int]{MinimumDegree: 2})
+		}
+		if err == nil {
+			b, err = OpenBucket(db, "b", &BucketOptions[int]{MinimumDegree: 3})
+		}
+
+		for i := 0; err == nil && i < 300; i++ {
+			k, v := r.Intn(100), r.Int()
+
+			err = db.Update(func(tx *Tx) error {
+				if r.Intn(3) == 0 {
+					if _, err := a.With(tx).Delete(k); err != nil {
+						return err
+					}
+					_, err := b.With(tx).Delete(k)
+
+					return err
+				}
+
+				if err := a.With(tx).Insert(k, v); err != nil {
+					return err
+				}
+
+				return b.With(tx).Insert(k, v)
+			})
+		}
+
+		if err != nil && !errors.Is(err, errCrashed) {
+			t.Fatalf("seed %v: unexpected error: %v", seed, err)
+		}
+
+		opts.FS = fs.crash(r)
+
+		db, err = OpenDB("db", opts)
+		if err != nil {
+			t.Fatalf("seed %v: failed to recover DB: %v", seed, err)
+		}
+
+		// Both buckets are written by every transaction, so they hold
+		// the same entries, unless the crash came before they existed.
+		names, err := db.Buckets()
+		if err != nil {
+			t.Fatalf("seed %v: failed to list buckets: %v", seed, err)
+		}
+
+		if len(names) == 2 {
+			a = openBucket(t, db, "a", &BucketOptions[int]{})
+			b = openBucket(t, db, "b", &BucketOptions[int]{})
+
+			for k := range 100 {
+				va, err := a.Search(k)
+				if err != nil {
+					t.Fatalf("seed %v: failed to search %v: %v", seed, k, err)
+				}
+
+				if vb, err := b.Search(k); err != nil || va != vb {
+					t.Fatalf("seed %v: expected %v to be %v in both buckets, got %v, %v", seed, k, va, vb, err)
+				}
+			}
+		}
+
+		if err := db.Close(); err != nil {
+			t.Fatalf("seed %v: failed to close DB: %v", seed, err)
+		}
+	}
+}
+
+func TestDeleteBucket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+
+	db := openDB(t, path, &Options[string]{PageSize: 256, MinimumDegree: 2})
+	defer db.Close()
+
+	keep := openBucket(t, db, "keep", &BucketOptions[int]{MinimumDegree: 2})
+	if err := keep.Insert(1, 1); err != nil {
+		t.Fatalf("failed to insert 1: %v", err)
+	}
+
+	var count uint32
+
+	for round := range 3 {
+		b := openBucket(t, db, "drop", &BucketOptions[int]{MinimumDegree: 2})
+
+		for k := range 500 {
+			if err := b.Insert(k, make([]byte, 300)); err != nil {
+				t.Fatalf("failed to insert %v: %v", k, err)
+			}
+		}
+
+		if err := db.DeleteBucket("drop"); err != nil {
+			t.Fatalf("failed to delete bucket: %v", err)
+		}
+
+		if _, err := b.Search(1); !errors.Is(err, ErrBucketNotFound) {
+			t.Fatalf("expected ErrBucketNotFound searching a deleted bucket, got %v", err)
+		}
+
+		// The pages of deleted buckets are reused.
+		if round > 0 && db.bt.meta.count != count {
+			t.Fatalf("round %v: expected the file to keep %v pages, got %v", round, count, db.bt.meta.count)
+		}
+		count = db.bt.meta.count
+	}
+
+	if err := db.Checkpoint(); err != nil {
+		t.Fatalf("failed to checkpoint: %v", err)
+	}
+
+	if r := verify(t, copyTree(t, path)); !r.OK() || r.Buckets != 1 {
+		t.Errorf("expected a DB of 1 bucket to verify, got %v", r)
+	}
+
+	if err := db.DeleteBucket("drop"); !errors.Is(err, ErrBucketNotFound) {
+		t.Errorf("expected ErrBucketNotFound deleting a missing bucket, got %v", err)
+	}
+}
+
+func TestBucketFiles(t *testing.T) {
+	dir := t.TempDir()
+
+	db := openDB(t, filepath.Join(dir, "db"), nil)
+	openBucket(t, db, "strings", &BucketOptions[string]{})
+
+	if _, err := OpenBucket(db, "strings", &BucketOptions[int]{}); !errors.Is(err, ErrCodecMismatch) {
+		t.Errorf("expected ErrCodecMismatch opening a bucket with other codecs, got %v", err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("failed to close DB: %v", err)
+	}
+
+	if _, err := Open[int](filepath.Join(dir, "db"), nil); !errors.Is(err, ErrBuckets) {
+		t.Errorf("expected ErrBuckets opening a DB as a tree, got %v", err)
+	}
+
+	mapped := openDB(t, filepath.Join(dir, "db"), &Options[string]{Mmap: true})
+	defer mapped.Close()
+
+	strings := openBucket(t, mapped, "strings", &BucketOptions[string]{Keys: codec.Ordered[string]()})
+	if err := strings.Insert("k", 1); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("expected ErrReadOnly writing to a mapped DB, got %v", err)
+	}
+
+	openTree(t, filepath.Join(dir, "tree"), &Options[int]{}).Close()
+
+	if _, err := OpenDB(filepath.Join(dir, "tree"), nil); err == nil {
+		t.Errorf("expected opening a tree as a DB to fail")
+	}
+
+	if _, err := OpenDB(filepath.Join(dir, "cow"), &Options[string]{AppendOnly: true}); !errors.Is(err, ErrAppendOnly) {
+		t.Errorf("expected ErrAppendOnly opening an append-only DB, got %v", err)
+	}
+}
@@ -0,0 +1,176 @@
+package disk
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// Compression is the codec pages are compressed with.
+type Compression byte
+
+const (
+	CompressNone Compression = iota
+	CompressFlate
+	CompressZlib
+)
+
+func (c Compression) String() string {
+	switch c {
+	case CompressNone:
+		return "none"
+	case CompressFlate:
+		return "flate"
+	case CompressZlib:
+		return "zlib"
+	default:
+		return fmt.Sprintf("Compression(%d)", byte(c))
+	}
+}
+
+// Pages of compressed trees, but the meta page, are stored behind a header
+// holding the codec they're compressed with, their stored size and the size
+// of their image, which give the ratio achieved. Pages that don't shrink
+// are stored as they are, with CompressNone. Stored pages vary in size: the
+// WAL and backups only hold their bytes, and pages in the tree file keep
+// their place so that page IDs still locate them, but the blocks past their
+// end are deallocated, leaving holes in the file.
+const compressHeaderSize = 1 + 2 + 2
+
+// CompressionStats count the pages a compressed tree sealed, whether for
+// the WAL, the tree file or a backup, so a page is counted each time it's
+// stored, which gives the ratio achieved. Saved is the space the tree file
+// saves on disk.
+type CompressionStats struct {
+	Pages uint64
+	// Bytes is the size of their images and Stored the one they were
+	// stored in, headers included.
+	Bytes  uint64
+	Stored uint64
+	// Saved is the number of bytes of the tree file left unallocated, by
+	// the holes past the end of compressed pages, as the file system
+	// reports it.
+	Saved uint64
+}
+
+// Ratio returns Bytes/Stored, or 1 if no page was stored.
+func (s CompressionStats) Ratio() float64 {
+	if s.Stored == 0 {
+		return 1
+	}
+
+	return float64(s.Bytes) / float64(s.Stored)
+}
+
+// compressWriter and compressReader are the writers and readers of both
+// codecs, which are reused as they're costly to allocate.
+type compressWriter interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+type compressReader interface {
+	io.ReadCloser
+	Reset(r io.Reader, dict []byte) error
+}
+
+type compressor struct {
+	codec   Compression
+	writers sync.Pool
+	readers [CompressZlib + 1]sync.Pool
+
+	pages, bytes, stored atomic.Uint64
+}
+
+func newCompressor(codec Compression) (*compressor, error) {
+	if codec != CompressFlate && codec != CompressZlib {
+		return nil, fmt.Errorf("disk: unknown compression %v", codec)
+	}
+
+	return &compressor{codec: codec}, nil
+}
+
+func (c *compressor) writer(w io.Writer) compressWriter {
+	if cw, ok := c.writers.Get().(compressWriter); ok {
+		cw.Reset(w)
+
+		return cw
+	}
+
+	if c.codec == CompressZlib {
+		return zlib.NewWriter(w)
+	}
+
+	cw, _ := flate.NewWriter(w, flate.DefaultCompression)
+
+	return cw
+}
+
+func (c *compressor) reader(codec Compression, r io.Reader) (compressReader, error) {
+	if cr, ok := c.readers[codec].Get().(compressReader); ok {
+		return cr, cr.Reset(r, nil)
+	}
+
+	if codec == CompressZlib {
+		cr, err := zlib.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+
+		return cr.(compressReader), nil
+	}
+
+	return flate.NewReader(r).(compressReader), nil
+}
+
+// compress returns buf compressed.
+func (c *compressor) compress(buf []byte) []byte {
+	var out bytes.Buffer
+
+	w := c.writer(&out)
+	w.Write(buf)
+	w.Close()
+	c.writers.Put(w)
+
+	return out.Bytes()
+}
+
+// decompress returns the image of size bytes data holds, compressed with
+// codec.
+func (c *compressor) decompress(codec Compression, data []byte, size int) ([]byte, error) {
+	if codec != CompressFlate && codec != CompressZlib {
+		return nil, fmt.Errorf("unknown compression %v", codec)
+	}
+
+	r, err := c.reader(codec, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer c.readers[codec].Put(r)
+
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+
+	return buf, nil
+}
+
+// count adds a page of size bytes stored in stored ones to the stats.
+func (c *compressor) count(size, stored int) {
+	c.pages.Add(1)
+	c.bytes.Add(uint64(size))
+	c.stored.Add(uint64(stored))
+}
+
+func (c *compressor) stats() CompressionStats {
+	return CompressionStats{
+		Pages:  c.pages.Load(),
+		Bytes:  c.bytes.Load(),
+		Stored: c.stored.Load(),
+	}
+}
@@ -0,0 +1,181 @@
+package disk
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCompression(t *testing.T) {
+	for _, c := range []Compression{CompressFlate, CompressZlib} {
+		t.Run(c.String(), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "tree")
+			opts := &Options[int]{PageSize: 512, MinimumDegree: 2, Compression: c}
+			value := strings.Repeat("compressible ", 200)
+
+			bt := openTree(t, path, opts)
+			for k := range 300 {
+				v := any(k)
+				if k%10 == 0 {
+					// Spilled to overflow pages.
+					v = value
+				}
+
+				if err := bt.Insert(k, v); err != nil {
+					t.Fatalf("failed to insert %v: %v", k, err)
+				}
+			}
+
+			s := bt.CompressionStats()
+			if s.Pages == 0 || s.Ratio() < 2 {
+				t.Errorf("expected pages to compress well, got %+v", s)
+			}
+
+			// Part of the tree is only in the WAL until it's closed.
+			if r := verify(t, copyTree(t, path)); !r.OK() {
+				t.Fatalf("expected the tree to verify, got %v", r)
+			}
+
+			if err := bt.Close(); err != nil {
+				t.Fatalf("failed to close tree: %v", err)
+			}
+
+			// The codec is the one the file was created with.
+			bt = openTree(t, path, &Options[int]{})
+			defer bt.Close()
+
+			checkInvariants(t, bt)
+
+			for k := range 300 {
+				expected := any(k)
+				if k%10 == 0 {
+					expected = value
+				}
+
+				if v, err := bt.Search(k); err != nil || v != expected {
+					t.Fatalf("expected %v to be found, got %v, %v", k, v, err)
+				}
+			}
+		})
+	}
+}
+
+func TestCompressedPageCorruption(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tree")
+
+	bt := openTree(t, path, &Options[int]{PageSize: 512, MinimumDegree: 2, Compression: CompressFlate})
+	for k := range 100 {
+		if err := bt.Insert(k, k); err != nil {
+			t.Fatalf("failed to insert %v: %v", k, err)
+		}
+	}
+	bt.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read the tree file: %v", err)
+	}
+
+	// Flips a byte of the compressed data of page 1.
+	data[512+compressHeaderSize+3] ^= 0xff
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatalf("failed to write the tree file: %v", err)
+	}
+
+	r := verify(t, path)
+
+	var cerr *CorruptionError
+	if r.OK() || !errors.As(r.Problems[0], &cerr) || cerr.Page != 1 {
+		t.Errorf("expected page 1 to be corrupted, got %v", r.Problems)
+	}
+}
+
+func TestUnknownCompression(t *testing.T) {
+	_, err := Open(filepath.Join(t.TempDir(), "tree"), &Options[int]{Compression: 7})
+	if err == nil {
+		t.Errorf("expected an unknown compression to fail")
+	}
+}
+
+func TestCompressedFileHoles(t *testing.T) {
+	dir := t.TempDir()
+
+	// Pages must span several blocks of the file system, which must
+	// support holes.
+	probe, err := os.Create(filepath.Join(dir, "probe"))
+	if err != nil {
+		t.Fatalf("failed to create a file: %v", err)
+	}
+	defer probe.Close()
+
+	f := osFile{probe}
+	if _, err := f.WriteAt(make([]byte, 64<<10), 0); err != nil {
+		t.Fatalf("failed to write a file: %v", err)
+	}
+	if block, err := f.BlockSize(); err != nil || block >= 32<<10 || f.PunchHole(0, block) != nil {
+		t.Skip("file system doesn't support holes")
+	}
+
+	path := filepath.Join(dir, "tree")
+	opts := &Options[int]{PageSize: 64 << 10, MinimumDegree: 2, Compression: CompressFlate}
+	value := strings.Repeat("compressible ", 400)
+
+	bt := openTree(t, path, opts)
+	for k := range 100 {
+		if err := bt.Insert(k, value); err != nil {
+			t.Fatalf("failed to insert %v: %v", k, err)
+		}
+	}
+
+	if err := bt.Checkpoint(); err != nil {
+		t.Fatalf("failed to checkpoint: %v", err)
+	}
+
+	size, err := bt.pager.file.Size()
+	if err != nil {
+		t.Fatalf("failed to stat the tree file: %v", err)
+	}
+
+	if s := bt.CompressionStats(); s.Saved < uint64(size)/2 {
+		t.Errorf("expected the file to save at least half of its %v bytes, got %+v", size, s)
+	}
+
+	// Pages that don't compress fill their holes back.
+	r := rand.New(rand.NewSource(1))
+	random := make([]byte, 5000)
+	r.Read(random)
+
+	for k := range 100 {
+		if k%3 == 0 {
+			if err := bt.Insert(k, random); err != nil {
+				t.Fatalf("failed to insert %v: %v", k, err)
+			}
+		}
+	}
+
+	if err := bt.Close(); err != nil {
+		t.Fatalf("failed to close tree: %v", err)
+	}
+
+	if r := verify(t, path); !r.OK() {
+		t.Fatalf("expected the tree to verify, got %v", r)
+	}
+
+	bt = openTree(t, path, &Options[int]{})
+	defer bt.Close()
+
+	for k := range 100 {
+		v, err := bt.Search(k)
+		if err != nil {
+			t.Fatalf("failed to search %v: %v", k, err)
+		}
+
+		if k%3 == 0 && !bytes.Equal(v.([]byte), random) || k%3 != 0 && v != value {
+			t.Fatalf("unexpected value of %v", k)
+		}
+	}
+}
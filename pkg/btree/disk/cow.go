@@ -0,0 +1,422 @@
+package disk
+
+import (
+	"bytes"
+	"errors"
+	"maps"
+	"math"
+	"slices"
+)
+
+// Append-only trees never write over the pages of their last commit, and
+// have no WAL. A commit writes the nodes it changed, and the ones leading to
+// them from the root, to pages no version of the tree still reads, or to new
+// ones at the end of the file, then the meta page pointing to the new root.
+// Meta pages alternate between pages 0 and 1 by LSN, leaving the one of the
+// previous commit intact: a crash in the middle of a commit leaves that meta
+// page and every page it reaches as they were, and opening the tree picks
+// the newest meta page that's valid. The part of the meta page that never
+// changes, page size included, is always read from page 0.
+//
+// The pages a commit drops are only reused once no View reads a version of
+// the tree holding them. Opening a tree reads every page it reaches, to find
+// the ones it may reuse.
+
+// freed are the pages dropped by the commit lsn.
+type freed struct {
+	lsn uint64
+	ids []pageID
+}
+
+// cow is the state of an append-only tree.
+type cow struct {
+	// reusable are the pages no version of the tree reads anymore, and
+	// pending the ones dropped by commits open views may still read.
+	reusable []pageID
+	pending  []freed
+	// views counts the open views by the LSN they read the tree at.
+	views map[uint64]int
+
+	// touched holds the nodes the running operation loaded, fresh the
+	// pages it took, which it may write over, taken the ones of them it
+	// took from reusable and freed the ones it dropped.
+	touched map[pageID]*node
+	fresh   map[pageID]bool
+	taken   []pageID
+	freed   []pageID
+}
+
+func newCow() *cow {
+	return &cow{views: map[uint64]int{}}
+}
+
+// metaSlot returns the meta page the commit lsn is written to.
+func metaSlot(lsn uint64) pageID {
+	return pageID(lsn % 2)
+}
+
+func (c *cow) begin() {
+	c.touched = map[pageID]*node{}
+	c.fresh = map[pageID]bool{}
+}
+
+func (c *cow) end() {
+	c.touched, c.fresh, c.taken, c.freed = nil, nil, nil, nil
+}
+
+// reset hands back the pages taken by a failed operation.
+func (c *cow) reset() {
+	c.reusable = append(c.reusable, c.taken...)
+	c.taken, c.freed = nil, nil
+	clear(c.touched)
+	clear(c.fresh)
+}
+
+// take returns a page to write to, growing the file of meta m if none is
+// reusable.
+func (c *cow) take(m *meta) pageID {
+	var id pageID
+
+	if n := len(c.reusable); n > 0 {
+		id, c.reusable = c.reusable[n-1], c.reusable[:n-1]
+		c.taken = append(c.taken, id)
+	} else {
+		id = pageID(m.count)
+		m.count++
+	}
+
+	c.fresh[id] = true
+
+	return id
+}
+
+// recycle makes reusable the pages dropped by commits no open view
+// predates.
+func (c *cow) recycle() {
+	oldest := uint64(math.MaxUint64)
+	for lsn := range c.views {
+		oldest = min(oldest, lsn)
+	}
+
+	i := 0
+	for ; i < len(c.pending) && c.pending[i].lsn <= oldest; i++ {
+		c.reusable = append(c.reusable, c.pending[i].ids...)
+	}
+
+	c.pending = c.pending[i:]
+}
+
+// appendOnly reports whether the tree of file is append-only, as its meta
+// page records or, for new files, as want sets. The creation of append-only
+// trees writes page 0 first, so if only that page is found, the creation
+// didn't complete, and the file is emptied to create the tree again.
+func appendOnly(fs FS, file File, path string, want bool) (bool, error) {
+	size, err := file.Size()
+	if err != nil {
+		return false, err
+	}
+
+	buf, err := (&pager{file: file}).readAt(metaPage, metaSize)
+	if err != nil {
+		buf = nil
+	}
+
+	m, err := decodeMeta(buf)
+	if err != nil && !errors.Is(err, ErrNotTreeFile) {
+		return false, err
+	}
+
+	if err == nil {
+		if m.appendOnly && size <= int64(m.pageSize) {
+			return true, file.Truncate(0)
+		}
+
+		return m.appendOnly, nil
+	}
+
+	// The file may be a tree with a WAL that wasn't checkpointed yet.
+	o, err := readWAL(fs, path+"-wal")
+	if err != nil {
+		return false, err
+	}
+
+	if !want || o.records > 0 {
+		return false, nil
+	}
+
+	// Shorter files are the start of a torn page 0.
+	n := min(len(buf), len(magic))
+	if len(buf) == metaSize || !bytes.Equal(buf[:n], magic[:n]) {
+		return false, ErrNotTreeFile
+	}
+
+	if size > 0 {
+		return true, file.Truncate(0)
+	}
+
+	return true, nil
+}
+
+// relocate moves the nodes the running operation changed in the subtree
+// of the page r references, and the ones leading to them, to fresh pages,
+// adding them to moved. It returns the reference to the subtree then,
+// which expects the LSN of the operation if it changed.
+func (bt *BTree[K]) relocate(r ref, moved map[pageID]*node) (ref, error) {
+	id := r.id
+
+	n, changed := bt.dirty[id]
+	if !changed {
+		// Subtrees the operation didn't load didn't change.
+		if n = bt.cow.touched[id]; n == nil {
+			return r, nil
+		}
+	}
+
+	if n.free || n.overflow {
+		return ref{}, corruption(id, "free or overflow page is part of the tree")
+	}
+
+	if !n.leaf {
+		for i, c := range n.childs {
+			to, err := bt.relocate(c, moved)
+			if err != nil {
+				return ref{}, err
+			}
+
+			if to != c {
+				n.childs[i] = to
+				changed = true
+			}
+		}
+	}
+
+	if !changed {
+		return r, nil
+	}
+
+	if !bt.cow.fresh[id] {
+		bt.cow.freed = append(bt.cow.freed, id)
+		n.id = bt.cow.take(bt.meta)
+	}
+
+	moved[n.id] = n
+
+	return ref{id: n.id, lsn: bt.nextLSN()}, nil
+}
+
+// flushAppendOnly commits the pages changed by an operation to fresh
+// pages, then flips the meta page, syncing the file after each. If it
+// fails while writing the meta page, the tree stops accepting operations
+// until it's reopened.
+func (bt *BTree[K]) flushAppendOnly() (*Commit, error) {
+	moved := map[pageID]*node{}
+
+	root, err := bt.relocate(bt.meta.root, moved)
+	if err != nil {
+		return nil, err
+	}
+
+	bt.meta.root = root
+
+	// Overflow pages are only written when fresh, and out of the reach of
+	// relocate.
+	for id, n := range bt.dirty {
+		if bt.cow.fresh[id] {
+			moved[id] = n
+		} else if moved[n.id] != n {
+			return nil, corruption(id, "page changed out of the tree")
+		}
+	}
+
+	bt.dirty = moved
+	bt.meta.lsn = bt.committed.lsn + 1
+
+	if err := bt.preserve(); err != nil {
+		return nil, err
+	}
+
+	var images []pageImage
+
+	for _, id := range slices.Sorted(maps.Keys(bt.dirty)) {
+		buf, page, err := bt.encode(id)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := bt.pager.writeRaw(id, page); err != nil {
+			return nil, err
+		}
+
+		images = append(images, pageImage{id: id, data: buf})
+	}
+
+	// Whether a failed sync left the pages written is unknown, but they're
+	// only reached once the meta page is.
+	if err := bt.pager.sync(); err != nil {
+		bt.failed = err
+
+		return nil, err
+	}
+
+	slot := metaSlot(bt.meta.lsn)
+
+	_, page, err := bt.encode(slot)
+	if err == nil {
+		err = bt.pager.writeRaw(slot, page)
+	}
+	if err == nil {
+		err = bt.pager.sync()
+	}
+	if err != nil {
+		bt.failed = err
+
+		return nil, err
+	}
+
+	if len(bt.cow.freed) > 0 {
+		bt.cow.pending = append(bt.cow.pending, freed{lsn: bt.meta.lsn, ids: bt.cow.freed})
+	}
+	bt.cow.taken, bt.cow.freed = nil, nil
+	bt.cow.recycle()
+
+	commit := bt.commit.committed(bt.meta.lsn)
+
+	clear(bt.dirty)
+	bt.committed = *bt.meta
+
+	for _, p := range images {
+		if err := bt.pool.cache(p.id, p.data); err != nil {
+			bt.failed = err
+
+			return nil, err
+		}
+	}
+
+	if err := bt.pinRoot(); err != nil {
+		bt.failed = err
+
+		return nil, err
+	}
+
+	return commit, nil
+}
+
+// reach adds to used the pages reached from the subtree of the page r
+// references.
+func (bt *BTree[K]) reach(r ref, used map[pageID]bool) error {
+	n, err := bt.load(r)
+	if err != nil {
+		return err
+	}
+
+	used[r.id] = true
+
+	for _, e := range n.entries {
+		err := bt.chain(e, func(o *node) bool {
+			used[o.id] = true
+
+			return true
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if n.leaf {
+		return nil
+	}
+
+	for _, c := range n.childs {
+		if err := bt.reach(c, used); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// scan makes reusable the pages the tree doesn't reach.
+func (bt *BTree[K]) scan() error {
+	used := map[pageID]bool{}
+	if err := bt.reach(bt.meta.root, used); err != nil {
+		return err
+	}
+
+	for id := pageID(2); uint32(id) < bt.meta.count; id++ {
+		if !used[id] {
+			bt.cow.reusable = append(bt.cow.reusable, id)
+		}
+	}
+
+	return nil
+}
+
+// View is a read-only snapshot of an append-only tree, as of the last
+// commit when it was taken. Commits made since don't change what it reads,
+// and the pages it reads aren't reused until it's closed, so views should
+// be short-lived.
+type View[K any] struct {
+	bt     *BTree[K]
+	meta   meta
+	closed bool
+}
+
+// View returns a view of the tree as it is now. The tree must be
+// append-only.
+func (bt *BTree[K]) View() (*View[K], error) {
+	bt.mutex.Lock()
+	defer bt.mutex.Unlock()
+
+	if bt.cow == nil {
+		return nil, errors.New("disk: views need an append-only tree")
+	}
+
+	if err := bt.usable(); err != nil {
+		return nil, err
+	}
+
+	v := &View[K]{bt: bt, meta: bt.committed}
+	bt.cow.views[v.meta.lsn]++
+
+	return v, nil
+}
+
+// LSN returns the LSN of the commit the view reads the tree at.
+func (v *View[K]) LSN() uint64 {
+	return v.meta.lsn
+}
+
+func (v *View[K]) Search(k K) (any, error) {
+	v.bt.mutex.RLock()
+	defer v.bt.mutex.RUnlock()
+
+	if v.closed {
+		return nil, ErrClosed
+	}
+
+	if err := v.bt.usable(); err != nil {
+		return nil, err
+	}
+
+	return v.bt.lookup(v.meta.root, k)
+}
+
+// Close closes the view, letting the tree reuse the pages only it read.
+func (v *View[K]) Close() error {
+	v.bt.mutex.Lock()
+	defer v.bt.mutex.Unlock()
+
+	if v.closed {
+		return ErrClosed
+	}
+
+	v.closed = true
+
+	if v.bt.cow.views[v.meta.lsn]--; v.bt.cow.views[v.meta.lsn] == 0 {
+		delete(v.bt.cow.views, v.meta.lsn)
+	}
+
+	v.bt.cow.recycle()
+
+	return nil
+}
@@ -0,0 +1,346 @@
+package disk
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func appendOnlyTree(t *testing.T, path string) *BTree[int] {
+	return openTree(t, path, &Options[int]{PageSize: 256, MinimumDegree: 2, AppendOnly: true})
+}
+
+func TestAppendOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tree")
+
+	bt := appendOnlyTree(t, path)
+	expected := fillAndThin(t, bt)
+	checkContents(t, bt, expected)
+
+	if err := bt.Close(); err != nil {
+		t.Fatalf("failed to close tree: %v", err)
+	}
+
+	if _, err := os.Stat(path + "-wal"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected no WAL, got %v", err)
+	}
+
+	if r := verify(t, path); !r.OK() || !r.AppendOnly || r.FreePages == 0 {
+		t.Errorf("expected an append-only tree with free pages to verify, got %v", r)
+	}
+
+	// The layout is the one the file was created with.
+	bt = openTree(t, path, &Options[int]{})
+
+	if bt.cow == nil {
+		t.Fatalf("expected the tree to stay append-only")
+	}
+
+	checkContents(t, bt, expected)
+
+	if err := bt.Close(); err != nil {
+		t.Fatalf("failed to close tree: %v", err)
+	}
+
+	mapped := openTree(t, path, &Options[int]{Mmap: true})
+	defer mapped.Close()
+
+	checkContents(t, mapped, expected)
+}
+
+func TestAppendOnlyNewestMeta(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tree")
+
+	bt := appendOnlyTree(t, path)
+	for k := range 100 {
+		if err := bt.Insert(k, k); err != nil {
+			t.Fatalf("failed to insert %v: %v", k, err)
+		}
+	}
+
+	lsn := bt.meta.lsn
+	if err := bt.Close(); err != nil {
+		t.Fatalf("failed to close tree: %v", err)
+	}
+
+	// Tears the meta page of the last insert, whose pages the previous one
+	// doesn't reach.
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("failed to open %v: %v", path, err)
+	}
+	if _, err := file.WriteAt([]byte("torn"), int64(metaSlot(lsn))*256+100); err != nil {
+		t.Fatalf("failed to write %v: %v", path, err)
+	}
+	file.Close()
+
+	bt = appendOnlyTree(t, path)
+	defer bt.Close()
+
+	if bt.meta.lsn != lsn-1 {
+		t.Errorf("expected the meta page of LSN %v, got %v", lsn-1, bt.meta.lsn)
+	}
+
+	checkInvariants(t, bt)
+
+	for k := range 100 {
+		if v, err := bt.Search(k); err != nil || k < 99 && v != k || k == 99 && v != nil {
+			t.Fatalf("expected the last insert to be lost, got %v for %v, %v", v, k, err)
+		}
+	}
+
+	// The torn meta page is the next one written.
+	if err := bt.Insert(99, 99); err != nil {
+		t.Fatalf("failed to insert 99: %v", err)
+	}
+
+	if r := verify(t, copyTree(t, path)); !r.OK() {
+		t.Errorf("expected the tree to verify, got %v", r)
+	}
+}
+
+func TestAppendOnlyCrashRecovery(t *testing.T) {
+	for seed := range int64(200) {
+		r := rand.New(rand.NewSource(seed))
+		fs := newMemFS(1 + r.Intn(1000))
+		opts := &Options[int]{
+			PageSize:      256,
+			MinimumDegree: 2,
+			FS:            fs,
+			CacheSize:     16 * 256,
+			AppendOnly:    true,
+		}
+		switch seed % 3 {
+		case 0:
+			opts.Encryption = KeyRing{1: testKey(1)}
+		case 1:
+			opts.Compression = CompressFlate
+		}
+
+		bt, err := Open[int]("tree", opts)
+		if errors.Is(err, errCrashed) {
+			opts.FS = fs.crash(r)
+
+			bt, err = Open[int]("tree", opts)
+			if err != nil {
+				t.Fatalf("seed %v: failed to create tree again: %v", seed, err)
+			}
+
+			bt.Close()
+
+			continue
+		} else if err != nil {
+			t.Fatalf("seed %v: failed to open tree: %v", seed, err)
+		}
+
+		expected := map[int]int{}
+		inflight, value := -1, 0
+
+		for range 2000 {
+			k := r.Intn(300)
+
+			if r.Intn(3) == 0 {
+				if _, err = bt.Delete(k); err == nil {
+					delete(expected, k)
+				}
+				value = -1
+			} else {
+				value = r.Int()
+				if err = bt.Insert(k, value); err == nil {
+					expected[k] = value
+				}
+			}
+
+			if err != nil {
+				if !errors.Is(err, errCrashed) {
+					t.Fatalf("seed %v: unexpected error: %v", seed, err)
+				}
+
+				inflight = k
+
+				break
+			}
+		}
+
+		opts.FS = fs.crash(r)
+
+		bt, err = Open[int]("tree", opts)
+		if err != nil {
+			t.Fatalf("seed %v: failed to recover tree: %v", seed, err)
+		}
+
+		checkInvariants(t, bt)
+
+		for k := range 300 {
+			v, err := bt.Search(k)
+			if err != nil {
+				t.Fatalf("seed %v: failed to search %v: %v", seed, k, err)
+			}
+
+			if k == inflight && (v == nil && value == -1 || v == value) {
+				continue
+			}
+
+			if ev, ok := expected[k]; !ok && v != nil || ok && v != ev {
+				t.Fatalf("seed %v: expected %v to be %v, got %v", seed, k, ev, v)
+			}
+		}
+
+		if err := bt.Close(); err != nil {
+			t.Fatalf("seed %v: failed to close tree: %v", seed, err)
+		}
+	}
+}
+
+func TestViews(t *testing.T) {
+	bt := appendOnlyTree(t, filepath.Join(t.TempDir(), "tree"))
+	defer bt.Close()
+
+	for k := range 500 {
+		if err := bt.Insert(k, k); err != nil {
+			t.Fatalf("failed to insert %v: %v", k, err)
+		}
+	}
+
+	v, err := bt.View()
+	if err != nil {
+		t.Fatalf("failed to take a view: %v", err)
+	}
+
+	for round := range 3 {
+		for k := range 500 {
+			if err := bt.Insert(k, -k); err != nil {
+				t.Fatalf("failed to insert %v: %v", k, err)
+			}
+
+			if _, err := bt.Delete(k); err != nil {
+				t.Fatalf("failed to delete %v: %v", k, err)
+			}
+		}
+
+		for k := range 500 {
+			if got, err := v.Search(k); err != nil || got != k {
+				t.Fatalf("round %v: expected the view to find %v, got %v, %v", round, k, got, err)
+			}
+		}
+	}
+
+	if got, err := bt.Search(1); err != nil || got != nil {
+		t.Errorf("expected the tree to be empty, got %v, %v", got, err)
+	}
+
+	// Pages the view reads are only reused once it's closed.
+	pending := len(bt.cow.pending)
+	if pending == 0 {
+		t.Errorf("expected pages to be held by the view")
+	}
+
+	if err := v.Close(); err != nil {
+		t.Fatalf("failed to close the view: %v", err)
+	}
+
+	if len(bt.cow.pending) != 0 {
+		t.Errorf("expected closing the view to release %v commits, got %v left", pending, len(bt.cow.pending))
+	}
+
+	if _, err := v.Search(1); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected ErrClosed searching a closed view, got %v", err)
+	}
+
+	count := bt.meta.count
+
+	for k := range 500 {
+		if err := bt.Insert(k, k); err != nil {
+			t.Fatalf("failed to insert %v: %v", k, err)
+		}
+	}
+
+	if bt.meta.count != count {
+		t.Errorf("expected the file to keep %v pages, got %v", count, bt.meta.count)
+	}
+}
+
+func TestAppendOnlyPagesReused(t *testing.T) {
+	bt := appendOnlyTree(t, filepath.Join(t.TempDir(), "tree"))
+	defer bt.Close()
+
+	var count uint32
+
+	for round := range 3 {
+		for k := range 500 {
+			if err := bt.Insert(k, k); err != nil {
+				t.Fatalf("failed to insert %v: %v", k, err)
+			}
+		}
+
+		for k := range 500 {
+			if _, err := bt.Delete(k); err != nil {
+				t.Fatalf("failed to delete %v: %v", k, err)
+			}
+		}
+
+		if round > 0 && bt.meta.count != count {
+			t.Fatalf("round %v: expected the file to keep %v pages, got %v", round, count, bt.meta.count)
+		}
+		count = bt.meta.count
+	}
+}
+
+func TestAppendOnlyBackup(t *testing.T) {
+	keys := KeyRing{1: testKey(1)}
+	opts := &Options[int]{PageSize: 256, MinimumDegree: 2, AppendOnly: true, Encryption: keys}
+
+	bt := openTree(t, filepath.Join(t.TempDir(), "tree"), opts)
+	defer bt.Close()
+
+	expected := fillAndThin(t, bt)
+	full, lsn := takeBackup(t, bt, 0)
+
+	// Pages the full backup holds are reused by the writes after it.
+	for k := 1; k < 2000; k += 7 {
+		if err := bt.Insert(k, -k); err != nil {
+			t.Fatalf("failed to insert %v: %v", k, err)
+		}
+		expected[k] = -k
+	}
+
+	incremental, _ := takeBackup(t, bt, lsn)
+
+	restored := restoreTree(t, opts, full, incremental)
+	defer restored.Close()
+
+	if restored.cow == nil {
+		t.Fatalf("expected the restored tree to be append-only")
+	}
+
+	checkContents(t, restored, expected)
+}
+
+func TestAppendOnlyUnsupported(t *testing.T) {
+	opts := &Options[int]{AppendOnly: true, Encryption: KeyRing{1: testKey(1)}}
+
+	bt := openTree(t, filepath.Join(t.TempDir(), "tree"), opts)
+	defer bt.Close()
+
+	if err := bt.Vacuum(); !errors.Is(err, ErrAppendOnly) {
+		t.Errorf("expected ErrAppendOnly vacuuming, got %v", err)
+	}
+
+	if _, err := bt.VacuumIncremental(context.Background(), 1); !errors.Is(err, ErrAppendOnly) {
+		t.Errorf("expected ErrAppendOnly vacuuming, got %v", err)
+	}
+
+	if err := bt.RotateKey(context.Background(), 1); !errors.Is(err, ErrAppendOnly) {
+		t.Errorf("expected ErrAppendOnly rotating keys, got %v", err)
+	}
+
+	wal := openTree(t, filepath.Join(t.TempDir(), "tree"), &Options[int]{})
+	defer wal.Close()
+
+	if _, err := wal.View(); err == nil {
+		t.Errorf("expected views of trees with a WAL to fail")
+	}
+}
@@ -0,0 +1,497 @@
+package disk
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"maps"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrEncryption = errors.New("disk: encryption doesn't match the one of the tree file")
+	ErrUnknownKey = errors.New("disk: unknown encryption key")
+)
+
+// Encrypted pages are sealed with AES-GCM, and end with its tag, then the
+// ID of the key, the LSN of the WAL record that committed them and the
+// nonce. The page ID, key ID and LSN are authenticated along with the page,
+// so a page can't be moved to another ID or have its trailer altered. The
+// LSN must also be the one of the image, which must be the one its
+// reference expects, so an older image of the same page, sealed with a key
+// still known, doesn't read as valid either.
+const (
+	gcmTagSize   = 16
+	gcmNonceSize = 12
+
+	cryptOverhead = gcmTagSize + 4 + 8 + gcmNonceSize
+)
+
+// KeyProvider supplies the AES keys, of 16, 24 or 32 bytes, of an encrypted
+// tree. Keys are never stored along with the tree, only their IDs, so the
+// keys pages were encrypted with must stay available until they're
+// re-encrypted by BTree.RotateKey.
+type KeyProvider interface {
+	// CurrentKey returns the key new pages are encrypted with, and its ID.
+	CurrentKey() (uint32, []byte, error)
+	// Key returns the key with the given ID.
+	Key(id uint32) ([]byte, error)
+}
+
+// KeyRing is a KeyProvider holding keys in memory, by ID. Its current key
+// is the one with the highest ID.
+type KeyRing map[uint32][]byte
+
+func (r KeyRing) CurrentKey() (uint32, []byte, error) {
+	if len(r) == 0 {
+		return 0, nil, ErrUnknownKey
+	}
+
+	id := slices.Max(slices.Collect(maps.Keys(r)))
+
+	return id, r[id], nil
+}
+
+func (r KeyRing) Key(id uint32) ([]byte, error) {
+	key, ok := r[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownKey, id)
+	}
+
+	return key, nil
+}
+
+type commandKeys struct {
+	name string
+	args []string
+}
+
+// CommandKeys returns a KeyProvider asking a command for keys, such as the
+// client of a key management service, so they don't have to be stored in
+// a file. The command is run with args followed by "current" or the ID of
+// a key. For "current", it must print the ID of the current key and the key
+// in hex, separated by a space, and otherwise the key in hex.
+func CommandKeys(name string, args ...string) KeyProvider {
+	return &commandKeys{name: name, args: args}
+}
+
+func (c *commandKeys) run(arg string) ([]string, error) {
+	out, err := exec.Command(c.name, append(slices.Clone(c.args), arg)...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("disk: key command failed: %w", err)
+	}
+
+	return strings.Fields(string(out)), nil
+}
+
+func (c *commandKeys) CurrentKey() (uint32, []byte, error) {
+	fields, err := c.run("current")
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if len(fields) != 2 {
+		return 0, nil, errors.New("disk: key command must print a key ID and a key")
+	}
+
+	id, err := strconv.ParseUint(fields[0], 10, 32)
+	if err != nil {
+		return 0, nil, fmt.Errorf("disk: invalid key ID: %w", err)
+	}
+
+	key, err := hex.DecodeString(fields[1])
+	if err != nil {
+		return 0, nil, fmt.Errorf("disk: invalid key: %w", err)
+	}
+
+	return uint32(id), key, nil
+}
+
+func (c *commandKeys) Key(id uint32) ([]byte, error) {
+	fields, err := c.run(strconv.FormatUint(uint64(id), 10))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(fields) != 1 {
+		return nil, errors.New("disk: key command must print a key")
+	}
+
+	key, err := hex.DecodeString(fields[0])
+	if err != nil {
+		return nil, fmt.Errorf("disk: invalid key: %w", err)
+	}
+
+	return key, nil
+}
+
+// crypter encrypts and decrypts pages, keeping the ciphers of the keys it
+// used so far.
+type crypter struct {
+	keys    KeyProvider
+	mutex   sync.Mutex
+	ciphers map[uint32]cipher.AEAD
+	current uint32
+}
+
+func newCrypter(keys KeyProvider) (*crypter, error) {
+	c := &crypter{keys: keys, ciphers: map[uint32]cipher.AEAD{}}
+
+	if err := c.refresh(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func newCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("disk: invalid encryption key: %w", err)
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// refresh asks the provider for its current key, which pages are sealed
+// with from then on.
+func (c *crypter) refresh() error {
+	id, key, err := c.keys.CurrentKey()
+	if err != nil {
+		return err
+	}
+
+	aead, err := newCipher(key)
+	if err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.ciphers[id], c.current = aead, id
+
+	return nil
+}
+
+func (c *crypter) cipher(id uint32) (cipher.AEAD, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if aead, ok := c.ciphers[id]; ok {
+		return aead, nil
+	}
+
+	key, err := c.keys.Key(id)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	c.ciphers[id] = aead
+
+	return aead, nil
+}
+
+// additionalData returns what's authenticated along with page id: its ID
+// and the key ID and LSN of its trailer.
+func additionalData(id pageID, trailer []byte) []byte {
+	return append(binary.BigEndian.AppendUint32(nil, uint32(id)), trailer[:4+8]...)
+}
+
+// seal encrypts the image buf of page id, committed by the WAL record lsn,
+// with the current key. Meta pages are only authenticated.
+func (c *crypter) seal(id pageID, buf []byte, lsn uint64, meta bool) ([]byte, error) {
+	c.mutex.Lock()
+	key := c.current
+	aead := c.ciphers[key]
+	c.mutex.Unlock()
+
+	page := make([]byte, len(buf)+cryptOverhead)
+
+	trailer := page[len(buf)+gcmTagSize:]
+	binary.BigEndian.PutUint32(trailer, key)
+	binary.BigEndian.PutUint64(trailer[4:], lsn)
+
+	nonce := trailer[4+8:]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	ad := additionalData(id, trailer)
+
+	if meta {
+		copy(page, buf)
+		aead.Seal(page[:len(buf)], nonce, nil, append(ad, buf...))
+	} else {
+		aead.Seal(page[:0], nonce, buf, ad)
+	}
+
+	return page, nil
+}
+
+// open decrypts page id, returning its image and the LSN of its trailer.
+func (c *crypter) open(id pageID, page []byte, meta bool) ([]byte, uint64, error) {
+	size := len(page) - cryptOverhead
+	if size < 0 {
+		return nil, 0, corruption(id, "page is too short")
+	}
+
+	trailer := page[size+gcmTagSize:]
+
+	aead, err := c.cipher(binary.BigEndian.Uint32(trailer))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	nonce := trailer[4+8:]
+	ad := additionalData(id, trailer)
+
+	var buf []byte
+	if meta {
+		buf = page[:size]
+		_, err = aead.Open(nil, nonce, page[size:size+gcmTagSize], append(ad, buf...))
+	} else {
+		buf, err = aead.Open(nil, nonce, page[:size+gcmTagSize], ad)
+	}
+
+	if err != nil {
+		return nil, 0, corruption(id, "page fails authentication")
+	}
+
+	return buf, binary.BigEndian.Uint64(trailer[4:]), nil
+}
+
+// rotation is the progress of a RotateKey.
+type rotation struct {
+	// next is the page the next step starts at.
+	next pageID
+	// lsn is the one of the last commit before the rotation started.
+	// Pages written since hold the current key already.
+	lsn uint64
+	// owners maps the pages of the buckets of a DB to the catalog keys of
+	// their buckets. Pages that didn't change since lsn still belong to
+	// the same ones.
+	owners map[pageID]string
+}
+
+// startRotation starts a rotation of the tree as it is.
+func (bt *BTree[K]) startRotation() (*rotation, error) {
+	r := &rotation{next: 1, lsn: bt.meta.lsn, owners: map[pageID]string{}}
+
+	if !bt.catalog {
+		return r, nil
+	}
+
+	err := bt.walk(bt.meta.root, func(e *entry) error {
+		b, ok := decodeBucket(e.v)
+		if !ok {
+			return fmt.Errorf("%w: bucket %x has a malformed catalog entry", ErrCorrupted, e.key())
+		}
+
+		used := map[pageID]bool{}
+		if err := bt.reach(b.root, used); err != nil {
+			return err
+		}
+
+		for id := range used {
+			r.owners[id] = string(e.key())
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// rewrite marks page id to be rewritten, unless it was since r started,
+// along with the pages holding its LSN, which changes. For a page of a
+// bucket, they include its catalog entry.
+func (bt *BTree[K]) rewrite(r *rotation, id pageID) error {
+	n, err := bt.loadPage(id)
+	if err != nil || n.lsn > r.lsn {
+		return err
+	}
+
+	k, ok := r.owners[id]
+	if !ok {
+		return bt.rewriteIn(n)
+	}
+
+	v, found, err := bt.get(bt.meta.root, []byte(k))
+	if err != nil {
+		return err
+	}
+
+	b, ok := decodeBucket(v)
+	if !found || !ok {
+		return fmt.Errorf("%w: bucket %x has a missing or malformed catalog entry", ErrCorrupted, k)
+	}
+
+	err = bt.in(b, func(*node) error {
+		return bt.rewriteIn(n)
+	})
+	if err != nil || !b.changed {
+		return err
+	}
+
+	return bt.saveBucket([]byte(k), b)
+}
+
+// rewriteIn marks n to be rewritten in the tree it belongs to, along with
+// the nodes leading to a node, or the ones leading to the entry of an
+// overflow chain and the whole chain, rewritten along with its first page.
+// Free pages are left to rewriteFreeList.
+func (bt *BTree[K]) rewriteIn(n *node) error {
+	var err error
+
+	switch {
+	case n.free || n.overflow && n.prev != 0:
+		return nil
+	case n.overflow:
+		e, _, err := bt.chainOf(n)
+		if err != nil {
+			return err
+		}
+
+		return bt.chain(e, func(o *node) bool {
+			bt.mark(o)
+
+			return true
+		})
+	case n.id == bt.meta.root.id:
+		if n, err = bt.load(bt.meta.root); err != nil {
+			return err
+		}
+	default:
+		if _, _, err := bt.parent(n); err != nil {
+			return err
+		}
+	}
+
+	bt.mark(n)
+
+	return nil
+}
+
+// rewriteFreeList marks every page of the free list to be rewritten.
+func (bt *BTree[K]) rewriteFreeList() error {
+	refs, err := bt.freeList()
+	if err != nil {
+		return err
+	}
+
+	for i, r := range refs {
+		var next ref
+		if i+1 < len(refs) {
+			next = refs[i+1]
+		}
+
+		bt.mark(&node{id: r.id, free: true, next: next})
+	}
+
+	return nil
+}
+
+// rotateStep rewrites up to step pages from page r.next on, moving r.next
+// past them, and the whole free list along with the first page. It returns
+// false once every page was rewritten.
+func (bt *BTree[K]) rotateStep(r *rotation, step int) (bool, error) {
+	bt.mutex.Lock()
+	defer bt.mutex.Unlock()
+
+	more := true
+
+	_, err := bt.write(func(*node) error {
+		if r.next == 1 {
+			if err := bt.rewriteFreeList(); err != nil {
+				return err
+			}
+		}
+
+		for i := 0; i < step; i++ {
+			if uint32(r.next) >= bt.meta.count {
+				more = false
+
+				return nil
+			}
+
+			if err := bt.rewrite(r, r.next); err != nil {
+				return err
+			}
+
+			r.next++
+		}
+
+		return nil
+	})
+
+	return more, err
+}
+
+// RotateKey re-encrypts every page with the current key of
+// Options.Encryption, rewriting at most step pages at a time and letting
+// other operations through between steps. Once it returns without error,
+// the file and the WAL no longer hold pages encrypted with other keys.
+// It stops early when ctx is done; pages rewritten so far stay so.
+// Append-only trees return ErrAppendOnly.
+func (bt *BTree[K]) RotateKey(ctx context.Context, step int) error {
+	if bt.pager.crypt == nil {
+		return ErrEncryption
+	}
+
+	if bt.cow != nil {
+		return ErrAppendOnly
+	}
+
+	if step < 1 {
+		step = 1
+	}
+
+	var r *rotation
+
+	bt.mutex.Lock()
+	err := bt.writable()
+	if err == nil {
+		err = bt.pager.crypt.refresh()
+	}
+	if err == nil {
+		r, err = bt.startRotation()
+	}
+	bt.mutex.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		more, err := bt.rotateStep(r, step)
+		if err != nil {
+			return err
+		}
+
+		if !more {
+			return bt.Checkpoint()
+		}
+	}
+}
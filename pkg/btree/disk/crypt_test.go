@@ -0,0 +1,275 @@
+package disk
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testKey(id byte) []byte {
+	return bytes.Repeat([]byte{id}, 32)
+}
+
+func encryptedTree(t *testing.T, path string, keys KeyProvider) *BTree[int] {
+	return openTree(t, path, &Options[int]{PageSize: 256, MinimumDegree: 2, Encryption: keys})
+}
+
+func TestEncryption(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tree")
+	keys := KeyRing{1: testKey(1)}
+	secret := strings.Repeat("secret", 100)
+
+	bt := encryptedTree(t, path, keys)
+	for k := range 300 {
+		if err := bt.Insert(k, secret); err != nil {
+			t.Fatalf("failed to insert %v: %v", k, err)
+		}
+	}
+
+	// Part of the tree is only in the WAL until it's closed.
+	wal, err := os.ReadFile(path + "-wal")
+	if err != nil {
+		t.Fatalf("failed to read the WAL: %v", err)
+	}
+	if bytes.Contains(wal, []byte("secret")) {
+		t.Errorf("WAL holds plain values")
+	}
+
+	if r, err := Verify(copyTree(t, path), &VerifyOptions{Encryption: keys}); err != nil || !r.OK() {
+		t.Fatalf("expected the tree to verify, got %v, %v", r, err)
+	}
+
+	if err := bt.Close(); err != nil {
+		t.Fatalf("failed to close tree: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read the tree file: %v", err)
+	}
+	if bytes.Contains(data, []byte("secret")) {
+		t.Errorf("tree file holds plain values")
+	}
+
+	bt = encryptedTree(t, path, keys)
+	defer bt.Close()
+
+	checkInvariants(t, bt)
+
+	for k := range 300 {
+		if v, err := bt.Search(k); err != nil || v != secret {
+			t.Fatalf("expected %v to be found, got %v, %v", k, v, err)
+		}
+	}
+}
+
+func TestEncryptionMismatch(t *testing.T) {
+	dir := t.TempDir()
+	plain, encrypted := filepath.Join(dir, "plain"), filepath.Join(dir, "encrypted")
+
+	openTree(t, plain, &Options[int]{}).Close()
+	encryptedTree(t, encrypted, KeyRing{1: testKey(1)}).Close()
+
+	if _, err := Open(plain, &Options[int]{Encryption: KeyRing{1: testKey(1)}}); !errors.Is(err, ErrEncryption) {
+		t.Errorf("expected ErrEncryption opening a plain tree with a key, got %v", err)
+	}
+
+	if _, err := Open[int](encrypted, nil); !errors.Is(err, ErrEncryption) {
+		t.Errorf("expected ErrEncryption opening an encrypted tree without keys, got %v", err)
+	}
+
+	if _, err := Open(encrypted, &Options[int]{Encryption: KeyRing{2: testKey(2)}}); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("expected ErrUnknownKey opening an encrypted tree without its key, got %v", err)
+	}
+
+	if _, err := Open(encrypted, &Options[int]{Encryption: KeyRing{1: testKey(2)}}); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("expected ErrCorrupted opening an encrypted tree with a wrong key, got %v", err)
+	}
+}
+
+func TestEncryptedPagesAreBound(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tree")
+	keys := KeyRing{1: testKey(1)}
+
+	bt := encryptedTree(t, path, keys)
+	for k := range 100 {
+		if err := bt.Insert(k, k); err != nil {
+			t.Fatalf("failed to insert %v: %v", k, err)
+		}
+	}
+	bt.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read the tree file: %v", err)
+	}
+
+	// Copies page 1 over page 2. Both are valid pages, but not at the
+	// other's ID.
+	copy(data[2*256:3*256], data[256:2*256])
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatalf("failed to write the tree file: %v", err)
+	}
+
+	r, err := Verify(path, &VerifyOptions{Encryption: keys})
+	if err != nil {
+		t.Fatalf("failed to verify: %v", err)
+	}
+
+	var cerr *CorruptionError
+	if r.OK() || !errors.As(r.Problems[0], &cerr) || cerr.Page != 2 {
+		t.Errorf("expected page 2 to fail authentication, got %v", r.Problems)
+	}
+}
+
+func TestRotateKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tree")
+	keys := KeyRing{1: testKey(1)}
+
+	bt := encryptedTree(t, path, keys)
+	for k := range 300 {
+		if err := bt.Insert(k, k); err != nil {
+			t.Fatalf("failed to insert %v: %v", k, err)
+		}
+	}
+
+	// Overflow chains and free pages are rewritten as well.
+	for k := 300; k < 400; k++ {
+		if err := bt.Insert(k, bytes.Repeat([]byte{byte(k)}, 600)); err != nil {
+			t.Fatalf("failed to insert %v: %v", k, err)
+		}
+	}
+	for k := 300; k < 400; k += 2 {
+		if _, err := bt.Delete(k); err != nil {
+			t.Fatalf("failed to delete %v: %v", k, err)
+		}
+	}
+
+	keys[2] = testKey(2)
+
+	if err := bt.RotateKey(context.Background(), 7); err != nil {
+		t.Fatalf("failed to rotate key: %v", err)
+	}
+
+	if err := bt.Insert(300, 300); err != nil {
+		t.Fatalf("failed to insert after rotating: %v", err)
+	}
+	bt.Close()
+
+	// The first key is no longer needed.
+	delete(keys, 1)
+
+	if r, err := Verify(path, &VerifyOptions{Encryption: keys}); err != nil || !r.OK() {
+		t.Fatalf("expected the tree to verify with the new key, got %v, %v", r, err)
+	}
+
+	bt = encryptedTree(t, path, keys)
+	defer bt.Close()
+
+	for k := range 301 {
+		if v, err := bt.Search(k); err != nil || v != k {
+			t.Fatalf("expected %v to be found, got %v, %v", k, v, err)
+		}
+	}
+
+	for k := 301; k < 400; k += 2 {
+		if v, err := bt.Search(k); err != nil || !bytes.Equal(v.([]byte), bytes.Repeat([]byte{byte(k)}, 600)) {
+			t.Fatalf("expected %v to be found, got %v", k, err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := bt.RotateKey(ctx, 1); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected a canceled rotation, got %v", err)
+	}
+
+	plain := openTree(t, filepath.Join(t.TempDir(), "plain"), &Options[int]{})
+	defer plain.Close()
+
+	if err := plain.RotateKey(context.Background(), 1); !errors.Is(err, ErrEncryption) {
+		t.Errorf("expected ErrEncryption rotating the key of a plain tree, got %v", err)
+	}
+}
+
+func TestRotateKeyDB(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	keys := KeyRing{1: testKey(1)}
+	opts := &Options[string]{PageSize: 512, MinimumDegree: 2, Encryption: keys}
+
+	db := openDB(t, path, opts)
+	for _, name := range []string{"a", "b", "c"} {
+		b := openBucket(t, db, name, &BucketOptions[int]{MinimumDegree: 2})
+		for k := range 200 {
+			if err := b.Insert(k, strings.Repeat(name, k%5*100)); err != nil {
+				t.Fatalf("failed to insert %v in %v: %v", k, name, err)
+			}
+		}
+	}
+
+	keys[2] = testKey(2)
+
+	if err := db.RotateKey(context.Background(), 5); err != nil {
+		t.Fatalf("failed to rotate key: %v", err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("failed to close DB: %v", err)
+	}
+
+	delete(keys, 1)
+
+	if r, err := Verify(path, &VerifyOptions{Encryption: keys}); err != nil || !r.OK() || r.Buckets != 3 {
+		t.Fatalf("expected the DB to verify with the new key, got %v, %v", r, err)
+	}
+
+	db = openDB(t, path, opts)
+	defer db.Close()
+
+	b := openBucket(t, db, "b", &BucketOptions[int]{})
+	for k := range 200 {
+		if v, err := b.Search(k); err != nil || v != strings.Repeat("b", k%5*100) {
+			t.Fatalf("expected %v to be found, got %v, %v", k, v, err)
+		}
+	}
+}
+
+func TestCommandKeys(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no shell")
+	}
+
+	key := hex.EncodeToString(testKey(3))
+	keys := CommandKeys("sh", "-c", `case $1 in current) echo 3 `+key+`;; 3) echo `+key+`;; *) exit 1;; esac`, "keys")
+
+	id, k, err := keys.CurrentKey()
+	if err != nil || id != 3 || !bytes.Equal(k, testKey(3)) {
+		t.Errorf("expected current key 3, got %v, %x, %v", id, k, err)
+	}
+
+	if k, err := keys.Key(3); err != nil || !bytes.Equal(k, testKey(3)) {
+		t.Errorf("expected key 3, got %x, %v", k, err)
+	}
+
+	if _, err := keys.Key(4); err == nil {
+		t.Errorf("expected an unknown key to fail")
+	}
+
+	path := filepath.Join(t.TempDir(), "tree")
+	bt := encryptedTree(t, path, keys)
+
+	if err := bt.Insert(1, 1); err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+
+	if err := bt.Close(); err != nil {
+		t.Fatalf("failed to close tree: %v", err)
+	}
+}
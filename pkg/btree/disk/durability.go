@@ -0,0 +1,257 @@
+package disk
+
+import (
+	"sync"
+	"time"
+)
+
+type durabilityMode int
+
+const (
+	syncEveryWrite durabilityMode = iota
+	groupCommit
+	noSync
+)
+
+// Durability sets when the writes of a tree are synced to disk. Whatever
+// it is, a crash never leaves the tree inconsistent, though it may lose the
+// writes not synced yet.
+type Durability struct {
+	mode     durabilityMode
+	interval time.Duration
+	maxBatch int
+}
+
+var (
+	// SyncEveryWrite syncs the WAL on every write, before it returns. It's
+	// the default.
+	SyncEveryWrite = Durability{mode: syncEveryWrite}
+
+	// NoSync only syncs the WAL on checkpoints, and when the buffer pool
+	// writes pages back to the tree file.
+	NoSync = Durability{mode: noSync}
+)
+
+// GroupCommit syncs the WAL once for all the writes waiting on it: once
+// interval passed since the first of them, or as soon as maxBatch are
+// waiting. Concurrent writers thus share syncs.
+func GroupCommit(interval time.Duration, maxBatch int) Durability {
+	return Durability{mode: groupCommit, interval: interval, maxBatch: max(maxBatch, 1)}
+}
+
+// Commit is the commit of a write, which is durable once done.
+type Commit struct {
+	lsn  uint64
+	done chan struct{}
+	err  error
+}
+
+func (c *Commit) finish(err error) {
+	c.err = err
+	close(c.done)
+}
+
+// Done returns a channel closed once the write is durable, or failed to
+// be.
+func (c *Commit) Done() <-chan struct{} {
+	return c.done
+}
+
+// Wait waits until the write is durable, returning an error if it failed
+// to be synced, in which case the tree must be reopened.
+func (c *Commit) Wait() error {
+	<-c.done
+
+	return c.err
+}
+
+// committer syncs the WAL as the durability requires, completing the
+// commits of the records it syncs. Records are appended under the tree
+// lock, but group commits sync them in the background, without it.
+type committer struct {
+	durability Durability
+	wal        *wal
+
+	// syncing serializes syncs.
+	syncing sync.Mutex
+
+	mutex    sync.Mutex
+	appended uint64
+	synced   uint64
+	waiting  []*Commit
+	failed   error
+
+	first, full, stop chan struct{}
+	stopped           chan struct{}
+}
+
+func newCommitter(w *wal, d Durability) *committer {
+	c := &committer{durability: d, wal: w}
+
+	if d.mode == groupCommit {
+		c.first = make(chan struct{}, 1)
+		c.full = make(chan struct{}, 1)
+		c.stop = make(chan struct{})
+		c.stopped = make(chan struct{})
+
+		go c.run()
+	}
+
+	return c
+}
+
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// run syncs the batches of group commits.
+func (c *committer) run() {
+	defer close(c.stopped)
+
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-c.first:
+		}
+
+		timer := time.NewTimer(c.durability.interval)
+
+		select {
+		case <-c.stop:
+			timer.Stop()
+
+			return
+		case <-timer.C:
+		case <-c.full:
+			timer.Stop()
+		}
+
+		// A batch filling up while syncing is synced along.
+		select {
+		case <-c.full:
+		default:
+		}
+
+		c.sync(0)
+	}
+}
+
+// committed returns the commit of record lsn, just appended to the WAL.
+func (c *committer) committed(lsn uint64) *Commit {
+	commit := &Commit{lsn: lsn, done: make(chan struct{})}
+
+	c.mutex.Lock()
+	c.appended = lsn
+
+	switch {
+	case c.failed != nil:
+		commit.finish(c.failed)
+	case c.durability.mode == noSync:
+		commit.finish(nil)
+	default:
+		c.waiting = append(c.waiting, commit)
+
+		if len(c.waiting) == 1 {
+			signal(c.first)
+		}
+
+		if len(c.waiting) >= c.durability.maxBatch {
+			signal(c.full)
+		}
+	}
+	c.mutex.Unlock()
+
+	if c.durability.mode == syncEveryWrite {
+		c.sync(lsn)
+	}
+
+	return commit
+}
+
+// sync syncs the WAL, unless it's synced up to record lsn already, or up
+// to the last record appended if lsn is 0.
+func (c *committer) sync(lsn uint64) error {
+	c.syncing.Lock()
+	defer c.syncing.Unlock()
+
+	c.mutex.Lock()
+	target, err := c.appended, c.failed
+	if lsn == 0 {
+		lsn = target
+	}
+	done := c.synced >= lsn
+	c.mutex.Unlock()
+
+	if err != nil || done {
+		return err
+	}
+
+	err = c.wal.file.Sync()
+	if err != nil {
+		c.fail(err)
+
+		return err
+	}
+
+	c.durable(target)
+
+	return nil
+}
+
+// durable completes the commits up to record lsn, which is durable.
+func (c *committer) durable(lsn uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.synced = max(c.synced, lsn)
+
+	i := 0
+	for ; i < len(c.waiting) && c.waiting[i].lsn <= c.synced; i++ {
+		c.waiting[i].finish(nil)
+	}
+
+	c.waiting = c.waiting[i:]
+
+	// Commits appended while syncing start the next batch.
+	if len(c.waiting) > 0 && c.first != nil {
+		signal(c.first)
+	}
+}
+
+// fail fails the commits waiting and every one after them.
+func (c *committer) fail(err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.failed == nil {
+		c.failed = err
+	}
+
+	for _, commit := range c.waiting {
+		commit.finish(c.failed)
+	}
+
+	c.waiting = nil
+}
+
+func (c *committer) failure() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.failed
+}
+
+// close stops syncing in the background, failing the commits still
+// waiting.
+func (c *committer) close() {
+	if c.stop != nil {
+		close(c.stop)
+		<-c.stopped
+	}
+
+	c.fail(ErrClosed)
+}
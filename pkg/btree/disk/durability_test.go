@@ -0,0 +1,231 @@
+package disk
+
+import (
+	"errors"
+	"maps"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingFS counts the syncs of its files.
+type countingFS struct {
+	FS
+	syncs atomic.Int64
+}
+
+type countingFile struct {
+	File
+	fs *countingFS
+}
+
+func (fs *countingFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := fs.FS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	return &countingFile{File: f, fs: fs}, nil
+}
+
+func (f *countingFile) Sync() error {
+	f.fs.syncs.Add(1)
+
+	return f.File.Sync()
+}
+
+func TestGroupCommit(t *testing.T) {
+	fs := &countingFS{FS: OSFS}
+	bt := openTree(t, filepath.Join(t.TempDir(), "tree"), &Options[int]{
+		FS:         fs,
+		Durability: GroupCommit(5*time.Millisecond, 8),
+	})
+	defer bt.Close()
+
+	syncs := fs.syncs.Load()
+
+	var wg sync.WaitGroup
+	for w := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for k := range 50 {
+				if err := bt.Insert(w*50+k, k); err != nil {
+					t.Errorf("failed to insert %v: %v", w*50+k, err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Writers waiting together share syncs.
+	if n := fs.syncs.Load() - syncs; n == 0 || n >= 400 {
+		t.Errorf("expected fewer syncs than writes, got %v", n)
+	}
+
+	for k := range 400 {
+		if v, err := bt.Search(k); err != nil || v != k%50 {
+			t.Fatalf("expected %v to be found, got %v, %v", k, v, err)
+		}
+	}
+}
+
+func TestCommitFuture(t *testing.T) {
+	bt := openTree(t, filepath.Join(t.TempDir(), "tree"), &Options[int]{
+		Durability: GroupCommit(time.Hour, 100),
+	})
+
+	commit, err := bt.InsertAsync(1, 1)
+	if err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+
+	select {
+	case <-commit.Done():
+		t.Fatalf("expected the commit to wait for its group")
+	default:
+	}
+
+	// The write is visible before it's durable.
+	if v, err := bt.Search(1); err != nil || v != 1 {
+		t.Fatalf("expected 1 to be found, got %v, %v", v, err)
+	}
+
+	v, deleted, err := bt.DeleteAsync(1)
+	if err != nil || v != 1 {
+		t.Fatalf("expected 1 to be deleted, got %v, %v", v, err)
+	}
+
+	// Checkpoints make every write durable.
+	if err := bt.Checkpoint(); err != nil {
+		t.Fatalf("failed to checkpoint: %v", err)
+	}
+
+	if err := commit.Wait(); err != nil {
+		t.Errorf("expected the commit to succeed, got %v", err)
+	}
+
+	if err := deleted.Wait(); err != nil {
+		t.Errorf("expected the commit to succeed, got %v", err)
+	}
+
+	if err := bt.Close(); err != nil {
+		t.Fatalf("failed to close tree: %v", err)
+	}
+
+	bt = openTree(t, filepath.Join(t.TempDir(), "tree"), &Options[int]{Durability: NoSync})
+	defer bt.Close()
+
+	if commit, err = bt.InsertAsync(1, 1); err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+
+	select {
+	case <-commit.Done():
+	default:
+		t.Errorf("expected the commit not to wait")
+	}
+}
+
+func TestCrashRecoveryDurability(t *testing.T) {
+	for _, d := range []Durability{NoSync, GroupCommit(time.Microsecond, 1)} {
+		for seed := range int64(40) {
+			r := rand.New(rand.NewSource(seed))
+			fs := newMemFS(1 + r.Intn(2000))
+			opts := &Options[int]{
+				PageSize:       256,
+				MinimumDegree:  2,
+				FS:             fs,
+				CheckpointSize: 8 << 10,
+				CacheSize:      16 * 256,
+				Durability:     d,
+			}
+
+			bt, err := Open[int]("tree", opts)
+			if errors.Is(err, errCrashed) {
+				continue
+			} else if err != nil {
+				t.Fatalf("seed %v: failed to open tree: %v", seed, err)
+			}
+
+			// The states after each write, and the number of writes
+			// that returned.
+			states := []map[int]int{{}}
+			acknowledged := 0
+
+			for range 500 {
+				k := r.Intn(100)
+				state := maps.Clone(states[len(states)-1])
+
+				if r.Intn(3) == 0 {
+					delete(state, k)
+					states = append(states, state)
+					_, err = bt.Delete(k)
+				} else {
+					state[k] = r.Int()
+					states = append(states, state)
+					err = bt.Insert(k, state[k])
+				}
+
+				if err != nil {
+					break
+				}
+
+				acknowledged++
+			}
+
+			if err != nil && !errors.Is(err, errCrashed) {
+				t.Fatalf("seed %v: unexpected error: %v", seed, err)
+			}
+
+			opts.FS = fs.crash(r)
+
+			bt, err = Open[int]("tree", opts)
+			if err != nil {
+				t.Fatalf("seed %v: failed to recover tree: %v", seed, err)
+			}
+
+			checkInvariants(t, bt)
+
+			recovered := map[int]int{}
+			for k := range 100 {
+				v, err := bt.Search(k)
+				if err != nil {
+					t.Fatalf("seed %v: failed to search %v: %v", seed, k, err)
+				}
+
+				if v != nil {
+					recovered[k] = v.(int)
+				}
+			}
+
+			// The tree is as it was after some of the writes, which
+			// include the acknowledged ones unless nothing is synced.
+			first := 0
+			if d.mode != noSync {
+				first = acknowledged
+			}
+
+			found := false
+			for _, state := range states[first:] {
+				if maps.Equal(state, recovered) {
+					found = true
+
+					break
+				}
+			}
+
+			if !found {
+				t.Fatalf("seed %v, durability %v: recovered tree matches no state after write %v",
+					seed, d.mode, first)
+			}
+
+			bt.Close()
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package disk
+
+import "container/list"
+
+// Eviction decides which page the buffer pool drops when it's full.
+type Eviction int
+
+const (
+	// EvictLRU drops the least recently used page.
+	EvictLRU Eviction = iota
+	// EvictClock approximates LRU with a reference bit per page, swept by
+	// a clock hand.
+	EvictClock
+	// Evict2Q keeps pages read only once in a FIFO queue, apart from the
+	// ones read again, so scans don't flush the pages used the most.
+	Evict2Q
+)
+
+// replacer tracks the resident pages of the buffer pool for an Eviction.
+type replacer interface {
+	insert(id pageID)
+	access(id pageID)
+	// victim picks a page to evict among the evictable ones, without
+	// removing it.
+	victim(evictable func(id pageID) bool) (pageID, bool)
+	remove(id pageID)
+}
+
+func newReplacer(e Eviction, capacity int) replacer {
+	switch e {
+	case EvictClock:
+		return newClock()
+	case Evict2Q:
+		return new2Q(capacity)
+	default:
+		return newLRU()
+	}
+}
+
+type lru struct {
+	list  *list.List
+	elems map[pageID]*list.Element
+}
+
+func newLRU() *lru {
+	return &lru{list: list.New(), elems: map[pageID]*list.Element{}}
+}
+
+func (r *lru) insert(id pageID) {
+	r.elems[id] = r.list.PushFront(id)
+}
+
+func (r *lru) access(id pageID) {
+	r.list.MoveToFront(r.elems[id])
+}
+
+func (r *lru) victim(evictable func(id pageID) bool) (pageID, bool) {
+	for e := r.list.Back(); e != nil; e = e.Prev() {
+		if id := e.Value.(pageID); evictable(id) {
+			return id, true
+		}
+	}
+
+	return 0, false
+}
+
+func (r *lru) remove(id pageID) {
+	r.list.Remove(r.elems[id])
+	delete(r.elems, id)
+}
+
+type clockSlot struct {
+	id   pageID
+	used bool
+	ref  bool
+}
+
+type clock struct {
+	slots []clockSlot
+	index map[pageID]int
+	free  []int
+	hand  int
+}
+
+func newClock() *clock {
+	return &clock{index: map[pageID]int{}}
+}
+
+func (r *clock) insert(id pageID) {
+	i := len(r.slots)
+	if len(r.free) > 0 {
+		i, r.free = r.free[len(r.free)-1], r.free[:len(r.free)-1]
+	} else {
+		r.slots = append(r.slots, clockSlot{})
+	}
+
+	r.slots[i] = clockSlot{id: id, used: true, ref: true}
+	r.index[id] = i
+}
+
+func (r *clock) access(id pageID) {
+	r.slots[r.index[id]].ref = true
+}
+
+func (r *clock) victim(evictable func(id pageID) bool) (pageID, bool) {
+	if len(r.slots) == 0 {
+		return 0, false
+	}
+
+	// A sweep clears every reference bit, so the next one finds a victim
+	// if there is one.
+	for range 2*len(r.slots) + 1 {
+		s := &r.slots[r.hand]
+		r.hand = (r.hand + 1) % len(r.slots)
+
+		if !s.used || !evictable(s.id) {
+			continue
+		}
+
+		if s.ref {
+			s.ref = false
+
+			continue
+		}
+
+		return s.id, true
+	}
+
+	return 0, false
+}
+
+func (r *clock) remove(id pageID) {
+	i := r.index[id]
+
+	r.slots[i] = clockSlot{}
+	r.free = append(r.free, i)
+	delete(r.index, id)
+}
+
+// twoQ is the full 2Q algorithm: pages enter a FIFO queue, and only the
+// ones read again after leaving it, while still remembered in the ghost
+// queue, get into the main LRU one.
+type twoQ struct {
+	in, main *lru
+	out      *list.List
+	ghosts   map[pageID]*list.Element
+	kin      int
+	kout     int
+}
+
+func new2Q(capacity int) *twoQ {
+	return &twoQ{
+		in:     newLRU(),
+		main:   newLRU(),
+		out:    list.New(),
+		ghosts: map[pageID]*list.Element{},
+		kin:    max(capacity/4, 1),
+		kout:   max(capacity/2, 1),
+	}
+}
+
+func (r *twoQ) insert(id pageID) {
+	if g, ok := r.ghosts[id]; ok {
+		r.out.Remove(g)
+		delete(r.ghosts, id)
+
+		r.main.insert(id)
+
+		return
+	}
+
+	r.in.insert(id)
+}
+
+func (r *twoQ) access(id pageID) {
+	if _, ok := r.main.elems[id]; ok {
+		r.main.access(id)
+	}
+}
+
+func (r *twoQ) victim(evictable func(id pageID) bool) (pageID, bool) {
+	if r.in.list.Len() > r.kin {
+		if id, ok := r.in.victim(evictable); ok {
+			return id, true
+		}
+	}
+
+	if id, ok := r.main.victim(evictable); ok {
+		return id, true
+	}
+
+	return r.in.victim(evictable)
+}
+
+func (r *twoQ) remove(id pageID) {
+	if _, ok := r.main.elems[id]; ok {
+		r.main.remove(id)
+
+		return
+	}
+
+	r.in.remove(id)
+
+	r.ghosts[id] = r.out.PushFront(id)
+	if r.out.Len() > r.kout {
+		g := r.out.Back()
+		r.out.Remove(g)
+		delete(r.ghosts, g.Value.(pageID))
+	}
+}
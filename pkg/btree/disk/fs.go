@@ -0,0 +1,91 @@
+package disk
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	iofs "io/fs"
+	"os"
+)
+
+// File is the part of *os.File used by the tree.
+type File interface {
+	io.ReaderAt
+	io.WriterAt
+	Size() (int64, error)
+	Truncate(size int64) error
+	Sync() error
+	Close() error
+}
+
+// FS opens the files of a tree. It's meant to be replaced in tests, e.g. to
+// simulate crashes.
+type FS interface {
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Remove(name string) error
+}
+
+// SparseFile is a File that can deallocate ranges of itself, which then
+// read as zeros. Compressed trees deallocate the end of the pages they store
+// short of their size when their file is one, as the ones of OSFS are on
+// Linux.
+type SparseFile interface {
+	File
+	// BlockSize returns the size of the blocks the file is allocated by.
+	BlockSize() (int64, error)
+	// PunchHole deallocates size bytes from off, whole blocks, keeping the
+	// size of the file. It returns errors.ErrUnsupported if the file system
+	// can't.
+	PunchHole(off, size int64) error
+	// Allocated returns the number of bytes allocated to the file.
+	Allocated() (int64, error)
+}
+
+type osFile struct {
+	*os.File
+}
+
+func (f osFile) Size() (int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	return info.Size(), nil
+}
+
+type osFS struct{}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	return osFile{f}, nil
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+// OSFS is the FS of the operating system.
+var OSFS FS = osFS{}
+
+func removeIfExists(name string) error {
+	if err := os.Remove(name); err != nil && !errors.Is(err, iofs.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// syncDir syncs the directory at path, making renames in it durable.
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("disk: failed to sync %v: %w", path, err)
+	}
+
+	return errors.Join(dir.Sync(), dir.Close())
+}
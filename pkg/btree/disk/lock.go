@@ -0,0 +1,285 @@
+package disk
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	iofs "io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Trees on the file system of the operating system are locked against
+// other processes through a lock file next to them, at path+"-lock":
+// writers lock it exclusively, and read-only openers shared, so a tree is
+// open by a single writing process or by any number of reading ones. Locks
+// are held by processes, which share them between the readers they open,
+// and follow the same rule within a process: a tree it writes can't be
+// mapped by it, nor one it maps written, as mapped readers don't see the
+// pages a writer moves or frees. Locks are released by the system when
+// their holder exits, so they never go stale, and holders write their PID
+// to the lock file to be named by the processes they keep out, blanking it
+// once they let go. Locks are only taken on unix platforms.
+
+var ErrLocked = errors.New("disk: tree is locked")
+
+// errLockHeld is returned by flock when another lock is in the way.
+var errLockHeld = errors.New("disk: lock is held")
+
+// processLock is the lock a process holds on a tree, for either its writer
+// or its readers.
+type processLock struct {
+	file    *os.File
+	writer  bool
+	readers int
+	// pid is the offset of the line holding the PID of the process in the
+	// lock file, or -1 if it wrote none.
+	pid int64
+}
+
+var (
+	locksMutex sync.Mutex
+	// locks holds the locks of the process by the absolute path of their
+	// lock file.
+	locks = map[string]*processLock{}
+)
+
+// fileLock is the part of the lock of a tree held by one of its openers.
+type fileLock struct {
+	path   string
+	shared bool
+}
+
+// lockFile takes the lock of the tree at path, shared or exclusive,
+// failing with ErrLocked if another process holds it, or if the process
+// already has a writer open, or readers for an exclusive one.
+func lockFile(path string, shared bool) (*fileLock, error) {
+	path, err := filepath.Abs(path + "-lock")
+	if err != nil {
+		return nil, err
+	}
+
+	locksMutex.Lock()
+	defer locksMutex.Unlock()
+
+	l := locks[path]
+
+	switch {
+	case l == nil:
+		if l, err = openLock(path, shared); err != nil {
+			return nil, err
+		}
+
+		locks[path] = l
+	case l.writer || !shared:
+		return nil, lockedBy(holders(l.file))
+	}
+
+	if shared {
+		l.readers++
+	} else {
+		l.writer = true
+	}
+
+	return &fileLock{path: path, shared: shared}, nil
+}
+
+// openLock opens the lock file at path and locks it. Lock files are only
+// removed by their holder, so the one locked is opened again if it was
+// removed meanwhile, as no one else would lock it anymore.
+func openLock(path string, shared bool) (*processLock, error) {
+	for {
+		file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("disk: failed to open the lock file: %w", err)
+		}
+
+		l := &processLock{file: file, pid: -1}
+		if err := l.take(shared); err != nil {
+			return nil, errors.Join(err, file.Close())
+		}
+
+		locked, err := file.Stat()
+		if err != nil {
+			return nil, errors.Join(err, file.Close())
+		}
+
+		current, err := os.Stat(path)
+		if err != nil && !errors.Is(err, iofs.ErrNotExist) {
+			return nil, errors.Join(err, file.Close())
+		}
+
+		if err == nil && os.SameFile(locked, current) {
+			return l, nil
+		}
+
+		if err := file.Close(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// take locks the lock file, writing the PID of the process to it.
+func (l *processLock) take(shared bool) error {
+	if err := flock(l.file, shared); err != nil {
+		if errors.Is(err, errLockHeld) {
+			err = lockedBy(holders(l.file))
+		}
+
+		return err
+	}
+
+	// Readers append their PID, and writers empty the file first.
+	line := pidLine()
+
+	var err error
+	if !shared {
+		err = l.file.Truncate(0)
+	}
+	if err == nil {
+		_, err = l.file.WriteString(line)
+	}
+	if err == nil {
+		l.pid, err = l.file.Seek(0, io.SeekCurrent)
+		l.pid -= int64(len(line))
+	}
+	if err != nil {
+		return fmt.Errorf("disk: failed to write the lock file: %w", err)
+	}
+
+	return nil
+}
+
+func pidLine() string {
+	return fmt.Sprintf("%d\n", os.Getpid())
+}
+
+// close blanks the PID of the process in the lock file, if still there,
+// so that it's no longer named once it closes the tree, and closes it. PIDs
+// are overwritten in place, through another descriptor as the lock file is
+// appended to, since the processes holding it alongside append theirs.
+func (l *processLock) close() error {
+	if l.pid < 0 {
+		return l.file.Close()
+	}
+
+	file, err := os.OpenFile(l.file.Name(), os.O_RDWR, 0)
+	if err != nil {
+		return errors.Join(err, l.file.Close())
+	}
+
+	line := pidLine()
+
+	// A writer of another process may have emptied the file since.
+	buf := make([]byte, len(line))
+	if _, err := file.ReadAt(buf, l.pid); err == nil && string(buf) == line {
+		_, err = file.WriteAt([]byte(strings.Repeat(" ", len(line)-1)+"\n"), l.pid)
+		if err != nil {
+			err = fmt.Errorf("disk: failed to write the lock file: %w", err)
+		}
+
+		return errors.Join(err, file.Close(), l.file.Close())
+	}
+
+	return errors.Join(file.Close(), l.file.Close())
+}
+
+// holders returns the PIDs the lock file holds of processes still running.
+func holders(file *os.File) []int {
+	var pids []int
+
+	// Appending moved the offset of files the process wrote its PID to.
+	s := bufio.NewScanner(io.NewSectionReader(file, 0, 1<<20))
+	for s.Scan() {
+		if pid, err := strconv.Atoi(s.Text()); err == nil && running(pid) {
+			pids = append(pids, pid)
+		}
+	}
+
+	return pids
+}
+
+func lockedBy(pids []int) error {
+	if len(pids) == 0 {
+		return ErrLocked
+	}
+
+	names := make([]string, len(pids))
+	for i, pid := range pids {
+		names[i] = strconv.Itoa(pid)
+	}
+
+	plural := ""
+	if len(pids) > 1 {
+		plural = "es"
+	}
+
+	return fmt.Errorf("%w: held by process%s %v", ErrLocked, plural, strings.Join(names, ", "))
+}
+
+// unlock releases the lock, if any, letting other processes and the process
+// itself write the tree once it has no reader open, and open it once it has
+// no writer.
+func (fl *fileLock) unlock() error {
+	return fl.release(false)
+}
+
+// lockOffline locks the tree at path as a writer, for functions writing its
+// file while it isn't open, and returns the function releasing the lock.
+// It leaves no lock file behind: the one it creates is removed then.
+func lockOffline(path string) (func() error, error) {
+	_, err := os.Stat(path + "-lock")
+	if err != nil && !errors.Is(err, iofs.ErrNotExist) {
+		return nil, err
+	}
+
+	created := err != nil
+
+	fl, err := lockFile(path, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() error {
+		return fl.release(created)
+	}, nil
+}
+
+// release releases the lock, removing the lock file if remove is set and
+// the process no longer holds it.
+func (fl *fileLock) release(remove bool) error {
+	if fl == nil {
+		return nil
+	}
+
+	locksMutex.Lock()
+	defer locksMutex.Unlock()
+
+	l := locks[fl.path]
+
+	if fl.shared {
+		l.readers--
+	} else {
+		l.writer = false
+	}
+
+	if l.readers > 0 {
+		return nil
+	}
+
+	delete(locks, fl.path)
+
+	// Removing the lock file while holding it keeps other processes from
+	// locking the one removed.
+	var err error
+	if remove {
+		err = os.Remove(fl.path)
+		l.pid = -1
+	}
+
+	return errors.Join(err, l.close())
+}
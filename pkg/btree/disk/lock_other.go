@@ -0,0 +1,13 @@
+//go:build !unix
+
+package disk
+
+import "os"
+
+func flock(f *os.File, shared bool) error {
+	return nil
+}
+
+func running(pid int) bool {
+	return true
+}
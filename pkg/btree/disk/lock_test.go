@@ -0,0 +1,240 @@
+//go:build unix
+
+package disk
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestLockHelper isn't a test of its own: lockingProcess runs it in another
+// process, to hold the lock of a tree until its stdin is closed.
+func TestLockHelper(t *testing.T) {
+	path := os.Getenv("BTREE_LOCK_PATH")
+	if path == "" {
+		t.Skip("only run by lockingProcess")
+	}
+
+	bt, err := Open(path, &Options[int]{Mmap: os.Getenv("BTREE_LOCK_MMAP") != ""})
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	fmt.Println("locked")
+	io.Copy(io.Discard, os.Stdin)
+
+	bt.Close()
+	os.Exit(0)
+}
+
+// lockingProcess starts a process opening the tree at path, mapped if mmap
+// is set, and returns it once it holds the lock. Closing its stdin makes it
+// close the tree and exit.
+func lockingProcess(t *testing.T, path string, mmap bool) (*exec.Cmd, io.Closer) {
+	cmd, stdin, line := helperProcess(t, path, mmap)
+	if line != "locked\n" {
+		t.Fatalf("expected the helper to lock the tree, got %q", line)
+	}
+
+	return cmd, stdin
+}
+
+// helperProcess starts a process opening the tree at path, mapped if mmap
+// is set, and returns it along with the first line it prints: "locked" or
+// the error opening the tree.
+func helperProcess(t *testing.T, path string, mmap bool) (*exec.Cmd, io.Closer, string) {
+	cmd := exec.Command(os.Args[0], "-test.run=^TestLockHelper$")
+	cmd.Env = append(os.Environ(), "BTREE_LOCK_PATH="+path)
+	if mmap {
+		cmd.Env = append(cmd.Env, "BTREE_LOCK_MMAP=1")
+	}
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatalf("failed to pipe stdin: %v", err)
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatalf("failed to pipe stdout: %v", err)
+	}
+
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("failed to start helper: %v", err)
+	}
+
+	t.Cleanup(func() {
+		stdin.Close()
+		cmd.Wait()
+	})
+
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatalf("failed to read from helper: %v", err)
+	}
+
+	return cmd, stdin, line
+}
+
+func expectLocked(t *testing.T, err error, pid int) {
+	t.Helper()
+
+	if !errors.Is(err, ErrLocked) || !slices.Contains(lockHolders(err.Error()), strconv.Itoa(pid)) {
+		t.Errorf("expected ErrLocked naming process %v, got %v", pid, err)
+	}
+}
+
+// lockHolders returns the PIDs named by the ErrLocked message msg.
+func lockHolders(msg string) []string {
+	_, pids, _ := strings.Cut(msg, "held by process")
+
+	return strings.FieldsFunc(strings.TrimPrefix(pids, "es"), func(r rune) bool {
+		return r == ' ' || r == ',' || r == '\n'
+	})
+}
+
+func TestLockWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tree")
+	openTree(t, path, &Options[int]{}).Close()
+
+	cmd, stdin := lockingProcess(t, path, false)
+
+	_, err := Open[int](path, nil)
+	expectLocked(t, err, cmd.Process.Pid)
+
+	_, err = Open(path, &Options[int]{Mmap: true})
+	expectLocked(t, err, cmd.Process.Pid)
+
+	stdin.Close()
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("helper failed: %v", err)
+	}
+
+	bt := openTree(t, path, &Options[int]{})
+	defer bt.Close()
+
+	// Trees the process writes can't be mapped by it either.
+	_, err = Open(path, &Options[int]{Mmap: true})
+	expectLocked(t, err, os.Getpid())
+
+	_, err = Open[int](path, nil)
+	expectLocked(t, err, os.Getpid())
+}
+
+func TestLockReaders(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tree")
+	openTree(t, path, &Options[int]{}).Close()
+
+	first, _ := lockingProcess(t, path, true)
+	second, _ := lockingProcess(t, path, true)
+
+	mapped := openTree(t, path, &Options[int]{Mmap: true})
+	defer mapped.Close()
+
+	_, err := Open[int](path, nil)
+	expectLocked(t, err, first.Process.Pid)
+	expectLocked(t, err, second.Process.Pid)
+}
+
+func TestLockReleasedOnExit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tree")
+	openTree(t, path, &Options[int]{}).Close()
+
+	cmd, _ := lockingProcess(t, path, false)
+
+	if err := cmd.Process.Kill(); err != nil {
+		t.Fatalf("failed to kill helper: %v", err)
+	}
+	cmd.Wait()
+
+	bt := openTree(t, path, &Options[int]{})
+	defer bt.Close()
+}
+
+func TestLockMappedByProcess(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tree")
+	openTree(t, path, &Options[int]{}).Close()
+
+	other, stdin := lockingProcess(t, path, true)
+
+	mapped := openTree(t, path, &Options[int]{Mmap: true})
+
+	// Trees the process maps can't be written by it, nor by another one
+	// once the others have let go.
+	_, err := Open[int](path, nil)
+	expectLocked(t, err, os.Getpid())
+
+	stdin.Close()
+	if err := other.Wait(); err != nil {
+		t.Fatalf("helper failed: %v", err)
+	}
+
+	_, err = Open[int](path, nil)
+	expectLocked(t, err, os.Getpid())
+
+	_, _, line := helperProcess(t, path, false)
+	if !strings.Contains(line, ErrLocked.Error()) || !slices.Contains(lockHolders(line), strconv.Itoa(os.Getpid())) {
+		t.Errorf("expected another process to fail to write the tree, got %q", line)
+	}
+
+	if err := mapped.Close(); err != nil {
+		t.Fatalf("failed to close tree: %v", err)
+	}
+
+	openTree(t, path, &Options[int]{}).Close()
+}
+
+func TestLockForgetsClosed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tree")
+	openTree(t, path, &Options[int]{}).Close()
+
+	openTree(t, path, &Options[int]{Mmap: true}).Close()
+
+	other, _ := lockingProcess(t, path, true)
+
+	if _, err := Verify(path, nil); err != nil {
+		t.Fatalf("failed to verify tree: %v", err)
+	}
+
+	_, err := Open[int](path, nil)
+	expectLocked(t, err, other.Process.Pid)
+
+	if slices.Contains(lockHolders(err.Error()), strconv.Itoa(os.Getpid())) {
+		t.Errorf("expected closed readers not to be named, got %v", err)
+	}
+}
+
+func TestLockRestoreAndVerify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tree")
+	openTree(t, path, &Options[int]{}).Close()
+
+	cmd, _ := lockingProcess(t, path, false)
+
+	_, err := Verify(path, nil)
+	expectLocked(t, err, cmd.Process.Pid)
+
+	var full bytes.Buffer
+	err = Restore(path, &full)
+	expectLocked(t, err, cmd.Process.Pid)
+}
+
+func TestLockRestoreTo(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tree")
+	openTree(t, path, &Options[int]{}).Close()
+
+	cmd, _ := lockingProcess(t, path, true)
+
+	_, err := RestoreTo(path, t.TempDir(), RecoveryTarget{})
+	expectLocked(t, err, cmd.Process.Pid)
+}
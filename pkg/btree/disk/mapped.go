@@ -0,0 +1,74 @@
+package disk
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/franciscosbf/b-tree-go/pkg/btree/codec"
+)
+
+// openMapped opens the tree at path read-only, mapping its file in memory.
+// It shares the lock of the tree with other readers.
+func openMapped[K any](
+	path string, keys codec.KeyCodec[K], values codec.ValueCodec[any], crypt *crypter, catalog bool,
+) (*BTree[K], error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	lock, err := lockFile(path, true)
+	if err != nil {
+		return nil, errors.Join(err, file.Close())
+	}
+
+	overlay, err := readWAL(OSFS, path+"-wal")
+	if err != nil {
+		return nil, errors.Join(err, file.Close(), lock.unlock())
+	}
+
+	bt := &BTree[K]{
+		pager:    &pager{file: osFile{file}, crypt: crypt, overlay: overlay.pages},
+		dirty:    map[pageID]*node{},
+		keys:     keys,
+		values:   values,
+		readOnly: true,
+		catalog:  catalog,
+		lock:     lock,
+	}
+
+	if err := bt.openMapped(file); err != nil {
+		return nil, errors.Join(err, bt.pager.close(), lock.unlock())
+	}
+
+	return bt, nil
+}
+
+func (bt *BTree[K]) openMapped(file *os.File) error {
+	size, err := bt.pager.file.Size()
+	if err != nil {
+		return err
+	}
+
+	if size > 0 {
+		if bt.pager.mapped, err = mmap(file, int(size)); err != nil {
+			return fmt.Errorf("disk: failed to map %v: %w", file.Name(), err)
+		}
+	}
+
+	m, err := bt.pager.readMeta()
+	if err != nil {
+		return err
+	}
+
+	if err := bt.checkFile(m); err != nil {
+		return err
+	}
+
+	bt.meta = m
+	bt.t = int(m.degree)
+	bt.maxEntry = maxEntrySize(bt.pager.nodeSpace(), bt.t)
+
+	return nil
+}
@@ -0,0 +1,142 @@
+//go:build unix
+
+package disk
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestMmap(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tree")
+
+	bt := openTree(t, path, &Options[int]{PageSize: 256, MinimumDegree: 2})
+	for k := range 500 {
+		if err := bt.Insert(k, k); err != nil {
+			t.Fatalf("failed to insert %v: %v", k, err)
+		}
+	}
+
+	if err := bt.Checkpoint(); err != nil {
+		t.Fatalf("failed to checkpoint: %v", err)
+	}
+
+	// Left only in the WAL, which the mapped trees read into memory.
+	for k := range 100 {
+		if _, err := bt.Delete(k); err != nil {
+			t.Fatalf("failed to delete %v: %v", k, err)
+		}
+	}
+
+	// Trees open for writing can't be mapped, so the copy left as by a
+	// crash is, and both trees share its mapping.
+	path = copyTree(t, path)
+
+	mapped := []*BTree[int]{
+		openTree(t, path, &Options[int]{Mmap: true}),
+		openTree(t, path, &Options[int]{Mmap: true}),
+	}
+
+	for _, m := range mapped {
+		checkInvariants(t, m)
+
+		for k := range 500 {
+			v, err := m.Search(k)
+			if err != nil {
+				t.Fatalf("failed to search %v: %v", k, err)
+			}
+
+			if k < 100 && v != nil || k >= 100 && v != k {
+				t.Fatalf("unexpected value of %v: %v", k, v)
+			}
+		}
+
+		if err := m.Insert(1000, 1000); !errors.Is(err, ErrReadOnly) {
+			t.Fatalf("expected %v on insert, got %v", ErrReadOnly, err)
+		}
+
+		if _, err := m.Delete(200); !errors.Is(err, ErrReadOnly) {
+			t.Fatalf("expected %v on delete, got %v", ErrReadOnly, err)
+		}
+
+		if err := m.Vacuum(); !errors.Is(err, ErrReadOnly) {
+			t.Fatalf("expected %v on vacuum, got %v", ErrReadOnly, err)
+		}
+
+		if err := m.Checkpoint(); !errors.Is(err, ErrReadOnly) {
+			t.Fatalf("expected %v on checkpoint, got %v", ErrReadOnly, err)
+		}
+
+		if err := m.Close(); err != nil {
+			t.Fatalf("failed to close mapped tree: %v", err)
+		}
+
+		if _, err := m.Search(200); !errors.Is(err, ErrClosed) {
+			t.Fatalf("expected %v, got %v", ErrClosed, err)
+		}
+	}
+
+	if err := bt.Close(); err != nil {
+		t.Fatalf("failed to close tree: %v", err)
+	}
+}
+
+func TestMmapMissingFile(t *testing.T) {
+	if _, err := Open[int](filepath.Join(t.TempDir(), "tree"), &Options[int]{Mmap: true}); err == nil {
+		t.Fatalf("expected mapping a missing file to fail")
+	}
+}
+
+func TestMmapEncrypted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tree")
+	keys := KeyRing{1: testKey(1)}
+
+	bt := encryptedTree(t, path, keys)
+	defer bt.Close()
+
+	for k := range 200 {
+		if err := bt.Insert(k, k); err != nil {
+			t.Fatalf("failed to insert %v: %v", k, err)
+		}
+	}
+
+	m := openTree(t, copyTree(t, path), &Options[int]{Mmap: true, Encryption: keys})
+	defer m.Close()
+
+	checkInvariants(t, m)
+
+	for k := range 200 {
+		if v, err := m.Search(k); err != nil || v != k {
+			t.Fatalf("expected %v to be found, got %v, %v", k, v, err)
+		}
+	}
+}
+
+func TestMmapCompressed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tree")
+
+	bt := openTree(t, path, &Options[int]{PageSize: 256, MinimumDegree: 2, Compression: CompressZlib})
+	defer bt.Close()
+
+	for k := range 200 {
+		if err := bt.Insert(k, k); err != nil {
+			t.Fatalf("failed to insert %v: %v", k, err)
+		}
+	}
+
+	if err := bt.Checkpoint(); err != nil {
+		t.Fatalf("failed to checkpoint: %v", err)
+	}
+
+	m := openTree(t, copyTree(t, path), &Options[int]{Mmap: true})
+	defer m.Close()
+
+	checkInvariants(t, m)
+
+	for k := range 200 {
+		if v, err := m.Search(k); err != nil || v != k {
+			t.Fatalf("expected %v to be found, got %v, %v", k, v, err)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package disk
+
+import "os"
+
+// FormatVersion returns the format version of the tree file at path, which
+// may be one this package doesn't read.
+func FormatVersion(path string) (int, error) {
+	buf, err := readHeader(path)
+	if err != nil {
+		return 0, err
+	}
+
+	if [7]byte(buf[:7]) != magic {
+		return 0, ErrNotTreeFile
+	}
+
+	return int(buf[7]), nil
+}
+
+// readHeader reads the fixed part of the meta page of the tree file at
+// path, which is stored as is whether the tree is encrypted or not.
+func readHeader(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	buf := make([]byte, metaSize)
+	if _, err := file.ReadAt(buf, 0); err != nil {
+		return nil, ErrNotTreeFile
+	}
+
+	return buf, nil
+}
+
+// readMetaHeader decodes the fixed part of the meta page of the tree file
+// at path.
+func readMetaHeader(path string) (*meta, error) {
+	buf, err := readHeader(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeMeta(buf)
+}
+
+// Migrate upgrades the tree file at path to the current format, in place.
+// Version 1 is the only format so far, so there's nothing to upgrade yet:
+// Migrate checks that the file is a tree file of version 1, failing with
+// ErrFormatVersion for other versions. Empty files are left as they are.
+func Migrate(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	} else if info.Size() == 0 {
+		return nil
+	}
+
+	_, err = readMetaHeader(path)
+
+	return err
+}
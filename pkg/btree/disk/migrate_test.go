@@ -0,0 +1,115 @@
+package disk
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/franciscosbf/b-tree-go/pkg/btree/codec"
+)
+
+func fileVersion(t *testing.T, path string) int {
+	version, err := FormatVersion(path)
+	if err != nil {
+		t.Fatalf("failed to read the format version of %v: %v", path, err)
+	}
+
+	return version
+}
+
+func TestMigrate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tree")
+
+	// Empty files have nothing to migrate.
+	if err := os.WriteFile(path, nil, 0o644); err != nil {
+		t.Fatalf("failed to write %v: %v", path, err)
+	}
+	if err := Migrate(path); err != nil {
+		t.Fatalf("failed to migrate an empty file: %v", err)
+	}
+
+	bt := openTree(t, path, &Options[int]{})
+	for k := range 100 {
+		if err := bt.Insert(k, k); err != nil {
+			t.Fatalf("failed to insert %v: %v", k, err)
+		}
+	}
+
+	if err := bt.Close(); err != nil {
+		t.Fatalf("failed to close tree: %v", err)
+	}
+
+	if err := Migrate(path); err != nil {
+		t.Fatalf("failed to migrate a current tree: %v", err)
+	}
+
+	if v := fileVersion(t, path); v != formatVersion {
+		t.Errorf("expected version %v, got %v", formatVersion, v)
+	}
+
+	other := filepath.Join(t.TempDir(), "other")
+	if err := os.WriteFile(other, []byte("not a tree"), 0o644); err != nil {
+		t.Fatalf("failed to write %v: %v", other, err)
+	}
+
+	if err := Migrate(other); !errors.Is(err, ErrNotTreeFile) {
+		t.Errorf("expected ErrNotTreeFile migrating another file, got %v", err)
+	}
+}
+
+func TestNewerFormat(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tree")
+	openTree(t, path, &Options[int]{}).Close()
+
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("failed to open %v: %v", path, err)
+	}
+	if _, err := file.WriteAt([]byte{formatVersion + 1}, 7); err != nil {
+		t.Fatalf("failed to write %v: %v", path, err)
+	}
+	file.Close()
+
+	if _, err := Open(path, &Options[int]{}); !errors.Is(err, ErrFormatVersion) {
+		t.Errorf("expected ErrFormatVersion, got %v", err)
+	}
+
+	if err := Migrate(path); !errors.Is(err, ErrFormatVersion) {
+		t.Errorf("expected ErrFormatVersion migrating, got %v", err)
+	}
+
+	if v := fileVersion(t, path); v != formatVersion+1 {
+		t.Errorf("expected version %v, got %v", formatVersion+1, v)
+	}
+}
+
+func TestCodecMismatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tree")
+	openTree(t, path, &Options[int]{}).Close()
+
+	bt, err := Open(path, &Options[int]{Keys: codec.Ordered[int]()})
+	if err != nil {
+		t.Fatalf("expected the same codecs to open the tree, got %v", err)
+	}
+	bt.Close()
+
+	if _, err := Open(path, &Options[uint32]{}); !errors.Is(err, ErrCodecMismatch) {
+		t.Errorf("expected ErrCodecMismatch opening with another key codec, got %v", err)
+	}
+
+	_, err = Open(path, &Options[int]{Mmap: true, Values: codec.Any(codec.JSON[int]())})
+	if !errors.Is(err, ErrCodecMismatch) {
+		t.Errorf("expected ErrCodecMismatch mapping with another value codec, got %v", err)
+	}
+
+	// Unnamed codecs aren't checked.
+	raw, err := Open(path, &Options[[]byte]{
+		Keys:   rawCodec{codec.Bytes()},
+		Values: codec.Any[[]byte](rawCodec{codec.Bytes()}),
+	})
+	if err != nil {
+		t.Fatalf("expected unnamed codecs to open the tree, got %v", err)
+	}
+	raw.Close()
+}
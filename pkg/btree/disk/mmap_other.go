@@ -0,0 +1,18 @@
+//go:build !unix
+
+package disk
+
+import (
+	"errors"
+	"os"
+)
+
+var errMmapUnsupported = errors.New("disk: mmap isn't supported on this platform")
+
+func mmap(f *os.File, size int) ([]byte, error) {
+	return nil, errMmapUnsupported
+}
+
+func munmap(b []byte) error {
+	return errMmapUnsupported
+}
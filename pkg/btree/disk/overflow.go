@@ -0,0 +1,104 @@
+package disk
+
+// overflowCapacity is the space for key and data in an overflow page.
+func (bt *BTree[K]) overflowCapacity() int {
+	return bt.pager.nodeSpace() - overflowHeaderSize
+}
+
+// spill moves the value of e to a new chain of overflow pages.
+func (bt *BTree[K]) spill(e *entry) error {
+	var prev *node
+
+	for data, first := e.v, true; first || len(data) > 0; first = false {
+		n, err := bt.allocate(false)
+		if err != nil {
+			return err
+		}
+
+		n.overflow = true
+
+		size := bt.overflowCapacity()
+		if first {
+			n.key = e.key()
+			size -= len(n.key)
+
+			e.overflow = ref{id: n.id}
+		} else {
+			n.prev = prev.id
+			prev.next = ref{id: n.id}
+		}
+
+		size = min(size, len(data))
+		n.data, data = data[:size], data[size:]
+
+		prev = n
+	}
+
+	e.length, e.v = uint32(len(e.v)), nil
+
+	return nil
+}
+
+// chain calls fn with each page of the overflow chain of e, stopping if it
+// returns false.
+func (bt *BTree[K]) chain(e *entry, fn func(n *node) bool) error {
+	var prev pageID
+
+	for r := e.overflow; r.id != 0; {
+		n, err := bt.load(r)
+		if err != nil {
+			return err
+		}
+
+		if !n.overflow || n.prev != prev || prev == 0 && e.compare(n.key) != 0 {
+			return corruption(r.id, "invalid overflow chain")
+		}
+
+		next := n.next
+		if !fn(n) {
+			return nil
+		}
+
+		prev, r = r.id, next
+	}
+
+	return nil
+}
+
+// value returns the value of e, reading it from its overflow chain if it
+// has one.
+func (bt *BTree[K]) value(e *entry) ([]byte, error) {
+	if e.overflow.id == 0 {
+		return e.v, nil
+	}
+
+	v := make([]byte, 0, e.length)
+
+	err := bt.chain(e, func(n *node) bool {
+		v = append(v, n.data...)
+
+		return len(v) <= int(e.length)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(v) != int(e.length) {
+		return nil, corruption(e.overflow.id, "overflow chain doesn't match the value length")
+	}
+
+	return v, nil
+}
+
+// unspill puts the overflow chain of e, if it has one, on the free list.
+func (bt *BTree[K]) unspill(e *entry) error {
+	if e.overflow.id == 0 {
+		return nil
+	}
+
+	return bt.chain(e, func(n *node) bool {
+		bt.release(n)
+
+		return true
+	})
+}
@@ -0,0 +1,242 @@
+package disk
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/franciscosbf/b-tree-go/pkg/btree/codec"
+)
+
+func overflowTree(t *testing.T, path string) *BTree[int] {
+	return openTree(t, path, &Options[int]{
+		PageSize:      256,
+		MinimumDegree: 2,
+		Values:        codec.Any(codec.Bytes()),
+	})
+}
+
+func randomValue(r *rand.Rand) []byte {
+	size := r.Intn(40)
+	if r.Intn(2) == 0 {
+		size = r.Intn(3000)
+	}
+
+	v := make([]byte, size)
+	r.Read(v)
+
+	return v
+}
+
+func TestOverflow(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tree")
+	r := rand.New(rand.NewSource(1))
+	expected := map[int][]byte{}
+
+	bt := overflowTree(t, path)
+
+	check := func() {
+		checkInvariants(t, bt)
+
+		for k := range 200 {
+			v, err := bt.Search(k)
+			if err != nil {
+				t.Fatalf("failed to search %v: %v", k, err)
+			}
+
+			if ev, ok := expected[k]; !ok && v != nil || ok && !bytes.Equal(v.([]byte), ev) {
+				t.Fatalf("unexpected value of %v", k)
+			}
+		}
+	}
+
+	for range 2000 {
+		k := r.Intn(200)
+
+		if r.Intn(3) == 0 {
+			v, err := bt.Delete(k)
+			if err != nil {
+				t.Fatalf("failed to delete %v: %v", k, err)
+			}
+
+			if ev, ok := expected[k]; ok && !bytes.Equal(v.([]byte), ev) {
+				t.Fatalf("delete returned the wrong value of %v", k)
+			}
+
+			delete(expected, k)
+		} else {
+			v := randomValue(r)
+			if err := bt.Insert(k, v); err != nil {
+				t.Fatalf("failed to insert %v: %v", k, err)
+			}
+
+			expected[k] = v
+		}
+	}
+
+	check()
+
+	if err := bt.Close(); err != nil {
+		t.Fatalf("failed to close tree: %v", err)
+	}
+
+	if r := verify(t, path); !r.OK() || r.OverflowPages == 0 {
+		t.Fatalf("unexpected report:\n%v", r)
+	}
+
+	bt = overflowTree(t, path)
+	defer bt.Close()
+
+	check()
+
+	// Overflow chains are freed along with their entries, so once the
+	// tree is empty every page but the meta and root ones is free.
+	for k := range 200 {
+		if _, err := bt.Delete(k); err != nil {
+			t.Fatalf("failed to delete %v: %v", k, err)
+		}
+	}
+	clear(expected)
+
+	ids, err := bt.freeList()
+	if err != nil {
+		t.Fatalf("failed to read the free list: %v", err)
+	}
+
+	if len(ids) != int(bt.meta.count)-2 {
+		t.Fatalf("expected %v free pages, got %v", bt.meta.count-2, len(ids))
+	}
+}
+
+func TestOverflowOverwrite(t *testing.T) {
+	bt := overflowTree(t, filepath.Join(t.TempDir(), "tree"))
+	defer bt.Close()
+
+	large := bytes.Repeat([]byte{1}, 5000)
+
+	// The new chain is written before the old one is freed, so there are
+	// two of them after the first overwrite, and the next ones reuse the
+	// freed chain.
+	for range 2 {
+		if err := bt.Insert(1, large); err != nil {
+			t.Fatalf("failed to insert: %v", err)
+		}
+	}
+
+	count := bt.meta.count
+
+	for range 10 {
+		if err := bt.Insert(1, large); err != nil {
+			t.Fatalf("failed to overwrite: %v", err)
+		}
+	}
+
+	if bt.meta.count != count {
+		t.Fatalf("expected the file to keep %v pages, got %v", count, bt.meta.count)
+	}
+
+	if err := bt.Insert(1, []byte{2}); err != nil {
+		t.Fatalf("failed to overwrite: %v", err)
+	}
+
+	if ids, _ := bt.freeList(); len(ids) != int(count)-2 {
+		t.Fatalf("expected %v free pages, got %v", count-2, len(ids))
+	}
+
+	if v, err := bt.Search(1); err != nil || !bytes.Equal(v.([]byte), []byte{2}) {
+		t.Fatalf("unexpected value: %v, %v", v, err)
+	}
+}
+
+func TestOverflowVacuum(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tree")
+	r := rand.New(rand.NewSource(2))
+	expected := map[int][]byte{}
+
+	bt := overflowTree(t, path)
+
+	for k := range 300 {
+		v := randomValue(r)
+		if err := bt.Insert(k, v); err != nil {
+			t.Fatalf("failed to insert %v: %v", k, err)
+		}
+		expected[k] = v
+	}
+
+	for k := range 300 {
+		if k%4 != 0 {
+			if _, err := bt.Delete(k); err != nil {
+				t.Fatalf("failed to delete %v: %v", k, err)
+			}
+			delete(expected, k)
+		}
+	}
+
+	if err := bt.Vacuum(); err != nil {
+		t.Fatalf("failed to vacuum: %v", err)
+	}
+
+	if err := bt.Close(); err != nil {
+		t.Fatalf("failed to close tree: %v", err)
+	}
+
+	if r := verify(t, path); !r.OK() || r.FreePages != 0 || r.OverflowPages == 0 {
+		t.Fatalf("unexpected report:\n%v", r)
+	}
+
+	bt = overflowTree(t, path)
+	defer bt.Close()
+
+	for k, ev := range expected {
+		if v, err := bt.Search(k); err != nil || !bytes.Equal(v.([]byte), ev) {
+			t.Fatalf("unexpected value of %v: %v", k, err)
+		}
+	}
+}
+
+func TestVerifyOverflow(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tree")
+
+	bt := overflowTree(t, path)
+
+	if err := bt.Insert(1, bytes.Repeat([]byte{1}, 1000)); err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+
+	var id pageID
+	_, err := bt.write(func(root *node) error {
+		e := *root.entries[0]
+		e.length++
+		id = e.overflow.id
+
+		root.entries[0] = &e
+		bt.mark(root)
+
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to corrupt the tree: %v", err)
+	}
+
+	if _, err := bt.Search(1); !errors.Is(err, ErrCorrupted) {
+		t.Fatalf("expected %v, got %v", ErrCorrupted, err)
+	}
+
+	if err := bt.Close(); err != nil {
+		t.Fatalf("failed to close tree: %v", err)
+	}
+
+	r := verify(t, path)
+
+	found := slices.ContainsFunc(r.Problems, func(err error) bool {
+		var ce *CorruptionError
+
+		return errors.As(err, &ce) && ce.Page == uint32(id)
+	})
+	if !found {
+		t.Fatalf("expected a problem with page %v, got report:\n%v", id, r)
+	}
+}
@@ -0,0 +1,640 @@
+package disk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"slices"
+)
+
+type pageID uint32
+
+const (
+	metaPage pageID = 0
+
+	leafPage     byte = 1
+	internalPage byte = 2
+	freePage     byte = 3
+	overflowPage byte = 4
+
+	// Nodes start with their type, number of entries and length of the
+	// prefix shared by their keys, which follows. Entries only store what
+	// comes after it, and the length of their key and value. Internal
+	// nodes only store keys, and then the references to their childs.
+	nodeHeaderSize = 1 + 2 + 2
+	entryOverhead  = 2 + 2
+	keyOverhead    = 2
+	childSize      = refSize
+
+	// References to pages hold their ID and the LSN they're expected at.
+	refSize = 4 + 8
+
+	// The value length of an entry is set to overflowMarker when it's in
+	// overflow pages, and followed by its length and first page.
+	overflowMarker  = 0xffff
+	overflowRefSize = 4 + refSize
+	// Overflow pages start with their type, next and previous pages, and
+	// the lengths of the key and data they hold.
+	overflowHeaderSize = 1 + refSize + 4 + 2 + 2
+	// Free pages hold their type and the next page of the free list.
+	freeHeaderSize = 1 + refSize
+
+	// Every page ends with the CRC32C of its ID and the rest of its
+	// contents, so misplaced writes are caught as well.
+	pageTrailerSize = 4
+	// Pages hold, before the checksum, the LSN of the WAL record that last
+	// wrote them.
+	pageLSNSize = 8
+)
+
+// CorruptionError reports a page whose contents aren't valid. It matches
+// ErrCorrupted with errors.Is.
+type CorruptionError struct {
+	Page   uint32
+	Reason string
+}
+
+func corruption(id pageID, reason string) *CorruptionError {
+	return &CorruptionError{Page: uint32(id), Reason: reason}
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("%v: page %d: %v", ErrCorrupted, e.Page, e.Reason)
+}
+
+func (e *CorruptionError) Is(target error) bool {
+	return target == ErrCorrupted
+}
+
+func pageChecksum(id pageID, buf []byte) uint32 {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(id))
+
+	return crc32.Update(
+		crc32.Checksum(b[:], castagnoli),
+		castagnoli, buf[:len(buf)-pageTrailerSize])
+}
+
+// seal stores the checksum of page id in its trailer.
+func seal(id pageID, buf []byte) {
+	binary.BigEndian.PutUint32(buf[len(buf)-pageTrailerSize:], pageChecksum(id, buf))
+}
+
+// stampLSN stores lsn in a page.
+func stampLSN(buf []byte, lsn uint64) {
+	binary.BigEndian.PutUint64(buf[len(buf)-pageTrailerSize-pageLSNSize:], lsn)
+}
+
+func pageLSN(buf []byte) uint64 {
+	return binary.BigEndian.Uint64(buf[len(buf)-pageTrailerSize-pageLSNSize:])
+}
+
+// ref references a page along with the LSN it's expected to hold, which
+// only changes as the page does, so an older image of the page put back
+// in its place doesn't match.
+type ref struct {
+	id  pageID
+	lsn uint64
+}
+
+func (r ref) String() string {
+	return fmt.Sprintf("%v@%v", r.id, r.lsn)
+}
+
+func putRef(buf []byte, r ref) {
+	binary.BigEndian.PutUint32(buf, uint32(r.id))
+	binary.BigEndian.PutUint64(buf[4:], r.lsn)
+}
+
+func getRef(buf []byte) ref {
+	return ref{id: pageID(binary.BigEndian.Uint32(buf)), lsn: binary.BigEndian.Uint64(buf[4:])}
+}
+
+// staleLSN reports a page holding another LSN than the one its reference
+// expects, like an older image of it.
+func staleLSN(r ref, lsn uint64) error {
+	return corruption(r.id, fmt.Sprintf("page is at LSN %d, expected %d", lsn, r.lsn))
+}
+
+func checkPage(id pageID, buf []byte) error {
+	if binary.BigEndian.Uint32(buf[len(buf)-pageTrailerSize:]) != pageChecksum(id, buf) {
+		return corruption(id, "checksum mismatch")
+	}
+
+	return nil
+}
+
+// Tree files start with the meta page, which starts with magic and the
+// version of the format of the file.
+var magic = [7]byte{'b', 't', 'r', 'e', 'e', 'g', 'o'}
+
+const (
+	// formatVersion is the version of the format of tree files, the only
+	// one so far. Files of other versions fail to open with
+	// ErrFormatVersion.
+	formatVersion = 1
+
+	// metaSize is the size of the fixed part of the meta page, which the
+	// names of the codecs follow, prefixed by their length.
+	metaSize = 8 + 4 + 4 + 4 + 4 + 8 + 4 + 4 + 4 + 8 + 8
+
+	metaEncrypted  uint32 = 1 << 0
+	metaAppendOnly uint32 = 1 << 1
+	metaBuckets    uint32 = 1 << 2
+)
+
+type meta struct {
+	version  int
+	pageSize uint32
+	degree   uint32
+	root     ref
+	count    uint32
+	// lsn is the one of the last WAL record applied to the file.
+	lsn uint64
+	// free is the first page of the free list, or 0 if it's empty.
+	free ref
+	// encrypted is set for trees whose pages are encrypted. The meta page
+	// itself is only authenticated, as it's read to learn the page size.
+	encrypted bool
+	// compression is the codec pages are compressed with.
+	compression Compression
+	// appendOnly is set for trees that never write over committed pages.
+	appendOnly bool
+	// buckets is set for the files of a DB, whose tree is the catalog of
+	// its buckets.
+	buckets bool
+	// keyCodec and valueCodec are the names of the codecs the tree was
+	// created with, empty if unknown.
+	keyCodec   string
+	valueCodec string
+}
+
+// size returns the size of the encoded meta page.
+func (m *meta) size() int {
+	return metaSize + 1 + len(m.keyCodec) + 1 + len(m.valueCodec)
+}
+
+func (m *meta) encode(buf []byte) {
+	copy(buf, magic[:])
+	buf[7] = byte(m.version)
+	binary.BigEndian.PutUint32(buf[8:], m.pageSize)
+	binary.BigEndian.PutUint32(buf[12:], m.degree)
+	binary.BigEndian.PutUint32(buf[16:], uint32(m.root.id))
+	binary.BigEndian.PutUint32(buf[20:], m.count)
+	binary.BigEndian.PutUint64(buf[24:], m.lsn)
+	binary.BigEndian.PutUint32(buf[32:], uint32(m.free.id))
+
+	var flags uint32
+	if m.encrypted {
+		flags |= metaEncrypted
+	}
+	if m.appendOnly {
+		flags |= metaAppendOnly
+	}
+	if m.buckets {
+		flags |= metaBuckets
+	}
+	binary.BigEndian.PutUint32(buf[36:], flags)
+	binary.BigEndian.PutUint32(buf[40:], uint32(m.compression))
+	binary.BigEndian.PutUint64(buf[44:], m.root.lsn)
+	binary.BigEndian.PutUint64(buf[52:], m.free.lsn)
+
+	off := metaSize
+	for _, name := range []string{m.keyCodec, m.valueCodec} {
+		buf[off] = byte(len(name))
+		off += 1 + copy(buf[off+1:], name)
+	}
+}
+
+// decodeMeta decodes the meta page in buf. The names of the codecs are
+// only decoded if buf holds more than the fixed part.
+func decodeMeta(buf []byte) (*meta, error) {
+	if len(buf) < metaSize || [7]byte(buf[:7]) != magic {
+		return nil, ErrNotTreeFile
+	}
+
+	m := &meta{
+		version:  int(buf[7]),
+		pageSize: binary.BigEndian.Uint32(buf[8:]),
+		degree:   binary.BigEndian.Uint32(buf[12:]),
+		root: ref{
+			id:  pageID(binary.BigEndian.Uint32(buf[16:])),
+			lsn: binary.BigEndian.Uint64(buf[44:]),
+		},
+		count: binary.BigEndian.Uint32(buf[20:]),
+		lsn:   binary.BigEndian.Uint64(buf[24:]),
+		free: ref{
+			id:  pageID(binary.BigEndian.Uint32(buf[32:])),
+			lsn: binary.BigEndian.Uint64(buf[52:]),
+		},
+		encrypted:   binary.BigEndian.Uint32(buf[36:])&metaEncrypted != 0,
+		appendOnly:  binary.BigEndian.Uint32(buf[36:])&metaAppendOnly != 0,
+		buckets:     binary.BigEndian.Uint32(buf[36:])&metaBuckets != 0,
+		compression: Compression(binary.BigEndian.Uint32(buf[40:])),
+	}
+
+	if m.version != formatVersion {
+		return nil, fmt.Errorf("%w: the file is version %d, and only version %d is supported",
+			ErrFormatVersion, m.version, formatVersion)
+	}
+
+	if len(buf) == metaSize {
+		return m, nil
+	}
+
+	off := metaSize
+	for _, name := range []*string{&m.keyCodec, &m.valueCodec} {
+		if off >= len(buf) || off+1+int(buf[off]) > len(buf) {
+			return nil, corruption(metaPage, "invalid codec names")
+		}
+
+		*name = string(buf[off+1 : off+1+int(buf[off])])
+		off += 1 + int(buf[off])
+	}
+
+	return m, nil
+}
+
+type entry struct {
+	// prefix is the one shared by the keys of the node the entry was read
+	// from, stored once for all of them, and k what follows it. Entries
+	// built otherwise hold their whole key in k.
+	prefix []byte
+	k      []byte
+	v      []byte
+	// Values too large for a node are stored in a chain of overflow
+	// pages, starting at page overflow, and v is left empty.
+	overflow ref
+	length   uint32
+}
+
+// key returns the key of e, which is built for entries read with a prefix.
+func (e *entry) key() []byte {
+	if len(e.prefix) == 0 {
+		return e.k
+	}
+
+	return append(slices.Clip(e.prefix), e.k...)
+}
+
+func (e *entry) keyLen() int {
+	return len(e.prefix) + len(e.k)
+}
+
+// keyAt returns the i-th byte of the key of e.
+func (e *entry) keyAt(i int) byte {
+	if i < len(e.prefix) {
+		return e.prefix[i]
+	}
+
+	return e.k[i-len(e.prefix)]
+}
+
+// copyKey copies the key of e past its first from bytes to buf, returning
+// the number of bytes copied.
+func (e *entry) copyKey(buf []byte, from int) int {
+	if from < len(e.prefix) {
+		n := copy(buf, e.prefix[from:])
+
+		return n + copy(buf[n:], e.k)
+	}
+
+	return copy(buf, e.k[from-len(e.prefix):])
+}
+
+// compare compares the key of e with k, without building it.
+func (e *entry) compare(k []byte) int {
+	p := e.prefix
+	if len(k) < len(p) {
+		if c := bytes.Compare(p[:len(k)], k); c != 0 {
+			return c
+		}
+
+		return 1
+	}
+
+	if c := bytes.Compare(p, k[:len(p)]); c != 0 {
+		return c
+	}
+
+	return bytes.Compare(e.k, k[len(p):])
+}
+
+// size returns the size of e in a leaf, without a prefix.
+func (e *entry) size() int {
+	if e.overflow.id != 0 {
+		return entryOverhead + e.keyLen() + overflowRefSize
+	}
+
+	return entryOverhead + e.keyLen() + len(e.v)
+}
+
+func (e *entry) String() string {
+	if e.overflow.id != 0 {
+		return fmt.Sprintf("entry{key: %x, overflow: %v, length: %v}", e.key(), e.overflow, e.length)
+	}
+
+	return fmt.Sprintf("entry{key: %x, value: %x}", e.key(), e.v)
+}
+
+// separator returns the shortest key greater than the one of a and not
+// greater than the one of b, which must be greater: the one of b up to the
+// first byte they differ in. Internal nodes hold such keys, not the ones of
+// entries, so they fit more of them.
+func separator(a, b *entry) *entry {
+	ka, kb := a.key(), b.key()
+
+	i := 0
+	for ; i < len(ka) && i < len(kb)-1 && ka[i] == kb[i]; i++ {
+	}
+
+	return &entry{k: kb[: i+1 : i+1]}
+}
+
+// node is a node of the tree, or a free or overflow page. Leaves hold the
+// entries of the tree, and internal nodes only the keys separating their
+// childs, the i-th child holding the keys from the one of entries[i-1] up
+// to the one of entries[i].
+type node struct {
+	id pageID
+	// lsn is the one the page held when read, which references to it
+	// must match.
+	lsn     uint64
+	leaf    bool
+	entries []*entry
+	childs  []ref
+	// free pages only hold the next one of the free list.
+	free bool
+	next ref
+	// overflow pages hold part of a value, and are linked both ways. The
+	// first one of a chain has no previous page, but holds the key of the
+	// entry instead.
+	overflow bool
+	prev     pageID
+	key      []byte
+	data     []byte
+}
+
+func (n *node) String() string {
+	switch {
+	case n.free:
+		return fmt.Sprintf("node{id: %v, free: true, next: %v}", n.id, n.next)
+	case n.overflow:
+		return fmt.Sprintf(
+			"node{id: %v, overflow: true, prev: %v, next: %v, key: %x, data: %v bytes}",
+			n.id, n.prev, n.next, n.key, len(n.data))
+	}
+
+	return fmt.Sprintf(
+		"node{id: %v, leaf: %v, entries: %v, childs: %v}",
+		n.id, n.leaf, n.entries, n.childs)
+}
+
+func (n *node) encode(buf []byte) {
+	clear(buf)
+
+	switch {
+	case n.free:
+		buf[0] = freePage
+		putRef(buf[1:], n.next)
+
+		return
+	case n.overflow:
+		buf[0] = overflowPage
+		putRef(buf[1:], n.next)
+		binary.BigEndian.PutUint32(buf[13:], uint32(n.prev))
+		binary.BigEndian.PutUint16(buf[17:], uint16(len(n.key)))
+		binary.BigEndian.PutUint16(buf[19:], uint16(len(n.data)))
+
+		off := overflowHeaderSize + copy(buf[overflowHeaderSize:], n.key)
+		copy(buf[off:], n.data)
+
+		return
+	}
+
+	buf[0] = internalPage
+	if n.leaf {
+		buf[0] = leafPage
+	}
+	binary.BigEndian.PutUint16(buf[1:], uint16(len(n.entries)))
+
+	plen := n.prefixLen()
+	binary.BigEndian.PutUint16(buf[3:], uint16(plen))
+
+	off := nodeHeaderSize
+	if plen > 0 {
+		off += n.entries[0].copyKey(buf[off:off+plen], 0)
+	}
+
+	for _, e := range n.entries {
+		binary.BigEndian.PutUint16(buf[off:], uint16(e.keyLen()-plen))
+		off += 2
+		off += e.copyKey(buf[off:], plen)
+
+		if !n.leaf {
+			continue
+		}
+
+		if e.overflow.id != 0 {
+			binary.BigEndian.PutUint16(buf[off:], overflowMarker)
+			binary.BigEndian.PutUint32(buf[off+2:], e.length)
+			putRef(buf[off+6:], e.overflow)
+			off += 2 + overflowRefSize
+
+			continue
+		}
+
+		binary.BigEndian.PutUint16(buf[off:], uint16(len(e.v)))
+		off += 2
+		off += copy(buf[off:], e.v)
+	}
+
+	for _, c := range n.childs {
+		putRef(buf[off:], c)
+		off += childSize
+	}
+}
+
+// prefixLen returns the length of the prefix shared by the keys of n,
+// which is the one of the first and last ones, as they're sorted.
+func (n *node) prefixLen() int {
+	if len(n.entries) == 0 {
+		return 0
+	}
+
+	first, last := n.entries[0], n.entries[len(n.entries)-1]
+
+	i := 0
+	for ; i < first.keyLen() && i < last.keyLen() && first.keyAt(i) == last.keyAt(i); i++ {
+	}
+
+	return i
+}
+
+// prefix returns the prefix shared by the keys of n.
+func (n *node) prefix() []byte {
+	if len(n.entries) == 0 {
+		return nil
+	}
+
+	return n.entries[0].key()[:n.prefixLen()]
+}
+
+// size returns the size of the encoding of n.
+func (n *node) size() int {
+	plen := n.prefixLen()
+
+	size := nodeHeaderSize + plen + len(n.childs)*childSize
+	for _, e := range n.entries {
+		if n.leaf {
+			size += e.size() - plen
+		} else {
+			size += keyOverhead + e.keyLen() - plen
+		}
+	}
+
+	return size
+}
+
+func decodeOverflow(id pageID, buf []byte) (*node, error) {
+	if len(buf) < overflowHeaderSize {
+		return nil, corruption(id, "invalid overflow page")
+	}
+
+	klen := int(binary.BigEndian.Uint16(buf[17:]))
+	dlen := int(binary.BigEndian.Uint16(buf[19:]))
+	if overflowHeaderSize+klen+dlen > len(buf) {
+		return nil, corruption(id, "invalid overflow page")
+	}
+
+	off := overflowHeaderSize
+
+	return &node{
+		id:       id,
+		overflow: true,
+		next:     getRef(buf[1:]),
+		prev:     pageID(binary.BigEndian.Uint32(buf[13:])),
+		key:      buf[off : off+klen : off+klen],
+		data:     buf[off+klen : off+klen+dlen : off+klen+dlen],
+	}, nil
+}
+
+// decodeNode decodes the image of page id, which ends with its LSN and
+// checksum.
+func decodeNode(id pageID, buf []byte) (*node, error) {
+	if len(buf) < pageLSNSize+pageTrailerSize {
+		return nil, corruption(id, "invalid node")
+	}
+
+	n, err := decodePage(id, buf[:len(buf)-pageLSNSize-pageTrailerSize])
+	if err != nil {
+		return nil, err
+	}
+
+	n.lsn = pageLSN(buf)
+
+	return n, nil
+}
+
+func decodePage(id pageID, buf []byte) (*node, error) {
+	corrupted := func() (*node, error) {
+		return nil, corruption(id, "invalid node")
+	}
+
+	if len(buf) >= freeHeaderSize && buf[0] == freePage {
+		return &node{id: id, free: true, next: getRef(buf[1:])}, nil
+	}
+
+	if len(buf) > 0 && buf[0] == overflowPage {
+		return decodeOverflow(id, buf)
+	}
+
+	if len(buf) < nodeHeaderSize || buf[0] != leafPage && buf[0] != internalPage {
+		return corrupted()
+	}
+
+	n := &node{
+		id:      id,
+		leaf:    buf[0] == leafPage,
+		entries: make([]*entry, binary.BigEndian.Uint16(buf[1:])),
+	}
+
+	plen := int(binary.BigEndian.Uint16(buf[3:]))
+	if nodeHeaderSize+plen > len(buf) {
+		return corrupted()
+	}
+
+	prefix := buf[nodeHeaderSize : nodeHeaderSize+plen : nodeHeaderSize+plen]
+
+	off := nodeHeaderSize + plen
+	field := func() []byte {
+		if off+2 > len(buf) {
+			return nil
+		}
+
+		size := int(binary.BigEndian.Uint16(buf[off:]))
+		off += 2
+
+		if size == overflowMarker {
+			size = overflowRefSize
+		}
+
+		if off+size > len(buf) {
+			return nil
+		}
+
+		// Fields point into the page, which is never modified once read,
+		// so pages are decoded without copying: keys keep the prefix of
+		// the node, shared by all of them, apart from what follows it.
+		b := buf[off : off+size : off+size]
+		off += size
+
+		return b
+	}
+
+	for i := range n.entries {
+		k := field()
+		if k == nil {
+			return corrupted()
+		}
+
+		e := &entry{prefix: prefix, k: k}
+		if !n.leaf {
+			n.entries[i] = e
+
+			continue
+		}
+
+		overflow := off+2 <= len(buf) && binary.BigEndian.Uint16(buf[off:]) == overflowMarker
+		v := field()
+		if v == nil {
+			return corrupted()
+		}
+
+		e.v = v
+		if overflow {
+			e.v = nil
+			e.length = binary.BigEndian.Uint32(v)
+			e.overflow = getRef(v[4:])
+		}
+
+		n.entries[i] = e
+	}
+
+	if n.leaf {
+		return n, nil
+	}
+
+	n.childs = make([]ref, len(n.entries)+1)
+	if off+len(n.childs)*childSize > len(buf) {
+		return corrupted()
+	}
+
+	for i := range n.childs {
+		n.childs[i] = getRef(buf[off:])
+		off += childSize
+	}
+
+	return n, nil
+}
@@ -0,0 +1,231 @@
+package disk
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNodePrefix(t *testing.T) {
+	keys := func(ks ...string) []*entry {
+		var entries []*entry
+		for _, k := range ks {
+			entries = append(entries, &entry{k: []byte(k), v: []byte("v")})
+		}
+
+		return entries
+	}
+
+	var urls []string
+	for i := range 10 {
+		urls = append(urls, fmt.Sprintf("https://example.com/some/long/path/%02d", i))
+	}
+
+	cases := []struct {
+		name    string
+		entries []*entry
+		prefix  string
+	}{
+		{"empty", nil, ""},
+		{"single", keys("abc"), "abc"},
+		{"unrelated", keys("a", "b"), ""},
+		{"urls", keys(urls...), "https://example.com/some/long/path/0"},
+		{"empty key", keys("", "a"), ""},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			n := &node{id: 1, leaf: true, entries: c.entries}
+
+			if p := n.prefix(); string(p) != c.prefix {
+				t.Fatalf("expected prefix %q, got %q", c.prefix, p)
+			}
+
+			buf := make([]byte, 1024)
+			n.encode(buf)
+
+			if c.prefix != "" && bytes.Count(buf, []byte(c.prefix)) != 1 {
+				t.Fatalf("expected the prefix to be stored once")
+			}
+
+			d, err := decodeNode(1, buf)
+			if err != nil {
+				t.Fatalf("failed to decode: %v", err)
+			}
+
+			if len(d.entries) != len(c.entries) {
+				t.Fatalf("expected %v entries, got %v", len(c.entries), len(d.entries))
+			}
+
+			for i, e := range d.entries {
+				if !bytes.Equal(e.key(), c.entries[i].k) || !bytes.Equal(e.v, c.entries[i].v) {
+					t.Fatalf("expected %v, got %v", c.entries[i], e)
+				}
+			}
+		})
+	}
+}
+
+func TestNodePrefixOverflow(t *testing.T) {
+	n := &node{
+		id:   1,
+		leaf: true,
+		entries: []*entry{
+			{k: []byte("prefix/a"), v: []byte("v")},
+			{k: []byte("prefix/b"), overflow: ref{id: 7, lsn: 3}, length: 5000},
+		},
+	}
+
+	buf := make([]byte, 256)
+	n.encode(buf)
+
+	d, err := decodeNode(1, buf)
+	if err != nil {
+		t.Fatalf("failed to decode: %v", err)
+	}
+
+	if d.String() != n.String() {
+		t.Fatalf("expected %v, got %v", n, d)
+	}
+}
+
+func TestInternalNodeKeys(t *testing.T) {
+	n := &node{
+		id: 1,
+		entries: []*entry{
+			{k: []byte("prefix/a")},
+			{k: []byte("prefix/b")},
+		},
+		childs: []ref{{2, 5}, {3, 6}, {4, 7}},
+	}
+
+	buf := make([]byte, 256)
+	n.encode(buf)
+
+	// Internal nodes only store keys, after their prefix.
+	if size := nodeHeaderSize + len("prefix/") + 2*(keyOverhead+1) + 3*childSize; n.size() != size {
+		t.Fatalf("expected size %v, got %v", size, n.size())
+	}
+
+	d, err := decodeNode(1, buf)
+	if err != nil {
+		t.Fatalf("failed to decode: %v", err)
+	}
+
+	if d.String() != n.String() {
+		t.Fatalf("expected %v, got %v", n, d)
+	}
+
+	// Decoded keys share the prefix, stored once in the page.
+	if &d.entries[0].prefix[0] != &d.entries[1].prefix[0] || string(d.entries[1].k) != "b" {
+		t.Fatalf("expected the keys to share their prefix, got %q and %q",
+			d.entries[0].k, d.entries[1].k)
+	}
+}
+
+func TestSeparator(t *testing.T) {
+	cases := []struct{ a, b, sep string }{
+		{"apple", "banana", "b"},
+		{"abc", "abd", "abd"},
+		{"ab", "abc", "abc"},
+		{"a", "abc", "ab"},
+		{"", "a", "a"},
+		{"users/0017/name", "users/0123/name", "users/01"},
+	}
+
+	for _, c := range cases {
+		a := &entry{k: []byte(c.a)}
+
+		// The key of b may be split by a prefix.
+		b := &entry{prefix: []byte(c.b[:len(c.b)/2]), k: []byte(c.b[len(c.b)/2:])}
+
+		if sep := separator(a, b); string(sep.key()) != c.sep {
+			t.Errorf("expected the separator of %q and %q to be %q, got %q", c.a, c.b, c.sep, sep.key())
+		}
+	}
+}
+
+func TestEntryCompare(t *testing.T) {
+	e := &entry{prefix: []byte("abc"), k: []byte("de")}
+
+	for _, k := range []string{"", "a", "abc", "abcd", "abcde", "abcdf", "abd", "abcdef", "b"} {
+		if got, want := e.compare([]byte(k)), bytes.Compare([]byte("abcde"), []byte(k)); got != want {
+			t.Errorf("expected comparing with %q to be %v, got %v", k, want, got)
+		}
+	}
+}
+
+func TestPrefixedKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tree")
+	opts := &Options[string]{PageSize: 512, MinimumDegree: 3}
+
+	key := func(i int) string {
+		return fmt.Sprintf("/srv/data/users/%03d/files/%04d", i%7, i)
+	}
+
+	bt := openTree(t, path, opts)
+	for i := range 1000 {
+		if err := bt.Insert(key(i), i); err != nil {
+			t.Fatalf("failed to insert %v: %v", key(i), err)
+		}
+	}
+
+	if err := bt.Close(); err != nil {
+		t.Fatalf("failed to close tree: %v", err)
+	}
+
+	if r := verify(t, path); !r.OK() {
+		t.Fatalf("unexpected report:\n%v", r)
+	}
+
+	bt = openTree(t, path, opts)
+	defer bt.Close()
+
+	for i := range 1000 {
+		if v, err := bt.Search(key(i)); err != nil || v != i {
+			t.Fatalf("expected %v to be %v, got %v, %v", key(i), i, v, err)
+		}
+	}
+}
+
+func TestTruncatedSeparators(t *testing.T) {
+	bt := openTree(t, filepath.Join(t.TempDir(), "tree"), &Options[string]{MinimumDegree: 4})
+	defer bt.Close()
+
+	// Neighbors differ early on, so internal nodes only keep the start of
+	// the keys, and many more of them than a leaf holds entries.
+	key := func(i int) string {
+		return fmt.Sprintf("%05d/%v", i, strings.Repeat("x", 100))
+	}
+
+	for i := range 600 {
+		if err := bt.Insert(key(i), i); err != nil {
+			t.Fatalf("failed to insert %v: %v", key(i), err)
+		}
+	}
+
+	checkInvariants(t, bt)
+
+	root, err := bt.load(bt.meta.root)
+	if err != nil {
+		t.Fatalf("failed to load the root: %v", err)
+	}
+
+	if root.leaf || len(root.entries) <= 2*bt.t-1 {
+		t.Fatalf("expected the root to hold more than %v keys, got %v", 2*bt.t-1, root)
+	}
+
+	for _, e := range root.entries {
+		if e.keyLen() > len("00000/x") {
+			t.Fatalf("expected short keys in the root, got %q", e.key())
+		}
+	}
+
+	for i := range 600 {
+		if v, err := bt.Search(key(i)); err != nil || v != i {
+			t.Fatalf("expected %v to be %v, got %v, %v", key(i), i, v, err)
+		}
+	}
+}
@@ -0,0 +1,369 @@
+package disk
+
+import (
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+// pager reads and writes fixed-size pages of a single file. Page i lives at
+// offset i*pageSize.
+type pager struct {
+	file     File
+	pageSize int
+	// crypt encrypts the pages of encrypted trees. Their images are then
+	// smaller than pages, by cryptOverhead.
+	crypt *crypter
+	// compress compresses the pages of compressed trees. Their file, if
+	// sparse, has the blocks past the end of their pages deallocated, unless
+	// its blocks are as large as pages or it doesn't support holes.
+	compress *compressor
+	sparse   SparseFile
+	block    int64
+	noHoles  atomic.Bool
+	// dualMeta is set for append-only trees, whose page 1 is a meta page
+	// as well.
+	dualMeta bool
+	// mapped, when set, is the file mapped in memory, and overlay holds
+	// pages read from the WAL. Both are read instead of the file.
+	mapped  []byte
+	overlay map[pageID][]byte
+}
+
+// isMeta reports whether page id is a meta page.
+func (p *pager) isMeta(id pageID) bool {
+	return id == metaPage || p.dualMeta && id == 1
+}
+
+// nodeSize returns the size of the images of pages other than the meta
+// page, as encoded and decoded by nodes.
+func (p *pager) nodeSize() int {
+	size := p.imageSize(metaPage)
+	if p.compress != nil {
+		size -= compressHeaderSize
+	}
+
+	return size
+}
+
+// nodeSpace returns the space for the contents of nodes in their images.
+func (p *pager) nodeSpace() int {
+	return p.nodeSize() - pageLSNSize - pageTrailerSize
+}
+
+// imageSize returns the size of the image of page id.
+func (p *pager) imageSize(id pageID) int {
+	if !p.isMeta(id) {
+		return p.nodeSize()
+	}
+
+	if p.crypt != nil {
+		return p.pageSize - cryptOverhead
+	}
+
+	return p.pageSize
+}
+
+// fitsMeta checks that m fits in the meta page.
+func (p *pager) fitsMeta(m *meta) error {
+	if len(m.keyCodec) > 0xff || len(m.valueCodec) > 0xff {
+		return errors.New("disk: codec names must be at most 255 bytes long")
+	}
+
+	if m.size() > p.imageSize(metaPage)-pageLSNSize-pageTrailerSize {
+		return errors.New("disk: page size is too small for the meta page")
+	}
+
+	return nil
+}
+
+// readAt reads up to the first size bytes of page id as stored in the file.
+// Fewer are only returned if the page is stored in fewer bytes, which is
+// left to the caller to check.
+func (p *pager) readAt(id pageID, size int) ([]byte, error) {
+	if buf, ok := p.overlay[id]; ok {
+		return buf[:min(size, len(buf))], nil
+	}
+
+	off := int64(id) * int64(p.pageSize)
+
+	if p.mapped != nil {
+		if off >= int64(len(p.mapped)) {
+			return nil, corruption(id, "page is past the end of the file")
+		}
+
+		end := min(off+int64(size), int64(len(p.mapped)))
+
+		return p.mapped[off:end:end], nil
+	}
+
+	buf := make([]byte, size)
+
+	n, err := p.file.ReadAt(buf, off)
+	if err == io.EOF && n > 0 {
+		return buf[:n], nil
+	} else if err == io.EOF {
+		return nil, corruption(id, "page is past the end of the file")
+	} else if err != nil {
+		return nil, err
+	}
+
+	return buf, nil
+}
+
+// read returns the image of page id, decompressed, decrypted and checked.
+func (p *pager) read(id pageID) ([]byte, error) {
+	buf, err := p.readAt(id, p.pageSize)
+	if err != nil {
+		return nil, err
+	}
+
+	codec, size := CompressNone, 0
+
+	if p.compress != nil && !p.isMeta(id) {
+		if len(buf) < compressHeaderSize {
+			return nil, corruption(id, "page is past the end of the file")
+		}
+
+		codec = Compression(buf[0])
+		stored := compressHeaderSize + int(binary.BigEndian.Uint16(buf[1:]))
+		size = int(binary.BigEndian.Uint16(buf[3:]))
+
+		if stored > len(buf) || size != p.nodeSize() {
+			return nil, corruption(id, "invalid compression header")
+		}
+
+		buf = buf[compressHeaderSize:stored]
+	} else if len(buf) < p.pageSize {
+		return nil, corruption(id, "page is past the end of the file")
+	}
+
+	var lsn uint64
+	if p.crypt != nil {
+		if buf, lsn, err = p.crypt.open(id, buf, p.isMeta(id)); err != nil {
+			return nil, err
+		}
+	}
+
+	if codec != CompressNone {
+		if buf, err = p.compress.decompress(codec, buf, size); err != nil {
+			return nil, corruption(id, fmt.Sprintf("page fails decompression: %v", err))
+		}
+	}
+
+	if len(buf) != p.imageSize(id) {
+		return nil, corruption(id, "invalid page size")
+	}
+
+	if err := checkPage(id, buf); err != nil {
+		return nil, err
+	}
+
+	if p.crypt != nil && pageLSN(buf) != lsn {
+		return nil, corruption(id, "page LSN doesn't match the authenticated one")
+	}
+
+	return buf, nil
+}
+
+// readMeta reads the meta page, setting the page size to the one it holds.
+// Of the two meta pages of append-only trees, it returns the one of the last
+// commit: the other one, unless the last one written is torn.
+func (p *pager) readMeta() (*meta, error) {
+	buf, err := p.readAt(metaPage, metaSize)
+	if err != nil {
+		return nil, ErrNotTreeFile
+	}
+
+	m, err := decodeMeta(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.pageSize < minPageSize || m.pageSize > maxPageSize {
+		return nil, corruption(metaPage, "invalid page size")
+	}
+
+	if m.encrypted != (p.crypt != nil) {
+		return nil, ErrEncryption
+	}
+
+	p.pageSize = int(m.pageSize)
+	p.dualMeta = m.appendOnly
+
+	if m.compression != CompressNone {
+		if err := p.compressWith(m.compression); err != nil {
+			return nil, corruption(metaPage, err.Error())
+		}
+	}
+
+	ids := []pageID{metaPage}
+	if p.dualMeta {
+		ids = append(ids, 1)
+	}
+
+	var (
+		last  *meta
+		first error
+	)
+
+	for _, id := range ids {
+		buf, err := p.read(id)
+		if err == nil {
+			m, err = decodeMeta(buf)
+		}
+
+		if err != nil {
+			first = cmp.Or(first, err)
+		} else if last == nil || m.lsn > last.lsn {
+			last = m
+		}
+	}
+
+	if last == nil {
+		return nil, first
+	}
+
+	return last, nil
+}
+
+// seal returns what's stored for the image buf of page id, committed by
+// the WAL record lsn.
+func (p *pager) seal(id pageID, buf []byte, lsn uint64) ([]byte, error) {
+	compressed := p.compress != nil && !p.isMeta(id)
+
+	codec, data := CompressNone, buf
+	if compressed {
+		if c := p.compress.compress(buf); len(c) < len(buf) {
+			codec, data = p.compress.codec, c
+		}
+	}
+
+	if p.crypt != nil {
+		var err error
+		if data, err = p.crypt.seal(id, data, lsn, p.isMeta(id)); err != nil {
+			return nil, err
+		}
+	}
+
+	if !compressed {
+		return data, nil
+	}
+
+	page := make([]byte, compressHeaderSize+len(data))
+	page[0] = byte(codec)
+	binary.BigEndian.PutUint16(page[1:], uint16(len(data)))
+	binary.BigEndian.PutUint16(page[3:], uint16(len(buf)))
+	copy(page[compressHeaderSize:], data)
+
+	p.compress.count(len(buf), len(page))
+
+	return page, nil
+}
+
+func (p *pager) write(id pageID, buf []byte, lsn uint64) error {
+	buf, err := p.seal(id, buf, lsn)
+	if err != nil {
+		return err
+	}
+
+	return p.writeRaw(id, buf)
+}
+
+// writeRaw writes page id as already sealed.
+func (p *pager) writeRaw(id pageID, buf []byte) error {
+	if _, err := p.file.WriteAt(buf, int64(id)*int64(p.pageSize)); err != nil {
+		return err
+	}
+
+	if p.compress != nil && !p.isMeta(id) {
+		return p.punch(id, len(buf))
+	}
+
+	return nil
+}
+
+// compressWith sets the codec pages are compressed with, once the page size
+// is known.
+func (p *pager) compressWith(codec Compression) error {
+	var err error
+	if p.compress, err = newCompressor(codec); err != nil {
+		return err
+	}
+
+	sparse, ok := p.file.(SparseFile)
+	if !ok {
+		return nil
+	}
+
+	if block, err := sparse.BlockSize(); err == nil && block > 0 && block < int64(p.pageSize) {
+		p.sparse, p.block = sparse, block
+	}
+
+	return nil
+}
+
+// punch deallocates the blocks of page id past its first size bytes, which
+// read as zeros then.
+func (p *pager) punch(id pageID, size int) error {
+	if p.sparse == nil || p.noHoles.Load() {
+		return nil
+	}
+
+	off := int64(id) * int64(p.pageSize)
+	start := (off + int64(size) + p.block - 1) / p.block * p.block
+	end := (off + int64(p.pageSize)) / p.block * p.block
+
+	if start >= end {
+		return nil
+	}
+
+	err := p.sparse.PunchHole(start, end-start)
+	if errors.Is(err, errors.ErrUnsupported) {
+		p.noHoles.Store(true)
+
+		return nil
+	}
+
+	return err
+}
+
+// saved returns the bytes of the file that aren't allocated on disk.
+func (p *pager) saved() uint64 {
+	if p.sparse == nil {
+		return 0
+	}
+
+	size, err := p.file.Size()
+	if err != nil {
+		return 0
+	}
+
+	allocated, err := p.sparse.Allocated()
+	if err != nil || allocated >= size {
+		return 0
+	}
+
+	return uint64(size - allocated)
+}
+
+func (p *pager) sync() error {
+	return p.file.Sync()
+}
+
+func (p *pager) close() error {
+	var err error
+	if p.mapped != nil {
+		err = munmap(p.mapped)
+	}
+
+	return errors.Join(err, p.file.Close())
+}
+
+// truncate drops the pages from count on.
+func (p *pager) truncate(count uint32) error {
+	return p.file.Truncate(int64(count) * int64(p.pageSize))
+}
@@ -0,0 +1,282 @@
+package disk
+
+import (
+	"maps"
+	"slices"
+	"sync"
+)
+
+// CacheStats are the counters of the buffer pool.
+type CacheStats struct {
+	Hits       uint64
+	Misses     uint64
+	Evictions  uint64
+	WriteBacks uint64
+	// Resident is the number of pages in the pool, Dirty the ones not yet
+	// written back to the tree file and Internal the ones of internal
+	// nodes.
+	Resident int
+	Dirty    int
+	Internal int
+}
+
+type frame struct {
+	id    pageID
+	data  []byte
+	pins  int
+	dirty bool
+	// lsn is the one of the WAL record that committed a dirty page, which
+	// encrypted pages are sealed with.
+	lsn uint64
+	// internal is set for the pages of internal nodes.
+	internal bool
+}
+
+// isInternal reports whether the image data of page id is the one of an
+// internal node.
+func (p *pool) isInternal(id pageID, data []byte) bool {
+	return !p.pager.isMeta(id) && len(data) > 0 && data[0] == internalPage
+}
+
+// pool is the buffer pool, holding up to capacity page images. Committed
+// pages are put in it dirty and only written back to the tree file when
+// evicted or on checkpoints, as the WAL already holds them. Pinned pages
+// are never evicted; if every page is pinned, the pool grows past its
+// capacity.
+//
+// Internal nodes are read by every operation going down the tree, while
+// each leaf only by the ones on its keys, so the pages of internal nodes
+// are only evicted when no other page can be, as long as they take at most
+// half of the pool. Scans going through many leaves then only evict other
+// leaves. Past that share, which trees whose upper levels don't fit in half
+// of the pool reach, every page is evicted alike.
+type pool struct {
+	mutex    sync.Mutex
+	pager    *pager
+	capacity int
+	frames   map[pageID]*frame
+	replacer replacer
+	stats    CacheStats
+	// internal is the number of pages of internal nodes in the pool.
+	internal int
+	// sync makes the WAL durable up to the record lsn, which must be
+	// before the pages it committed are written back.
+	sync func(lsn uint64) error
+}
+
+func newPool(p *pager, capacity int, e Eviction, sync func(lsn uint64) error) *pool {
+	return &pool{
+		sync:     sync,
+		pager:    p,
+		capacity: capacity,
+		frames:   map[pageID]*frame{},
+		replacer: newReplacer(e, capacity),
+	}
+}
+
+// get returns the frame of page id pinned. It must be unpinned once its
+// data isn't needed anymore.
+func (p *pool) get(id pageID) (*frame, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if f, ok := p.frames[id]; ok {
+		p.stats.Hits++
+		p.replacer.access(id)
+		f.pins++
+
+		return f, nil
+	}
+
+	p.stats.Misses++
+
+	if err := p.makeRoom(); err != nil {
+		return nil, err
+	}
+
+	data, err := p.pager.read(id)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &frame{id: id, data: data, pins: 1}
+	p.add(f)
+
+	return f, nil
+}
+
+func (p *pool) unpin(f *frame) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	f.pins--
+}
+
+// put replaces the image of page id by the one committed by the WAL record
+// lsn.
+func (p *pool) put(id pageID, data []byte, lsn uint64) error {
+	return p.store(&frame{id: id, data: data, dirty: true, lsn: lsn})
+}
+
+// cache replaces the image of page id by the one already written to the
+// tree file.
+func (p *pool) cache(id pageID, data []byte) error {
+	return p.store(&frame{id: id, data: data})
+}
+
+func (p *pool) store(nf *frame) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if f, ok := p.frames[nf.id]; ok {
+		p.setInternal(f, p.isInternal(nf.id, nf.data))
+		f.data, f.dirty, f.lsn = nf.data, nf.dirty, nf.lsn
+		p.replacer.access(nf.id)
+
+		return nil
+	}
+
+	if err := p.makeRoom(); err != nil {
+		return err
+	}
+
+	p.add(nf)
+
+	return nil
+}
+
+// add puts f in the pool.
+func (p *pool) add(f *frame) {
+	p.frames[f.id] = f
+	p.replacer.insert(f.id)
+	p.setInternal(f, p.isInternal(f.id, f.data))
+}
+
+// evict drops page id from the pool.
+func (p *pool) evict(id pageID) {
+	p.setInternal(p.frames[id], false)
+	p.replacer.remove(id)
+	delete(p.frames, id)
+}
+
+// setInternal sets whether f holds the page of an internal node.
+func (p *pool) setInternal(f *frame, internal bool) {
+	if f.internal != internal {
+		if internal {
+			p.internal++
+		} else {
+			p.internal--
+		}
+	}
+
+	f.internal = internal
+}
+
+// victim picks the page to evict, among the ones of leaves and overflow
+// pages first while internal nodes take at most half of the pool.
+func (p *pool) victim() (pageID, bool) {
+	if p.internal <= p.capacity/2 {
+		id, ok := p.replacer.victim(func(id pageID) bool {
+			f := p.frames[id]
+
+			return f.pins == 0 && !f.internal
+		})
+		if ok {
+			return id, true
+		}
+	}
+
+	return p.replacer.victim(func(id pageID) bool {
+		return p.frames[id].pins == 0
+	})
+}
+
+func (p *pool) makeRoom() error {
+	for len(p.frames) >= p.capacity {
+		id, ok := p.victim()
+		if !ok {
+			return nil
+		}
+
+		if f := p.frames[id]; f.dirty {
+			if err := p.sync(f.lsn); err != nil {
+				return err
+			}
+
+			if err := p.pager.write(id, f.data, f.lsn); err != nil {
+				return err
+			}
+
+			p.stats.WriteBacks++
+		}
+
+		p.evict(id)
+		p.stats.Evictions++
+	}
+
+	return nil
+}
+
+// drop evicts the pages from count on without writing them back, as
+// they're no longer part of the file.
+func (p *pool) drop(count uint32) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for id := range p.frames {
+		if uint32(id) >= count {
+			p.evict(id)
+		}
+	}
+}
+
+// writeBack writes every dirty page to the tree file.
+func (p *pool) writeBack() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	var lsn uint64
+	for _, f := range p.frames {
+		if f.dirty {
+			lsn = max(lsn, f.lsn)
+		}
+	}
+
+	if lsn != 0 {
+		if err := p.sync(lsn); err != nil {
+			return err
+		}
+	}
+
+	for _, id := range slices.Sorted(maps.Keys(p.frames)) {
+		f := p.frames[id]
+		if !f.dirty {
+			continue
+		}
+
+		if err := p.pager.write(id, f.data, f.lsn); err != nil {
+			return err
+		}
+
+		f.dirty = false
+		p.stats.WriteBacks++
+	}
+
+	return nil
+}
+
+func (p *pool) cacheStats() CacheStats {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	s := p.stats
+	s.Resident = len(p.frames)
+	s.Internal = p.internal
+	for _, f := range p.frames {
+		if f.dirty {
+			s.Dirty++
+		}
+	}
+
+	return s
+}
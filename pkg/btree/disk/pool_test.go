@@ -0,0 +1,213 @@
+package disk
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"path/filepath"
+	"testing"
+)
+
+func TestReplacers(t *testing.T) {
+	all := func(pageID) bool { return true }
+
+	cases := []struct {
+		name     string
+		replacer replacer
+		expected pageID
+	}{
+		// 2 is the least recently used, as 1 was used after it.
+		{"LRU", newLRU(), 2},
+		// The hand clears the reference bits of 2, 3 and 4 on its first
+		// sweep, and then 2 is the first one without it.
+		{"Clock", newClock(), 2},
+		// 1 got into the main queue after being evicted, so 2 is the
+		// oldest page of the FIFO one.
+		{"2Q", new2Q(4), 2},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := c.replacer
+
+			for id := range pageID(4) {
+				r.insert(id + 1)
+			}
+
+			if c.name == "2Q" {
+				r.remove(1)
+				r.insert(1)
+			}
+
+			r.access(1)
+			r.access(3)
+			r.access(4)
+
+			if c.name == "Clock" {
+				r.victim(func(id pageID) bool { return id == 1 })
+				r.access(1)
+			}
+
+			if id, ok := r.victim(func(id pageID) bool { return id != 1 }); !ok || id != c.expected {
+				t.Fatalf("expected %v to be evicted, got %v", c.expected, id)
+			}
+
+			r.remove(c.expected)
+
+			if _, ok := r.victim(func(pageID) bool { return false }); ok {
+				t.Fatalf("expected no victim without evictable pages")
+			}
+
+			for range 3 {
+				id, ok := r.victim(all)
+				if !ok {
+					t.Fatalf("expected a victim")
+				}
+
+				r.remove(id)
+			}
+
+			if id, ok := r.victim(all); ok {
+				t.Fatalf("expected an empty replacer, got %v", id)
+			}
+		})
+	}
+}
+
+func TestBoundedPool(t *testing.T) {
+	for _, e := range []Eviction{EvictLRU, EvictClock, Evict2Q} {
+		path := filepath.Join(t.TempDir(), "tree")
+		r := rand.New(rand.NewSource(int64(e)))
+		expected := map[int]int{}
+
+		opts := &Options[int]{PageSize: 256, MinimumDegree: 2, CacheSize: 10 * 256, Eviction: e}
+		bt := openTree(t, path, opts)
+
+		for range 3000 {
+			k := r.Intn(1000)
+			if r.Intn(3) == 0 {
+				if _, err := bt.Delete(k); err != nil {
+					t.Fatalf("failed to delete %v: %v", k, err)
+				}
+				delete(expected, k)
+			} else {
+				if err := bt.Insert(k, k); err != nil {
+					t.Fatalf("failed to insert %v: %v", k, err)
+				}
+				expected[k] = k
+			}
+
+			if s := bt.CacheStats(); s.Resident > 10 {
+				t.Fatalf("%v: expected at most 10 resident pages, got %v", e, s.Resident)
+			}
+
+			if _, ok := bt.pool.frames[bt.meta.root.id]; !ok {
+				t.Fatalf("%v: root page %v isn't resident", e, bt.meta.root)
+			}
+		}
+
+		checkInvariants(t, bt)
+
+		for k := range 1000 {
+			v, err := bt.Search(k)
+			if err != nil {
+				t.Fatalf("failed to search %v: %v", k, err)
+			}
+
+			if ev, ok := expected[k]; !ok && v != nil || ok && v != ev {
+				t.Fatalf("expected %v to be %v, got %v", k, ev, v)
+			}
+		}
+
+		s := bt.CacheStats()
+		if s.Evictions == 0 || s.WriteBacks == 0 || s.Misses == 0 || s.Hits == 0 {
+			t.Fatalf("%v: expected every counter to be set, got %+v", e, s)
+		}
+
+		if err := bt.Close(); err != nil {
+			t.Fatalf("failed to close tree: %v", err)
+		}
+
+		bt = openTree(t, path, opts)
+
+		checkInvariants(t, bt)
+
+		if err := bt.Close(); err != nil {
+			t.Fatalf("failed to close tree: %v", err)
+		}
+	}
+}
+
+func TestCheckpointWritesBack(t *testing.T) {
+	bt := openTree(t, filepath.Join(t.TempDir(), "tree"), &Options[int]{})
+	defer bt.Close()
+
+	for k := range 100 {
+		if err := bt.Insert(k, k); err != nil {
+			t.Fatalf("failed to insert %v: %v", k, err)
+		}
+	}
+
+	if s := bt.CacheStats(); s.Dirty == 0 {
+		t.Fatalf("expected dirty pages before the checkpoint, got %+v", s)
+	}
+
+	if err := bt.Checkpoint(); err != nil {
+		t.Fatalf("failed to checkpoint: %v", err)
+	}
+
+	if s := bt.CacheStats(); s.Dirty != 0 {
+		t.Fatalf("expected no dirty pages after the checkpoint, got %+v", s)
+	}
+}
+
+func TestInternalPagesSurviveScans(t *testing.T) {
+	for _, e := range []Eviction{EvictLRU, EvictClock, Evict2Q} {
+		path := filepath.Join(t.TempDir(), "tree")
+		opts := &Options[int]{PageSize: 512, MinimumDegree: 6, CacheSize: 128 * 512, Eviction: e}
+
+		bt := openTree(t, path, opts)
+		for k := range 3000 {
+			if err := bt.Insert(k, k); err != nil {
+				t.Fatalf("failed to insert %v: %v", k, err)
+			}
+		}
+
+		var internal []pageID
+
+		nodes := []ref{bt.meta.root}
+		for len(nodes) > 0 {
+			n, err := bt.load(nodes[0])
+			if err != nil {
+				t.Fatalf("failed to load page %v: %v", nodes[0], err)
+			}
+
+			nodes = nodes[1:]
+			if !n.leaf {
+				internal = append(internal, n.id)
+				nodes = append(nodes, n.childs...)
+			}
+		}
+
+		// Backups read every page through the pool, which holds a fraction
+		// of them.
+		if _, err := bt.Backup(context.Background(), io.Discard); err != nil {
+			t.Fatalf("failed to back up the tree: %v", err)
+		}
+
+		s := bt.CacheStats()
+		if s.Evictions == 0 || s.Internal != len(internal) {
+			t.Errorf("%v: expected evictions and %v internal pages, got %+v", e, len(internal), s)
+		}
+
+		for _, id := range internal {
+			if _, ok := bt.pool.frames[id]; !ok {
+				t.Errorf("%v: internal page %v was evicted by the scan", e, id)
+			}
+		}
+
+		if err := bt.Close(); err != nil {
+			t.Fatalf("failed to close tree: %v", err)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+//go:build linux
+
+package disk
+
+import (
+	"errors"
+	"syscall"
+)
+
+const (
+	fallocKeepSize  = 0x1
+	fallocPunchHole = 0x2
+)
+
+func (f osFile) stat() (*syscall.Stat_t, error) {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(int(f.Fd()), &st); err != nil {
+		return nil, err
+	}
+
+	return &st, nil
+}
+
+func (f osFile) BlockSize() (int64, error) {
+	st, err := f.stat()
+	if err != nil {
+		return 0, err
+	}
+
+	return st.Blksize, nil
+}
+
+func (f osFile) PunchHole(off, size int64) error {
+	err := syscall.Fallocate(int(f.Fd()), fallocKeepSize|fallocPunchHole, off, size)
+	if errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, syscall.ENOSYS) {
+		return errors.ErrUnsupported
+	}
+
+	return err
+}
+
+// Allocated returns the blocks of the file, which stat counts in 512 bytes.
+func (f osFile) Allocated() (int64, error) {
+	st, err := f.stat()
+	if err != nil {
+		return 0, err
+	}
+
+	return st.Blocks * 512, nil
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+package disk
+
+import "errors"
+
+func (f osFile) BlockSize() (int64, error) {
+	return 0, errors.ErrUnsupported
+}
+
+func (f osFile) PunchHole(off, size int64) error {
+	return errors.ErrUnsupported
+}
+
+func (f osFile) Allocated() (int64, error) {
+	return 0, errors.ErrUnsupported
+}
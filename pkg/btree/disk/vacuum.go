@@ -0,0 +1,434 @@
+package disk
+
+import (
+	"context"
+	"maps"
+	"math"
+	"slices"
+)
+
+// freeList returns the references to the pages of the free list, in
+// order.
+func (bt *BTree[K]) freeList() ([]ref, error) {
+	var refs []ref
+
+	for r := bt.meta.free; r.id != 0; {
+		n, err := bt.load(r)
+		if err != nil {
+			return nil, err
+		}
+
+		if !n.free || len(refs) >= int(bt.meta.count) {
+			return nil, corruption(r.id, "page in the free list isn't free or the list has a cycle")
+		}
+
+		refs = append(refs, r)
+		r = n.next
+	}
+
+	return refs, nil
+}
+
+// path returns the nodes from the root down to page id, or to the leaf
+// that may hold k if it doesn't meet it. Each node holds the LSN of the
+// next one, so it marks the ones above the last, for the caller to change.
+func (bt *BTree[K]) path(k []byte, id pageID) ([]*node, error) {
+	n, err := bt.load(bt.meta.root)
+	if err != nil {
+		return nil, err
+	}
+
+	path := []*node{n}
+	for n.id != id && !n.leaf {
+		if n, err = bt.load(n.childs[n.child(k)]); err != nil {
+			return nil, err
+		}
+
+		path = append(path, n)
+	}
+
+	for _, n := range path[:len(path)-1] {
+		bt.mark(n)
+	}
+
+	return path, nil
+}
+
+// parent returns the node pointing to n, a node other than the root, along
+// with the index of the pointer, marking the nodes leading to it. It's
+// found by looking up the first key of n.
+func (bt *BTree[K]) parent(n *node) (*node, int, error) {
+	if len(n.entries) == 0 {
+		return nil, 0, corruption(n.id, "node other than the root without entries")
+	}
+
+	k := n.entries[0].key()
+
+	path, err := bt.path(k, n.id)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if len(path) < 2 || path[len(path)-1].id != n.id {
+		return nil, 0, corruption(n.id, "node isn't reachable by its first key")
+	}
+
+	p := path[len(path)-2]
+	bt.mark(p)
+
+	return p, p.child(k), nil
+}
+
+// chainOf returns the entry whose overflow chain holds the overflow page
+// n, and the page before n in it, or nil if n is the first one. It marks
+// the pages that reference n, directly or not: the nodes down to the leaf
+// of the entry, which then holds a copy of it for the caller to change,
+// and the pages before n in the chain.
+func (bt *BTree[K]) chainOf(n *node) (*entry, *node, error) {
+	first := n
+	for steps := 0; first.prev != 0; steps++ {
+		if steps >= int(bt.meta.count) {
+			return nil, nil, corruption(n.id, "overflow chain has a cycle")
+		}
+
+		var err error
+		if first, err = bt.loadPage(first.prev); err != nil {
+			return nil, nil, err
+		}
+
+		if !first.overflow {
+			return nil, nil, corruption(n.id, "invalid overflow chain")
+		}
+	}
+
+	path, err := bt.path(first.key, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	leaf := path[len(path)-1]
+
+	i, found := slices.BinarySearchFunc(leaf.entries, first.key, (*entry).compare)
+	if !found || leaf.entries[i].overflow.id != first.id {
+		return nil, nil, corruption(n.id, "overflow chain isn't referenced by its entry")
+	}
+
+	e := *leaf.entries[i]
+	leaf.entries[i] = &e
+	bt.mark(leaf)
+
+	var (
+		prev    *node
+		reached bool
+	)
+
+	err = bt.chain(&e, func(o *node) bool {
+		if reached = o.id == n.id; reached {
+			return false
+		}
+
+		bt.mark(o)
+		prev = o
+
+		return true
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !reached {
+		return nil, nil, corruption(n.id, "overflow page isn't part of the chain it links to")
+	}
+
+	return &e, prev, nil
+}
+
+// moveOverflow relinks the overflow page n, moving to page to.
+func (bt *BTree[K]) moveOverflow(n *node, to pageID) error {
+	e, prev, err := bt.chainOf(n)
+	if err != nil {
+		return err
+	}
+
+	if prev == nil {
+		e.overflow = ref{id: to}
+	} else {
+		prev.next = ref{id: to}
+	}
+
+	if n.next.id != 0 {
+		c, err := bt.load(n.next)
+		if err != nil {
+			return err
+		}
+
+		c.prev = to
+		bt.mark(c)
+	}
+
+	return nil
+}
+
+// move moves the node or overflow page of page from to page to.
+func (bt *BTree[K]) move(from, to pageID) error {
+	n, err := bt.loadPage(from)
+	if err != nil {
+		return err
+	}
+
+	if n.overflow {
+		if err := bt.moveOverflow(n, to); err != nil {
+			return err
+		}
+	} else if from == bt.meta.root.id {
+		if _, ok := bt.dirty[from]; !ok && n.lsn != bt.meta.root.lsn {
+			return staleLSN(bt.meta.root, n.lsn)
+		}
+
+		bt.meta.root = ref{id: to}
+	} else {
+		p, i, err := bt.parent(n)
+		if err != nil {
+			return err
+		}
+
+		p.childs[i] = ref{id: to}
+	}
+
+	delete(bt.dirty, from)
+
+	n.id = to
+	bt.mark(n)
+
+	return nil
+}
+
+// vacuum moves up to limit nodes from the end of the file to the lowest
+// free pages, dropping the free pages left at the end. It returns the
+// number of pages the file shrinks by.
+func (bt *BTree[K]) vacuum(limit int) (int, error) {
+	refs, err := bt.freeList()
+	if err != nil || len(refs) == 0 {
+		return 0, err
+	}
+
+	free := map[pageID]bool{}
+	for _, r := range refs {
+		free[r.id] = true
+	}
+
+	targets := slices.Sorted(maps.Keys(free))
+	count := bt.meta.count
+
+	for moved := 0; ; moved++ {
+		for free[pageID(count-1)] {
+			delete(free, pageID(count-1))
+			count--
+		}
+
+		if len(free) == 0 || moved == limit {
+			break
+		}
+
+		for !free[targets[0]] {
+			targets = targets[1:]
+		}
+
+		if err := bt.move(pageID(count-1), targets[0]); err != nil {
+			return 0, err
+		}
+
+		delete(free, targets[0])
+		count--
+	}
+
+	// Unlinks the pages taken from the free list, rewriting the ones whose
+	// next page changes, or is rewritten, as they hold its LSN.
+	next := map[pageID]pageID{}
+	for i, r := range refs[:len(refs)-1] {
+		next[r.id] = refs[i+1].id
+	}
+
+	left := slices.DeleteFunc(refs, func(r ref) bool {
+		return !free[r.id]
+	})
+
+	bt.meta.free = ref{}
+	for i := len(left) - 1; i >= 0; i-- {
+		_, rewritten := bt.dirty[bt.meta.free.id]
+		if rewritten || next[left[i].id] != bt.meta.free.id {
+			bt.mark(&node{id: left[i].id, free: true, next: bt.meta.free})
+		}
+
+		bt.meta.free = left[i]
+	}
+
+	reclaimed := int(bt.meta.count - count)
+	bt.meta.count = count
+
+	return reclaimed, nil
+}
+
+// shrink truncates the file to count pages, once the operation that
+// reclaimed the ones past it is durable. Writes committed since then may
+// have taken pages back, so it keeps those in use by the tree.
+func (bt *BTree[K]) shrink(count uint32) error {
+	count = max(count, bt.meta.count)
+
+	bt.pool.drop(count)
+
+	if err := bt.pager.truncate(count); err != nil {
+		bt.failed = err
+
+		return err
+	}
+
+	return nil
+}
+
+// generation returns a copy of the tree as of its last commit, which keeps
+// the pages its operation changes to itself, so that it runs without the
+// tree lock while other operations read the tree.
+func (bt *BTree[K]) generation() (*BTree[K], error) {
+	bt.mutex.RLock()
+	defer bt.mutex.RUnlock()
+
+	if err := bt.writable(); err != nil {
+		return nil, err
+	}
+
+	if bt.cow != nil {
+		return nil, ErrAppendOnly
+	}
+
+	m := bt.committed
+
+	return &BTree[K]{
+		pager:     bt.pager,
+		meta:      &m,
+		t:         bt.t,
+		maxEntry:  bt.maxEntry,
+		dirty:     map[pageID]*node{},
+		keys:      bt.keys,
+		values:    bt.values,
+		pool:      bt.pool,
+		committed: m,
+		catalog:   bt.catalog,
+	}, nil
+}
+
+// moveNodes moves up to limit nodes to free pages and commits it, returning
+// the commit, the number of pages reclaimed and the page count left. The
+// nodes are relocated in a generation of the tree, which only takes the
+// tree lock to be published; if a write was committed meanwhile, they're
+// relocated again from it.
+func (bt *BTree[K]) moveNodes(limit int) (*Commit, int, uint32, error) {
+	for {
+		g, err := bt.generation()
+		if err != nil {
+			return nil, 0, 0, err
+		}
+
+		reclaimed, err := g.vacuum(limit)
+
+		bt.mutex.Lock()
+
+		if werr := bt.writable(); werr != nil {
+			bt.mutex.Unlock()
+
+			return nil, 0, 0, werr
+		}
+
+		if bt.meta.lsn != g.committed.lsn {
+			bt.mutex.Unlock()
+
+			continue
+		}
+
+		if err != nil || reclaimed == 0 {
+			bt.mutex.Unlock()
+
+			return nil, 0, 0, err
+		}
+
+		commit, err := bt.write(func(*node) error {
+			maps.Copy(bt.dirty, g.dirty)
+			*bt.meta = *g.meta
+
+			return nil
+		})
+		count := bt.meta.count
+
+		bt.mutex.Unlock()
+
+		return commit, reclaimed, count, err
+	}
+}
+
+// vacuumStep runs a step of a vacuum. The tree lock is only taken to
+// publish the relocated nodes and to truncate the file: unless writes sync
+// as they commit, with SyncEveryWrite, the WAL is synced without it.
+func (bt *BTree[K]) vacuumStep(limit int) (int, error) {
+	bt.vacuuming.Lock()
+	defer bt.vacuuming.Unlock()
+
+	commit, reclaimed, count, err := bt.moveNodes(limit)
+	if err != nil || reclaimed == 0 {
+		return 0, err
+	}
+
+	// The pages dropped mustn't outlive the record moving them, whatever
+	// the durability.
+	if err := bt.commit.sync(commit.lsn); err != nil {
+		return 0, err
+	}
+
+	bt.mutex.Lock()
+	defer bt.mutex.Unlock()
+
+	if err := bt.usable(); err != nil {
+		return 0, err
+	}
+
+	return reclaimed, bt.shrink(count)
+}
+
+// Vacuum compacts the file, moving the nodes at its end to free pages, and
+// truncates it. Readers go on while it relocates every node at once, but
+// writers committed meanwhile make it start over; VacuumIncremental moves
+// a few at a time. Append-only trees return ErrAppendOnly.
+func (bt *BTree[K]) Vacuum() error {
+	if _, err := bt.vacuumStep(math.MaxInt); err != nil {
+		return err
+	}
+
+	return bt.Checkpoint()
+}
+
+// VacuumIncremental compacts the file like Vacuum, but moving at most step
+// nodes at a time. Each step relocates its nodes against the last commit
+// without blocking other operations, and only blocks them to commit the
+// result, as writes do; a step is relocated again if a write was committed
+// meanwhile. With SyncEveryWrite, the commit includes a WAL sync; with
+// other durabilities, the WAL is synced without blocking them. It returns
+// the number of pages the file shrank by, and stops early when ctx is done.
+func (bt *BTree[K]) VacuumIncremental(ctx context.Context, step int) (int, error) {
+	if step < 1 {
+		step = 1
+	}
+
+	var reclaimed int
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return reclaimed, err
+		}
+
+		n, err := bt.vacuumStep(step)
+		if err != nil || n == 0 {
+			return reclaimed, err
+		}
+
+		reclaimed += n
+	}
+}
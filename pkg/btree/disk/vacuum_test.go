@@ -0,0 +1,240 @@
+package disk
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func fileSize(t *testing.T, path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("failed to stat %v: %v", path, err)
+	}
+
+	return info.Size()
+}
+
+func TestFreePagesReused(t *testing.T) {
+	bt := openTree(t, filepath.Join(t.TempDir(), "tree"), &Options[int]{PageSize: 256, MinimumDegree: 2})
+	defer bt.Close()
+
+	var count uint32
+
+	for round := range 3 {
+		for k := range 500 {
+			if err := bt.Insert(k, k); err != nil {
+				t.Fatalf("failed to insert %v: %v", k, err)
+			}
+		}
+
+		for k := range 500 {
+			if _, err := bt.Delete(k); err != nil {
+				t.Fatalf("failed to delete %v: %v", k, err)
+			}
+		}
+
+		ids, err := bt.freeList()
+		if err != nil {
+			t.Fatalf("failed to read the free list: %v", err)
+		}
+
+		// Every page but the meta and root ones is free once the tree is
+		// empty, so the next round takes every page it needs from the free
+		// list.
+		if len(ids) != int(bt.meta.count)-2 {
+			t.Fatalf("round %v: expected %v free pages, got %v", round, bt.meta.count-2, len(ids))
+		}
+
+		if round > 0 && bt.meta.count != count {
+			t.Fatalf("round %v: expected the file to keep %v pages, got %v", round, count, bt.meta.count)
+		}
+		count = bt.meta.count
+	}
+}
+
+func fillAndThin(t testing.TB, bt *BTree[int]) map[int]int {
+	expected := map[int]int{}
+
+	for k := range 2000 {
+		if err := bt.Insert(k, k); err != nil {
+			t.Fatalf("failed to insert %v: %v", k, err)
+		}
+		expected[k] = k
+	}
+
+	for k := range 2000 {
+		if k%10 != 0 {
+			if _, err := bt.Delete(k); err != nil {
+				t.Fatalf("failed to delete %v: %v", k, err)
+			}
+			delete(expected, k)
+		}
+	}
+
+	return expected
+}
+
+func checkContents(t *testing.T, bt *BTree[int], expected map[int]int) {
+	checkInvariants(t, bt)
+
+	for k := range 2000 {
+		v, err := bt.Search(k)
+		if err != nil {
+			t.Fatalf("failed to search %v: %v", k, err)
+		}
+
+		if ev, ok := expected[k]; !ok && v != nil || ok && v != ev {
+			t.Fatalf("expected %v to be %v, got %v", k, ev, v)
+		}
+	}
+}
+
+func TestVacuum(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tree")
+	opts := &Options[int]{PageSize: 256, MinimumDegree: 2}
+
+	bt := openTree(t, path, opts)
+	expected := fillAndThin(t, bt)
+
+	if err := bt.Checkpoint(); err != nil {
+		t.Fatalf("failed to checkpoint: %v", err)
+	}
+
+	before := fileSize(t, path)
+
+	if err := bt.Vacuum(); err != nil {
+		t.Fatalf("failed to vacuum: %v", err)
+	}
+
+	after := fileSize(t, path)
+	if bt.meta.free.id != 0 || after >= before || after != int64(bt.meta.count)*256 {
+		t.Fatalf("expected the file to shrink from %v to %v pages, got %v bytes and free list %v",
+			before/256, bt.meta.count, after, bt.meta.free)
+	}
+
+	checkContents(t, bt, expected)
+
+	if err := bt.Close(); err != nil {
+		t.Fatalf("failed to close tree: %v", err)
+	}
+
+	bt = openTree(t, path, opts)
+	defer bt.Close()
+
+	checkContents(t, bt, expected)
+}
+
+func TestVacuumIncremental(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tree")
+
+	bt := openTree(t, path, &Options[int]{PageSize: 256, MinimumDegree: 2})
+	defer bt.Close()
+
+	expected := fillAndThin(t, bt)
+	count := bt.meta.count
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for k := 0; ; k = (k + 10) % 2000 {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				if v, err := bt.Search(k); err != nil || v != k {
+					t.Errorf("expected %v while vacuuming, got %v, %v", k, v, err)
+
+					return
+				}
+			}
+		}()
+	}
+
+	// Writes committed while a step relocates make it start over. They
+	// rewrite a value in place, so they take no pages.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			if err := bt.Insert(0, 0); err != nil {
+				t.Errorf("failed to insert while vacuuming: %v", err)
+
+				return
+			}
+		}
+	}()
+
+	reclaimed, err := bt.VacuumIncremental(context.Background(), 3)
+	close(done)
+	wg.Wait()
+
+	if err != nil {
+		t.Fatalf("failed to vacuum: %v", err)
+	}
+
+	if reclaimed == 0 || bt.meta.free.id != 0 || bt.meta.count != count-uint32(reclaimed) {
+		t.Fatalf("expected %v pages to be left, got %v", count-uint32(reclaimed), bt.meta.count)
+	}
+
+	checkContents(t, bt, expected)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := bt.VacuumIncremental(ctx, 1); err != context.Canceled {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+}
+
+// BenchmarkVacuumStep measures the relocation and commit of a vacuum step,
+// for steps of 16 nodes. Only the commit holds the tree lock.
+func BenchmarkVacuumStep(b *testing.B) {
+	for _, d := range []struct {
+		name       string
+		durability Durability
+	}{
+		{"SyncEveryWrite", SyncEveryWrite},
+		{"NoSync", NoSync},
+	} {
+		b.Run(d.name, func(b *testing.B) {
+			bt, err := Open(filepath.Join(b.TempDir(), "tree"), &Options[int]{
+				PageSize:      256,
+				MinimumDegree: 2,
+				Durability:    d.durability,
+			})
+			if err != nil {
+				b.Fatalf("failed to open tree: %v", err)
+			}
+			defer bt.Close()
+
+			for range b.N {
+				if bt.meta.free.id == 0 {
+					b.StopTimer()
+					fillAndThin(b, bt)
+					b.StartTimer()
+				}
+
+				if _, _, _, err := bt.moveNodes(16); err != nil {
+					b.Fatalf("failed to vacuum: %v", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,363 @@
+package disk
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Report is the result of Verify.
+type Report struct {
+	FormatVersion int
+	// AppendOnly is set for append-only trees, whose free pages are the
+	// ones the tree doesn't reach.
+	AppendOnly    bool
+	PageSize      int
+	MinimumDegree int
+	Pages         int
+	Nodes         int
+	FreePages     int
+	OverflowPages int
+	Entries       int
+	Depth         int
+	// Buckets is the number of buckets of DB files. The trees of buckets
+	// are checked along with the catalog, whose depth is Depth.
+	Buckets int
+	// WALRecords is the number of WAL records taken into account, as
+	// opening the tree would replay them.
+	WALRecords int
+	// Problems holds a *CorruptionError for each problem found.
+	Problems []error
+}
+
+func (r *Report) OK() bool {
+	return len(r.Problems) == 0
+}
+
+func (r *Report) String() string {
+	var b strings.Builder
+
+	layout := ""
+	if r.AppendOnly {
+		layout = ", append-only"
+	}
+
+	fmt.Fprintf(&b, "pages: %d (format version %d%s, page size %d, minimum degree %d)\n",
+		r.Pages, r.FormatVersion, layout, r.PageSize, r.MinimumDegree)
+	fmt.Fprintf(&b, "nodes: %d, overflow pages: %d, free pages: %d, entries: %d, depth: %d\n",
+		r.Nodes, r.OverflowPages, r.FreePages, r.Entries, r.Depth)
+	if r.Buckets > 0 {
+		fmt.Fprintf(&b, "buckets: %d\n", r.Buckets)
+	}
+	fmt.Fprintf(&b, "wal records: %d\n", r.WALRecords)
+
+	if r.OK() {
+		b.WriteString("ok\n")
+
+		return b.String()
+	}
+
+	fmt.Fprintf(&b, "%d problems:\n", len(r.Problems))
+	for _, p := range r.Problems {
+		fmt.Fprintf(&b, "  %v\n", p)
+	}
+
+	return b.String()
+}
+
+// VerifyOptions sets the KeyProvider of encrypted trees.
+type VerifyOptions struct {
+	Encryption KeyProvider
+}
+
+type verifier struct {
+	report *Report
+	pager  *pager
+	meta   *meta
+	seen   map[pageID]bool
+	// root, degree and depth are the ones of the tree being walked, the
+	// tree of the file or a bucket of a DB.
+	root   pageID
+	degree int
+	depth  int
+	// catalog is set while walking the catalog of a DB, which gathers
+	// the entries of its buckets.
+	catalog bool
+	buckets []*bucket
+}
+
+func (v *verifier) problem(id pageID, format string, args ...any) {
+	v.report.Problems = append(v.report.Problems, corruption(id, fmt.Sprintf(format, args...)))
+}
+
+// visit loads the page r references, unless it's out of range or was
+// already visited, checking it holds the LSN r expects.
+func (v *verifier) visit(r ref) *node {
+	id := r.id
+
+	if v.pager.isMeta(id) || uint32(id) >= v.meta.count {
+		v.problem(id, "page is out of range")
+
+		return nil
+	}
+
+	if v.seen[id] {
+		v.problem(id, "page is referenced more than once")
+
+		return nil
+	}
+	v.seen[id] = true
+
+	buf, err := v.pager.read(id)
+	if err != nil {
+		v.report.Problems = append(v.report.Problems, err)
+
+		return nil
+	}
+
+	n, err := decodeNode(id, buf)
+	if err != nil {
+		v.report.Problems = append(v.report.Problems, err)
+
+		return nil
+	}
+
+	if n.lsn != r.lsn {
+		v.report.Problems = append(v.report.Problems, staleLSN(r, n.lsn))
+	}
+
+	return n
+}
+
+func (v *verifier) walk(r ref, level int, lo, hi []byte) {
+	id := r.id
+
+	n := v.visit(r)
+	if n == nil {
+		return
+	}
+
+	if n.free || n.overflow {
+		v.problem(id, "free or overflow page is part of the tree")
+
+		return
+	}
+
+	v.report.Nodes++
+
+	// Leaves hold the entries, and internal nodes keys strictly between
+	// the bounds of their subtree, as none of their childs is empty.
+	t := v.degree
+	if n.leaf && len(n.entries) > 2*t-1 || id != v.root && len(n.entries) < t-1 ||
+		id == v.root && !n.leaf && len(n.entries) == 0 {
+		v.problem(id, "node has %d entries, out of the bounds of minimum degree %d", len(n.entries), t)
+	}
+
+	for i, e := range n.entries {
+		low := lo != nil && (e.compare(lo) < 0 || !n.leaf && e.compare(lo) == 0)
+		if low || hi != nil && e.compare(hi) >= 0 || i > 0 && e.compare(n.entries[i-1].key()) <= 0 {
+			v.problem(id, "key %x is out of order", e.key())
+		}
+
+		if !n.leaf {
+			continue
+		}
+
+		v.report.Entries++
+
+		if e.overflow.id != 0 {
+			v.walkOverflow(e)
+		}
+
+		if v.catalog {
+			v.catalogEntry(id, e)
+		}
+	}
+
+	if n.leaf {
+		if v.depth == -1 {
+			v.depth = level
+		} else if v.depth != level {
+			v.problem(id, "leaf is at depth %d, others at %d", level, v.depth)
+		}
+
+		return
+	}
+
+	for i, c := range n.childs {
+		clo, chi := lo, hi
+		if i > 0 {
+			clo = n.entries[i-1].key()
+		}
+		if i < len(n.entries) {
+			chi = n.entries[i].key()
+		}
+
+		v.walk(c, level+1, clo, chi)
+	}
+}
+
+// catalogEntry gathers the bucket of the catalog entry e, held by page id.
+func (v *verifier) catalogEntry(id pageID, e *entry) {
+	if e.overflow.id != 0 {
+		v.problem(id, "catalog entry of key %x spills", e.key())
+
+		return
+	}
+
+	b, ok := decodeBucket(e.v)
+	if !ok {
+		v.problem(id, "catalog entry of key %x is malformed", e.key())
+
+		return
+	}
+
+	v.buckets = append(v.buckets, b)
+}
+
+// walkTree walks the tree of the given root and minimum degree, returning
+// its depth.
+func (v *verifier) walkTree(root ref, degree int) int {
+	v.root, v.degree, v.depth = root.id, degree, -1
+	v.walk(root, 0, nil, nil)
+
+	return v.depth + 1
+}
+
+func (v *verifier) walkOverflow(e *entry) {
+	var (
+		prev   pageID
+		length int
+	)
+
+	for r := e.overflow; r.id != 0; {
+		id := r.id
+
+		n := v.visit(r)
+		if n == nil {
+			return
+		}
+
+		if !n.overflow {
+			v.problem(id, "page in an overflow chain isn't an overflow page")
+
+			return
+		}
+
+		if n.prev != prev {
+			v.problem(id, "overflow page links back to page %d, expected %d", n.prev, prev)
+		}
+
+		if prev == 0 && e.compare(n.key) != 0 {
+			v.problem(id, "overflow chain of key %x holds key %x", e.key(), n.key)
+		}
+
+		v.report.OverflowPages++
+		length += len(n.data)
+		prev, r = id, n.next
+	}
+
+	if length != int(e.length) {
+		v.problem(e.overflow.id, "overflow chain holds %d bytes, expected %d", length, e.length)
+	}
+}
+
+func (v *verifier) walkFreeList() {
+	for r := v.meta.free; r.id != 0; {
+		n := v.visit(r)
+		if n == nil {
+			return
+		}
+
+		if !n.free {
+			v.problem(r.id, "page in the free list isn't free")
+
+			return
+		}
+
+		v.report.FreePages++
+		r = n.next
+	}
+}
+
+// Verify checks the whole tree stored at path: page checksums, the LSN of
+// each page against its reference, key order, node occupancy, leaf depth,
+// overflow chains and the free list, and that every page is either part of
+// the tree or free, the trees of the buckets of DB files included. Pages
+// are read as they'd be after replaying the WAL, which is left untouched,
+// and so is the file.
+//
+// The problems found are listed in the report. An error is only returned
+// if the file can't be read, isn't a tree file or is open for writing, by
+// another process or this one, like ErrLocked. Encrypted trees need
+// opts.Encryption.
+func Verify(path string, opts *VerifyOptions) (*Report, error) {
+	if opts == nil {
+		opts = &VerifyOptions{}
+	}
+
+	file, err := OSFS.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	lock, err := lockFile(path, true)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.unlock()
+
+	v := &verifier{
+		report: &Report{},
+		pager:  &pager{file: file},
+		seen:   map[pageID]bool{},
+	}
+
+	if opts.Encryption != nil {
+		if v.pager.crypt, err = newCrypter(opts.Encryption); err != nil {
+			return nil, err
+		}
+	}
+
+	overlay, err := readWAL(OSFS, path+"-wal")
+	if err != nil {
+		return nil, err
+	}
+
+	v.pager.overlay = overlay.pages
+	v.report.WALRecords = overlay.records
+
+	if v.meta, err = v.pager.readMeta(); err != nil {
+		return nil, err
+	}
+
+	v.report.FormatVersion = v.meta.version
+	v.report.AppendOnly = v.meta.appendOnly
+	v.report.PageSize = int(v.meta.pageSize)
+	v.report.MinimumDegree = int(v.meta.degree)
+	v.report.Pages = int(v.meta.count)
+
+	v.catalog = v.meta.buckets
+	v.report.Depth = v.walkTree(v.meta.root, int(v.meta.degree))
+	v.catalog = false
+
+	for _, b := range v.buckets {
+		v.walkTree(b.root, b.degree)
+	}
+	v.report.Buckets = len(v.buckets)
+
+	v.walkFreeList()
+
+	for id := pageID(1); uint32(id) < v.meta.count; id++ {
+		switch {
+		case v.seen[id] || v.pager.isMeta(id):
+		case v.meta.appendOnly:
+			v.report.FreePages++
+		default:
+			v.problem(id, "page is neither part of the tree nor free")
+		}
+	}
+
+	return v.report, nil
+}
@@ -0,0 +1,284 @@
+package disk
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func filledTree(t *testing.T, path string) *BTree[int] {
+	bt := openTree(t, path, &Options[int]{PageSize: 256, MinimumDegree: 2})
+
+	for k := range 500 {
+		if err := bt.Insert(k, k); err != nil {
+			t.Fatalf("failed to insert %v: %v", k, err)
+		}
+	}
+
+	for k := range 500 {
+		if k%3 != 0 {
+			if _, err := bt.Delete(k); err != nil {
+				t.Fatalf("failed to delete %v: %v", k, err)
+			}
+		}
+	}
+
+	return bt
+}
+
+// firstLeaf returns the leftmost leaf of the tree.
+func firstLeaf(t *testing.T, bt *BTree[int]) *node {
+	n, err := bt.load(bt.meta.root)
+	for err == nil && !n.leaf {
+		n, err = bt.load(n.childs[0])
+	}
+	if err != nil {
+		t.Fatalf("failed to load the leftmost leaf: %v", err)
+	}
+
+	return n
+}
+
+// rewrite marks n, a node other than the root, to be rewritten along with
+// the nodes leading to it, which hold its LSN.
+func rewrite(bt *BTree[int], n *node) error {
+	if _, _, err := bt.parent(n); err != nil {
+		return err
+	}
+
+	bt.mark(n)
+
+	return nil
+}
+
+// copyTree copies the tree file at path and its WAL, if any, to another
+// directory while the tree is open, as a crash would leave them, and returns
+// the path of the copy, which the open tree's lock doesn't cover.
+func copyTree(t *testing.T, path string) string {
+	dst := filepath.Join(t.TempDir(), filepath.Base(path))
+
+	for _, suffix := range []string{"", "-wal"} {
+		data, err := os.ReadFile(path + suffix)
+		if errors.Is(err, os.ErrNotExist) && suffix != "" {
+			continue
+		} else if err != nil {
+			t.Fatalf("failed to read %v: %v", path+suffix, err)
+		}
+
+		if err := os.WriteFile(dst+suffix, data, 0o644); err != nil {
+			t.Fatalf("failed to write %v: %v", dst+suffix, err)
+		}
+	}
+
+	return dst
+}
+
+func verify(t *testing.T, path string) *Report {
+	r, err := Verify(path, nil)
+	if err != nil {
+		t.Fatalf("failed to verify %v: %v", path, err)
+	}
+
+	return r
+}
+
+func TestVerify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tree")
+	bt := filledTree(t, path)
+
+	// The tree isn't closed, so part of it is only in the WAL.
+	r := verify(t, copyTree(t, path))
+	if !r.OK() || r.WALRecords == 0 || r.Entries != 167 || r.FreePages == 0 ||
+		r.Nodes+r.OverflowPages+r.FreePages+1 != r.Pages {
+		t.Fatalf("unexpected report:\n%v", r)
+	}
+
+	if err := bt.Close(); err != nil {
+		t.Fatalf("failed to close tree: %v", err)
+	}
+
+	if r := verify(t, path); !r.OK() || r.WALRecords != 0 || r.Entries != 167 {
+		t.Fatalf("unexpected report:\n%v", r)
+	}
+}
+
+func TestVerifyProblems(t *testing.T) {
+	cases := []struct {
+		name    string
+		corrupt func(bt *BTree[int]) (pageID, error)
+	}{
+		{"occupancy", func(bt *BTree[int]) (pageID, error) {
+			n := firstLeaf(t, bt)
+			if err := rewrite(bt, n); err != nil {
+				return 0, err
+			}
+			n.entries = nil
+
+			return n.id, nil
+		}},
+		{"order", func(bt *BTree[int]) (pageID, error) {
+			n := firstLeaf(t, bt)
+			if err := rewrite(bt, n); err != nil {
+				return 0, err
+			}
+			n.entries[0] = &entry{k: bt.keys.AppendKey(nil, 1000), v: n.entries[0].v}
+
+			return n.id, nil
+		}},
+		{"stale", func(bt *BTree[int]) (pageID, error) {
+			n := firstLeaf(t, bt)
+			bt.mark(n)
+
+			return n.id, nil
+		}},
+		{"free list", func(bt *BTree[int]) (pageID, error) {
+			n := firstLeaf(t, bt)
+			bt.meta.free = ref{id: n.id, lsn: n.lsn}
+
+			return n.id, nil
+		}},
+		{"leak", func(bt *BTree[int]) (pageID, error) {
+			bt.meta.free = ref{}
+			n, err := bt.allocate(true)
+			if err != nil {
+				return 0, err
+			}
+
+			return n.id, nil
+		}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "tree")
+			bt := filledTree(t, path)
+
+			var id pageID
+			_, err := bt.write(func(*node) (err error) {
+				id, err = c.corrupt(bt)
+
+				return err
+			})
+			if err != nil {
+				t.Fatalf("failed to corrupt the tree: %v", err)
+			}
+
+			if err := bt.Close(); err != nil {
+				t.Fatalf("failed to close tree: %v", err)
+			}
+
+			r := verify(t, path)
+
+			found := slices.ContainsFunc(r.Problems, func(err error) bool {
+				var ce *CorruptionError
+
+				return errors.As(err, &ce) && ce.Page == uint32(id)
+			})
+			if !found {
+				t.Fatalf("expected a problem with page %v, got report:\n%v", id, r)
+			}
+		})
+	}
+}
+
+func TestChecksumMismatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tree")
+	bt := filledTree(t, path)
+	id := firstLeaf(t, bt).id
+
+	if err := bt.Close(); err != nil {
+		t.Fatalf("failed to close tree: %v", err)
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("failed to open %v: %v", path, err)
+	}
+
+	if _, err := f.WriteAt([]byte{0xff}, int64(id)*256+10); err != nil {
+		t.Fatalf("failed to corrupt page %v: %v", id, err)
+	}
+	f.Close()
+
+	r := verify(t, path)
+
+	var ce *CorruptionError
+	if r.OK() || !errors.As(r.Problems[0], &ce) || ce.Page != uint32(id) {
+		t.Fatalf("expected a checksum mismatch on page %v, got report:\n%v", id, r)
+	}
+
+	bt = openTree(t, path, &Options[int]{})
+	defer bt.Close()
+
+	// 1 is in the leftmost leaf.
+	if _, err := bt.Search(1); !errors.As(err, &ce) || ce.Page != uint32(id) || !errors.Is(err, ErrCorrupted) {
+		t.Fatalf("expected a corruption error on page %v, got %v", id, err)
+	}
+}
+
+func TestStalePage(t *testing.T) {
+	for _, keys := range []KeyProvider{nil, KeyRing{1: testKey(1)}} {
+		path := filepath.Join(t.TempDir(), "tree")
+		opts := &Options[int]{PageSize: 256, MinimumDegree: 2, Encryption: keys}
+
+		bt := openTree(t, path, opts)
+		for k := range 100 {
+			if err := bt.Insert(k, k); err != nil {
+				t.Fatalf("failed to insert %v: %v", k, err)
+			}
+		}
+		id := firstLeaf(t, bt).id
+
+		if err := bt.Close(); err != nil {
+			t.Fatalf("failed to close tree: %v", err)
+		}
+
+		file, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("failed to read %v: %v", path, err)
+		}
+		old := file[int(id)*256 : int(id+1)*256]
+
+		// 0 is in the leftmost leaf, which is rewritten.
+		bt = openTree(t, path, opts)
+		if err := bt.Insert(0, -1); err != nil {
+			t.Fatalf("failed to insert: %v", err)
+		}
+		if err := bt.Close(); err != nil {
+			t.Fatalf("failed to close tree: %v", err)
+		}
+
+		// The older image of the leaf is valid on its own, checksum and
+		// encryption included, but not the one its parent expects.
+		f, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatalf("failed to open %v: %v", path, err)
+		}
+		if _, err := f.WriteAt(old, int64(id)*256); err != nil {
+			t.Fatalf("failed to write page %v: %v", id, err)
+		}
+		f.Close()
+
+		r, err := Verify(path, &VerifyOptions{Encryption: keys})
+		if err != nil {
+			t.Fatalf("failed to verify: %v", err)
+		}
+
+		var ce *CorruptionError
+		if r.OK() || !errors.As(r.Problems[0], &ce) || ce.Page != uint32(id) {
+			t.Fatalf("expected a stale page %v, got report:\n%v", id, r)
+		}
+		if !strings.Contains(ce.Reason, "LSN") {
+			t.Fatalf("expected page %v to be stale, got %v", id, ce)
+		}
+
+		bt = openTree(t, path, opts)
+		if _, err := bt.Search(0); !errors.As(err, &ce) || ce.Page != uint32(id) {
+			t.Fatalf("expected a corruption error on page %v, got %v", id, err)
+		}
+		bt.Close()
+	}
+}
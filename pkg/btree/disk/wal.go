@@ -0,0 +1,271 @@
+package disk
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	iofs "io/fs"
+	"os"
+	"time"
+)
+
+const (
+	// Magic, page size, flags and the LSN of the first record.
+	walHeaderSize = 8 + 4 + 4 + 8
+	// Record size and checksum, followed by the LSN, commit time and
+	// number of pages.
+	walRecordHeaderSize = 4 + 4 + 8 + 8 + 4
+
+	// walSizedPages is set in the header of logs whose pages are each
+	// preceded by their ID and size, as compressed pages vary in size.
+	// Otherwise, pages only follow their ID.
+	walSizedPages uint32 = 1 << 0
+)
+
+var (
+	walMagic = [8]byte{'b', 't', 'r', 'e', 'e', 'w', 'a', 'l'}
+
+	castagnoli = crc32.MakeTable(crc32.Castagnoli)
+)
+
+type pageImage struct {
+	id   pageID
+	data []byte
+}
+
+// walRecord holds the images of every page changed by an operation, the
+// meta page included, so replaying it applies the whole operation or,
+// if it was torn by a crash, none of it.
+type walRecord struct {
+	lsn   uint64
+	time  time.Time
+	pages []pageImage
+}
+
+func (r *walRecord) encode() []byte {
+	size := walRecordHeaderSize
+	for _, p := range r.pages {
+		size += 4 + 4 + len(p.data)
+	}
+
+	buf := make([]byte, size)
+
+	binary.BigEndian.PutUint32(buf[0:], uint32(size))
+	binary.BigEndian.PutUint64(buf[8:], r.lsn)
+	binary.BigEndian.PutUint64(buf[16:], uint64(r.time.UnixNano()))
+	binary.BigEndian.PutUint32(buf[24:], uint32(len(r.pages)))
+
+	off := walRecordHeaderSize
+	for _, p := range r.pages {
+		binary.BigEndian.PutUint32(buf[off:], uint32(p.id))
+		binary.BigEndian.PutUint32(buf[off+4:], uint32(len(p.data)))
+		copy(buf[off+8:], p.data)
+		off += 4 + 4 + len(p.data)
+	}
+
+	binary.BigEndian.PutUint32(buf[4:], crc32.Checksum(buf[8:], castagnoli))
+
+	return buf
+}
+
+// wal is a write-ahead log of page images. Operations are appended to it,
+// and synced, before their pages are written to the tree file. On
+// checkpoints, once the tree file has been synced, it's truncated, after
+// its records are copied to the archive directory, if it has one.
+type wal struct {
+	file     File
+	pageSize int
+	start    uint64
+	next     uint64
+	size     int64
+
+	fs      FS
+	archive string
+}
+
+func (w *wal) writeHeader() error {
+	buf := make([]byte, walHeaderSize)
+
+	copy(buf, walMagic[:])
+	binary.BigEndian.PutUint32(buf[8:], uint32(w.pageSize))
+	binary.BigEndian.PutUint32(buf[12:], walSizedPages)
+	binary.BigEndian.PutUint64(buf[16:], w.start)
+
+	_, err := w.file.WriteAt(buf, 0)
+
+	return err
+}
+
+// records reads the records of the log up to the first one that is torn,
+// corrupted or out of sequence.
+func (w *wal) records() ([]*walRecord, error) {
+	size, err := w.file.Size()
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, walHeaderSize)
+	if size < walHeaderSize {
+		return nil, nil
+	}
+
+	if _, err := w.file.ReadAt(header, 0); err != nil {
+		return nil, err
+	}
+
+	if [8]byte(header[:8]) != walMagic {
+		return nil, nil
+	}
+
+	w.pageSize = int(binary.BigEndian.Uint32(header[8:]))
+	sized := binary.BigEndian.Uint32(header[12:])&walSizedPages != 0
+	w.start = binary.BigEndian.Uint64(header[16:])
+
+	var records []*walRecord
+
+	for off, lsn := int64(walHeaderSize), w.start; off+walRecordHeaderSize <= size; lsn++ {
+		rh := make([]byte, walRecordHeaderSize)
+		if _, err := w.file.ReadAt(rh, off); err != nil {
+			return nil, err
+		}
+
+		recordSize := int64(binary.BigEndian.Uint32(rh[0:]))
+		count := int64(binary.BigEndian.Uint32(rh[24:]))
+		if recordSize < walRecordHeaderSize+count*4 || off+recordSize > size ||
+			!sized && recordSize != walRecordHeaderSize+count*int64(4+w.pageSize) {
+			break
+		}
+
+		buf := make([]byte, recordSize)
+		if _, err := w.file.ReadAt(buf, off); err != nil {
+			return nil, err
+		}
+
+		if crc32.Checksum(buf[8:], castagnoli) != binary.BigEndian.Uint32(buf[4:]) ||
+			binary.BigEndian.Uint64(buf[8:]) != lsn {
+			break
+		}
+
+		r := &walRecord{
+			lsn:   lsn,
+			time:  time.Unix(0, int64(binary.BigEndian.Uint64(buf[16:]))),
+			pages: make([]pageImage, count),
+		}
+
+		if !w.decodePages(r, buf[walRecordHeaderSize:], sized) {
+			break
+		}
+
+		records = append(records, r)
+		off += recordSize
+	}
+
+	return records, nil
+}
+
+// decodePages decodes the pages of record r from p, reporting whether they
+// fill it exactly.
+func (w *wal) decodePages(r *walRecord, p []byte, sized bool) bool {
+	for i := range r.pages {
+		if len(p) < 4 {
+			return false
+		}
+
+		id, size, off := pageID(binary.BigEndian.Uint32(p)), w.pageSize, 4
+		if sized {
+			if len(p) < 8 {
+				return false
+			}
+
+			size, off = int(binary.BigEndian.Uint32(p[4:])), 8
+		}
+
+		if size > w.pageSize || len(p) < off+size {
+			return false
+		}
+
+		r.pages[i] = pageImage{id: id, data: p[off : off+size : off+size]}
+		p = p[off+size:]
+	}
+
+	return len(p) == 0
+}
+
+func (w *wal) append(r *walRecord) error {
+	r.lsn = w.next
+
+	buf := r.encode()
+
+	if _, err := w.file.WriteAt(buf, w.size); err != nil {
+		return err
+	}
+
+	w.size += int64(len(buf))
+	w.next++
+
+	return nil
+}
+
+// reset empties the log, which continues at LSN next.
+func (w *wal) reset(next uint64) error {
+	if err := w.archiveRecords(); err != nil {
+		return err
+	}
+
+	if err := w.file.Truncate(0); err != nil {
+		return err
+	}
+
+	w.start, w.next, w.size = next, next, walHeaderSize
+
+	if err := w.writeHeader(); err != nil {
+		return err
+	}
+
+	return w.file.Sync()
+}
+
+func openWAL(fs FS, name string) (*wal, error) {
+	file, err := fs.OpenFile(name, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &wal{file: file, fs: fs}, nil
+}
+
+// walOverlay holds the last image of each page in the records of a WAL.
+type walOverlay struct {
+	pages   map[pageID][]byte
+	records int
+}
+
+// readWAL reads the WAL at name, if there is one, without changing it.
+func readWAL(fs FS, name string) (*walOverlay, error) {
+	o := &walOverlay{pages: map[pageID][]byte{}}
+
+	file, err := fs.OpenFile(name, os.O_RDONLY, 0)
+	if errors.Is(err, iofs.ErrNotExist) {
+		return o, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	w := &wal{file: file}
+
+	records, err := w.records()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range records {
+		for _, p := range r.pages {
+			o.pages[p.id] = p.data
+		}
+	}
+
+	o.records = len(records)
+
+	return o, nil
+}
@@ -0,0 +1,340 @@
+package disk
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"sync"
+	"testing"
+)
+
+var errCrashed = errors.New("crashed")
+
+// memFS keeps files in memory, along with what would survive a crash: the
+// contents they had on their last sync. After a number of writes, syncs and
+// truncations it crashes, failing that operation and every other one.
+type memFS struct {
+	mutex  sync.Mutex
+	files  map[string]*memFile
+	budget int
+}
+
+type memWrite struct {
+	off      int64
+	data     []byte
+	truncate bool
+}
+
+type memFile struct {
+	fs      *memFS
+	data    []byte
+	synced  []byte
+	pending []memWrite
+}
+
+func newMemFS(budget int) *memFS {
+	return &memFS{files: map[string]*memFile{}, budget: budget}
+}
+
+func (fs *memFS) spend() error {
+	if fs.budget == 0 {
+		return errCrashed
+	}
+
+	fs.budget--
+	if fs.budget == 0 {
+		return errCrashed
+	}
+
+	return nil
+}
+
+// crash returns the files as they could be found after a crash: every
+// synced write is there, and each of the others was either lost, applied
+// or torn.
+func (fs *memFS) crash(r *rand.Rand) *memFS {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	fs.budget = 0
+
+	crashed := newMemFS(-1)
+	for name, f := range fs.files {
+		data := append([]byte(nil), f.synced...)
+
+		for _, w := range f.pending {
+			switch op := r.Intn(3); {
+			case op == 0:
+			case w.truncate:
+				data = resize(data, w.off)
+			default:
+				d := w.data
+				if op == 2 {
+					d = d[:r.Intn(len(d)+1)]
+				}
+
+				data = writeAt(data, d, w.off)
+			}
+		}
+
+		crashed.files[name] = &memFile{fs: crashed, data: data, synced: append([]byte(nil), data...)}
+	}
+
+	return crashed
+}
+
+func resize(data []byte, size int64) []byte {
+	if int64(len(data)) >= size {
+		return data[:size]
+	}
+
+	return append(data, make([]byte, size-int64(len(data)))...)
+}
+
+func writeAt(data, p []byte, off int64) []byte {
+	if end := off + int64(len(p)); int64(len(data)) < end {
+		data = resize(data, end)
+	}
+
+	copy(data[off:], p)
+
+	return data
+}
+
+func (fs *memFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	if fs.budget == 0 {
+		return nil, errCrashed
+	}
+
+	f, ok := fs.files[name]
+	if !ok {
+		if flag&os.O_CREATE == 0 {
+			return nil, os.ErrNotExist
+		}
+
+		f = &memFile{fs: fs}
+		fs.files[name] = f
+	}
+
+	return f, nil
+}
+
+func (fs *memFS) Remove(name string) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	if err := fs.spend(); err != nil {
+		return err
+	}
+
+	delete(fs.files, name)
+
+	return nil
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+
+	if off >= int64(len(f.data)) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, f.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+
+	if err := f.fs.spend(); err != nil {
+		return 0, err
+	}
+
+	f.data = writeAt(f.data, p, off)
+	f.pending = append(f.pending, memWrite{off: off, data: append([]byte(nil), p...)})
+
+	return len(p), nil
+}
+
+func (f *memFile) Size() (int64, error) {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+
+	return int64(len(f.data)), nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+
+	if err := f.fs.spend(); err != nil {
+		return err
+	}
+
+	f.data = resize(f.data, size)
+	f.pending = append(f.pending, memWrite{off: size, truncate: true})
+
+	return nil
+}
+
+func (f *memFile) Sync() error {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+
+	if err := f.fs.spend(); err != nil {
+		return err
+	}
+
+	f.synced = append([]byte(nil), f.data...)
+	f.pending = nil
+
+	return nil
+}
+
+func (f *memFile) Close() error {
+	return nil
+}
+
+func TestCrashRecovery(t *testing.T) {
+	for seed := range int64(200) {
+		r := rand.New(rand.NewSource(seed))
+		fs := newMemFS(1 + r.Intn(3000))
+		opts := &Options[int]{
+			PageSize:       256,
+			MinimumDegree:  2,
+			FS:             fs,
+			CheckpointSize: 16 << 10,
+			CacheSize:      16 * 256,
+			Eviction:       Eviction(seed % 3),
+		}
+		switch seed % 4 {
+		case 0:
+			opts.Encryption = KeyRing{1: testKey(1)}
+		case 1:
+			opts.Compression = CompressFlate
+		case 2:
+			opts.Compression, opts.Encryption = CompressZlib, KeyRing{1: testKey(1)}
+		}
+
+		bt, err := Open[int]("tree", opts)
+		if errors.Is(err, errCrashed) {
+			continue
+		} else if err != nil {
+			t.Fatalf("seed %v: failed to open tree: %v", seed, err)
+		}
+
+		expected := map[int]int{}
+		inflight, value := -1, 0
+
+		for range 2000 {
+			k := r.Intn(300)
+
+			if r.Intn(100) == 0 {
+				k = -1
+				_, err = bt.VacuumIncremental(context.Background(), 1+r.Intn(4))
+			} else if r.Intn(3) == 0 {
+				if _, err = bt.Delete(k); err == nil {
+					delete(expected, k)
+				}
+				value = -1
+			} else {
+				value = r.Int()
+				if err = bt.Insert(k, value); err == nil {
+					expected[k] = value
+				}
+			}
+
+			if err != nil {
+				if !errors.Is(err, errCrashed) {
+					t.Fatalf("seed %v: unexpected error: %v", seed, err)
+				}
+
+				inflight = k
+
+				break
+			}
+		}
+
+		opts.FS = fs.crash(r)
+
+		bt, err = Open[int]("tree", opts)
+		if err != nil {
+			t.Fatalf("seed %v: failed to recover tree: %v", seed, err)
+		}
+
+		checkInvariants(t, bt)
+
+		for k := range 300 {
+			v, err := bt.Search(k)
+			if err != nil {
+				t.Fatalf("seed %v: failed to search %v: %v", seed, k, err)
+			}
+
+			if k == inflight && (v == nil && value == -1 || v == value) {
+				continue
+			}
+
+			if ev, ok := expected[k]; !ok && v != nil || ok && v != ev {
+				t.Fatalf("seed %v: expected %v to be %v, got %v", seed, k, ev, v)
+			}
+		}
+
+		if err := bt.Close(); err != nil {
+			t.Fatalf("seed %v: failed to close tree: %v", seed, err)
+		}
+	}
+}
+
+func TestFailedTreeMustBeReopened(t *testing.T) {
+	fs := newMemFS(-1)
+
+	opts := &Options[int]{FS: fs, CheckpointSize: 1}
+
+	bt, err := Open[int]("tree", opts)
+	if err != nil {
+		t.Fatalf("failed to open tree: %v", err)
+	}
+
+	if err := bt.Insert(1, 1); err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+
+	// Crashes right after the WAL append, when the checkpoint writes to
+	// the tree file. The insert is committed regardless.
+	fs.budget = 3
+
+	if err := bt.Insert(2, 2); err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+
+	if _, err := bt.Search(1); !errors.Is(err, ErrFailed) {
+		t.Fatalf("expected %v, got %v", ErrFailed, err)
+	}
+
+	fs.budget = -1
+
+	if err := bt.Close(); err != nil {
+		t.Fatalf("failed to close tree: %v", err)
+	}
+
+	bt, err = Open[int]("tree", opts)
+	if err != nil {
+		t.Fatalf("failed to reopen tree: %v", err)
+	}
+	defer bt.Close()
+
+	if v, err := bt.Search(2); err != nil || v != 2 {
+		t.Fatalf("expected the committed insert to be recovered, got %v, %v", v, err)
+	}
+}
@@ -0,0 +1,148 @@
+package btree
+
+import "cmp"
+
+type frame[K cmp.Ordered] struct {
+	n *node[K]
+	i int
+}
+
+// Iterator walks the tree in ascending key order. It reads a snapshot taken
+// when it was created, so it observes exactly the state at that moment no
+// matter the writes made afterwards, and never blocks them. Iterators aren't
+// safe for concurrent use.
+type Iterator[K cmp.Ordered] struct {
+	root  *node[K]
+	tier  *tier[K]
+	stack []frame[K]
+	cur   *entry[K]
+	err   error
+}
+
+func (it *Iterator[K]) pushLeft(n *node[K]) error {
+	for {
+		var err error
+		if n, err = it.tier.resolve(n); err != nil {
+			return err
+		}
+
+		it.stack = append(it.stack, frame[K]{n: n})
+
+		if n.leaf {
+			return nil
+		}
+
+		n = n.childs[0]
+	}
+}
+
+// fail stops the iterator with err.
+func (it *Iterator[K]) fail(err error) {
+	it.stack = it.stack[:0]
+	it.cur = nil
+	it.err = err
+}
+
+// Seek positions the iterator so that the next call to Next moves it to the
+// smallest key greater or equal than k.
+func (it *Iterator[K]) Seek(k K) {
+	it.stack = it.stack[:0]
+	it.cur = nil
+	it.err = nil
+
+	n := it.root
+	for {
+		var err error
+		if n, err = it.tier.resolve(n); err != nil {
+			it.fail(err)
+
+			return
+		}
+
+		i := 0
+
+		for ; i < len(n.entries) && n.entries[i].k < k; i++ {
+		}
+
+		it.stack = append(it.stack, frame[K]{n: n, i: i})
+
+		if n.leaf || i < len(n.entries) && n.entries[i].k == k {
+			return
+		}
+
+		n = n.childs[i]
+	}
+}
+
+// Rewind positions the iterator before the smallest key.
+func (it *Iterator[K]) Rewind() {
+	it.stack = it.stack[:0]
+	it.cur = nil
+	it.err = nil
+
+	if err := it.pushLeft(it.root); err != nil {
+		it.fail(err)
+	}
+}
+
+// Next moves the iterator to the next key, and reports whether there's one.
+// Once the iterator fails, it reports there's none, and Err the failure.
+func (it *Iterator[K]) Next() bool {
+	if err := it.tier.usable(); err != nil {
+		it.fail(err)
+	}
+
+	for len(it.stack) > 0 {
+		f := &it.stack[len(it.stack)-1]
+
+		if f.i == len(f.n.entries) {
+			it.stack = it.stack[:len(it.stack)-1]
+
+			continue
+		}
+
+		it.cur = f.n.entries[f.i]
+		f.i++
+
+		// The entry is still returned when the subtree after it can't
+		// be read, so the failure stops the next call.
+		if !f.n.leaf {
+			if err := it.pushLeft(f.n.childs[f.i]); err != nil {
+				it.stack = it.stack[:0]
+				it.err = err
+			}
+		}
+
+		return true
+	}
+
+	it.cur = nil
+
+	return false
+}
+
+// Err returns the failure that stopped the iterator, which only those of
+// tiered trees have: reading their spill file, or ErrClosed once the tree
+// is closed.
+func (it *Iterator[K]) Err() error {
+	return it.err
+}
+
+func (it *Iterator[K]) Key() K {
+	return it.cur.k
+}
+
+func (it *Iterator[K]) Value() any {
+	return it.cur.v
+}
+
+func (bt *BTree[K]) Iterator() *Iterator[K] {
+	it := &Iterator[K]{
+		root: bt.snapshot(),
+		tier: bt.tier,
+	}
+
+	it.Rewind()
+
+	return it
+}
@@ -0,0 +1,106 @@
+package btree
+
+import (
+	"slices"
+	"sync"
+	"testing"
+)
+
+func collect(it *Iterator[int]) []int {
+	var keys []int
+
+	for it.Next() {
+		keys = append(keys, it.Key())
+	}
+
+	return keys
+}
+
+func TestIterator(t *testing.T) {
+	for degree := 2; degree <= 4; degree++ {
+		bt := New[int](degree)
+
+		if keys := collect(bt.Iterator()); len(keys) != 0 {
+			t.Fatalf("empty tree yielded keys: %v", keys)
+		}
+
+		var expected []int
+		for i := range 200 {
+			bt.Insert(i*2, i)
+			expected = append(expected, i*2)
+		}
+
+		it := bt.Iterator()
+
+		if keys := collect(it); !slices.Equal(keys, expected) {
+			t.Fatalf("got different keys (degree %v): %v", degree, keys)
+		}
+
+		for _, tc := range []struct {
+			seek     int
+			expected []int
+		}{
+			{-1, expected},
+			{0, expected},
+			{101, expected[51:]},
+			{100, expected[50:]},
+			{398, expected[199:]},
+			{399, nil},
+		} {
+			it.Seek(tc.seek)
+
+			if keys := collect(it); !slices.Equal(keys, tc.expected) {
+				t.Fatalf(
+					"got different keys seeking %v (degree %v): got=%v expected=%v",
+					tc.seek, degree, keys, tc.expected)
+			}
+		}
+
+		it.Rewind()
+
+		if !it.Next() || it.Key() != 0 || it.Value() != 0 {
+			t.Fatalf("rewind didn't go back to the first key")
+		}
+	}
+}
+
+func TestIteratorSnapshot(t *testing.T) {
+	bt := New[int](2)
+
+	for i := range 500 {
+		bt.Insert(i, i)
+	}
+
+	it := bt.Iterator()
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for i := range 500 {
+			bt.Delete(i)
+			bt.Insert(i+500, i)
+		}
+	}()
+
+	count := 0
+	for ; it.Next(); count++ {
+		if it.Key() != count || it.Value() != count {
+			t.Fatalf("got (%v, %v) at position %v", it.Key(), it.Value(), count)
+		}
+	}
+
+	wg.Wait()
+
+	if count != 500 {
+		t.Fatalf("iterated %v keys, expected 500", count)
+	}
+
+	if keys := collect(bt.Iterator()); len(keys) != 500 || keys[0] != 500 {
+		t.Fatalf("new iterator didn't see the latest writes: %v", keys)
+	}
+
+	checkInvariants(t, bt)
+}
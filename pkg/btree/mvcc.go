@@ -0,0 +1,130 @@
+package btree
+
+import (
+	"cmp"
+	"slices"
+	"sync/atomic"
+)
+
+var generation atomic.Uint64
+
+func nextGen() uint64 {
+	return generation.Add(1)
+}
+
+type revision[K cmp.Ordered] struct {
+	number uint64
+	root   *node[K]
+}
+
+// beginWrite starts a write, returning the root to roll back to. Writes of
+// versioned trees, and of tiered ones, which roll back those that fail to
+// load a node, change copies of the nodes of earlier writes.
+func (bt *BTree[K]) beginWrite() *node[K] {
+	prev := bt.root
+
+	if bt.versioned || bt.tier != nil {
+		bt.gen = nextGen()
+	}
+
+	return prev
+}
+
+func (bt *BTree[K]) commitWrite(prev *node[K]) {
+	if bt.versioned {
+		bt.versions = append(bt.versions, revision[K]{
+			number: bt.version,
+			root:   prev,
+		})
+	}
+
+	bt.version++
+}
+
+// snapshot freezes the current nodes, so the returned root stays unchanged
+// by later writes and can be read without holding the lock.
+func (bt *BTree[K]) snapshot() *node[K] {
+	bt.mutex.Lock()
+	defer bt.mutex.Unlock()
+
+	if bt.root.gen == bt.gen {
+		bt.gen = nextGen()
+	}
+
+	return bt.root
+}
+
+func (bt *BTree[K]) rootAt(number uint64) *node[K] {
+	if number >= bt.version || len(bt.versions) == 0 {
+		return bt.root
+	}
+
+	i, found := slices.BinarySearchFunc(
+		bt.versions, number,
+		func(v revision[K], number uint64) int {
+			return cmp.Compare(v.number, number)
+		})
+	if !found && i > 0 {
+		i--
+	}
+
+	return bt.versions[i].root
+}
+
+// Version returns the version stamped by the last Insert or Delete that
+// changed the tree. An empty tree starts at version 0.
+func (bt *BTree[K]) Version() uint64 {
+	bt.mutex.RLock()
+	defer bt.mutex.RUnlock()
+
+	return bt.version
+}
+
+// GetAt searches k in the tree as it was at the given version. Versions
+// discarded by ReleaseBefore (or every past version, if the tree wasn't
+// created with NewVersioned) read the oldest state still retained.
+func (bt *BTree[K]) GetAt(k K, version uint64) any {
+	bt.mutex.RLock()
+	defer bt.mutex.RUnlock()
+
+	return bt.search(bt.rootAt(version), k)
+}
+
+// RangeAt calls fn in ascending order for each key in [lo, hi) as it was at
+// the given version, until fn returns false. On versioned trees, fn runs
+// without holding the tree lock, so writers aren't blocked meanwhile.
+func (bt *BTree[K]) RangeAt(lo, hi K, version uint64, fn func(k K, v any) bool) {
+	bt.mutex.RLock()
+	root := bt.rootAt(version)
+	if bt.versioned {
+		bt.mutex.RUnlock()
+	} else {
+		defer bt.mutex.RUnlock()
+	}
+
+	bt.ascend(root, lo, hi, func(e *entry[K]) bool {
+		return fn(e.k, e.v)
+	})
+}
+
+// ReleaseBefore discards every version older than the given one, allowing
+// values superseded since then to be garbage collected.
+func (bt *BTree[K]) ReleaseBefore(version uint64) {
+	bt.mutex.Lock()
+	defer bt.mutex.Unlock()
+
+	i, _ := slices.BinarySearchFunc(
+		bt.versions, version,
+		func(v revision[K], number uint64) int {
+			return cmp.Compare(v.number, number)
+		})
+
+	bt.versions = slices.Delete(bt.versions, 0, i)
+}
+
+func NewVersioned[K cmp.Ordered](minimumDegree int) *BTree[K] {
+	bt := New[K](minimumDegree)
+	bt.versioned = true
+
+	return bt
+}
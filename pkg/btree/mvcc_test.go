@@ -0,0 +1,180 @@
+package btree
+
+import (
+	"slices"
+	"sync"
+	"testing"
+)
+
+func collectAt(bt *BTree[int], lo, hi int, version uint64) []int {
+	var keys []int
+
+	bt.RangeAt(lo, hi, version, func(k int, v any) bool {
+		keys = append(keys, k)
+
+		return true
+	})
+
+	return keys
+}
+
+func TestVersionStamping(t *testing.T) {
+	bt := NewVersioned[int](2)
+
+	if version := bt.Version(); version != 0 {
+		t.Fatalf("empty tree has version %v", version)
+	}
+
+	for i := range 10 {
+		bt.Insert(i, i)
+	}
+
+	bt.Delete(42)
+
+	if version := bt.Version(); version != 10 {
+		t.Fatalf("got version=%v, expected=10", version)
+	}
+
+	bt.Delete(3)
+
+	if version := bt.Version(); version != 11 {
+		t.Fatalf("got version=%v, expected=11", version)
+	}
+}
+
+func TestGetAt(t *testing.T) {
+	bt := NewVersioned[int](2)
+
+	for i := range 20 {
+		bt.Insert(i, i)
+	}
+
+	bt.Insert(5, "five")
+	bt.Delete(7)
+
+	for _, tc := range []struct {
+		key           int
+		version       uint64
+		expectedValue any
+	}{
+		{5, 0, nil},
+		{5, 5, nil},
+		{5, 6, 5},
+		{5, 20, 5},
+		{5, 21, "five"},
+		{7, 21, 7},
+		{7, 22, nil},
+		{19, 19, nil},
+		{19, 20, 19},
+	} {
+		if value := bt.GetAt(tc.key, tc.version); value != tc.expectedValue {
+			t.Fatalf(
+				"got different value for key %v at version %v: got=%v expected=%v",
+				tc.key, tc.version, value, tc.expectedValue)
+		}
+	}
+}
+
+func TestRangeAt(t *testing.T) {
+	bt := NewVersioned[int](3)
+
+	for i := range 50 {
+		bt.Insert(i, i)
+	}
+
+	for i := 0; i < 50; i += 2 {
+		bt.Delete(i)
+	}
+
+	if keys := collectAt(bt, 10, 15, 50); !slices.Equal(keys, []int{10, 11, 12, 13, 14}) {
+		t.Fatalf("got different keys at version 50: %v", keys)
+	}
+
+	if keys := collectAt(bt, 10, 15, bt.Version()); !slices.Equal(keys, []int{11, 13}) {
+		t.Fatalf("got different keys at current version: %v", keys)
+	}
+
+	if keys := collectAt(bt, 0, 50, 3); !slices.Equal(keys, []int{0, 1, 2}) {
+		t.Fatalf("got different keys at version 3: %v", keys)
+	}
+}
+
+func TestReleaseBefore(t *testing.T) {
+	bt := NewVersioned[int](2)
+
+	for i := range 10 {
+		bt.Insert(0, i)
+	}
+
+	bt.ReleaseBefore(5)
+
+	if n := len(bt.versions); n != 5 {
+		t.Fatalf("got %v retained versions, expected 5", n)
+	}
+
+	for version := uint64(5); version <= 10; version++ {
+		if value := bt.GetAt(0, version); value != int(version)-1 {
+			t.Fatalf(
+				"got different value at version %v: got=%v expected=%v",
+				version, value, version-1)
+		}
+	}
+
+	if value := bt.GetAt(0, 2); value != 4 {
+		t.Fatalf("released version didn't read the oldest retained one: got=%v", value)
+	}
+
+	bt.ReleaseBefore(bt.Version())
+
+	if n := len(bt.versions); n != 0 {
+		t.Fatalf("got %v retained versions, expected none", n)
+	}
+}
+
+func TestUnversionedTreeKeepsNoHistory(t *testing.T) {
+	bt := New[int](2)
+
+	for i := range 10 {
+		bt.Insert(i, i)
+	}
+
+	if n := len(bt.versions); n != 0 {
+		t.Fatalf("got %v retained versions, expected none", n)
+	}
+
+	if value := bt.GetAt(9, 0); value != 9 {
+		t.Fatalf("got value=%v, expected the current one", value)
+	}
+}
+
+func TestRangeAtWhileWriting(t *testing.T) {
+	bt := NewVersioned[int](2)
+
+	for i := range 100 {
+		bt.Insert(i, i)
+	}
+
+	version := bt.Version()
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for i := range 100 {
+			bt.Delete(i)
+			bt.Insert(i+100, i)
+		}
+	}()
+
+	for range 50 {
+		if keys := collectAt(bt, 0, 200, version); len(keys) != 100 || keys[99] != 99 {
+			t.Fatalf("got different keys at version %v: %v", version, keys)
+		}
+	}
+
+	wg.Wait()
+
+	checkInvariants(t, bt)
+}
@@ -0,0 +1,221 @@
+package btree
+
+import (
+	"cmp"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+type partition[K cmp.Ordered] struct {
+	child *node[K]
+	entry *entry[K]
+}
+
+// partitions splits the subtree of n along its childs. Each partition holds
+// a child and the entry following it, so walking them in order walks the
+// whole subtree in key order. Partitions outside [lo, hi) are left out.
+func (bt *BTree[K]) partitions(n *node[K], lo, hi K) []partition[K] {
+	if n.leaf {
+		return []partition[K]{{child: n}}
+	}
+
+	var parts []partition[K]
+
+	for i, c := range n.childs {
+		var e *entry[K]
+		if i < len(n.entries) {
+			e = n.entries[i]
+		}
+
+		if e != nil && e.k < lo {
+			continue
+		}
+
+		parts = append(parts, partition[K]{child: c, entry: e})
+
+		if e != nil && e.k >= hi {
+			break
+		}
+	}
+
+	return parts
+}
+
+func (bt *BTree[K]) ascendPartition(p partition[K], lo, hi K, fn func(e *entry[K]) bool) bool {
+	if !bt.ascend(p.child, lo, hi, fn) {
+		return false
+	}
+
+	if p.entry == nil || p.entry.k < lo {
+		return true
+	}
+
+	return p.entry.k < hi && fn(p.entry)
+}
+
+func (bt *BTree[K]) parallel(lo, hi K, workers int, work func(i int, p partition[K])) {
+	parallel(bt.partitions(bt.snapshot(), lo, hi), workers, work)
+}
+
+// parallel runs work over parts from up to workers goroutines, handing the
+// partitions out in order.
+func parallel[K cmp.Ordered](parts []partition[K], workers int, work func(i int, p partition[K])) {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	next := make(chan int)
+
+	var wg sync.WaitGroup
+
+	for range min(workers, len(parts)) {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for i := range next {
+				work(i, parts[i])
+			}
+		}()
+	}
+
+	for i := range parts {
+		next <- i
+	}
+	close(next)
+
+	wg.Wait()
+}
+
+// ParallelRange calls fn for each key in [lo, hi) from up to workers
+// goroutines (GOMAXPROCS, if workers isn't positive), each one walking a
+// subtree of the root in key order. Calls for different subtrees run
+// concurrently and in no particular order, so fn must be safe for
+// concurrent use; ParallelRangeOrdered calls it in key order instead. Every
+// call sees the tree as it was when ParallelRange started, while writers
+// carry on. Once fn returns false, no more calls are started.
+func (bt *BTree[K]) ParallelRange(lo, hi K, workers int, fn func(k K, v any) bool) {
+	var stopped atomic.Bool
+
+	bt.parallel(lo, hi, workers, func(_ int, p partition[K]) {
+		if stopped.Load() {
+			return
+		}
+
+		bt.ascendPartition(p, lo, hi, func(e *entry[K]) bool {
+			if stopped.Load() || !fn(e.k, e.v) {
+				stopped.Store(true)
+
+				return false
+			}
+
+			return true
+		})
+	})
+}
+
+// orderedBuffer is the number of entries a subtree walked ahead of the one
+// being consumed by ParallelRangeOrdered may hold.
+const orderedBuffer = 256
+
+// ParallelRangeOrdered walks the subtrees of the root in parallel as
+// ParallelRange does, but merges what they find back in key order: fn is
+// called from the calling goroutine, one key after the other, and needn't be
+// safe for concurrent use. Subtrees ahead of the one being consumed hold up
+// to orderedBuffer entries each until their turn.
+func (bt *BTree[K]) ParallelRangeOrdered(lo, hi K, workers int, fn func(k K, v any) bool) {
+	parts := bt.partitions(bt.snapshot(), lo, hi)
+
+	results := make([]chan *entry[K], len(parts))
+	for i := range results {
+		results[i] = make(chan *entry[K], orderedBuffer)
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		parallel(parts, workers, func(i int, p partition[K]) {
+			defer close(results[i])
+
+			bt.ascendPartition(p, lo, hi, func(e *entry[K]) bool {
+				select {
+				case results[i] <- e:
+					return true
+				case <-stop:
+					return false
+				}
+			})
+		})
+	}()
+
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	// Partitions are handed out in order, so the one consumed has always
+	// been started, whatever the number of workers.
+	for _, result := range results {
+		for e := range result {
+			if !fn(e.k, e.v) {
+				return
+			}
+		}
+	}
+}
+
+// Reducer describes how ParallelReduce folds entries. Each subtree is folded
+// into its own accumulator, starting from Init, and the partial results are
+// then combined with Merge. With Ordered set, they are combined in key order,
+// otherwise in whatever order subtrees finish.
+type Reducer[K cmp.Ordered, R any] struct {
+	Init    func() R
+	Fold    func(acc R, k K, v any) R
+	Merge   func(a, b R) R
+	Ordered bool
+}
+
+func ParallelReduce[K cmp.Ordered, R any](bt *BTree[K], lo, hi K, workers int, r Reducer[K, R]) R {
+	var (
+		mutex    sync.Mutex
+		acc      = r.Init()
+		partials []*R
+	)
+
+	bt.parallel(lo, hi, workers, func(i int, p partition[K]) {
+		partial := r.Init()
+
+		bt.ascendPartition(p, lo, hi, func(e *entry[K]) bool {
+			partial = r.Fold(partial, e.k, e.v)
+
+			return true
+		})
+
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		if !r.Ordered {
+			acc = r.Merge(acc, partial)
+
+			return
+		}
+
+		if i >= len(partials) {
+			partials = append(partials, make([]*R, i+1-len(partials))...)
+		}
+		partials[i] = &partial
+	})
+
+	for _, partial := range partials {
+		if partial != nil {
+			acc = r.Merge(acc, *partial)
+		}
+	}
+
+	return acc
+}
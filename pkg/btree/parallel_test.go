@@ -0,0 +1,184 @@
+package btree
+
+import (
+	"slices"
+	"sync"
+	"testing"
+)
+
+func TestParallelRange(t *testing.T) {
+	bt := New[int](2)
+
+	for i := range 1000 {
+		bt.Insert(i, i*2)
+	}
+
+	var (
+		mutex sync.Mutex
+		keys  []int
+	)
+
+	bt.ParallelRange(100, 900, 4, func(k int, v any) bool {
+		if v != k*2 {
+			t.Errorf("got different value for key %v: %v", k, v)
+		}
+
+		mutex.Lock()
+		keys = append(keys, k)
+		mutex.Unlock()
+
+		return true
+	})
+
+	slices.Sort(keys)
+
+	if len(keys) != 800 || keys[0] != 100 || keys[799] != 899 {
+		t.Fatalf("got different keys: %v", keys)
+	}
+}
+
+func TestParallelRangeStop(t *testing.T) {
+	bt := New[int](3)
+
+	for i := range 1000 {
+		bt.Insert(i, i)
+	}
+
+	var (
+		mutex sync.Mutex
+		calls int
+	)
+
+	bt.ParallelRange(0, 1000, 1, func(k int, v any) bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		calls++
+
+		return calls < 10
+	})
+
+	if calls != 10 {
+		t.Fatalf("got %v calls after stopping at the 10th", calls)
+	}
+}
+
+func TestParallelReduce(t *testing.T) {
+	bt := New[int](2)
+
+	for i := range 500 {
+		bt.Insert(i, i)
+	}
+
+	sum := ParallelReduce(bt, 0, 500, 8, Reducer[int, int]{
+		Init: func() int { return 0 },
+		Fold: func(acc int, k int, v any) int {
+			return acc + v.(int)
+		},
+		Merge: func(a, b int) int { return a + b },
+	})
+
+	if sum != 499*500/2 {
+		t.Fatalf("got different sum: %v", sum)
+	}
+
+	keys := ParallelReduce(bt, 10, 490, 8, Reducer[int, []int]{
+		Init: func() []int { return nil },
+		Fold: func(acc []int, k int, v any) []int {
+			return append(acc, k)
+		},
+		Merge: func(a, b []int) []int {
+			return append(a, b...)
+		},
+		Ordered: true,
+	})
+
+	if len(keys) != 480 || !slices.IsSorted(keys) || keys[0] != 10 {
+		t.Fatalf("keys weren't merged in order: %v", keys)
+	}
+}
+
+func TestParallelReduceSnapshot(t *testing.T) {
+	bt := New[int](2)
+
+	for i := range 1000 {
+		bt.Insert(i, 1)
+	}
+
+	started := make(chan struct{})
+	resume := make(chan struct{})
+
+	var once sync.Once
+
+	done := make(chan int)
+	go func() {
+		done <- ParallelReduce(bt, 0, 1000, 2, Reducer[int, int]{
+			Init: func() int { return 0 },
+			Fold: func(acc int, k int, v any) int {
+				once.Do(func() {
+					close(started)
+					<-resume
+				})
+
+				return acc + v.(int)
+			},
+			Merge: func(a, b int) int { return a + b },
+		})
+	}()
+
+	<-started
+
+	for i := range 1000 {
+		bt.Delete(i)
+	}
+
+	close(resume)
+
+	if count := <-done; count != 1000 {
+		t.Fatalf("reduce didn't see a consistent snapshot: counted %v keys", count)
+	}
+
+	checkInvariants(t, bt)
+}
+
+func TestParallelRangeOrdered(t *testing.T) {
+	bt := New[int](2)
+
+	for i := range 5000 {
+		bt.Insert(i, i*2)
+	}
+
+	for _, workers := range []int{1, 3, 8} {
+		var keys []int
+
+		bt.ParallelRangeOrdered(100, 4900, workers, func(k int, v any) bool {
+			if v != k*2 {
+				t.Errorf("got different value for key %v: %v", k, v)
+			}
+
+			keys = append(keys, k)
+
+			return true
+		})
+
+		if len(keys) != 4800 || !slices.IsSorted(keys) || keys[0] != 100 {
+			t.Fatalf("expected keys from 100 to 4899 in order (%v workers), got %v keys", workers, len(keys))
+		}
+
+		var calls int
+
+		bt.ParallelRangeOrdered(0, 5000, workers, func(k int, v any) bool {
+			if k != calls {
+				t.Fatalf("expected key %v, got %v", calls, k)
+			}
+
+			calls++
+
+			return calls < 10
+		})
+
+		if calls != 10 {
+			t.Fatalf("expected 10 calls before stopping, got %v", calls)
+		}
+	}
+}
@@ -0,0 +1,319 @@
+package btree
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"slices"
+
+	"github.com/franciscosbf/b-tree-go/pkg/btree/codec"
+)
+
+// A snapshot stream starts with a header: magic, format version and
+// minimum degree. Each entry follows, prefixed by snapshotEntry, with the
+// lengths of its encoded key and value as uvarints. The entries end with
+// snapshotEnd, their count as an uvarint and the CRC32C of everything
+// before it.
+const (
+	snapshotVersion = 1
+
+	snapshotEntry byte = 1
+	snapshotEnd   byte = 0
+
+	maxSnapshotField = 1 << 30
+)
+
+var (
+	snapshotMagic = [8]byte{'b', 't', 'r', 'e', 'e', 's', 'n', 'p'}
+
+	castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+	ErrInvalidSnapshot = errors.New("btree: invalid snapshot")
+)
+
+// SnapshotOptions sets the codecs of Save and Load. Keys defaults to
+// codec.Ordered and Values to codec.Gob, so value types other than the
+// basic ones must be registered with gob.Register.
+type SnapshotOptions[K cmp.Ordered] struct {
+	Keys   codec.KeyCodec[K]
+	Values codec.ValueCodec[any]
+}
+
+func (o *SnapshotOptions[K]) codecs() (codec.KeyCodec[K], codec.ValueCodec[any]) {
+	var keys codec.KeyCodec[K] = codec.Ordered[K]()
+	values := codec.Gob[any]()
+
+	if o != nil && o.Keys != nil {
+		keys = o.Keys
+	}
+
+	if o != nil && o.Values != nil {
+		values = o.Values
+	}
+
+	return keys, values
+}
+
+// Save writes the entries of the tree to w in ascending key order. It reads
+// a snapshot, as iterators do, so writers aren't blocked while it runs.
+func (bt *BTree[K]) Save(w io.Writer, opts *SnapshotOptions[K]) error {
+	keys, values := opts.codecs()
+
+	h := crc32.New(castagnoli)
+	bw := bufio.NewWriter(io.MultiWriter(w, h))
+
+	header := binary.BigEndian.AppendUint16(slices.Clone(snapshotMagic[:]), snapshotVersion)
+	header = binary.BigEndian.AppendUint32(header, uint32(bt.t))
+
+	if _, err := bw.Write(header); err != nil {
+		return err
+	}
+
+	var (
+		count uint64
+		buf   []byte
+	)
+
+	it := bt.Iterator()
+
+	for ; it.Next(); count++ {
+		k := keys.AppendKey(nil, it.Key())
+
+		v, err := values.AppendValue(nil, it.Value())
+		if err != nil {
+			return fmt.Errorf("btree: failed to encode value of %v: %w", it.Key(), err)
+		}
+
+		buf = append(buf[:0], snapshotEntry)
+		buf = binary.AppendUvarint(buf, uint64(len(k)))
+		buf = append(buf, k...)
+		buf = binary.AppendUvarint(buf, uint64(len(v)))
+		buf = append(buf, v...)
+
+		if _, err := bw.Write(buf); err != nil {
+			return err
+		}
+	}
+
+	if err := it.Err(); err != nil {
+		return err
+	}
+
+	buf = append(buf[:0], snapshotEnd)
+	buf = binary.AppendUvarint(buf, count)
+
+	if _, err := bw.Write(buf); err != nil {
+		return err
+	}
+
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+
+	_, err := w.Write(h.Sum(nil))
+
+	return err
+}
+
+// snapshotReader reads a snapshot, hashing what it reads.
+type snapshotReader struct {
+	r *bufio.Reader
+	h hash.Hash32
+}
+
+func (sr *snapshotReader) ReadByte() (byte, error) {
+	b, err := sr.r.ReadByte()
+	if err == nil {
+		sr.h.Write([]byte{b})
+	}
+
+	return b, err
+}
+
+func (sr *snapshotReader) Read(p []byte) (int, error) {
+	n, err := io.ReadFull(sr.r, p)
+	sr.h.Write(p[:n])
+
+	return n, err
+}
+
+func (sr *snapshotReader) field() ([]byte, error) {
+	size, err := binary.ReadUvarint(sr)
+	if err != nil {
+		return nil, err
+	}
+
+	if size > maxSnapshotField {
+		return nil, fmt.Errorf("%w: field of %d bytes", ErrInvalidSnapshot, size)
+	}
+
+	buf := make([]byte, size)
+	if _, err := sr.Read(buf); err != nil {
+		return nil, err
+	}
+
+	return buf, nil
+}
+
+// build builds the nodes of a tree from sorted entries, level by level
+// from the leaves up, spreading the entries evenly across each level.
+func build[K cmp.Ordered](t int, gen uint64, entries []*entry[K]) *node[K] {
+	var childs []*node[K]
+
+	for {
+		// Nodes, along with the separator after them, hold up to 2t
+		// entries, which is never less than t-1 each once spread.
+		count := (len(entries) + 2*t) / (2 * t)
+		size := len(entries) - (count - 1)
+
+		nodes := make([]*node[K], count)
+		separators := make([]*entry[K], 0, count-1)
+
+		for i, off := 0, 0; i < count; i++ {
+			c := size / count
+			if i < size%count {
+				c++
+			}
+
+			n := &node[K]{
+				gen:     gen,
+				leaf:    childs == nil,
+				entries: slices.Clone(entries[off : off+c]),
+			}
+			if childs != nil {
+				n.childs = slices.Clone(childs[off : off+c+1])
+			}
+
+			off += c
+			if i < count-1 {
+				separators = append(separators, entries[off])
+				off++
+			}
+
+			nodes[i] = n
+		}
+
+		if count == 1 {
+			return nodes[0]
+		}
+
+		entries, childs = separators, nodes
+	}
+}
+
+// Load reads a tree written by Save, with the same minimum degree. It
+// builds the tree in a single pass over the entries rather than inserting
+// them one by one.
+func Load[K cmp.Ordered](r io.Reader, opts *SnapshotOptions[K]) (*BTree[K], error) {
+	keys, values := opts.codecs()
+
+	sr := &snapshotReader{r: bufio.NewReader(r), h: crc32.New(castagnoli)}
+
+	invalid := func(format string, args ...any) (*BTree[K], error) {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSnapshot, fmt.Sprintf(format, args...))
+	}
+
+	eof := func(err error) error {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return fmt.Errorf("%w: truncated stream", ErrInvalidSnapshot)
+		}
+
+		return err
+	}
+
+	header := make([]byte, len(snapshotMagic)+2+4)
+	if _, err := sr.Read(header); err != nil {
+		return nil, eof(err)
+	}
+
+	if [8]byte(header[:8]) != snapshotMagic {
+		return invalid("not a snapshot")
+	}
+
+	if v := binary.BigEndian.Uint16(header[8:]); v != snapshotVersion {
+		return invalid("unsupported version %d", v)
+	}
+
+	t := int(binary.BigEndian.Uint32(header[10:]))
+	if t < 2 {
+		return invalid("minimum degree %d", t)
+	}
+
+	// The entries are decoded once the checksum is verified.
+	var raw [][2][]byte
+
+	for {
+		marker, err := sr.ReadByte()
+		if err != nil {
+			return nil, eof(err)
+		}
+
+		if marker == snapshotEnd {
+			break
+		} else if marker != snapshotEntry {
+			return invalid("unknown marker %d", marker)
+		}
+
+		k, err := sr.field()
+		if err != nil {
+			return nil, eof(err)
+		}
+
+		v, err := sr.field()
+		if err != nil {
+			return nil, eof(err)
+		}
+
+		raw = append(raw, [2][]byte{k, v})
+	}
+
+	count, err := binary.ReadUvarint(sr)
+	if err != nil {
+		return nil, eof(err)
+	}
+
+	if count != uint64(len(raw)) {
+		return invalid("expected %d entries, got %d", count, len(raw))
+	}
+
+	sum := sr.h.Sum32()
+
+	crc := make([]byte, 4)
+	if _, err := io.ReadFull(sr.r, crc); err != nil {
+		return nil, eof(err)
+	}
+
+	if binary.BigEndian.Uint32(crc) != sum {
+		return invalid("checksum mismatch")
+	}
+
+	entries := make([]*entry[K], len(raw))
+
+	for i, r := range raw {
+		k, err := keys.DecodeKey(r[0])
+		if err != nil {
+			return nil, err
+		}
+
+		if i > 0 && k <= entries[i-1].k {
+			return invalid("key %v is out of order", k)
+		}
+
+		v, err := values.DecodeValue(r[1])
+		if err != nil {
+			return nil, err
+		}
+
+		entries[i] = &entry[K]{k, v}
+	}
+
+	bt := New[K](t)
+	bt.root = build(t, bt.gen, entries)
+
+	return bt, nil
+}
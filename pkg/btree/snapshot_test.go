@@ -0,0 +1,142 @@
+package btree
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"testing"
+
+	"github.com/franciscosbf/b-tree-go/pkg/btree/codec"
+)
+
+func TestSaveLoad(t *testing.T) {
+	for degree := 2; degree <= 5; degree++ {
+		for _, size := range []int{0, 1, 2, 3, 7, 8, 9, 100, 1000} {
+			bt := New[int](degree)
+			for i := range size {
+				bt.Insert(i*3, strconv.Itoa(i))
+			}
+
+			var buf bytes.Buffer
+			if err := bt.Save(&buf, nil); err != nil {
+				t.Fatalf("failed to save: %v", err)
+			}
+
+			loaded, err := Load[int](&buf, nil)
+			if err != nil {
+				t.Fatalf("failed to load %v entries with degree %v: %v", size, degree, err)
+			}
+
+			if loaded.t != degree {
+				t.Fatalf("expected degree %v, got %v", degree, loaded.t)
+			}
+
+			checkInvariants(t, loaded)
+
+			if keys := collect(loaded.Iterator()); len(keys) != size {
+				t.Fatalf("expected %v keys, got %v", size, len(keys))
+			}
+
+			for i := range size {
+				if v := loaded.Search(i * 3); v != strconv.Itoa(i) {
+					t.Fatalf("expected %v to be %v, got %v", i*3, i, v)
+				}
+			}
+
+			// The loaded tree is a regular one.
+			for i := range size {
+				loaded.Insert(i*3+1, nil)
+				loaded.Delete(i * 3)
+			}
+
+			checkInvariants(t, loaded)
+		}
+	}
+}
+
+func TestSaveReadsSnapshot(t *testing.T) {
+	bt := New[int](3)
+	for i := range 100 {
+		bt.Insert(i, i)
+	}
+
+	var buf bytes.Buffer
+
+	// Writes made while saving aren't in the stream.
+	w := writerFunc(func(p []byte) (int, error) {
+		bt.Insert(1000, 1000)
+		bt.Delete(0)
+
+		return buf.Write(p)
+	})
+
+	if err := bt.Save(w, nil); err != nil {
+		t.Fatalf("failed to save: %v", err)
+	}
+
+	loaded, err := Load[int](&buf, nil)
+	if err != nil {
+		t.Fatalf("failed to load: %v", err)
+	}
+
+	if loaded.Search(0) != 0 || loaded.Search(1000) != nil {
+		t.Fatalf("expected the tree as it was when the save started")
+	}
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+func TestSaveLoadCodecs(t *testing.T) {
+	bt := New[string](2)
+	for i := range 50 {
+		bt.Insert(strconv.Itoa(i), i)
+	}
+
+	opts := &SnapshotOptions[string]{Values: codec.Any(codec.JSON[int]())}
+
+	var buf bytes.Buffer
+	if err := bt.Save(&buf, opts); err != nil {
+		t.Fatalf("failed to save: %v", err)
+	}
+
+	loaded, err := Load[string](&buf, opts)
+	if err != nil {
+		t.Fatalf("failed to load: %v", err)
+	}
+
+	if v := loaded.Search("42"); v != 42 {
+		t.Fatalf("expected 42, got %v", v)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	bt := New[int](2)
+	for i := range 20 {
+		bt.Insert(i, i)
+	}
+
+	var buf bytes.Buffer
+	if err := bt.Save(&buf, nil); err != nil {
+		t.Fatalf("failed to save: %v", err)
+	}
+	stream := buf.Bytes()
+
+	cases := map[string][]byte{
+		"empty":     nil,
+		"magic":     append([]byte("notsnaps"), stream[8:]...),
+		"version":   append(append(bytes.Clone(stream[:8]), 0, 9), stream[10:]...),
+		"truncated": stream[:len(stream)-10],
+		"flipped":   append(append(bytes.Clone(stream[:30]), stream[30]^0xff), stream[31:]...),
+		"checksum":  append(bytes.Clone(stream[:len(stream)-1]), stream[len(stream)-1]^0xff),
+	}
+
+	for name, s := range cases {
+		if _, err := Load[int](bytes.NewReader(s), nil); !errors.Is(err, ErrInvalidSnapshot) {
+			t.Fatalf("%v: expected %v, got %v", name, ErrInvalidSnapshot, err)
+		}
+	}
+}
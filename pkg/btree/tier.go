@@ -0,0 +1,1080 @@
+package btree
+
+import (
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"runtime"
+	"slices"
+	"sync"
+	"weak"
+
+	"github.com/franciscosbf/b-tree-go/pkg/btree/codec"
+)
+
+// A spill file starts with spillMagic. Each node spilled follows as a
+// record: the length of its payload and the CRC32C of it, then the payload
+// itself, a flag byte, the count of entries as an uvarint, each entry as its
+// encoded key and value prefixed by their lengths as uvarints and, for
+// internal nodes, the offsets of the records of their childs as uvarints.
+// Records are only ever appended, so an offset never goes stale while the
+// file is open, and the records of nodes changed since they were spilled
+// are left behind. Once the file has grown by more than spillCompaction and
+// by more than what it held after its last compaction, the records the tree
+// refers to are moved to a new file, renamed over it. Stubs and nodes keep
+// the file their record is in, so snapshots go on reading the old one,
+// which is closed once none of them refers to it anymore.
+const (
+	spillLeaf byte = 1
+
+	spillRecordHeader = 8
+	spillCompaction   = 1 << 20
+)
+
+// The memory a node takes is estimated as nodeOverhead, childOverhead per
+// child and, per entry, entryOverhead plus the size of its key and value:
+// the length of strings and byte slices, 8 bytes for other basic types and
+// valueEstimate bytes for anything else.
+const (
+	nodeOverhead  = 96
+	childOverhead = 8
+	entryOverhead = 48
+	valueEstimate = 64
+
+	minTieredBytes = 4 << 10
+)
+
+var (
+	spillMagic = [8]byte{'b', 't', 'r', 'e', 'e', 's', 'p', 'l'}
+
+	ErrSpill  = errors.New("btree: spill file failure")
+	ErrClosed = errors.New("btree: tiered tree is closed")
+)
+
+// TieredOptions sets the memory budget of a tiered tree and where it spills
+// the rest. Keys defaults to codec.Ordered and Values to codec.Gob, as in
+// SnapshotOptions.
+type TieredOptions[K cmp.Ordered] struct {
+	// Path is the spill file, created or truncated by NewTiered and
+	// removed by Close. It's compacted through Path+".compact".
+	Path string
+	// MaxBytes is the memory the nodes kept in memory may take, as
+	// estimated from their entries, past which the least recently used
+	// subtrees are spilled. It must be at least 4 KiB.
+	MaxBytes int64
+	Keys     codec.KeyCodec[K]
+	Values   codec.ValueCodec[any]
+}
+
+// spillFile is a spill file, with the number of stubs and nodes referring
+// to its records.
+type spillFile struct {
+	f    *os.File
+	refs int
+}
+
+// location is where the record of a node is.
+type location struct {
+	file *spillFile
+	off  int64
+}
+
+// tierNode is what the tier knows of a node: the record it stands for, if
+// it's a stub, or the one it was last written to, if it's unchanged since;
+// and the tick of its last access.
+type tierNode struct {
+	loc  location
+	used uint64
+}
+
+type tier[K cmp.Ordered] struct {
+	// mutex guards nodes, the files and closed, which readers of snapshots
+	// use without the tree lock, as does the cleanup of nodes collected.
+	mutex  sync.Mutex
+	nodes  map[weak.Pointer[node[K]]]*tierNode
+	file   *spillFile
+	old    map[*spillFile]bool
+	closed bool
+
+	size int64
+	// live is the size of the file after its last compaction.
+	live int64
+	path string
+	// err is the failure that stopped the tree from spilling, if any.
+	err      error
+	keys     codec.KeyCodec[K]
+	values   codec.ValueCodec[any]
+	maxBytes int64
+	// resident is the memory the nodes in memory take, counted up as they
+	// grow, and counted again when it's past maxBytes.
+	resident int64
+	clock    uint64
+}
+
+func spillFailure(err error) error {
+	return fmt.Errorf("%w: %w", ErrSpill, err)
+}
+
+// spillPanic carries a failure reading the spill file out of the recursive
+// operations on tiered trees, up to the methods of Tiered, which recover it
+// with try: it never escapes the package.
+type spillPanic struct {
+	err error
+}
+
+// try returns what fn does, or the failure reading the spill file that
+// interrupted it.
+func try[T any](fn func() T) (v T, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			p, ok := r.(spillPanic)
+			if !ok {
+				panic(r)
+			}
+
+			err = p.err
+		}
+	}()
+
+	return fn(), nil
+}
+
+// isStub reports whether n stands for a spilled subtree: stubs are the only
+// internal nodes without childs.
+func isStub[K cmp.Ordered](n *node[K]) bool {
+	return !n.leaf && n.childs == nil
+}
+
+// valueSize estimates the memory v takes.
+func valueSize(v any) int64 {
+	switch v := v.(type) {
+	case nil:
+		return 0
+	case string:
+		return int64(len(v))
+	case []byte:
+		return int64(len(v))
+	case bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64,
+		uintptr, float32, float64, complex64:
+		return 8
+	default:
+		return valueEstimate
+	}
+}
+
+func entrySize[K cmp.Ordered](k K, v any) int64 {
+	return entryOverhead + valueSize(k) + valueSize(v)
+}
+
+// nodeSize estimates the memory n takes, besides its childs.
+func nodeSize[K cmp.Ordered](n *node[K]) int64 {
+	size := int64(nodeOverhead + childOverhead*len(n.childs))
+	for _, e := range n.entries {
+		size += entrySize(e.k, e.v)
+	}
+
+	return size
+}
+
+// fail records the first failure writing the spill file, after which the
+// tree keeps its nodes in memory.
+func (t *tier[K]) fail(err error) {
+	if t.err == nil {
+		t.err = spillFailure(err)
+	}
+}
+
+// usable returns ErrClosed once the tree is closed.
+func (t *tier[K]) usable() error {
+	if t == nil {
+		return nil
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.closed {
+		return ErrClosed
+	}
+
+	return nil
+}
+
+// grow counts memory taken by nodes added to the tree.
+func (t *tier[K]) grow(size int64) {
+	if t != nil {
+		t.resident += size
+	}
+}
+
+// add counts an entry added to the tree.
+func (t *tier[K]) add(k K, v any) {
+	if t != nil {
+		t.resident += entrySize(k, v)
+	}
+}
+
+// tick starts an operation, whose accesses are all marked with the same
+// tick, so that parents are never used less recently than their childs.
+func (t *tier[K]) tick() {
+	if t != nil {
+		t.clock++
+	}
+}
+
+// info returns what the tier knows of n, which it keeps until n is
+// collected. It's called holding t.mutex.
+func (t *tier[K]) info(n *node[K]) *tierNode {
+	key := weak.Make(n)
+	if i, ok := t.nodes[key]; ok {
+		return i
+	}
+
+	i := &tierNode{}
+	t.nodes[key] = i
+	runtime.AddCleanup(n, t.forget, key)
+
+	return i
+}
+
+// forget drops what the tier knows of a node collected.
+func (t *tier[K]) forget(key weak.Pointer[node[K]]) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if i, ok := t.nodes[key]; ok {
+		t.place(i, location{})
+		delete(t.nodes, key)
+	}
+}
+
+// place sets the record of a node, releasing the file of the one it had.
+// It's called holding t.mutex.
+func (t *tier[K]) place(i *tierNode, loc location) {
+	if loc.file != nil {
+		loc.file.refs++
+	}
+
+	if old := i.loc.file; old != nil {
+		old.refs--
+		t.release(old)
+	}
+
+	i.loc = loc
+}
+
+// release closes f once it was replaced by a compaction and no stub or
+// node refers to its records anymore. It's called holding t.mutex.
+func (t *tier[K]) release(f *spillFile) {
+	if !t.old[f] || f.refs > 0 || t.closed {
+		return
+	}
+
+	delete(t.old, f)
+
+	// It's only read, so closing it can't lose anything.
+	f.f.Close()
+}
+
+// stub returns a node standing for the subtree whose root's record is at
+// loc. It's called holding t.mutex.
+func (t *tier[K]) stub(loc location) *node[K] {
+	s := &node[K]{}
+	t.place(t.info(s), loc)
+
+	return s
+}
+
+// newStub is stub for callers not holding t.mutex.
+func (t *tier[K]) newStub(loc location) *node[K] {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.stub(loc)
+}
+
+// use marks n as accessed by the running operation.
+func (t *tier[K]) use(n *node[K]) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.info(n).used = t.clock
+}
+
+// inherit gives c, a copy of n, its last access and, if c is unchanged,
+// its record.
+func (t *tier[K]) inherit(c, n *node[K], unchanged bool) {
+	if t == nil {
+		return
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	ni, ci := t.info(n), t.info(c)
+	ci.used = ni.used
+
+	if unchanged {
+		t.place(ci, ni.loc)
+	}
+}
+
+// changed forgets the record of n, which no longer matches it.
+func (t *tier[K]) changed(n *node[K]) {
+	if t == nil {
+		return
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if i, ok := t.nodes[weak.Make(n)]; ok {
+		t.place(i, location{})
+	}
+}
+
+// resolve returns the node n stands for, loading it if n is a stub, but
+// without attaching it to the tree. It's safe for readers of snapshots,
+// which don't hold the tree lock.
+func (t *tier[K]) resolve(n *node[K]) (*node[K], error) {
+	if t == nil || !isStub(n) {
+		return n, nil
+	}
+
+	return t.load(n)
+}
+
+// visit is resolve for the recursive operations run through try, raising
+// failures as a spillPanic.
+func (t *tier[K]) visit(n *node[K]) *node[K] {
+	n, err := t.resolve(n)
+	if err != nil {
+		panic(spillPanic{err})
+	}
+
+	return n
+}
+
+// load decodes the node the stub s stands for, with stubs as childs.
+func (t *tier[K]) load(s *node[K]) (*node[K], error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.closed {
+		return nil, ErrClosed
+	}
+
+	loc := t.info(s).loc
+
+	n, err := t.read(loc)
+	if err != nil {
+		return nil, spillFailure(fmt.Errorf("failed to load node at %d: %w", loc.off, err))
+	}
+
+	return n, nil
+}
+
+// read decodes the record at loc. It's called holding t.mutex.
+func (t *tier[K]) read(loc location) (*node[K], error) {
+	if loc.file == nil {
+		return nil, errors.New("node has no record")
+	}
+
+	header := make([]byte, spillRecordHeader)
+	if _, err := loc.file.f.ReadAt(header, loc.off); err != nil {
+		return nil, err
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint32(header))
+	if _, err := loc.file.f.ReadAt(payload, loc.off+spillRecordHeader); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+
+		return nil, err
+	}
+
+	if len(payload) == 0 || crc32.Checksum(payload, castagnoli) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, errors.New("checksum mismatch")
+	}
+
+	n := &node[K]{leaf: payload[0] == spillLeaf}
+	buf := payload[1:]
+
+	uvarint := func() (uint64, error) {
+		u, l := binary.Uvarint(buf)
+		if l <= 0 {
+			return 0, errors.New("truncated record")
+		}
+		buf = buf[l:]
+
+		return u, nil
+	}
+
+	field := func() ([]byte, error) {
+		l, err := uvarint()
+		if err != nil || l > uint64(len(buf)) {
+			return nil, errors.New("truncated record")
+		}
+		f := buf[:l]
+		buf = buf[l:]
+
+		return f, nil
+	}
+
+	count, err := uvarint()
+	if err != nil {
+		return nil, err
+	}
+
+	n.entries = make([]*entry[K], count)
+
+	for i := range n.entries {
+		rk, err := field()
+		if err != nil {
+			return nil, err
+		}
+
+		rv, err := field()
+		if err != nil {
+			return nil, err
+		}
+
+		k, err := t.keys.DecodeKey(rk)
+		if err != nil {
+			return nil, err
+		}
+
+		v, err := t.values.DecodeValue(rv)
+		if err != nil {
+			return nil, err
+		}
+
+		n.entries[i] = &entry[K]{k, v}
+	}
+
+	if !n.leaf {
+		n.childs = make([]*node[K], count+1)
+
+		for i := range n.childs {
+			c, err := uvarint()
+			if err != nil {
+				return nil, err
+			}
+
+			n.childs[i] = t.stub(location{file: loc.file, off: int64(c)})
+		}
+	}
+
+	t.place(t.info(n), loc)
+
+	return n, nil
+}
+
+// write appends the records of the subtree of n missing from the file,
+// childs first, and returns the location of the record of n. Nodes
+// unchanged since their record was written to the file aren't written
+// again, and the ones spilled to an older file are moved to it.
+func (t *tier[K]) write(n *node[K]) (location, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.writeLocked(n)
+}
+
+func (t *tier[K]) writeLocked(n *node[K]) (location, error) {
+	loc := t.info(n).loc
+	if loc.file == t.file {
+		return loc, nil
+	}
+
+	if isStub(n) {
+		var err error
+		if n, err = t.read(loc); err != nil {
+			return location{}, fmt.Errorf("failed to move node at %d: %w", loc.off, err)
+		}
+	}
+
+	buf := make([]byte, spillRecordHeader, 64)
+
+	var flag byte
+	if n.leaf {
+		flag = spillLeaf
+	}
+
+	buf = append(buf, flag)
+	buf = binary.AppendUvarint(buf, uint64(len(n.entries)))
+
+	for _, e := range n.entries {
+		k := t.keys.AppendKey(nil, e.k)
+
+		v, err := t.values.AppendValue(nil, e.v)
+		if err != nil {
+			return location{}, fmt.Errorf("failed to encode value of %v: %w", e.k, err)
+		}
+
+		buf = binary.AppendUvarint(buf, uint64(len(k)))
+		buf = append(buf, k...)
+		buf = binary.AppendUvarint(buf, uint64(len(v)))
+		buf = append(buf, v...)
+	}
+
+	for _, c := range n.childs {
+		loc, err := t.writeLocked(c)
+		if err != nil {
+			return location{}, err
+		}
+
+		buf = binary.AppendUvarint(buf, uint64(loc.off))
+	}
+
+	binary.BigEndian.PutUint32(buf, uint32(len(buf)-spillRecordHeader))
+	binary.BigEndian.PutUint32(buf[4:], crc32.Checksum(buf[spillRecordHeader:], castagnoli))
+
+	if _, err := t.file.f.WriteAt(buf, t.size); err != nil {
+		return location{}, err
+	}
+
+	loc = location{file: t.file, off: t.size}
+	t.place(t.info(n), loc)
+	t.size += int64(len(buf))
+
+	return loc, nil
+}
+
+// own returns n if it belongs to the current generation, or else a copy of
+// it that does, which unlike the ones of mutable keeps its record, since
+// it's only changed to attach or detach childs.
+func (bt *BTree[K]) own(n *node[K]) *node[K] {
+	if n.gen == bt.gen {
+		return n
+	}
+
+	c := &node[K]{
+		gen:     bt.gen,
+		leaf:    n.leaf,
+		entries: slices.Clone(n.entries),
+		childs:  slices.Clone(n.childs),
+	}
+	bt.tier.inherit(c, n, true)
+
+	return c
+}
+
+// child returns the i-th child of n, loading it if spilled. Loaded childs
+// are attached to n, if n can be changed, so they are loaded only once.
+// It's only called holding the write lock, as it marks the child as used,
+// and through try, as it raises failures to load it.
+func (bt *BTree[K]) child(n *node[K], i int) *node[K] {
+	t := bt.tier
+	if t == nil {
+		return n.childs[i]
+	}
+
+	c := n.childs[i]
+	if isStub(c) {
+		c = t.visit(c)
+
+		if n.gen == bt.gen {
+			c.gen = bt.gen
+			n.childs[i] = c
+			t.grow(nodeSize(c))
+		}
+	}
+
+	t.use(c)
+
+	return c
+}
+
+// lookup searches k as search does, but attaching the nodes it loads, so
+// that the ones searched often stay in memory.
+func (bt *BTree[K]) lookup(k K) any {
+	bt.tier.tick()
+	bt.root = bt.own(bt.root)
+
+	n := bt.root
+	for {
+		i := 0
+
+		for ; i < len(n.entries) && k > n.entries[i].k; i++ {
+		}
+
+		if i < len(n.entries) && k == n.entries[i].k {
+			return n.entries[i].v
+		}
+
+		if n.leaf {
+			return nil
+		}
+
+		c := bt.own(bt.child(n, i))
+		n.childs[i] = c
+		n = c
+	}
+}
+
+// resident is a node in memory found by shed, with the index of its parent
+// and its position among the childs of it.
+type resident[K cmp.Ordered] struct {
+	n      *node[K]
+	parent int
+	pos    int
+}
+
+// shed spills the least recently used subtrees once the nodes in memory
+// take more than the budget, down to three quarters of it, so that it
+// doesn't spill again on the next few writes, then compacts the spill file
+// if it's due. The root is never spilled. Failures stop the tree from
+// spilling, leaving the subtrees not spilled yet in memory.
+func (bt *BTree[K]) shed() {
+	t := bt.tier
+	if t == nil || t.err != nil || t.resident <= t.maxBytes {
+		return
+	}
+
+	nodes := []resident[K]{{n: bt.root, parent: -1}}
+
+	for i := 0; i < len(nodes); i++ {
+		for j, c := range nodes[i].n.childs {
+			if !isStub(c) {
+				nodes = append(nodes, resident[K]{n: c, parent: i, pos: j})
+			}
+		}
+	}
+
+	sizes := make([]int64, len(nodes))
+	t.resident = 0
+
+	for i, r := range nodes {
+		sizes[i] = nodeSize(r.n)
+		t.resident += sizes[i]
+	}
+
+	if t.resident <= t.maxBytes {
+		return
+	}
+
+	// Nodes are found parents first, so sizes are summed up backwards.
+	for i := len(nodes) - 1; i > 0; i-- {
+		sizes[nodes[i].parent] += sizes[i]
+	}
+
+	used := make([]uint64, len(nodes))
+
+	t.mutex.Lock()
+	for i, r := range nodes {
+		used[i] = t.info(r.n).used
+	}
+	t.mutex.Unlock()
+
+	order := make([]int, len(nodes)-1)
+	for i := range order {
+		order[i] = i + 1
+	}
+
+	slices.SortStableFunc(order, func(a, b int) int {
+		return cmp.Compare(used[a], used[b])
+	})
+
+	chosen := make([]bool, len(nodes))
+	target := t.maxBytes * 3 / 4
+
+	for _, i := range order {
+		if t.resident <= target {
+			break
+		}
+
+		spilled := false
+		for a := nodes[i].parent; a > 0 && !spilled; a = nodes[a].parent {
+			spilled = chosen[a]
+		}
+
+		if spilled {
+			continue
+		}
+
+		// Subtrees chosen below i were already taken off its size.
+		chosen[i] = true
+		t.resident -= sizes[i]
+
+		for a := nodes[i].parent; a >= 0; a = nodes[a].parent {
+			sizes[a] -= sizes[i]
+		}
+	}
+
+	owned := make([]*node[K], len(nodes))
+
+	var own func(i int) *node[K]
+	own = func(i int) *node[K] {
+		if owned[i] == nil {
+			if i == 0 {
+				bt.root = bt.own(bt.root)
+				owned[i] = bt.root
+			} else {
+				p := own(nodes[i].parent)
+				owned[i] = bt.own(p.childs[nodes[i].pos])
+				p.childs[nodes[i].pos] = owned[i]
+			}
+		}
+
+		return owned[i]
+	}
+
+	for i := 1; i < len(nodes); i++ {
+		if !chosen[i] {
+			continue
+		}
+
+		// Those below a subtree spilled are spilled along with it.
+		under := false
+		for a := nodes[i].parent; a > 0 && !under; a = nodes[a].parent {
+			under = chosen[a]
+		}
+
+		if !under {
+			loc, err := t.write(nodes[i].n)
+			if err != nil {
+				t.fail(err)
+
+				return
+			}
+
+			own(nodes[i].parent).childs[nodes[i].pos] = t.newStub(loc)
+		}
+	}
+
+	if grown := t.size - t.live; grown > spillCompaction && grown > t.live {
+		if err := bt.compact(); err != nil {
+			t.fail(err)
+		}
+	}
+}
+
+// compact moves the records the tree refers to to a new spill file, which
+// replaces the current one. On failure, the tree keeps the current one,
+// but for the stubs already moved, which read the new one.
+func (bt *BTree[K]) compact() error {
+	t := bt.tier
+	name := t.path + ".compact"
+
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(spillMagic[:]); err != nil {
+		return errors.Join(err, f.Close(), os.Remove(name))
+	}
+
+	file := &spillFile{f: f}
+
+	t.mutex.Lock()
+	old, size := t.file, t.size
+	t.file, t.size = file, int64(len(spillMagic))
+	t.mutex.Unlock()
+
+	root, err := bt.moveRecords(bt.root)
+	if err == nil {
+		err = os.Rename(name, t.path)
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if err != nil {
+		t.file, t.size = old, size
+		t.retire(file)
+
+		return errors.Join(err, os.Remove(name))
+	}
+
+	t.retire(old)
+	bt.root = root
+	t.live = t.size
+
+	return nil
+}
+
+// retire marks f as replaced by a compaction, to be closed once no stub or
+// node refers to it. It's called holding t.mutex.
+func (t *tier[K]) retire(f *spillFile) {
+	t.old[f] = true
+	t.release(f)
+}
+
+// moveRecords moves the records of the subtree of n to the spill file,
+// returning n, or a copy of it owned by the tree if its childs changed.
+// Nodes in memory whose record is in an older file forget it.
+func (bt *BTree[K]) moveRecords(n *node[K]) (*node[K], error) {
+	t := bt.tier
+
+	if isStub(n) {
+		loc, err := t.write(n)
+		if err != nil {
+			return nil, err
+		}
+
+		return t.newStub(loc), nil
+	}
+
+	t.mutex.Lock()
+	if i := t.info(n); i.loc.file != t.file {
+		t.place(i, location{})
+	}
+	t.mutex.Unlock()
+
+	for i, c := range n.childs {
+		moved, err := bt.moveRecords(c)
+		if err != nil {
+			return nil, err
+		}
+
+		if moved != c {
+			n = bt.own(n)
+			n.childs[i] = moved
+		}
+	}
+
+	return n, nil
+}
+
+// Tiered is a tree that keeps a budget of memory for its nodes, spilling
+// the least recently used subtrees to a file past it, and loading them back
+// as they are accessed. Its methods return the failures reading the spill
+// file, wrapping ErrSpill, after which writes leave the tree unchanged, and
+// ErrClosed once it's closed. Searches take the write lock, since they keep
+// track of the nodes used. Tiered trees aren't versioned.
+type Tiered[K cmp.Ordered] struct {
+	bt *BTree[K]
+}
+
+func (tt *Tiered[K]) Search(k K) (any, error) {
+	bt := tt.bt
+
+	bt.mutex.Lock()
+	defer bt.mutex.Unlock()
+
+	if err := bt.tier.usable(); err != nil {
+		return nil, err
+	}
+
+	v, err := try(func() any {
+		return bt.lookup(k)
+	})
+
+	bt.shed()
+
+	return v, err
+}
+
+func (tt *Tiered[K]) Insert(k K, v any) error {
+	bt := tt.bt
+
+	bt.mutex.Lock()
+
+	if err := bt.tier.usable(); err != nil {
+		bt.mutex.Unlock()
+
+		return err
+	}
+
+	prev := bt.beginWrite()
+
+	old, err := try(func() *entry[K] {
+		return bt.insertKey(k, v)
+	})
+	if err != nil {
+		bt.root = prev
+		bt.mutex.Unlock()
+
+		return err
+	}
+
+	bt.commitWrite(prev)
+	bt.shed()
+
+	bt.unlockAndNotify(insertEvent(k, v, old, bt.version))
+
+	return nil
+}
+
+func (tt *Tiered[K]) Delete(k K) (any, error) {
+	bt := tt.bt
+
+	bt.mutex.Lock()
+
+	if err := bt.tier.usable(); err != nil {
+		bt.mutex.Unlock()
+
+		return nil, err
+	}
+
+	prev := bt.beginWrite()
+
+	old, err := try(func() *entry[K] {
+		return bt.deleteKey(k)
+	})
+	if err != nil {
+		bt.root = prev
+		bt.mutex.Unlock()
+
+		return nil, err
+	}
+
+	if old == nil {
+		bt.shed()
+		bt.unlockAndNotify()
+
+		return nil, nil
+	}
+
+	bt.commitWrite(prev)
+	bt.shed()
+
+	bt.unlockAndNotify(deleteEvent(old, bt.version))
+
+	return old.v, nil
+}
+
+// Range calls fn in ascending order for each key in [lo, hi), until fn
+// returns false. It reads a snapshot, as iterators do, so writers aren't
+// blocked while it runs.
+func (tt *Tiered[K]) Range(lo, hi K, fn func(k K, v any) bool) error {
+	bt := tt.bt
+
+	if err := bt.tier.usable(); err != nil {
+		return err
+	}
+
+	root := bt.snapshot()
+
+	_, err := try(func() bool {
+		return bt.ascend(root, lo, hi, func(e *entry[K]) bool {
+			return fn(e.k, e.v)
+		})
+	})
+
+	return err
+}
+
+// Iterator returns an iterator over a snapshot of the tree, whose Err
+// reports the failures reading the spill file, and ErrClosed once the tree
+// is closed.
+func (tt *Tiered[K]) Iterator() *Iterator[K] {
+	return tt.bt.Iterator()
+}
+
+// Save writes the entries of the tree to w, as BTree.Save does.
+func (tt *Tiered[K]) Save(w io.Writer, opts *SnapshotOptions[K]) error {
+	return tt.bt.Save(w, opts)
+}
+
+// Within returns the view of the tree through tx, as the function Within
+// does. Failures reading the spill file fail tx, as MultiTx.Err reports.
+func (tt *Tiered[K]) Within(tx *MultiTx) *TxTree[K] {
+	if !slices.Contains(tx.trees, Participant(tt)) {
+		panic("tree isn't part of the transaction")
+	}
+
+	return &TxTree[K]{tx: tx, bt: tt.bt}
+}
+
+func (tt *Tiered[K]) txID() uint64 {
+	return tt.bt.txID()
+}
+
+func (tt *Tiered[K]) txBegin() {
+	tt.bt.txBegin()
+}
+
+func (tt *Tiered[K]) txCommit() func() {
+	return tt.bt.txCommit()
+}
+
+func (tt *Tiered[K]) txUnlock() {
+	tt.bt.txUnlock()
+}
+
+func (tt *Tiered[K]) txRollback() {
+	tt.bt.txRollback()
+}
+
+// Err returns the failure writing the spill file that stopped the tree
+// from spilling, wrapping ErrSpill, or nil. The tree still works past it,
+// keeping its nodes in memory.
+func (tt *Tiered[K]) Err() error {
+	tt.bt.mutex.Lock()
+	defer tt.bt.mutex.Unlock()
+
+	return tt.bt.tier.err
+}
+
+// Close closes and removes the spill file, along with the older ones
+// snapshots still read, and returns the failure Err returns along with any
+// closing them. The tree and its iterators return ErrClosed afterwards.
+func (tt *Tiered[K]) Close() error {
+	tt.bt.mutex.Lock()
+	defer tt.bt.mutex.Unlock()
+
+	t := tt.bt.tier
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.closed {
+		return nil
+	}
+
+	t.closed = true
+
+	errs := []error{t.err, t.file.f.Close(), os.Remove(t.path)}
+	for f := range t.old {
+		errs = append(errs, f.f.Close())
+	}
+	t.old = nil
+
+	return errors.Join(errs...)
+}
+
+// NewTiered returns a tree that keeps the nodes in memory within
+// opts.MaxBytes, spilling the least recently used subtrees to opts.Path
+// past that, and loading them back as they are accessed. Its values must be
+// encodable by opts.Values. Failures writing the spill file stop the tree
+// from spilling, and are returned by Err and Close.
+func NewTiered[K cmp.Ordered](minimumDegree int, opts TieredOptions[K]) (*Tiered[K], error) {
+	if opts.MaxBytes < minTieredBytes {
+		return nil, errors.New("btree: MaxBytes must be at least 4 KiB")
+	}
+
+	keys, values := (&SnapshotOptions[K]{Keys: opts.Keys, Values: opts.Values}).codecs()
+
+	f, err := os.OpenFile(opts.Path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return nil, spillFailure(err)
+	}
+
+	if _, err := f.Write(spillMagic[:]); err != nil {
+		return nil, spillFailure(errors.Join(err, f.Close(), os.Remove(opts.Path)))
+	}
+
+	bt := New[K](minimumDegree)
+	bt.tier = &tier[K]{
+		nodes:    map[weak.Pointer[node[K]]]*tierNode{},
+		file:     &spillFile{f: f},
+		old:      map[*spillFile]bool{},
+		size:     int64(len(spillMagic)),
+		live:     int64(len(spillMagic)),
+		path:     opts.Path,
+		keys:     keys,
+		values:   values,
+		maxBytes: opts.MaxBytes,
+		resident: nodeOverhead,
+	}
+
+	return &Tiered[K]{bt: bt}, nil
+}
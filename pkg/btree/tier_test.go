@@ -0,0 +1,503 @@
+package btree
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTiered(t *testing.T, degree int, maxBytes int64) *Tiered[int] {
+	tt, err := NewTiered(degree, TieredOptions[int]{
+		Path:     filepath.Join(t.TempDir(), "spill"),
+		MaxBytes: maxBytes,
+	})
+	if err != nil {
+		t.Fatalf("failed to create tiered tree: %v", err)
+	}
+
+	t.Cleanup(func() { tt.Close() })
+
+	return tt
+}
+
+func insert(t *testing.T, tt *Tiered[int], k int, v any) {
+	if err := tt.Insert(k, v); err != nil {
+		t.Fatalf("failed to insert %v: %v", k, err)
+	}
+}
+
+func search(t *testing.T, tt *Tiered[int], k int) any {
+	v, err := tt.Search(k)
+	if err != nil {
+		t.Fatalf("failed to search %v: %v", k, err)
+	}
+
+	return v
+}
+
+// residentSize estimates the memory the nodes of the tree that aren't
+// spilled take.
+func residentSize(tt *Tiered[int]) int64 {
+	var size func(n *node[int]) int64
+	size = func(n *node[int]) int64 {
+		if isStub(n) {
+			return 0
+		}
+
+		s := nodeSize(n)
+		for _, child := range n.childs {
+			s += size(child)
+		}
+
+		return s
+	}
+
+	return size(tt.bt.root)
+}
+
+func TestTieredBudget(t *testing.T) {
+	tt := newTiered(t, 3, 16<<10)
+
+	for i := range 5000 {
+		insert(t, tt, i, i*2)
+
+		if r := residentSize(tt); r > 16<<10 {
+			t.Fatalf("expected at most 16 KiB in memory after inserting %v, got %v", i, r)
+		}
+	}
+
+	if info, err := os.Stat(tt.bt.tier.path); err != nil || info.Size() <= int64(len(spillMagic)) {
+		t.Fatalf("expected nodes to be spilled, got %v, %v", info, err)
+	}
+
+	checkInvariants(t, tt.bt)
+
+	for i := range 5000 {
+		if v := search(t, tt, i); v != i*2 {
+			t.Fatalf("expected %v to be %v, got %v", i, i*2, v)
+		}
+
+		if r := residentSize(tt); r > 16<<10 {
+			t.Fatalf("expected at most 16 KiB in memory after searching %v, got %v", i, r)
+		}
+	}
+
+	// Larger values take more of the budget, so fewer nodes stay.
+	for i := range 5000 {
+		insert(t, tt, i, strings.Repeat("v", 100))
+
+		if r := residentSize(tt); r > 16<<10 {
+			t.Fatalf("expected at most 16 KiB in memory after inserting %v, got %v", i, r)
+		}
+	}
+}
+
+func TestTieredHotNodesStay(t *testing.T) {
+	tt := newTiered(t, 3, 16<<10)
+
+	for i := range 5000 {
+		insert(t, tt, i, i)
+	}
+
+	for i := range 5000 {
+		search(t, tt, i%10)
+		insert(t, tt, i, -i)
+	}
+
+	// The path to the keys searched throughout was never the least
+	// recently used, so it's still in memory.
+	n := tt.bt.root
+	for !n.leaf {
+		c := n.childs[0]
+		if isStub(c) {
+			t.Fatalf("expected the leftmost path to be in memory")
+		}
+		n = c
+	}
+}
+
+func TestTieredRandomOperations(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+
+	for degree := 2; degree <= 4; degree++ {
+		tt := newTiered(t, degree, 6<<10)
+		expected := map[int]int{}
+
+		for range 20000 {
+			k := r.Intn(2000)
+
+			switch r.Intn(3) {
+			case 0:
+				v, ok := expected[k]
+				if got, err := tt.Delete(k); err != nil || ok && got != v || !ok && got != nil {
+					t.Fatalf("expected deleting %v to return %v, got %v, %v", k, v, got, err)
+				}
+				delete(expected, k)
+			case 1:
+				v, ok := expected[k]
+				if got := search(t, tt, k); ok && got != v || !ok && got != nil {
+					t.Fatalf("expected %v to be %v, got %v", k, v, got)
+				}
+			default:
+				v := r.Int()
+				insert(t, tt, k, v)
+				expected[k] = v
+			}
+		}
+
+		checkInvariants(t, tt.bt)
+
+		keys := collect(tt.Iterator())
+		if len(keys) != len(expected) || !slices.IsSorted(keys) {
+			t.Fatalf("expected %v sorted keys, got %v", len(expected), len(keys))
+		}
+
+		for _, k := range keys {
+			if _, ok := expected[k]; !ok {
+				t.Fatalf("iterator yielded deleted key %v", k)
+			}
+		}
+	}
+}
+
+func TestTieredReaders(t *testing.T) {
+	tt := newTiered(t, 3, 10<<10)
+
+	for i := range 3000 {
+		insert(t, tt, i, i)
+	}
+
+	it := tt.Iterator()
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for i := range 3000 {
+			if err := tt.Insert(i, -i); err != nil {
+				t.Errorf("failed to insert %v: %v", i, err)
+			}
+
+			if _, err := tt.Delete(i + 3000); err != nil {
+				t.Errorf("failed to delete %v: %v", i+3000, err)
+			}
+		}
+	}()
+
+	// The iterator reads the tree as it was, spilled subtrees included.
+	for i := 0; it.Next(); i++ {
+		if it.Key() != i || it.Value() != i {
+			t.Errorf("expected %v to be %v, got %v", it.Key(), i, it.Value())
+		}
+	}
+
+	if err := it.Err(); err != nil {
+		t.Errorf("failed to iterate: %v", err)
+	}
+
+	wg.Wait()
+
+	var sum int
+
+	err := tt.Range(0, 3000, func(k int, v any) bool {
+		sum += v.(int)
+
+		return true
+	})
+	if err != nil {
+		t.Fatalf("failed to range: %v", err)
+	}
+
+	if sum != -3000*2999/2 {
+		t.Errorf("expected the values to sum up to %v, got %v", -3000*2999/2, sum)
+	}
+
+	var buf bytes.Buffer
+	if err := tt.Save(&buf, nil); err != nil {
+		t.Fatalf("failed to save: %v", err)
+	}
+
+	loaded, err := Load[int](&buf, nil)
+	if err != nil {
+		t.Fatalf("failed to load: %v", err)
+	}
+
+	if keys := collect(loaded.Iterator()); len(keys) != 3000 {
+		t.Errorf("expected 3000 keys to be loaded, got %v", len(keys))
+	}
+}
+
+func TestTieredTransactions(t *testing.T) {
+	tt := newTiered(t, 3, 10<<10)
+
+	for i := range 2000 {
+		insert(t, tt, i, i)
+	}
+
+	err := UpdateMulti(func(tx *MultiTx) error {
+		for i := range 2000 {
+			tt.Within(tx).Insert(i, -i)
+		}
+
+		return errors.New("fail")
+	}, tt)
+	if err == nil {
+		t.Fatalf("expected the transaction to fail")
+	}
+
+	for i := range 2000 {
+		if v := search(t, tt, i); v != i {
+			t.Fatalf("expected %v to be %v after rolling back, got %v", i, i, v)
+		}
+	}
+
+	err = UpdateMulti(func(tx *MultiTx) error {
+		for i := range 2000 {
+			tt.Within(tx).Delete(i)
+		}
+
+		return nil
+	}, tt)
+	if err != nil {
+		t.Fatalf("failed to commit: %v", err)
+	}
+
+	if keys := collect(tt.Iterator()); len(keys) != 0 {
+		t.Errorf("expected every key to be deleted, got %v", keys)
+	}
+
+	if r := residentSize(tt); r > 10<<10 {
+		t.Errorf("expected at most 10 KiB in memory, got %v", r)
+	}
+}
+
+func TestTieredClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spill")
+
+	if _, err := NewTiered(2, TieredOptions[int]{Path: path, MaxBytes: 1 << 10}); err == nil {
+		t.Errorf("expected a budget of 1 KiB to be refused")
+	}
+
+	tt, err := NewTiered(2, TieredOptions[int]{Path: path, MaxBytes: 4 << 10})
+	if err != nil {
+		t.Fatalf("failed to create tiered tree: %v", err)
+	}
+
+	for i := range 1000 {
+		insert(t, tt, i, i)
+	}
+
+	it := tt.Iterator()
+
+	if err := tt.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected the spill file to be removed, got %v", err)
+	}
+
+	if _, err := tt.Search(1); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected searching a closed tree to fail, got %v", err)
+	}
+
+	if err := tt.Insert(1, 1); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected inserting in a closed tree to fail, got %v", err)
+	}
+
+	if err := tt.Range(0, 1000, func(int, any) bool { return true }); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected ranging over a closed tree to fail, got %v", err)
+	}
+
+	if it.Next() || !errors.Is(it.Err(), ErrClosed) {
+		t.Errorf("expected iterating over a closed tree to fail, got %v", it.Err())
+	}
+
+	err = UpdateMulti(func(tx *MultiTx) error {
+		tt.Within(tx).Insert(1, 1)
+
+		return nil
+	}, tt)
+	if !errors.Is(err, ErrClosed) {
+		t.Errorf("expected a transaction over a closed tree to fail, got %v", err)
+	}
+
+	if err := tt.Close(); err != nil {
+		t.Errorf("expected closing again to do nothing, got %v", err)
+	}
+}
+
+func TestTieredCorruption(t *testing.T) {
+	tt := newTiered(t, 2, 4<<10)
+
+	for i := range 1000 {
+		insert(t, tt, i, i)
+	}
+
+	if _, err := tt.bt.tier.file.f.WriteAt(make([]byte, 64), int64(len(spillMagic))); err != nil {
+		t.Fatalf("failed to corrupt spill file: %v", err)
+	}
+
+	it := tt.Iterator()
+	for it.Next() {
+	}
+
+	if err := it.Err(); !errors.Is(err, ErrSpill) {
+		t.Errorf("expected iterating to fail with ErrSpill, got %v", err)
+	}
+
+	if err := tt.Range(0, 1000, func(int, any) bool { return true }); !errors.Is(err, ErrSpill) {
+		t.Errorf("expected ranging to fail with ErrSpill, got %v", err)
+	}
+
+	failed := 0
+
+	for i := range 1000 {
+		root := tt.bt.root
+
+		if err := tt.Insert(i, -i); errors.Is(err, ErrSpill) {
+			failed++
+
+			if tt.bt.root != root {
+				t.Fatalf("expected failing to insert %v to leave the tree unchanged", i)
+			}
+
+			if _, err := tt.Search(i); !errors.Is(err, ErrSpill) {
+				t.Fatalf("expected searching %v to fail with ErrSpill, got %v", i, err)
+			}
+		} else if err != nil {
+			t.Fatalf("failed to insert %v: %v", i, err)
+		} else if v := search(t, tt, i); v != -i {
+			t.Fatalf("expected %v to be %v, got %v", i, -i, v)
+		}
+	}
+
+	if failed == 0 {
+		t.Errorf("expected the keys of the corrupted node to fail")
+	}
+}
+func TestTieredCompaction(t *testing.T) {
+	tt := newTiered(t, 3, 6<<10)
+
+	for i := range 2000 {
+		insert(t, tt, i, i)
+	}
+
+	it := tt.Iterator()
+
+	var largest, prev int64
+	compacted := false
+
+	for round := 1; round <= 40; round++ {
+		for i := range 2000 {
+			insert(t, tt, i, i*round)
+		}
+
+		info, err := os.Stat(tt.bt.tier.path)
+		if err != nil {
+			t.Fatalf("failed to stat the spill file: %v", err)
+		}
+
+		compacted = compacted || info.Size() < prev
+		prev = info.Size()
+		largest = max(largest, info.Size())
+	}
+
+	if !compacted || largest > 2*spillCompaction {
+		t.Errorf("expected the spill file to be compacted, got %v bytes at most", largest)
+	}
+
+	if err := tt.Err(); err != nil {
+		t.Fatalf("failed to spill: %v", err)
+	}
+
+	checkInvariants(t, tt.bt)
+
+	for i := range 2000 {
+		if v := search(t, tt, i); v != i*40 {
+			t.Fatalf("expected %v to be %v, got %v", i, i*40, v)
+		}
+	}
+
+	// The iterator still reads the records of the files compacted since.
+	for i := 0; it.Next(); i++ {
+		if it.Key() != i || it.Value() != i {
+			t.Fatalf("expected %v to be %v, got %v", it.Key(), i, it.Value())
+		}
+	}
+
+	if err := it.Err(); err != nil {
+		t.Fatalf("failed to iterate: %v", err)
+	}
+
+	tt.bt.tier.mutex.Lock()
+	open := len(tt.bt.tier.old)
+	tt.bt.tier.mutex.Unlock()
+
+	if open == 0 {
+		t.Fatalf("expected the files the iterator reads to be kept open")
+	}
+
+	// Once the iterator is gone, nothing refers to them, so they're closed.
+	it = nil
+
+	closed := false
+	for range 100 {
+		runtime.GC()
+
+		tt.bt.tier.mutex.Lock()
+		closed = len(tt.bt.tier.old) == 0
+		tt.bt.tier.mutex.Unlock()
+
+		if closed {
+			break
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if !closed {
+		t.Errorf("expected the files compacted to be closed")
+	}
+}
+
+func TestTieredSpillFailure(t *testing.T) {
+	tt, err := NewTiered(2, TieredOptions[int]{
+		Path:     filepath.Join(t.TempDir(), "spill"),
+		MaxBytes: 4 << 10,
+	})
+	if err != nil {
+		t.Fatalf("failed to create tiered tree: %v", err)
+	}
+
+	// Channels can't be encoded, so nothing can be spilled.
+	for i := range 200 {
+		insert(t, tt, i, make(chan int))
+	}
+
+	if err := tt.Err(); !errors.Is(err, ErrSpill) {
+		t.Fatalf("expected a spill failure, got %v", err)
+	}
+
+	checkInvariants(t, tt.bt)
+
+	for i := range 200 {
+		if _, ok := search(t, tt, i).(chan int); !ok {
+			t.Fatalf("expected %v to be kept in memory", i)
+		}
+	}
+
+	if err := tt.Close(); !errors.Is(err, ErrSpill) {
+		t.Errorf("expected closing to return the spill failure, got %v", err)
+	}
+}
@@ -0,0 +1,263 @@
+package btree
+
+import (
+	"cmp"
+	"slices"
+	"sync/atomic"
+)
+
+var treeIDs atomic.Uint64
+
+// Participant is a tree that can take part in a MultiTx. It's implemented
+// by every *BTree, whatever its key type.
+type Participant interface {
+	txID() uint64
+	txBegin()
+	txCommit() func()
+	txUnlock()
+	txRollback()
+}
+
+type txState[K cmp.Ordered] struct {
+	prev   *node[K]
+	events []Event[K]
+}
+
+func (bt *BTree[K]) txID() uint64 {
+	if id := bt.id.Load(); id != 0 {
+		return id
+	}
+
+	bt.id.CompareAndSwap(0, treeIDs.Add(1))
+
+	return bt.id.Load()
+}
+
+func (bt *BTree[K]) txBegin() {
+	bt.mutex.Lock()
+
+	bt.tx = &txState[K]{prev: bt.root}
+	bt.gen = nextGen()
+}
+
+// txCommit makes the changes of the transaction the state of the tree,
+// still holding its lock, and returns the function delivering its events
+// once every tree of the transaction is unlocked.
+func (bt *BTree[K]) txCommit() func() {
+	tx := bt.tx
+	bt.tx = nil
+
+	if len(tx.events) == 0 {
+		bt.root = tx.prev
+
+		return func() {}
+	}
+
+	bt.commitWrite(tx.prev)
+	bt.shed()
+
+	for i := range tx.events {
+		tx.events[i].Seq = bt.version
+	}
+
+	return bt.enqueue(tx.events)
+}
+
+func (bt *BTree[K]) txUnlock() {
+	bt.mutex.Unlock()
+}
+
+func (bt *BTree[K]) txRollback() {
+	bt.root = bt.tx.prev
+	bt.tx = nil
+
+	bt.mutex.Unlock()
+}
+
+// MultiTx updates several trees atomically. It holds the write lock of every
+// tree from BeginMultiTx until Commit or Rollback, and none of the changes
+// made through it are visible before Commit. Each tree that changed stamps a
+// single version on commit, and its watchers receive the events of the
+// transaction afterwards, all with that version as Seq.
+type MultiTx struct {
+	trees []Participant
+	done  bool
+	err   error
+}
+
+// BeginMultiTx locks the given trees, in an order shared by every
+// transaction so that concurrent ones can't deadlock.
+func BeginMultiTx(trees ...Participant) *MultiTx {
+	trees = slices.Clone(trees)
+
+	slices.SortFunc(trees, func(a, b Participant) int {
+		return cmp.Compare(a.txID(), b.txID())
+	})
+	trees = slices.CompactFunc(trees, func(a, b Participant) bool {
+		return a.txID() == b.txID()
+	})
+
+	for _, bt := range trees {
+		bt.txBegin()
+	}
+
+	return &MultiTx{trees: trees}
+}
+
+func (tx *MultiTx) finish() {
+	if tx.done {
+		panic("transaction has already finished")
+	}
+
+	tx.done = true
+}
+
+// Commit makes the changes of the transaction visible. If it failed, as Err
+// reports, it rolls it back instead.
+func (tx *MultiTx) Commit() {
+	if tx.err != nil {
+		tx.Rollback()
+
+		return
+	}
+
+	tx.finish()
+
+	// Every tree is committed before any is unlocked, so readers never see
+	// some trees changed by the transaction and others not yet.
+	deliver := make([]func(), len(tx.trees))
+	for i, bt := range tx.trees {
+		deliver[i] = bt.txCommit()
+	}
+
+	for _, bt := range tx.trees {
+		bt.txUnlock()
+	}
+
+	for _, d := range deliver {
+		d()
+	}
+}
+
+// Rollback discards every change made through the transaction. It does
+// nothing once the transaction has been committed, so it can be deferred.
+func (tx *MultiTx) Rollback() {
+	if tx.done {
+		return
+	}
+
+	tx.finish()
+
+	for _, bt := range tx.trees {
+		bt.txRollback()
+	}
+}
+
+// Err returns the failure of an operation of the transaction on a tiered
+// tree, reading its spill file or once the tree is closed, or nil. The
+// operations of a failed transaction do nothing, and it can't be committed.
+func (tx *MultiTx) Err() error {
+	return tx.err
+}
+
+// UpdateMulti runs fn in a transaction over the given trees. It commits if
+// fn returns nil and rolls back otherwise, or if fn panics or the
+// transaction failed, returning the failure Err reports.
+func UpdateMulti(fn func(tx *MultiTx) error, trees ...Participant) error {
+	tx := BeginMultiTx(trees...)
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	if err := tx.Err(); err != nil {
+		return err
+	}
+
+	tx.Commit()
+
+	return nil
+}
+
+// TxTree is a view of a tree through a transaction.
+type TxTree[K cmp.Ordered] struct {
+	tx *MultiTx
+	bt *BTree[K]
+}
+
+func Within[K cmp.Ordered](tx *MultiTx, bt *BTree[K]) *TxTree[K] {
+	if !slices.Contains(tx.trees, Participant(bt)) {
+		panic("tree isn't part of the transaction")
+	}
+
+	return &TxTree[K]{tx: tx, bt: bt}
+}
+
+func (tt *TxTree[K]) state() *txState[K] {
+	if tt.tx.done {
+		panic("transaction has already finished")
+	}
+
+	return tt.bt.tx
+}
+
+// txRun runs op on the tree of tt, unless the transaction failed, and
+// reports whether it ran to completion. Failures fail the transaction.
+func txRun[K cmp.Ordered, T any](tt *TxTree[K], op func() T) (T, bool) {
+	var v T
+
+	if tt.tx.err != nil {
+		return v, false
+	}
+
+	err := tt.bt.tier.usable()
+	if err == nil {
+		v, err = try(op)
+	}
+	if err != nil {
+		tt.tx.err = err
+
+		return v, false
+	}
+
+	return v, true
+}
+
+func (tt *TxTree[K]) Search(k K) any {
+	tt.state()
+
+	v, _ := txRun(tt, func() any {
+		return tt.bt.search(tt.bt.root, k)
+	})
+
+	return v
+}
+
+func (tt *TxTree[K]) Insert(k K, v any) {
+	tx := tt.state()
+
+	old, ok := txRun(tt, func() *entry[K] {
+		return tt.bt.insertKey(k, v)
+	})
+	if !ok {
+		return
+	}
+
+	tx.events = append(tx.events, insertEvent(k, v, old, 0))
+}
+
+func (tt *TxTree[K]) Delete(k K) any {
+	tx := tt.state()
+
+	old, _ := txRun(tt, func() *entry[K] {
+		return tt.bt.deleteKey(k)
+	})
+	if old == nil {
+		return nil
+	}
+
+	tx.events = append(tx.events, deleteEvent(old, 0))
+
+	return old.v
+}
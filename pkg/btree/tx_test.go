@@ -0,0 +1,218 @@
+package btree
+
+import (
+	"errors"
+	"sync"
+	"testing"
+)
+
+func TestMultiTxCommit(t *testing.T) {
+	primary := NewVersioned[int](2)
+	index := New[string](2)
+
+	events, cancel := primary.Watch(0, 100, WatchOptions{})
+	defer cancel()
+
+	tx := BeginMultiTx(primary, index)
+
+	p, i := Within(tx, primary), Within(tx, index)
+	p.Insert(1, "alice")
+	p.Insert(2, "bob")
+	i.Insert("alice", 1)
+	i.Insert("bob", 2)
+
+	if value := p.Search(1); value != "alice" {
+		t.Fatalf("transaction doesn't see its own writes: got=%v", value)
+	}
+
+	tx.Commit()
+	tx.Rollback()
+
+	if value := primary.Search(2); value != "bob" {
+		t.Fatalf("got different value after commit: %v", value)
+	}
+
+	if value := index.Search("alice"); value != 1 {
+		t.Fatalf("got different value after commit: %v", value)
+	}
+
+	if version := primary.Version(); version != 1 {
+		t.Fatalf("transaction stamped version %v, expected 1", version)
+	}
+
+	if value := primary.GetAt(1, 0); value != nil {
+		t.Fatalf("version before the transaction sees its writes: %v", value)
+	}
+
+	for _, key := range []int{1, 2} {
+		if e := <-events; e.Key != key || e.Seq != 1 {
+			t.Fatalf("got different event: %v", e)
+		}
+	}
+}
+
+func TestMultiTxRollback(t *testing.T) {
+	primary := New[int](2)
+	index := New[string](2)
+
+	for i := range 20 {
+		primary.Insert(i, i)
+	}
+
+	events, cancel := primary.Watch(0, 100, WatchOptions{})
+	defer cancel()
+
+	errFailed := errors.New("failed")
+
+	err := UpdateMulti(func(tx *MultiTx) error {
+		for i := range 20 {
+			Within(tx, primary).Delete(i)
+		}
+
+		Within(tx, index).Insert("x", 1)
+
+		return errFailed
+	}, primary, index)
+	if err != errFailed {
+		t.Fatalf("got different error: %v", err)
+	}
+
+	for i := range 20 {
+		if value := primary.Search(i); value != i {
+			t.Fatalf("rollback didn't restore key %v: got=%v", i, value)
+		}
+	}
+
+	if value := index.Search("x"); value != nil {
+		t.Fatalf("rollback left a write behind: %v", value)
+	}
+
+	if version := primary.Version(); version != 20 {
+		t.Fatalf("rolled back transaction stamped a version: %v", version)
+	}
+
+	select {
+	case e := <-events:
+		t.Fatalf("rolled back transaction published %v", e)
+	default:
+	}
+
+	checkInvariants(t, primary)
+}
+
+func TestMultiTxPanic(t *testing.T) {
+	bt := New[int](2)
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatalf("panic wasn't propagated")
+			}
+		}()
+
+		UpdateMulti(func(tx *MultiTx) error {
+			Within(tx, bt).Insert(1, 1)
+
+			panic("boom")
+		}, bt)
+	}()
+
+	if value := bt.Search(1); value != nil {
+		t.Fatalf("panicking transaction left a write behind: %v", value)
+	}
+}
+
+func TestMultiTxLockOrder(t *testing.T) {
+	a, b := New[int](2), New[int](2)
+
+	var wg sync.WaitGroup
+
+	for i := range 8 {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			trees := []Participant{a, b, a}
+			if i%2 == 0 {
+				trees = []Participant{b, a}
+			}
+
+			for j := range 100 {
+				UpdateMulti(func(tx *MultiTx) error {
+					Within(tx, a).Insert(i*100+j, j)
+					Within(tx, b).Insert(i*100+j, j)
+
+					return nil
+				}, trees...)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	for i := range 800 {
+		if a.Search(i) != b.Search(i) || a.Search(i) == nil {
+			t.Fatalf("trees diverged at key %v", i)
+		}
+	}
+}
+
+func TestWithinOtherTree(t *testing.T) {
+	tx := BeginMultiTx(New[int](2))
+	defer tx.Rollback()
+
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("using a tree outside of the transaction didn't panic")
+		}
+	}()
+
+	Within(tx, New[int](2))
+}
+
+func TestMultiTxCommitAtomic(t *testing.T) {
+	a, b := New[int](2), New[int](2)
+	a.Insert(0, 0)
+	b.Insert(0, 0)
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+
+	// Both trees hold the same value once a transaction is committed, so
+	// the one read last is never behind the one read first.
+	for _, trees := range [][2]*BTree[int]{{a, b}, {b, a}} {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				first := trees[0].Search(0).(int)
+				if last := trees[1].Search(0).(int); last < first {
+					t.Errorf("read %v after %v from the other tree", last, first)
+
+					return
+				}
+			}
+		}()
+	}
+
+	for n := 1; n <= 2000; n++ {
+		UpdateMulti(func(tx *MultiTx) error {
+			Within(tx, a).Insert(0, n)
+			Within(tx, b).Insert(0, n)
+
+			return nil
+		}, a, b)
+	}
+
+	close(stop)
+	wg.Wait()
+}
@@ -0,0 +1,334 @@
+package btree
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"sync"
+)
+
+type Op int
+
+const (
+	OpInsert Op = iota
+	OpUpdate
+	OpDelete
+)
+
+func (op Op) String() string {
+	switch op {
+	case OpInsert:
+		return "insert"
+	case OpUpdate:
+		return "update"
+	case OpDelete:
+		return "delete"
+	default:
+		return fmt.Sprintf("Op(%d)", int(op))
+	}
+}
+
+// Event describes a committed change. Seq is the version stamped by the
+// change, so GetAt(Key, Seq) observes New.
+type Event[K cmp.Ordered] struct {
+	Op  Op
+	Key K
+	Old any
+	New any
+	Seq uint64
+}
+
+func (e Event[K]) String() string {
+	return fmt.Sprintf(
+		"Event{op: %v, key: %v, old: %v, new: %v, seq: %v}",
+		e.Op, e.Key, e.Old, e.New, e.Seq)
+}
+
+// WatchPolicy decides what happens to an event when the watcher's buffer is
+// full.
+type WatchPolicy int
+
+const (
+	// WatchBlock makes the writer wait until the watcher has room.
+	WatchBlock WatchPolicy = iota
+	// WatchDrop discards the event. Consumers notice it by a gap in Seq.
+	WatchDrop
+	// WatchCoalesce keeps pending events aside, merging the ones of the
+	// same key, until the watcher catches up. A merged event goes from the
+	// state before the first one to the state after the last one: an insert
+	// followed by a delete cancel out, a delete followed by an insert make
+	// an update, and otherwise Old is the oldest value and New the newest.
+	WatchCoalesce
+)
+
+const defaultWatchBuffer = 64
+
+type WatchOptions struct {
+	Policy WatchPolicy
+	Buffer int
+}
+
+type watcher[K cmp.Ordered] struct {
+	match  func(k K) bool
+	policy WatchPolicy
+	events chan Event[K]
+	done   chan struct{}
+	once   sync.Once
+
+	// senders is held for reading while an event is sent, so that cancel
+	// doesn't close events under a sender.
+	senders sync.RWMutex
+
+	mutex   sync.Mutex
+	wake    chan struct{}
+	pending []*Event[K]
+	busy    bool
+	exited  chan struct{}
+}
+
+func (w *watcher[K]) send(e Event[K]) {
+	w.senders.RLock()
+	defer w.senders.RUnlock()
+
+	select {
+	case <-w.done:
+		return
+	default:
+	}
+
+	switch w.policy {
+	case WatchDrop:
+		select {
+		case w.events <- e:
+		default:
+		}
+	case WatchCoalesce:
+		w.coalesce(e)
+	default:
+		select {
+		case w.events <- e:
+		case <-w.done:
+		}
+	}
+}
+
+func (w *watcher[K]) coalesce(e Event[K]) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if len(w.pending) == 0 && !w.busy {
+		select {
+		case w.events <- e:
+			return
+		default:
+		}
+	}
+
+	i := slices.IndexFunc(w.pending, func(p *Event[K]) bool {
+		return p.Key == e.Key
+	})
+	switch {
+	case i == -1:
+		w.pending = append(w.pending, &e)
+	case !merge(w.pending[i], e):
+		w.pending = slices.Delete(w.pending, i, i+1)
+	}
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// merge folds e into the pending event p of the same key, and reports
+// whether anything is left of them, which isn't the case when the key was
+// inserted and then deleted.
+func merge[K cmp.Ordered](p *Event[K], e Event[K]) bool {
+	existed, exists := p.Op != OpInsert, e.Op != OpDelete
+
+	switch {
+	case !existed && !exists:
+		return false
+	case !existed:
+		p.Op = OpInsert
+	case !exists:
+		p.Op = OpDelete
+	default:
+		p.Op = OpUpdate
+	}
+
+	p.New, p.Seq = e.New, e.Seq
+
+	return true
+}
+
+func (w *watcher[K]) flush() {
+	defer close(w.exited)
+
+	for {
+		select {
+		case <-w.wake:
+		case <-w.done:
+			return
+		}
+
+		for {
+			w.mutex.Lock()
+			if len(w.pending) == 0 {
+				w.busy = false
+				w.mutex.Unlock()
+
+				break
+			}
+			e := w.pending[0]
+			w.pending = slices.Delete(w.pending, 0, 1)
+			w.busy = true
+			w.mutex.Unlock()
+
+			select {
+			case w.events <- *e:
+			case <-w.done:
+				return
+			}
+		}
+	}
+}
+
+// watchers hands out tickets to writers in commit order, and lets them
+// deliver their events in turn once the tree lock is released.
+type watchers[K cmp.Ordered] struct {
+	mutex  sync.Mutex
+	list   []*watcher[K]
+	turn   sync.Cond
+	ticket uint64
+	served uint64
+}
+
+func (bt *BTree[K]) watch(match func(k K) bool, opts WatchOptions) (<-chan Event[K], func()) {
+	buffer := opts.Buffer
+	if buffer <= 0 {
+		buffer = defaultWatchBuffer
+	}
+
+	w := &watcher[K]{
+		match:  match,
+		policy: opts.Policy,
+		events: make(chan Event[K], buffer),
+		done:   make(chan struct{}),
+	}
+
+	if w.policy == WatchCoalesce {
+		w.wake = make(chan struct{}, 1)
+		w.exited = make(chan struct{})
+
+		go w.flush()
+	}
+
+	bt.watchers.mutex.Lock()
+	bt.watchers.list = append(bt.watchers.list, w)
+	bt.watchers.mutex.Unlock()
+
+	cancel := func() {
+		w.once.Do(func() {
+			close(w.done)
+
+			w.senders.Lock()
+			defer w.senders.Unlock()
+
+			bt.watchers.mutex.Lock()
+			bt.watchers.list = slices.DeleteFunc(
+				bt.watchers.list,
+				func(o *watcher[K]) bool {
+					return o == w
+				})
+			bt.watchers.mutex.Unlock()
+
+			if w.exited != nil {
+				<-w.exited
+			}
+
+			close(w.events)
+		})
+	}
+
+	return w.events, cancel
+}
+
+// Watch subscribes to changes of keys in [lo, hi). The returned function
+// cancels the subscription and closes the channel.
+func (bt *BTree[K]) Watch(lo, hi K, opts WatchOptions) (<-chan Event[K], func()) {
+	return bt.watch(func(k K) bool {
+		return k >= lo && k < hi
+	}, opts)
+}
+
+func (bt *BTree[K]) WatchKey(k K, opts WatchOptions) (<-chan Event[K], func()) {
+	return bt.watch(func(o K) bool {
+		return o == k
+	}, opts)
+}
+
+func insertEvent[K cmp.Ordered](k K, v any, old *entry[K], seq uint64) Event[K] {
+	if old != nil {
+		return Event[K]{Op: OpUpdate, Key: k, Old: old.v, New: v, Seq: seq}
+	}
+
+	return Event[K]{Op: OpInsert, Key: k, New: v, Seq: seq}
+}
+
+func deleteEvent[K cmp.Ordered](old *entry[K], seq uint64) Event[K] {
+	return Event[K]{Op: OpDelete, Key: old.k, Old: old.v, Seq: seq}
+}
+
+// unlockAndNotify releases the write lock and publishes events.
+func (bt *BTree[K]) unlockAndNotify(events ...Event[K]) {
+	deliver := bt.enqueue(events)
+
+	bt.mutex.Unlock()
+
+	deliver()
+}
+
+// enqueue takes a ticket for delivering events, while the write lock is
+// held, so tickets follow commit order. The returned function waits for the
+// writers before to be done, then sends the events to the watchers there
+// were at commit time. It's called once the write lock is released, so a
+// watcher holding back a writer never holds back readers or other writers
+// of the tree, and events are still delivered in Seq order.
+func (bt *BTree[K]) enqueue(events []Event[K]) func() {
+	if len(events) == 0 {
+		return func() {}
+	}
+
+	ws := &bt.watchers
+
+	ws.mutex.Lock()
+	if ws.turn.L == nil {
+		ws.turn.L = &ws.mutex
+	}
+	ticket := ws.ticket
+	ws.ticket++
+	list := slices.Clone(ws.list)
+	ws.mutex.Unlock()
+
+	return func() {
+		ws.mutex.Lock()
+		for ws.served != ticket {
+			ws.turn.Wait()
+		}
+		ws.mutex.Unlock()
+
+		for _, e := range events {
+			for _, w := range list {
+				if w.match(e.Key) {
+					w.send(e)
+				}
+			}
+		}
+
+		ws.mutex.Lock()
+		ws.served++
+		ws.turn.Broadcast()
+		ws.mutex.Unlock()
+	}
+}
@@ -0,0 +1,273 @@
+package btree
+
+import (
+	"testing"
+	"time"
+)
+
+func receive(t *testing.T, events <-chan Event[int]) Event[int] {
+	select {
+	case e := <-events:
+		return e
+	case <-time.After(time.Second):
+		t.Fatalf("didn't receive any event")
+	}
+
+	return Event[int]{}
+}
+
+func TestWatch(t *testing.T) {
+	bt := New[int](2)
+
+	events, cancel := bt.Watch(10, 20, WatchOptions{})
+	defer cancel()
+
+	bt.Insert(5, "a")
+	bt.Insert(10, "b")
+	bt.Insert(10, "c")
+	bt.Insert(20, "d")
+	bt.Delete(15)
+	bt.Delete(10)
+
+	for _, expected := range []Event[int]{
+		{Op: OpInsert, Key: 10, New: "b", Seq: 2},
+		{Op: OpUpdate, Key: 10, Old: "b", New: "c", Seq: 3},
+		{Op: OpDelete, Key: 10, Old: "c", Seq: 5},
+	} {
+		if e := receive(t, events); e != expected {
+			t.Fatalf("got different event: got=%v expected=%v", e, expected)
+		}
+	}
+
+	select {
+	case e := <-events:
+		t.Fatalf("got unexpected event %v", e)
+	default:
+	}
+}
+
+func TestWatchKey(t *testing.T) {
+	bt := New[int](2)
+
+	events, cancel := bt.WatchKey(3, WatchOptions{})
+	defer cancel()
+
+	for i := range 5 {
+		bt.Insert(i, i)
+	}
+
+	if e := receive(t, events); e.Key != 3 || e.Seq != 4 {
+		t.Fatalf("got different event: %v", e)
+	}
+}
+
+func TestWatchCancel(t *testing.T) {
+	bt := New[int](2)
+
+	events, cancel := bt.Watch(0, 10, WatchOptions{Buffer: 1})
+
+	bt.Insert(1, 1)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		bt.Insert(2, 2)
+	}()
+
+	cancel()
+	cancel()
+
+	<-done
+
+	if e, ok := <-events; !ok || e.Key != 1 {
+		t.Fatalf("got different event: %v", e)
+	}
+
+	if _, ok := <-events; ok {
+		t.Fatalf("channel wasn't closed")
+	}
+
+	bt.Insert(3, 3)
+}
+
+func TestWatchBlock(t *testing.T) {
+	bt := New[int](2)
+
+	events, cancel := bt.Watch(0, 10, WatchOptions{Policy: WatchBlock, Buffer: 1})
+	defer cancel()
+
+	bt.Insert(1, 1)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		bt.Insert(2, 2)
+	}()
+
+	select {
+	case <-done:
+		t.Fatalf("writer didn't block on a full watcher")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if value := bt.Search(2); value != 2 {
+		t.Fatalf("readers can't see the committed write: got=%v", value)
+	}
+
+	receive(t, events)
+	<-done
+
+	if e := receive(t, events); e.Key != 2 {
+		t.Fatalf("got different event: %v", e)
+	}
+}
+
+func TestWatchDrop(t *testing.T) {
+	bt := New[int](2)
+
+	events, cancel := bt.Watch(0, 10, WatchOptions{Policy: WatchDrop, Buffer: 2})
+	defer cancel()
+
+	for i := range 5 {
+		bt.Insert(i, i)
+	}
+
+	for _, expectedSeq := range []uint64{1, 2} {
+		if e := receive(t, events); e.Seq != expectedSeq {
+			t.Fatalf("got different event: %v", e)
+		}
+	}
+
+	bt.Insert(9, 9)
+
+	if e := receive(t, events); e.Seq != 6 {
+		t.Fatalf("got different event after the gap: %v", e)
+	}
+}
+
+func TestWatchCoalesce(t *testing.T) {
+	bt := New[int](2)
+
+	events, cancel := bt.Watch(0, 10, WatchOptions{Policy: WatchCoalesce, Buffer: 1})
+	defer cancel()
+
+	bt.Insert(0, "a")
+	bt.Insert(1, "b")
+
+	w := bt.watchers.list[0]
+	for busy := false; !busy; {
+		w.mutex.Lock()
+		busy = w.busy
+		w.mutex.Unlock()
+	}
+
+	bt.Insert(2, "c")
+	bt.Insert(2, "d")
+	bt.Insert(3, "e")
+	bt.Insert(2, "f")
+
+	for _, expected := range []Event[int]{
+		{Op: OpInsert, Key: 0, New: "a", Seq: 1},
+		{Op: OpInsert, Key: 1, New: "b", Seq: 2},
+		{Op: OpInsert, Key: 2, New: "f", Seq: 6},
+		{Op: OpInsert, Key: 3, New: "e", Seq: 5},
+	} {
+		if e := receive(t, events); e != expected {
+			t.Fatalf("got different event: got=%v expected=%v", e, expected)
+		}
+	}
+}
+
+// busyCoalescing fills up the buffer of a coalescing watcher, so that the
+// events that follow are kept pending.
+func busyCoalescing(t *testing.T, bt *BTree[int]) <-chan Event[int] {
+	events, cancel := bt.Watch(0, 10, WatchOptions{Policy: WatchCoalesce, Buffer: 1})
+	t.Cleanup(cancel)
+
+	bt.Insert(9, "x")
+	bt.Insert(9, "y")
+
+	w := bt.watchers.list[0]
+	for busy := false; !busy; {
+		w.mutex.Lock()
+		busy = w.busy
+		w.mutex.Unlock()
+	}
+
+	receive(t, events)
+	receive(t, events)
+
+	return events
+}
+
+func TestWatchCoalesceMerge(t *testing.T) {
+	bt := New[int](2)
+	bt.Insert(1, "a")
+	bt.Insert(2, "b")
+
+	events := busyCoalescing(t, bt)
+
+	// Inserted and deleted: nothing happened to 0.
+	bt.Insert(0, "c")
+	bt.Delete(0)
+
+	// Deleted and inserted again: 1 was updated.
+	bt.Delete(1)
+	bt.Insert(1, "d")
+
+	// Updated and deleted: 2 was deleted, from its first value.
+	bt.Insert(2, "e")
+	bt.Delete(2)
+
+	// Inserted, updated and updated again: 3 was inserted.
+	bt.Insert(3, "f")
+	bt.Insert(3, "g")
+	bt.Insert(3, "h")
+
+	for _, expected := range []Event[int]{
+		{Op: OpUpdate, Key: 1, Old: "a", New: "d", Seq: 8},
+		{Op: OpDelete, Key: 2, Old: "b", Seq: 10},
+		{Op: OpInsert, Key: 3, New: "h", Seq: 13},
+	} {
+		if e := receive(t, events); e != expected {
+			t.Fatalf("got different event: got=%v expected=%v", e, expected)
+		}
+	}
+
+	select {
+	case e := <-events:
+		t.Errorf("got unexpected event: %v", e)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestWatchBlockDoesntFreezeTree(t *testing.T) {
+	bt := New[int](2)
+
+	_, cancel := bt.Watch(0, 10, WatchOptions{Policy: WatchBlock, Buffer: 1})
+	defer cancel()
+
+	bt.Insert(1, 1)
+
+	// Both writers wait on the watcher, but the second one must not hold
+	// the tree lock meanwhile.
+	go bt.Insert(2, 2)
+	go bt.Insert(3, 3)
+
+	found := make(chan struct{})
+	go func() {
+		defer close(found)
+
+		for bt.Search(2) == nil || bt.Search(3) == nil {
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	select {
+	case <-found:
+	case <-time.After(time.Second):
+		t.Fatalf("readers were blocked by writers waiting on a watcher")
+	}
+}